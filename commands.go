@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/SyncYomi/SyncYomi/internal/config"
+	"github.com/SyncYomi/SyncYomi/internal/database"
+	"github.com/SyncYomi/SyncYomi/internal/domain"
+	"github.com/SyncYomi/SyncYomi/internal/logger"
+	"github.com/spf13/pflag"
+)
+
+// commands are the subcommands run instead of the server, by name.
+var commands = map[string]func(args []string) error{
+	"backup":    runBackup,
+	"db":        runDB,
+	"reencrypt": runReencrypt,
+	"sync":      runSync,
+}
+
+// runCommand runs the subcommand named by the first argument, if any.
+func runCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+
+	run, ok := commands[args[0]]
+	if !ok {
+		return false
+	}
+
+	if err := run(args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+		os.Exit(1)
+	}
+
+	return true
+}
+
+// commandEnv is what subcommands work with.
+type commandEnv struct {
+	cfg *domain.Config
+	log logger.Logger
+	db  *database.DB
+}
+
+// openDatabase reads the config and opens the database for a subcommand.
+func openDatabase(configPath string) (*commandEnv, error) {
+	cfg := config.New(configPath, version)
+	log := logger.New(cfg.Config)
+
+	db, err := database.NewDB(cfg.Config, log)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Open(); err != nil {
+		return nil, err
+	}
+
+	return &commandEnv{cfg: cfg.Config, log: log, db: db}, nil
+}
+
+// newFlagSet returns the flags of a subcommand, with --config
+// and a usage message of the usage line followed by the description.
+func newFlagSet(name string, usage string, description string) (*pflag.FlagSet, *string) {
+	flags := pflag.NewFlagSet(name, pflag.ExitOnError)
+	configPath := flags.String("config", "", "path to configuration file")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: syncyomi %s\n\n%s\n\n", usage, description)
+		flags.PrintDefaults()
+	}
+	return flags, configPath
+}
+
+// runReencrypt encrypts the stored sync data with the current master key.
+func runReencrypt(args []string) error {
+	flags, configPath := newFlagSet("reencrypt", "reencrypt [--config <path>]",
+		"Encrypts unencrypted sync data and re-wraps the data keys of\nolder master keys with the current one.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	env, err := openDatabase(*configPath)
+	if err != nil {
+		return err
+	}
+	defer env.db.Close()
+
+	updated, err := database.NewSyncRepo(env.log, env.db).ReencryptSyncData(context.Background())
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("re-encrypted %d rows\n", updated)
+	return nil
+}
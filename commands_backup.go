@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/SyncYomi/SyncYomi/internal/snapshot"
+	"github.com/SyncYomi/SyncYomi/pkg/errors"
+)
+
+// runBackup runs the instance backup subcommands.
+func runBackup(args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "create":
+			return runBackupCreate(args[1:])
+		case "restore":
+			return runBackupRestore(args[1:])
+		}
+	}
+
+	fmt.Fprintln(os.Stderr, "Usage: syncyomi backup <create|restore> [flags]")
+	return errors.New("unknown backup command")
+}
+
+// runBackupCreate writes a snapshot of the instance to a file.
+func runBackupCreate(args []string) error {
+	flags, configPath := newFlagSet("backup create", "backup create [--out <file>] [--config <path>]",
+		"Writes the users, API keys, notifications, sync data and config.toml to a backup archive.\nThe archive can be restored with either database driver.")
+	out := flags.String("out", "", "file to write the backup to (default syncyomi-backup-<date>.tar.gz)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *out == "" {
+		*out = fmt.Sprintf("syncyomi-backup-%s.tar.gz", time.Now().Format("20060102-150405"))
+	}
+
+	env, err := openDatabase(*configPath)
+	if err != nil {
+		return err
+	}
+	defer env.db.Close()
+
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := snapshot.Create(context.Background(), f, env.db, env.cfg.ConfigPath, version)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(*out)
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "created backup %s with %s\n", *out, manifest.Summary())
+	return nil
+}
+
+// runBackupRestore replaces the content of the database with a backup.
+func runBackupRestore(args []string) error {
+	flags, configPath := newFlagSet("backup restore", "backup restore [--restore-config] [--config <path>] <file>",
+		"Replaces the users, API keys, notifications and sync data with the content of a backup archive.\nStop the server before restoring, the config file is only restored with --restore-config.")
+	restoreConfig := flags.Bool("restore-config", false, "also restore config.toml, the current one is kept as config.toml.bak")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("a backup file is required")
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	env, err := openDatabase(*configPath)
+	if err != nil {
+		return err
+	}
+	defer env.db.Close()
+
+	manifest, err := snapshot.Restore(context.Background(), f, env.db, snapshot.RestoreOptions{
+		ConfigPath: env.cfg.ConfigPath,
+		Config:     *restoreConfig,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "restored backup of %s from %s with %s\n",
+		manifest.Version, manifest.CreatedAt.Format(time.RFC3339), manifest.Summary())
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/SyncYomi/SyncYomi/internal/config"
+	"github.com/SyncYomi/SyncYomi/internal/database"
+	"github.com/SyncYomi/SyncYomi/internal/logger"
+	"github.com/SyncYomi/SyncYomi/internal/snapshot"
+	"github.com/SyncYomi/SyncYomi/pkg/errors"
+)
+
+// runDB runs the database subcommands.
+func runDB(args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "migrate":
+			return runDBMigrate(args[1:])
+		}
+	}
+
+	fmt.Fprintln(os.Stderr, "Usage: syncyomi db <migrate> [flags]")
+	return errors.New("unknown db command")
+}
+
+// runDBMigrate copies the content of the database of one driver to the other.
+func runDBMigrate(args []string) error {
+	flags, configPath := newFlagSet("db migrate", "db migrate --from <sqlite|postgres> --to <sqlite|postgres> [--config <path>]",
+		"Copies users, API keys, notifications and sync data from one database to the other, both as set up in config.toml.\nThe source database is not changed, and both databases have to have the schema version of this SyncYomi, the target has to be empty.\nSet databaseType in config.toml to the target once the copy is done, devices keep syncing without pairing again.")
+	from := flags.String("from", "", "database type to copy from")
+	to := flags.String("to", "", "database type to copy to")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *from == "" || *to == "" {
+		flags.Usage()
+		return errors.New("--from and --to are required")
+	}
+	if *from == *to {
+		return errors.New("--from and --to are the same database")
+	}
+
+	cfg := config.New(*configPath, version)
+	log := logger.New(cfg.Config)
+
+	// both databases share the rest of the config, like the blob storage and encryption keys
+	srcCfg, dstCfg := *cfg.Config, *cfg.Config
+	srcCfg.DatabaseType, dstCfg.DatabaseType = *from, *to
+
+	src, err := database.NewDB(&srcCfg, log)
+	if err != nil {
+		return err
+	}
+	// the source is only read, it is neither upgraded nor changed
+	if err := src.OpenReadOnly(); err != nil {
+		return errors.Wrap(err, "could not open the %v database to copy from", *from)
+	}
+	defer src.Close()
+
+	dst, err := database.NewDB(&dstCfg, log)
+	if err != nil {
+		return err
+	}
+	if err := dst.OpenExisting(); err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	ctx := context.Background()
+
+	// OpenExisting refused a target with another schema version
+	schemaVersion, _, err := dst.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	rows, err := snapshot.Copy(ctx, src, dst)
+	if err != nil {
+		return err
+	}
+
+	manifest := snapshot.Manifest{Tables: src.SnapshotTables(), Rows: rows}
+	fmt.Fprintf(os.Stderr, "copied %s from %s to %s (schema version %d)\n", manifest.Summary(), src.Driver, dst.Driver, schemaVersion)
+	fmt.Fprintf(os.Stderr, "set databaseType = %q in config.toml and restart the server\n", dst.Driver)
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/SyncYomi/SyncYomi/internal/database"
+	"github.com/SyncYomi/SyncYomi/internal/domain"
+	"github.com/SyncYomi/SyncYomi/internal/sync"
+	"github.com/SyncYomi/SyncYomi/pkg/errors"
+)
+
+// runSync runs the sync data subcommands.
+func runSync(args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "export":
+			return runSyncExport(args[1:])
+		case "import":
+			return runSyncImport(args[1:])
+		}
+	}
+
+	fmt.Fprintln(os.Stderr, "Usage: syncyomi sync <export|import> [flags]")
+	return errors.New("unknown sync command")
+}
+
+// runSyncExport writes the sync data of a key to a file.
+func runSyncExport(args []string) error {
+	flags, configPath := newFlagSet("sync export", "sync export --key <name> [--out <file>] [--config <path>]",
+		"Writes the sync data of the API key to a .tachibk file, or to stdout without --out.")
+	keyName := flags.String("key", "", "name of the API key")
+	out := flags.String("out", "", "file to write the sync data to")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *keyName == "" {
+		flags.Usage()
+		return errors.New("--key is required")
+	}
+
+	env, err := openDatabase(*configPath)
+	if err != nil {
+		return err
+	}
+	defer env.db.Close()
+
+	ctx := context.Background()
+
+	key, err := findAPIKey(ctx, database.NewAPIRepo(env.log, env.db), *keyName)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	var etag string
+	found, err := database.NewSyncRepo(env.log, env.db).WriteSyncDataTo(ctx, key.ID, func(e string, size int64, data io.Reader) error {
+		etag = e
+		_, err := io.Copy(w, data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		if *out != "" {
+			os.Remove(*out)
+		}
+		return errors.New("no sync data for key %q", key.Name)
+	}
+
+	fmt.Fprintf(os.Stderr, "exported sync data of %q, etag %s\n", key.Name, etag)
+	return nil
+}
+
+// runSyncImport replaces the sync data of a key with a file,
+// checked against the same limits as uploads.
+func runSyncImport(args []string) error {
+	flags, configPath := newFlagSet("sync import", "sync import --key <name> [--device <name>] [--config <path>] <file>",
+		"Replaces the sync data of the API key with a .tachibk file, the replaced data is kept in the history.\nDevices pick up the imported data on their next sync.")
+	keyName := flags.String("key", "", "name of the API key")
+	deviceName := flags.String("device", "syncyomi cli", "device name recorded with the sync data")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *keyName == "" || flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("--key and a file are required")
+	}
+
+	data, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	env, err := openDatabase(*configPath)
+	if err != nil {
+		return err
+	}
+	defer env.db.Close()
+
+	ctx := context.Background()
+
+	key, err := findAPIKey(ctx, database.NewAPIRepo(env.log, env.db), *keyName)
+	if err != nil {
+		return err
+	}
+
+	if err := sync.ValidateSyncData(env.cfg, key, data); err != nil {
+		return err
+	}
+
+	repo := database.NewSyncRepo(env.log, env.db)
+
+	etag, _, err := repo.SetSyncData(ctx, key.ID, *deviceName, data)
+	if err != nil {
+		return err
+	}
+
+	if err := repo.PruneSyncDataHistory(ctx, key.ID, sync.HistoryDepth(env.cfg, key)); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "imported sync data of %q, etag %s\n", key.Name, *etag)
+	return nil
+}
+
+// findAPIKey returns the API key with the name, names are not unique so it has to match one key.
+func findAPIKey(ctx context.Context, repo domain.APIRepo, name string) (*domain.APIKey, error) {
+	keys, err := repo.GetKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []domain.APIKey
+	for _, k := range keys {
+		if k.Name == name {
+			found = append(found, k)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return nil, errors.New("no API key named %q", name)
+	case 1:
+		return &found[0], nil
+	default:
+		return nil, errors.New("%d API keys are named %q", len(found), name)
+	}
+}
@@ -4,18 +4,54 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
 	"github.com/SyncYomi/SyncYomi/internal/domain"
 	"github.com/SyncYomi/SyncYomi/internal/logger"
 	"github.com/rs/zerolog"
 )
 
+var (
+	// ErrInvalidQuota is returned by Store and Update when a quota is negative.
+	ErrInvalidQuota = errors.New("invalid quota")
+	// ErrInvalidScope is returned by Store and Update for an unknown scope.
+	ErrInvalidScope = errors.New("invalid scope")
+	// ErrInvalidExpiry is returned by Store and Update when the key would already be expired.
+	ErrInvalidExpiry = errors.New("invalid expiry")
+	// ErrInvalidGrace is returned by Rotate for a negative grace period.
+	ErrInvalidGrace = errors.New("invalid grace period")
+)
+
+// usagePeriod is how many days of uploads Usage sums up, including today.
+const usagePeriod = 30
+
+// DefaultRotationGrace is how long a rotated key keeps working by default.
+const DefaultRotationGrace = 24 * time.Hour
+
+// lastUsedInterval is how often the last use of a key is written while its ip stays the same,
+// so validating a key does not write on every request.
+const lastUsedInterval = time.Minute
+
 type Service interface {
 	Get(ctx context.Context, key string) (*domain.APIKey, error)
+	FindByID(ctx context.Context, id int) (*domain.APIKey, error)
 	List(ctx context.Context) ([]domain.APIKey, error)
+	// ListByUser lists the keys owned by a user.
+	ListByUser(ctx context.Context, userID int) ([]domain.APIKey, error)
 	Store(ctx context.Context, key *domain.APIKey) error
 	Update(ctx context.Context, key *domain.APIKey) error
-	Delete(ctx context.Context, key string) error
-	ValidateAPIKey(ctx context.Context, token string) bool
+	Delete(ctx context.Context, id int) error
+	// Rotate replaces the key with id by a new key for the same sync data,
+	// the old key keeps working for grace. Only the returned key has the new key.
+	Rotate(ctx context.Context, id int, grace time.Duration) (*domain.APIKey, error)
+	// ValidateAPIKey reports whether token is a key that has not expired,
+	// and records its use from ip.
+	ValidateAPIKey(ctx context.Context, token string, ip string) bool
+	// Usage lists what each key stores, and uploaded today and in the last 30 days.
+	Usage(ctx context.Context) ([]domain.APIKeyUsage, error)
 }
 
 type service struct {
@@ -23,6 +59,15 @@ type service struct {
 	repo domain.APIRepo
 
 	keyCache []domain.APIKey
+
+	lastUsedMu sync.Mutex
+	lastUsed   map[int]keyUse
+}
+
+// keyUse is the last use of a key written to the repo.
+type keyUse struct {
+	at time.Time
+	ip string
 }
 
 func NewService(log logger.Logger, repo domain.APIRepo) Service {
@@ -30,6 +75,7 @@ func NewService(log logger.Logger, repo domain.APIRepo) Service {
 		log:      log.With().Str("module", "api").Logger(),
 		repo:     repo,
 		keyCache: []domain.APIKey{},
+		lastUsed: map[int]keyUse{},
 	}
 }
 
@@ -37,6 +83,10 @@ func (s *service) Get(ctx context.Context, key string) (*domain.APIKey, error) {
 	return s.repo.Get(ctx, key)
 }
 
+func (s *service) FindByID(ctx context.Context, id int) (*domain.APIKey, error) {
+	return s.repo.FindByID(ctx, id)
+}
+
 func (s *service) List(ctx context.Context) ([]domain.APIKey, error) {
 	if len(s.keyCache) > 0 {
 		return s.keyCache, nil
@@ -45,7 +95,30 @@ func (s *service) List(ctx context.Context) ([]domain.APIKey, error) {
 	return s.repo.GetKeys(ctx)
 }
 
+// ListByUser lists the keys owned by a user.
+func (s *service) ListByUser(ctx context.Context, userID int) ([]domain.APIKey, error) {
+	return s.repo.GetUserKeys(ctx, userID)
+}
+
+// Store a new key, keys without scopes get the scopes to sync.
+// Only a hash of the key is stored, key.Key is the only time it can be read.
 func (s *service) Store(ctx context.Context, key *domain.APIKey) error {
+	if err := validateQuotas(key); err != nil {
+		return err
+	}
+
+	if err := validateExpiry(key); err != nil {
+		return err
+	}
+
+	if len(key.Scopes) == 0 {
+		key.Scopes = slices.Clone(domain.DefaultScopes)
+	}
+
+	if err := validateScopes(key); err != nil {
+		return err
+	}
+
 	key.Key = GenerateSecureToken(16)
 
 	if err := s.repo.Store(ctx, key); err != nil {
@@ -53,36 +126,133 @@ func (s *service) Store(ctx context.Context, key *domain.APIKey) error {
 	}
 
 	if len(s.keyCache) > 0 {
-		// set new key
-		s.keyCache = append(s.keyCache, *key)
+		// set new key, the cache is like the repo and has no key
+		cached := *key
+		cached.Key = ""
+		s.keyCache = append(s.keyCache, cached)
 	}
 
 	return nil
 }
 
+// Update the name, quotas, scopes and expiry of a key, nil scopes are left as they are.
 func (s *service) Update(ctx context.Context, key *domain.APIKey) error {
+	if err := validateQuotas(key); err != nil {
+		return err
+	}
+
+	if err := validateExpiry(key); err != nil {
+		return err
+	}
+
+	if err := validateScopes(key); err != nil {
+		return err
+	}
+
+	if err := s.repo.Update(ctx, key); err != nil {
+		return err
+	}
+
+	// reset
+	s.keyCache = []domain.APIKey{}
+
 	return nil
 }
 
-func (s *service) Delete(ctx context.Context, key string) error {
+func validateQuotas(key *domain.APIKey) error {
+	if key.MaxDataSize < 0 || key.MaxHistoryDepth < 0 || key.MaxDailyUpload < 0 {
+		return ErrInvalidQuota
+	}
+	return nil
+}
+
+func validateExpiry(key *domain.APIKey) error {
+	if key.Expired(time.Now()) {
+		return ErrInvalidExpiry
+	}
+	return nil
+}
+
+func validateScopes(key *domain.APIKey) error {
+	for _, scope := range key.Scopes {
+		if !domain.ValidScope(scope) {
+			return ErrInvalidScope
+		}
+	}
+	return nil
+}
+
+func (s *service) Delete(ctx context.Context, id int) error {
+	// reset
+	s.keyCache = []domain.APIKey{}
+
+	return s.repo.Delete(ctx, id)
+}
+
+// Rotate replaces the key with id by a new key for the same sync data,
+// the old key keeps working for grace. Only the returned key has the new key.
+func (s *service) Rotate(ctx context.Context, id int, grace time.Duration) (*domain.APIKey, error) {
+	if grace < 0 {
+		return nil, ErrInvalidGrace
+	}
+
+	newKey := GenerateSecureToken(16)
+
+	if err := s.repo.Rotate(ctx, id, newKey, time.Now().Add(grace)); err != nil {
+		return nil, err
+	}
+
 	// reset
 	s.keyCache = []domain.APIKey{}
 
-	return s.repo.Delete(ctx, key)
+	key, err := s.repo.FindByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	key.Key = newKey
+
+	return key, nil
 }
 
-func (s *service) ValidateAPIKey(ctx context.Context, key string) bool {
-	keys, err := s.repo.GetKeys(ctx)
+// ValidateAPIKey reports whether token is a key that has not expired,
+// and records its use from ip.
+func (s *service) ValidateAPIKey(ctx context.Context, token string, ip string) bool {
+	key, err := s.repo.Get(ctx, token)
 	if err != nil {
 		return false
 	}
 
-	for _, k := range keys {
-		if k.Key == key {
-			return true
-		}
+	now := time.Now()
+
+	if key.Expired(now) {
+		return false
 	}
-	return false
+
+	s.recordUse(ctx, key.ID, now, ip)
+
+	return true
+}
+
+// recordUse writes the last use of the key with id, at most once per lastUsedInterval unless the ip changed.
+func (s *service) recordUse(ctx context.Context, id int, at time.Time, ip string) {
+	s.lastUsedMu.Lock()
+	last, ok := s.lastUsed[id]
+	if ok && last.ip == ip && at.Sub(last.at) < lastUsedInterval {
+		s.lastUsedMu.Unlock()
+		return
+	}
+	s.lastUsed[id] = keyUse{at: at, ip: ip}
+	s.lastUsedMu.Unlock()
+
+	if err := s.repo.SetLastUsed(ctx, id, at, ip); err != nil {
+		s.log.Error().Err(err).Msg("could not record api key use")
+	}
+}
+
+// Usage lists what each key stores, and uploaded today and in the last 30 days.
+func (s *service) Usage(ctx context.Context) ([]domain.APIKeyUsage, error) {
+	today := time.Now().UTC()
+	return s.repo.ListUsage(ctx, today.AddDate(0, 0, -(usagePeriod-1)), today)
 }
 
 func GenerateSecureToken(length int) string {
@@ -0,0 +1,89 @@
+// Package audit keeps a durable log of administrative actions,
+// like logins and changes to api keys, notifications and the config.
+package audit
+
+import (
+	"context"
+	"time"
+
+	"github.com/SyncYomi/SyncYomi/internal/domain"
+	"github.com/SyncYomi/SyncYomi/internal/logger"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// DefaultLimit is the number of entries listed when the filter has no limit.
+	DefaultLimit = 50
+	// MaxLimit bounds the number of entries listed at once.
+	MaxLimit = 500
+)
+
+type Service interface {
+	// Record an administrative action, a failure to store it is only logged
+	// so the action itself does not fail.
+	Record(ctx context.Context, entry domain.AuditEntry)
+	// List the entries matching filter, newest first, and the number of
+	// entries matching it without limit and offset.
+	// The limit defaults to DefaultLimit and is capped at MaxLimit.
+	List(ctx context.Context, filter domain.AuditFilter) ([]domain.AuditEntry, int, error)
+	// Delete the entries older than the auditLogRetention days of the config.
+	Expire(ctx context.Context) error
+}
+
+type service struct {
+	log    zerolog.Logger
+	config *domain.Config
+	repo   domain.AuditRepo
+}
+
+func NewService(log logger.Logger, config *domain.Config, repo domain.AuditRepo) Service {
+	return &service{
+		log:    log.With().Str("module", "audit").Logger(),
+		config: config,
+		repo:   repo,
+	}
+}
+
+func (s *service) Record(ctx context.Context, entry domain.AuditEntry) {
+	if err := s.repo.Store(context.WithoutCancel(ctx), &entry); err != nil {
+		s.log.Error().Err(err).Msgf("could not record %v by %v", entry.Action, entry.Actor)
+		return
+	}
+
+	s.log.Debug().Msgf("%v by %v from %v: %v", entry.Action, entry.Actor, entry.IP, entry.Target)
+}
+
+func (s *service) List(ctx context.Context, filter domain.AuditFilter) ([]domain.AuditEntry, int, error) {
+	filter.Limit = Limit(filter.Limit)
+	return s.repo.List(ctx, filter)
+}
+
+// Limit returns the number of entries List lists for limit.
+func Limit(limit int) int {
+	if limit <= 0 {
+		return DefaultLimit
+	}
+	if limit > MaxLimit {
+		return MaxLimit
+	}
+	return limit
+}
+
+func (s *service) Expire(ctx context.Context) error {
+	if s.config.AuditLogRetention <= 0 {
+		return nil
+	}
+
+	before := time.Now().AddDate(0, 0, -s.config.AuditLogRetention)
+
+	deleted, err := s.repo.DeleteBefore(ctx, before)
+	if err != nil {
+		return err
+	}
+
+	if deleted > 0 {
+		s.log.Info().Msgf("Deleted %d expired audit log entries", deleted)
+	}
+
+	return nil
+}
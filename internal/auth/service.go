@@ -13,7 +13,7 @@ import (
 type Service interface {
 	GetUserCount(ctx context.Context) (int, error)
 	Login(ctx context.Context, username, password string) (*domain.User, error)
-	CreateUser(ctx context.Context, username, password string) error
+	CreateUser(ctx context.Context, username, password string, role domain.Role) error
 }
 
 type service struct {
@@ -62,20 +62,12 @@ func (s *service) Login(ctx context.Context, username, password string) (*domain
 	return u, nil
 }
 
-func (s *service) CreateUser(ctx context.Context, username, password string) error {
+// CreateUser adds a user with a role, usernames are unique.
+func (s *service) CreateUser(ctx context.Context, username, password string, role domain.Role) error {
 	if username == "" || password == "" {
 		return errors.New("empty credentials supplied")
 	}
 
-	userCount, err := s.userSvc.GetUserCount(ctx)
-	if err != nil {
-		return err
-	}
-
-	if userCount > 0 {
-		return errors.New("only 1 user account is supported at the moment")
-	}
-
 	hashed, err := argon2id.CreateHash(password, argon2id.DefaultParams)
 	if err != nil {
 		return errors.New("failed to hash password")
@@ -84,8 +76,12 @@ func (s *service) CreateUser(ctx context.Context, username, password string) err
 	newUser := domain.User{
 		Username: username,
 		Password: hashed,
+		Role:     role,
 	}
-	if err := s.userSvc.CreateUser(context.Background(), newUser); err != nil {
+	if err := s.userSvc.CreateUser(ctx, newUser); err != nil {
+		if errors.Is(err, domain.ErrUserExists) {
+			return err
+		}
 		s.log.Error().Err(err).Msgf("could not create user: %v", username)
 		return errors.New("failed to create new user")
 	}
@@ -0,0 +1,166 @@
+// Package backup decodes the library backups that Mihon and the other
+// Tachiyomi forks upload to the sync endpoints.
+//
+// The field numbers follow the app's Backup protobuf schema. Fields the
+// server does not model are kept as they are, so a decoded backup can be
+// encoded again without losing anything.
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+
+	"github.com/SyncYomi/SyncYomi/pkg/errors"
+)
+
+type Backup struct {
+	Manga      []Manga
+	Categories []Category
+	Sources    []Source
+
+	unknown []byte
+}
+
+type Manga struct {
+	Source             int64
+	URL                string
+	Title              string
+	Artist             string
+	Author             string
+	Description        string
+	Genre              []string
+	Status             int32
+	ThumbnailURL       string
+	DateAdded          int64
+	Viewer             int32
+	Chapters           []Chapter
+	Categories         []int64
+	Tracking           []Tracking
+	Favorite           bool
+	ChapterFlags       int32
+	ViewerFlags        int32
+	History            []History
+	UpdateStrategy     int32
+	LastModifiedAt     int64
+	FavoriteModifiedAt int64
+	ExcludedScanlators []string
+	Version            int64
+	Notes              string
+	Initialized        bool
+
+	unknown []byte
+}
+
+type Chapter struct {
+	URL            string
+	Name           string
+	Scanlator      string
+	Read           bool
+	Bookmark       bool
+	LastPageRead   int64
+	DateFetch      int64
+	DateUpload     int64
+	ChapterNumber  float32
+	SourceOrder    int64
+	LastModifiedAt int64
+	Version        int64
+
+	unknown []byte
+}
+
+type Category struct {
+	Name  string
+	Order int64
+	ID    int64
+	Flags int64
+
+	unknown []byte
+}
+
+type Tracking struct {
+	SyncID              int32
+	LibraryID           int64
+	MediaIDInt          int32
+	TrackingURL         string
+	Title               string
+	LastChapterRead     float32
+	TotalChapters       int32
+	Score               float32
+	Status              int32
+	StartedReadingDate  int64
+	FinishedReadingDate int64
+	Private             bool
+	MediaID             int64
+
+	unknown []byte
+}
+
+type History struct {
+	URL          string
+	LastRead     int64
+	ReadDuration int64
+
+	unknown []byte
+}
+
+type Source struct {
+	Name     string
+	SourceID int64
+
+	unknown []byte
+}
+
+// ErrTooLarge is returned by Decode if the uncompressed backup would exceed the size limit.
+var ErrTooLarge = errors.Sentinel("backup too large")
+
+// gzipMagic are the first bytes of every gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Decode parses a backup as it is stored by the sync endpoints.
+// The app gzips its backups, but uncompressed protobuf is accepted as well.
+// maxSize limits the size of the uncompressed backup, zero means no limit.
+func Decode(data []byte, maxSize int64) (*Backup, error) {
+	if bytes.HasPrefix(data, gzipMagic) {
+		var err error
+		if data, err = uncompress(data, maxSize); err != nil {
+			return nil, errors.Wrap(err, "could not uncompress backup")
+		}
+	}
+
+	return Unmarshal(data)
+}
+
+// Unmarshal parses an uncompressed backup protobuf.
+func Unmarshal(data []byte) (*Backup, error) {
+	var b Backup
+	if err := b.unmarshal(data); err != nil {
+		return nil, errors.Wrap(err, "could not decode backup")
+	}
+
+	return &b, nil
+}
+
+// uncompress gunzips data, reading at most one byte past maxSize
+// so a small upload cannot expand into gigabytes of memory.
+func uncompress(data []byte, maxSize int64) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	if maxSize <= 0 {
+		return io.ReadAll(reader)
+	}
+
+	out, err := io.ReadAll(io.LimitReader(reader, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(out)) > maxSize {
+		return nil, ErrTooLarge
+	}
+
+	return out, nil
+}
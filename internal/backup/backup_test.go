@@ -0,0 +1,170 @@
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func appendFloat(b []byte, num protowire.Number, v float32) []byte {
+	b = protowire.AppendTag(b, num, protowire.Fixed32Type)
+	return protowire.AppendFixed32(b, math.Float32bits(v))
+}
+
+// testBackup builds a backup the way the app encodes it.
+func testBackup() []byte {
+	var chapter []byte
+	chapter = appendString(chapter, 1, "/chapter/1")
+	chapter = appendString(chapter, 2, "Chapter 1")
+	chapter = appendVarint(chapter, 4, 1)
+	chapter = appendVarint(chapter, 6, 12)
+	chapter = appendFloat(chapter, 9, 1.5)
+	chapter = appendVarint(chapter, 11, 1700000000)
+
+	var history []byte
+	history = appendString(history, 1, "/chapter/1")
+	history = appendVarint(history, 2, 1700000001000)
+
+	var tracking []byte
+	tracking = appendVarint(tracking, 1, 2)
+	tracking = appendVarint(tracking, 2, 99)
+	tracking = appendFloat(tracking, 6, 1)
+	tracking = appendVarint(tracking, 100, 12345)
+
+	// categories are written unpacked by the app, packed must be accepted too
+	var packed []byte
+	packed = protowire.AppendVarint(packed, 2)
+	packed = protowire.AppendVarint(packed, 3)
+
+	var manga []byte
+	manga = appendVarint(manga, 1, 2499283573021220255)
+	manga = appendString(manga, 2, "/manga/1")
+	manga = appendString(manga, 3, "Title")
+	manga = appendString(manga, 7, "Action")
+	manga = appendString(manga, 7, "Drama")
+	manga = appendMessage(manga, 16, chapter)
+	manga = appendVarint(manga, 17, 1)
+	manga = appendMessage(manga, 17, packed)
+	manga = appendMessage(manga, 18, tracking)
+	manga = appendMessage(manga, 104, history)
+	manga = appendVarint(manga, 106, 1700000002)
+	// an unknown field is kept for encoding
+	manga = appendString(manga, 500, "unknown")
+
+	var removed []byte
+	removed = appendVarint(removed, 1, 1)
+	removed = appendString(removed, 2, "/manga/2")
+	removed = appendVarint(removed, 100, 0)
+
+	var category []byte
+	category = appendString(category, 1, "Reading")
+	category = appendVarint(category, 2, 1)
+	category = appendVarint(category, 3, 1)
+
+	var source []byte
+	source = appendString(source, 1, "Source")
+	source = appendVarint(source, 2, 2499283573021220255)
+
+	var backup []byte
+	backup = appendMessage(backup, 1, manga)
+	backup = appendMessage(backup, 1, removed)
+	backup = appendMessage(backup, 2, category)
+	backup = appendMessage(backup, 101, source)
+
+	return backup
+}
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecode(t *testing.T) {
+	want := &Backup{
+		Manga: []Manga{
+			{
+				Source: 2499283573021220255,
+				URL:    "/manga/1",
+				Title:  "Title",
+				Genre:  []string{"Action", "Drama"},
+				Chapters: []Chapter{
+					{URL: "/chapter/1", Name: "Chapter 1", Read: true, LastPageRead: 12, ChapterNumber: 1.5, LastModifiedAt: 1700000000},
+				},
+				Categories:     []int64{1, 2, 3},
+				Tracking:       []Tracking{{SyncID: 2, LibraryID: 99, LastChapterRead: 1, MediaID: 12345}},
+				Favorite:       true,
+				History:        []History{{URL: "/chapter/1", LastRead: 1700000001000}},
+				LastModifiedAt: 1700000002,
+				unknown:        appendString(nil, 500, "unknown"),
+			},
+			{Source: 1, URL: "/manga/2", Favorite: false},
+		},
+		Categories: []Category{{Name: "Reading", Order: 1, ID: 1}},
+		Sources:    []Source{{Name: "Source", SourceID: 2499283573021220255}},
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "gzip", data: gzipBytes(t, testBackup())},
+		{name: "uncompressed", data: testBackup()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Decode(tt.data, 0)
+			if err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Decode() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestDecode_invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "truncated", data: testBackup()[:10]},
+		{name: "wrong wire type", data: appendVarint(nil, 1, 1)},
+		{name: "broken gzip", data: []byte{0x1f, 0x8b, 0x00}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Decode(tt.data, 0); err == nil {
+				t.Error("Decode() error = nil, want error")
+			}
+		})
+	}
+}
+
+func TestDecode_tooLarge(t *testing.T) {
+	// a few KB of gzip expanding to 64 MiB of zeros
+	data := gzipBytes(t, make([]byte, 64<<20))
+
+	if _, err := Decode(data, 1<<20); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Decode() error = %v, want %v", err, ErrTooLarge)
+	}
+
+	// the limit is inclusive
+	backup := testBackup()
+	if _, err := Decode(gzipBytes(t, backup), int64(len(backup))); err != nil {
+		t.Errorf("Decode() error = %v, want nil", err)
+	}
+}
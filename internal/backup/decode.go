@@ -0,0 +1,365 @@
+package backup
+
+import (
+	"math"
+
+	"github.com/SyncYomi/SyncYomi/pkg/errors"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// field is a single decoded protobuf field.
+type field struct {
+	num protowire.Number
+	typ protowire.Type
+	v   uint64
+	b   []byte
+	// raw is the encoded field including its tag,
+	// used to keep the fields the server does not know about.
+	raw []byte
+}
+
+// parseFields walks the fields of a protobuf message and calls fn for each of them.
+func parseFields(b []byte, fn func(f field) error) error {
+	for len(b) > 0 {
+		start := b
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		f := field{num: num, typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			f.v, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(b)
+			f.v = uint64(v)
+		case protowire.Fixed64Type:
+			f.v, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			f.b, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		f.raw = start[:len(start)-len(b)]
+
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f field) wireTypeError() error {
+	return errors.New("field %d: unexpected wire type %d", f.num, f.typ)
+}
+
+func (f field) varint() (uint64, error) {
+	if f.typ != protowire.VarintType {
+		return 0, f.wireTypeError()
+	}
+	return f.v, nil
+}
+
+func (f field) int64() (int64, error) {
+	v, err := f.varint()
+	return int64(v), err
+}
+
+func (f field) int32() (int32, error) {
+	v, err := f.varint()
+	return int32(v), err
+}
+
+func (f field) bool() (bool, error) {
+	v, err := f.varint()
+	return v != 0, err
+}
+
+func (f field) float32() (float32, error) {
+	if f.typ != protowire.Fixed32Type {
+		return 0, f.wireTypeError()
+	}
+	return math.Float32frombits(uint32(f.v)), nil
+}
+
+func (f field) string() (string, error) {
+	if f.typ != protowire.BytesType {
+		return "", f.wireTypeError()
+	}
+	return string(f.b), nil
+}
+
+// int64s decodes a repeated int64 field, which may or may not be packed.
+func (f field) int64s() ([]int64, error) {
+	if f.typ == protowire.VarintType {
+		return []int64{int64(f.v)}, nil
+	}
+	if f.typ != protowire.BytesType {
+		return nil, f.wireTypeError()
+	}
+
+	var values []int64
+	b := f.b
+	for len(b) > 0 {
+		v, n := protowire.ConsumeVarint(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		values = append(values, int64(v))
+		b = b[n:]
+	}
+
+	return values, nil
+}
+
+type unmarshaler interface {
+	unmarshal(b []byte) error
+}
+
+func (f field) message(m unmarshaler) error {
+	if f.typ != protowire.BytesType {
+		return f.wireTypeError()
+	}
+	return m.unmarshal(f.b)
+}
+
+func (b *Backup) unmarshal(data []byte) error {
+	return parseFields(data, func(f field) error {
+		switch f.num {
+		case 1:
+			var m Manga
+			if err := f.message(&m); err != nil {
+				return err
+			}
+			b.Manga = append(b.Manga, m)
+		case 2:
+			var c Category
+			if err := f.message(&c); err != nil {
+				return err
+			}
+			b.Categories = append(b.Categories, c)
+		case 101:
+			var s Source
+			if err := f.message(&s); err != nil {
+				return err
+			}
+			b.Sources = append(b.Sources, s)
+		default:
+			b.unknown = append(b.unknown, f.raw...)
+		}
+		return nil
+	})
+}
+
+func (m *Manga) unmarshal(data []byte) error {
+	// the app treats manga without the field as being in the library
+	m.Favorite = true
+
+	return parseFields(data, func(f field) error {
+		var err error
+		switch f.num {
+		case 1:
+			m.Source, err = f.int64()
+		case 2:
+			m.URL, err = f.string()
+		case 3:
+			m.Title, err = f.string()
+		case 4:
+			m.Artist, err = f.string()
+		case 5:
+			m.Author, err = f.string()
+		case 6:
+			m.Description, err = f.string()
+		case 7:
+			var genre string
+			if genre, err = f.string(); err == nil {
+				m.Genre = append(m.Genre, genre)
+			}
+		case 8:
+			m.Status, err = f.int32()
+		case 9:
+			m.ThumbnailURL, err = f.string()
+		case 13:
+			m.DateAdded, err = f.int64()
+		case 14:
+			m.Viewer, err = f.int32()
+		case 16:
+			var c Chapter
+			if err = f.message(&c); err == nil {
+				m.Chapters = append(m.Chapters, c)
+			}
+		case 17:
+			var categories []int64
+			if categories, err = f.int64s(); err == nil {
+				m.Categories = append(m.Categories, categories...)
+			}
+		case 18:
+			var t Tracking
+			if err = f.message(&t); err == nil {
+				m.Tracking = append(m.Tracking, t)
+			}
+		case 100:
+			m.Favorite, err = f.bool()
+		case 101:
+			m.ChapterFlags, err = f.int32()
+		case 103:
+			m.ViewerFlags, err = f.int32()
+		case 104:
+			var h History
+			if err = f.message(&h); err == nil {
+				m.History = append(m.History, h)
+			}
+		case 105:
+			m.UpdateStrategy, err = f.int32()
+		case 106:
+			m.LastModifiedAt, err = f.int64()
+		case 107:
+			m.FavoriteModifiedAt, err = f.int64()
+		case 108:
+			var scanlator string
+			if scanlator, err = f.string(); err == nil {
+				m.ExcludedScanlators = append(m.ExcludedScanlators, scanlator)
+			}
+		case 109:
+			m.Version, err = f.int64()
+		case 110:
+			m.Notes, err = f.string()
+		case 111:
+			m.Initialized, err = f.bool()
+		default:
+			m.unknown = append(m.unknown, f.raw...)
+		}
+		return err
+	})
+}
+
+func (c *Chapter) unmarshal(data []byte) error {
+	return parseFields(data, func(f field) error {
+		var err error
+		switch f.num {
+		case 1:
+			c.URL, err = f.string()
+		case 2:
+			c.Name, err = f.string()
+		case 3:
+			c.Scanlator, err = f.string()
+		case 4:
+			c.Read, err = f.bool()
+		case 5:
+			c.Bookmark, err = f.bool()
+		case 6:
+			c.LastPageRead, err = f.int64()
+		case 7:
+			c.DateFetch, err = f.int64()
+		case 8:
+			c.DateUpload, err = f.int64()
+		case 9:
+			c.ChapterNumber, err = f.float32()
+		case 10:
+			c.SourceOrder, err = f.int64()
+		case 11:
+			c.LastModifiedAt, err = f.int64()
+		case 12:
+			c.Version, err = f.int64()
+		default:
+			c.unknown = append(c.unknown, f.raw...)
+		}
+		return err
+	})
+}
+
+func (c *Category) unmarshal(data []byte) error {
+	return parseFields(data, func(f field) error {
+		var err error
+		switch f.num {
+		case 1:
+			c.Name, err = f.string()
+		case 2:
+			c.Order, err = f.int64()
+		case 3:
+			c.ID, err = f.int64()
+		case 100:
+			c.Flags, err = f.int64()
+		default:
+			c.unknown = append(c.unknown, f.raw...)
+		}
+		return err
+	})
+}
+
+func (t *Tracking) unmarshal(data []byte) error {
+	return parseFields(data, func(f field) error {
+		var err error
+		switch f.num {
+		case 1:
+			t.SyncID, err = f.int32()
+		case 2:
+			t.LibraryID, err = f.int64()
+		case 3:
+			t.MediaIDInt, err = f.int32()
+		case 4:
+			t.TrackingURL, err = f.string()
+		case 5:
+			t.Title, err = f.string()
+		case 6:
+			t.LastChapterRead, err = f.float32()
+		case 7:
+			t.TotalChapters, err = f.int32()
+		case 8:
+			t.Score, err = f.float32()
+		case 9:
+			t.Status, err = f.int32()
+		case 10:
+			t.StartedReadingDate, err = f.int64()
+		case 11:
+			t.FinishedReadingDate, err = f.int64()
+		case 12:
+			t.Private, err = f.bool()
+		case 100:
+			t.MediaID, err = f.int64()
+		default:
+			t.unknown = append(t.unknown, f.raw...)
+		}
+		return err
+	})
+}
+
+func (h *History) unmarshal(data []byte) error {
+	return parseFields(data, func(f field) error {
+		var err error
+		switch f.num {
+		case 1:
+			h.URL, err = f.string()
+		case 2:
+			h.LastRead, err = f.int64()
+		case 3:
+			h.ReadDuration, err = f.int64()
+		default:
+			h.unknown = append(h.unknown, f.raw...)
+		}
+		return err
+	})
+}
+
+func (s *Source) unmarshal(data []byte) error {
+	return parseFields(data, func(f field) error {
+		var err error
+		switch f.num {
+		case 1:
+			s.Name, err = f.string()
+		case 2:
+			s.SourceID, err = f.int64()
+		default:
+			s.unknown = append(s.unknown, f.raw...)
+		}
+		return err
+	})
+}
@@ -0,0 +1,202 @@
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The app rejects messages that lack a field without a default value,
+// so those are always written, even when they hold the zero value.
+// Everything else is left out when it is the zero value, like the app does.
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendInt64(b []byte, num protowire.Number, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	return appendVarint(b, num, uint64(v))
+}
+
+func appendInt32(b []byte, num protowire.Number, v int32) []byte {
+	if v == 0 {
+		return b
+	}
+	// negative values are sign extended, as for int64
+	return appendVarint(b, num, uint64(int64(v)))
+}
+
+func appendBool(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+	return appendVarint(b, num, protowire.EncodeBool(v))
+}
+
+func appendFloat32(b []byte, num protowire.Number, v float32) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.Fixed32Type)
+	return protowire.AppendFixed32(b, math.Float32bits(v))
+}
+
+func appendString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	return appendRequiredString(b, num, v)
+}
+
+func appendRequiredString(b []byte, num protowire.Number, v string) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+func appendMessage(b []byte, num protowire.Number, m []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m)
+}
+
+// Encode serializes a backup the way the app uploads it, gzip compressed.
+func Encode(b *Backup) ([]byte, error) {
+	var buf bytes.Buffer
+
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(Marshal(b)); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Marshal serializes a backup to uncompressed protobuf.
+func Marshal(b *Backup) []byte {
+	var out []byte
+	for i := range b.Manga {
+		out = appendMessage(out, 1, b.Manga[i].marshal())
+	}
+	for i := range b.Categories {
+		out = appendMessage(out, 2, b.Categories[i].marshal())
+	}
+	for i := range b.Sources {
+		out = appendMessage(out, 101, b.Sources[i].marshal())
+	}
+	return append(out, b.unknown...)
+}
+
+// IsCompressed reports whether data is a gzip compressed backup.
+func IsCompressed(data []byte) bool {
+	return bytes.HasPrefix(data, gzipMagic)
+}
+
+func (m *Manga) marshal() []byte {
+	var b []byte
+	b = appendVarint(b, 1, uint64(m.Source))
+	b = appendRequiredString(b, 2, m.URL)
+	b = appendString(b, 3, m.Title)
+	b = appendString(b, 4, m.Artist)
+	b = appendString(b, 5, m.Author)
+	b = appendString(b, 6, m.Description)
+	for _, genre := range m.Genre {
+		b = appendRequiredString(b, 7, genre)
+	}
+	b = appendInt32(b, 8, m.Status)
+	b = appendString(b, 9, m.ThumbnailURL)
+	b = appendInt64(b, 13, m.DateAdded)
+	b = appendInt32(b, 14, m.Viewer)
+	for i := range m.Chapters {
+		b = appendMessage(b, 16, m.Chapters[i].marshal())
+	}
+	for _, category := range m.Categories {
+		b = appendVarint(b, 17, uint64(category))
+	}
+	for i := range m.Tracking {
+		b = appendMessage(b, 18, m.Tracking[i].marshal())
+	}
+	// favorite defaults to true in the app, so false has to be written
+	b = appendVarint(b, 100, protowire.EncodeBool(m.Favorite))
+	b = appendInt32(b, 101, m.ChapterFlags)
+	b = appendInt32(b, 103, m.ViewerFlags)
+	for i := range m.History {
+		b = appendMessage(b, 104, m.History[i].marshal())
+	}
+	b = appendInt32(b, 105, m.UpdateStrategy)
+	b = appendInt64(b, 106, m.LastModifiedAt)
+	b = appendInt64(b, 107, m.FavoriteModifiedAt)
+	for _, scanlator := range m.ExcludedScanlators {
+		b = appendRequiredString(b, 108, scanlator)
+	}
+	b = appendInt64(b, 109, m.Version)
+	b = appendString(b, 110, m.Notes)
+	b = appendBool(b, 111, m.Initialized)
+	return append(b, m.unknown...)
+}
+
+func (c *Chapter) marshal() []byte {
+	var b []byte
+	b = appendRequiredString(b, 1, c.URL)
+	b = appendRequiredString(b, 2, c.Name)
+	b = appendString(b, 3, c.Scanlator)
+	b = appendBool(b, 4, c.Read)
+	b = appendBool(b, 5, c.Bookmark)
+	b = appendInt64(b, 6, c.LastPageRead)
+	b = appendInt64(b, 7, c.DateFetch)
+	b = appendInt64(b, 8, c.DateUpload)
+	b = appendFloat32(b, 9, c.ChapterNumber)
+	b = appendInt64(b, 10, c.SourceOrder)
+	b = appendInt64(b, 11, c.LastModifiedAt)
+	b = appendInt64(b, 12, c.Version)
+	return append(b, c.unknown...)
+}
+
+func (c *Category) marshal() []byte {
+	var b []byte
+	b = appendRequiredString(b, 1, c.Name)
+	b = appendInt64(b, 2, c.Order)
+	b = appendInt64(b, 3, c.ID)
+	b = appendInt64(b, 100, c.Flags)
+	return append(b, c.unknown...)
+}
+
+func (t *Tracking) marshal() []byte {
+	var b []byte
+	b = appendVarint(b, 1, uint64(int64(t.SyncID)))
+	b = appendVarint(b, 2, uint64(t.LibraryID))
+	b = appendInt32(b, 3, t.MediaIDInt)
+	b = appendString(b, 4, t.TrackingURL)
+	b = appendString(b, 5, t.Title)
+	b = appendFloat32(b, 6, t.LastChapterRead)
+	b = appendInt32(b, 7, t.TotalChapters)
+	b = appendFloat32(b, 8, t.Score)
+	b = appendInt32(b, 9, t.Status)
+	b = appendInt64(b, 10, t.StartedReadingDate)
+	b = appendInt64(b, 11, t.FinishedReadingDate)
+	b = appendBool(b, 12, t.Private)
+	b = appendInt64(b, 100, t.MediaID)
+	return append(b, t.unknown...)
+}
+
+func (h *History) marshal() []byte {
+	var b []byte
+	b = appendRequiredString(b, 1, h.URL)
+	b = appendVarint(b, 2, uint64(h.LastRead))
+	b = appendInt64(b, 3, h.ReadDuration)
+	return append(b, h.unknown...)
+}
+
+func (s *Source) marshal() []byte {
+	var b []byte
+	b = appendString(b, 1, s.Name)
+	b = appendVarint(b, 2, uint64(s.SourceID))
+	return append(b, s.unknown...)
+}
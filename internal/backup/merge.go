@@ -0,0 +1,202 @@
+package backup
+
+// Merge combines the stored backup with an uploaded one that was based on an
+// older version of it.
+//
+// Manga are matched by source and url, chapters and history by url, and for
+// each of them the most recently modified or read entry wins. The uploaded
+// backup wins ties, and provides everything the server does not model,
+// like the app preferences.
+func Merge(stored, uploaded *Backup) *Backup {
+	merged := &Backup{
+		Categories: append([]Category(nil), uploaded.Categories...),
+		Sources:    append([]Source(nil), uploaded.Sources...),
+		unknown:    uploaded.unknown,
+	}
+
+	// Manga reference categories by their order, which differs between backups,
+	// so categories are matched by name and stored-only ones are appended.
+	categoryOrders := mergeCategories(merged, stored.Categories)
+
+	knownSources := make(map[int64]bool, len(merged.Sources))
+	for _, s := range merged.Sources {
+		knownSources[s.SourceID] = true
+	}
+	for _, s := range stored.Sources {
+		if !knownSources[s.SourceID] {
+			merged.Sources = append(merged.Sources, s)
+			knownSources[s.SourceID] = true
+		}
+	}
+
+	storedManga := make(map[mangaKey]*Manga, len(stored.Manga))
+	for i := range stored.Manga {
+		m := &stored.Manga[i]
+		storedManga[mangaKey{m.Source, m.URL}] = m
+	}
+
+	seen := make(map[mangaKey]bool, len(uploaded.Manga))
+	for i := range uploaded.Manga {
+		m := uploaded.Manga[i]
+		key := mangaKey{m.Source, m.URL}
+		seen[key] = true
+
+		if s, ok := storedManga[key]; ok {
+			m = mergeManga(remapCategories(*s, categoryOrders), m)
+		}
+		merged.Manga = append(merged.Manga, m)
+	}
+	for i := range stored.Manga {
+		m := stored.Manga[i]
+		if !seen[mangaKey{m.Source, m.URL}] {
+			merged.Manga = append(merged.Manga, remapCategories(m, categoryOrders))
+		}
+	}
+
+	return merged
+}
+
+type mangaKey struct {
+	source int64
+	url    string
+}
+
+// mergeCategories adds the stored categories missing from merged,
+// and returns the order each stored category has in merged.
+func mergeCategories(merged *Backup, stored []Category) map[int64]int64 {
+	byName := make(map[string]int64, len(merged.Categories))
+	var maxOrder int64
+	for _, c := range merged.Categories {
+		byName[c.Name] = c.Order
+		if c.Order > maxOrder {
+			maxOrder = c.Order
+		}
+	}
+
+	orders := make(map[int64]int64, len(stored))
+	for _, c := range stored {
+		order, ok := byName[c.Name]
+		if !ok {
+			maxOrder++
+			order = maxOrder
+
+			added := c
+			added.Order = order
+			merged.Categories = append(merged.Categories, added)
+			byName[c.Name] = order
+		}
+		orders[c.Order] = order
+	}
+
+	return orders
+}
+
+func remapCategories(m Manga, orders map[int64]int64) Manga {
+	var categories []int64
+	for _, c := range m.Categories {
+		if order, ok := orders[c]; ok {
+			categories = append(categories, order)
+		}
+	}
+	m.Categories = categories
+	return m
+}
+
+func mergeManga(stored, uploaded Manga) Manga {
+	merged := uploaded
+	if stored.LastModifiedAt > uploaded.LastModifiedAt {
+		merged = stored
+	}
+
+	if stored.FavoriteModifiedAt > uploaded.FavoriteModifiedAt {
+		merged.Favorite = stored.Favorite
+		merged.FavoriteModifiedAt = stored.FavoriteModifiedAt
+	} else if uploaded.FavoriteModifiedAt > stored.FavoriteModifiedAt {
+		merged.Favorite = uploaded.Favorite
+		merged.FavoriteModifiedAt = uploaded.FavoriteModifiedAt
+	}
+
+	merged.Chapters = mergeChapters(stored.Chapters, uploaded.Chapters)
+	merged.History = mergeHistory(stored.History, uploaded.History)
+	merged.Tracking = mergeTracking(stored.Tracking, uploaded.Tracking)
+
+	return merged
+}
+
+func mergeChapters(stored, uploaded []Chapter) []Chapter {
+	byURL := make(map[string]int, len(stored))
+	for i, c := range stored {
+		byURL[c.URL] = i
+	}
+
+	var merged []Chapter
+	seen := make(map[string]bool, len(uploaded))
+	for _, c := range uploaded {
+		seen[c.URL] = true
+		if i, ok := byURL[c.URL]; ok && stored[i].LastModifiedAt > c.LastModifiedAt {
+			c = stored[i]
+		}
+		merged = append(merged, c)
+	}
+	for _, c := range stored {
+		if !seen[c.URL] {
+			merged = append(merged, c)
+		}
+	}
+
+	return merged
+}
+
+func mergeHistory(stored, uploaded []History) []History {
+	byURL := make(map[string]int, len(stored))
+	for i, h := range stored {
+		byURL[h.URL] = i
+	}
+
+	var merged []History
+	seen := make(map[string]bool, len(uploaded))
+	for _, h := range uploaded {
+		seen[h.URL] = true
+		if i, ok := byURL[h.URL]; ok {
+			s := stored[i]
+			if s.LastRead > h.LastRead {
+				h.LastRead = s.LastRead
+			}
+			if s.ReadDuration > h.ReadDuration {
+				h.ReadDuration = s.ReadDuration
+			}
+		}
+		merged = append(merged, h)
+	}
+	for _, h := range stored {
+		if !seen[h.URL] {
+			merged = append(merged, h)
+		}
+	}
+
+	return merged
+}
+
+func mergeTracking(stored, uploaded []Tracking) []Tracking {
+	bySyncID := make(map[int32]int, len(stored))
+	for i, t := range stored {
+		bySyncID[t.SyncID] = i
+	}
+
+	var merged []Tracking
+	seen := make(map[int32]bool, len(uploaded))
+	for _, t := range uploaded {
+		seen[t.SyncID] = true
+		if i, ok := bySyncID[t.SyncID]; ok && stored[i].LastChapterRead > t.LastChapterRead {
+			t = stored[i]
+		}
+		merged = append(merged, t)
+	}
+	for _, t := range stored {
+		if !seen[t.SyncID] {
+			merged = append(merged, t)
+		}
+	}
+
+	return merged
+}
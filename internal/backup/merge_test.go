@@ -0,0 +1,111 @@
+package backup
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEncode_roundTrip(t *testing.T) {
+	want, err := Decode(testBackup(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := Encode(want)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	if !IsCompressed(data) {
+		t.Error("Encode() output is not gzip compressed")
+	}
+
+	got, err := Decode(data, 0)
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Decode(Encode()) = %+v, want %+v", got, want)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	stored := &Backup{
+		Manga: []Manga{
+			{
+				Source:         1,
+				URL:            "/manga/1",
+				Title:          "Stored title",
+				LastModifiedAt: 200,
+				Favorite:       true,
+				Categories:     []int64{5},
+				Chapters: []Chapter{
+					{URL: "/c/1", Read: true, LastModifiedAt: 300},
+					{URL: "/c/2", Read: false, LastModifiedAt: 100},
+					{URL: "/c/3", Read: true, LastModifiedAt: 100},
+				},
+				History: []History{{URL: "/c/1", LastRead: 300, ReadDuration: 10}},
+			},
+			{Source: 1, URL: "/manga/stored-only", Favorite: true, Categories: []int64{5}},
+		},
+		Categories: []Category{{Name: "Stored", Order: 5}},
+		Sources:    []Source{{Name: "A", SourceID: 1}},
+	}
+	uploaded := &Backup{
+		Manga: []Manga{
+			{
+				Source:         1,
+				URL:            "/manga/1",
+				Title:          "Uploaded title",
+				LastModifiedAt: 100,
+				Favorite:       true,
+				Chapters: []Chapter{
+					{URL: "/c/1", Read: false, LastModifiedAt: 200},
+					{URL: "/c/2", Read: true, LastModifiedAt: 200},
+				},
+				History: []History{{URL: "/c/1", LastRead: 100, ReadDuration: 20}},
+			},
+			{Source: 2, URL: "/manga/uploaded-only", Favorite: true},
+		},
+		Categories: []Category{{Name: "Uploaded", Order: 1}},
+		Sources:    []Source{{Name: "B", SourceID: 2}},
+	}
+
+	got := Merge(stored, uploaded)
+
+	want := &Backup{
+		Manga: []Manga{
+			{
+				Source:         1,
+				URL:            "/manga/1",
+				Title:          "Stored title",
+				LastModifiedAt: 200,
+				Favorite:       true,
+				Categories:     []int64{2},
+				Chapters: []Chapter{
+					{URL: "/c/1", Read: true, LastModifiedAt: 300},
+					{URL: "/c/2", Read: true, LastModifiedAt: 200},
+					{URL: "/c/3", Read: true, LastModifiedAt: 100},
+				},
+				History: []History{{URL: "/c/1", LastRead: 300, ReadDuration: 20}},
+			},
+			{Source: 2, URL: "/manga/uploaded-only", Favorite: true},
+			{Source: 1, URL: "/manga/stored-only", Favorite: true, Categories: []int64{2}},
+		},
+		Categories: []Category{{Name: "Uploaded", Order: 1}, {Name: "Stored", Order: 2}},
+		Sources:    []Source{{Name: "B", SourceID: 2}, {Name: "A", SourceID: 1}},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Merge() = %+v, want %+v", got, want)
+	}
+}
+
+func TestMerge_favoriteModifiedAt(t *testing.T) {
+	stored := &Backup{Manga: []Manga{{Source: 1, URL: "/m", Favorite: false, FavoriteModifiedAt: 300, LastModifiedAt: 100}}}
+	uploaded := &Backup{Manga: []Manga{{Source: 1, URL: "/m", Favorite: true, FavoriteModifiedAt: 200, LastModifiedAt: 200}}}
+
+	got := Merge(stored, uploaded)
+	if got.Manga[0].Favorite {
+		t.Error("Merge() kept the older favorite state")
+	}
+}
@@ -137,6 +137,142 @@ sessionSecret = "{{ .sessionSecret }}"
 # terminates TLS but does not send that header.
 #
 #secureCookie = false
+
+# Sync history depth
+#
+# Default: 5
+#
+# Number of previous sync data versions kept per API key.
+# They can be listed and restored through /api/sync/history.
+# Set to 0 to disable the history.
+#
+#syncHistoryDepth = 5
+
+# Enforce sync lease
+#
+# Default: false
+#
+# Devices can hold a lease through /api/sync/lock while they sync.
+# When enabled, writes from other devices are refused with 423 while a device holds the lease.
+#
+#enforceSyncLease = false
+
+# Sync event retention
+#
+# Default: 30
+#
+# Number of days sync events reported by devices are kept.
+# They can be listed through /api/sync/events.
+# Set to 0 to keep them forever.
+#
+#syncEventRetention = 30
+
+# Audit log retention
+#
+# Default: 90
+#
+# Number of days entries of the audit log are kept.
+# The audit log records logins and changes to api keys, notifications and the config,
+# and can be read through /api/audit.
+# Set to 0 to keep them forever.
+#
+#auditLogRetention = 90
+
+# Metrics
+#
+# Default: false
+#
+# Serve prometheus metrics on /metrics.
+#
+#metricsEnabled = false
+
+# Metrics API key
+#
+# Optional
+#
+# When set, /metrics is only served to scrapers sending it as bearer token,
+# in the X-API-Token header or as the apikey query parameter.
+#
+#metricsApiKey = ""
+
+# Max sync payload size
+#
+# Default: 100
+#
+# Max size of uploaded sync data in megabytes, larger uploads are rejected.
+# Uploads are held in memory up to this size, downloads are streamed
+# unless encryption at rest is enabled.
+# Set to 0 to disable the limit.
+#
+#maxSyncPayloadSize = 100
+
+# Server timeouts
+#
+# Default: 300, 300, 120
+#
+# Time in seconds to read a request, write a response, and keep an idle connection open.
+# Raise the read and write timeouts if large libraries fail to sync over slow connections.
+# Set to 0 to disable a timeout.
+#
+#readTimeout = 300
+#writeTimeout = 300
+#idleTimeout = 120
+
+# Encryption at rest
+#
+# Optional
+#
+# Encrypts stored sync data with a master key, a base64 encoded 32 byte key.
+# Generate one with: openssl rand -base64 32
+# Losing the key means losing the sync data, keep a copy somewhere safe.
+#
+#encryptionKey = ""
+
+# Encryption key file
+#
+# Optional
+#
+# Reads master keys from a file instead, one "<id> <base64 key>" per line.
+# New data is encrypted with encryptionKeyId, or with the last key in the file.
+# To rotate keys, append a new key, restart, and run "syncyomi reencrypt".
+# The old key can be removed afterwards.
+#
+#encryptionKeyFile = ""
+#encryptionKeyId = ""
+
+# Blob storage
+#
+# Default: "filesystem"
+#
+# Options: "filesystem", "s3"
+#
+# Where the sync data is stored, the database only keeps track of it.
+# Sync data stored in the database by older versions is moved on startup.
+#
+#blobStorage = "filesystem"
+
+# Blob storage path
+#
+# Optional
+#
+# Directory of the filesystem blob storage, defaults to "blobs" next to the config.
+#
+#blobStoragePath = ""
+
+# S3 blob storage
+#
+# Optional
+#
+# Bucket of an S3 compatible object storage, used with blobStorage = "s3".
+# Set s3PathStyle = true for MinIO and other servers without virtual-hosted buckets.
+#
+#s3Endpoint = "https://s3.us-east-1.amazonaws.com"
+#s3Region = "us-east-1"
+#s3Bucket = ""
+#s3Prefix = ""
+#s3AccessKeyId = ""
+#s3SecretAccessKey = ""
+#s3PathStyle = false
 `
 
 func writeConfig(configPath string, configFile string) error {
@@ -263,6 +399,17 @@ func (c *AppConfig) defaults() {
 		PostgresUser:     "SyncYomi",
 		PostgresPass:     "SyncYomi",
 		PostgresSslMode:  "disable",
+		SyncHistoryDepth: 5,
+
+		SyncEventRetention: 30,
+		AuditLogRetention:  90,
+		MaxSyncPayloadSize: 100,
+		ReadTimeout:        300,
+		WriteTimeout:       300,
+		IdleTimeout:        120,
+
+		BlobStorage: "filesystem",
+		S3Region:    "us-east-1",
 	}
 }
 
@@ -35,6 +35,12 @@ func TestAppConfig_defaults(t *testing.T) {
 	if c.Config.DatabaseType != "sqlite" {
 		t.Errorf("defaults() DatabaseType = %q, want %q", c.Config.DatabaseType, "sqlite")
 	}
+	if c.Config.BlobStorage != "filesystem" {
+		t.Errorf("defaults() BlobStorage = %q, want %q", c.Config.BlobStorage, "filesystem")
+	}
+	if got := c.Config.MaxSyncPayloadBytes(); got != 100<<20 {
+		t.Errorf("defaults() MaxSyncPayloadBytes() = %d, want %d", got, 100<<20)
+	}
 }
 
 func TestAppConfig_processLines(t *testing.T) {
@@ -2,7 +2,9 @@ package database
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	sq "github.com/Masterminds/squirrel"
 	"github.com/SyncYomi/SyncYomi/internal/domain"
 	"github.com/SyncYomi/SyncYomi/internal/logger"
@@ -25,56 +27,153 @@ type APIRepo struct {
 	cache map[string]domain.APIKey
 }
 
-func (r *APIRepo) Get(ctx context.Context, key string) (*domain.APIKey, error) {
-	queryBuilder := r.db.squirrel.
-		Select(
-			"name",
-			"key",
-			"scopes",
-			"created_at",
-		).
-		From("api_key")
+// apiKeyPrefixLength is how much of a key is stored in the clear, to tell keys apart.
+const apiKeyPrefixLength = 8
 
-	queryBuilder = queryBuilder.Where(sq.Eq{"key": key})
+// hashAPIKey hashes a key to store it. Keys are long random tokens,
+// so a hash without salt is enough, and keys can be looked up by their hash.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
 
-	query, args, err := queryBuilder.ToSql()
-	if err != nil {
-		return nil, errors.Wrap(err, "error building query")
+func apiKeyPrefix(key string) string {
+	if len(key) > apiKeyPrefixLength {
+		return key[:apiKeyPrefixLength]
 	}
+	return key
+}
 
-	row := r.db.handler.QueryRowContext(ctx, query, args...)
+// apiKeyColumns are the columns scanned by scanAPIKey.
+var apiKeyColumns = []string{
+	"id",
+	"name",
+	"key_prefix",
+	"scopes",
+	"created_at",
+	"max_data_size",
+	"max_history_depth",
+	"max_daily_upload",
+	"user_id",
+	"expires_at",
+	"last_used_at",
+	"last_used_ip",
+	"previous_key_expires_at",
+}
 
+func scanAPIKey(row sq.RowScanner) (*domain.APIKey, error) {
 	var a domain.APIKey
 
-	var name sql.NullString
+	var name, lastUsedIP sql.NullString
+	var userID sql.NullInt64
+	var expiresAt, lastUsedAt, previousKeyExpiresAt sql.NullTime
 
-	if err := row.Scan(&name, &a.Key, pq.Array(&a.Scopes), &a.CreatedAt); err != nil {
-		return nil, errors.Wrap(err, "error scanning row")
+	if err := row.Scan(&a.ID, &name, &a.Prefix, pq.Array(&a.Scopes), &a.CreatedAt, &a.MaxDataSize, &a.MaxHistoryDepth, &a.MaxDailyUpload, &userID, &expiresAt, &lastUsedAt, &lastUsedIP, &previousKeyExpiresAt); err != nil {
+		return nil, err
 	}
 
 	a.Name = name.String
+	a.UserID = int(userID.Int64)
+	a.ExpiresAt = nullTimePtr(expiresAt)
+	a.LastUsedAt = nullTimePtr(lastUsedAt)
+	a.LastUsedIP = lastUsedIP.String
+	a.PreviousKeyExpiresAt = nullTimePtr(previousKeyExpiresAt)
 
 	return &a, nil
 }
 
+func utcTimePtr(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	utc := t.UTC()
+	return &utc
+}
+
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// Get the key, a rotated key in its grace period returns the key it was replaced by.
+func (r *APIRepo) Get(ctx context.Context, key string) (*domain.APIKey, error) {
+	hash := hashAPIKey(key)
+
+	return r.findKey(ctx, r.db.squirrel.
+		Select(apiKeyColumns...).
+		From("api_key").
+		Where(sq.Or{
+			sq.Eq{"key_hash": hash},
+			sq.And{
+				sq.Eq{"previous_key_hash": hash},
+				sq.Gt{"previous_key_expires_at": time.Now().UTC()},
+			},
+		}).
+		// the key itself before a key it replaced
+		OrderByClause("CASE WHEN key_hash = ? THEN 0 ELSE 1 END", hash).
+		Limit(1))
+}
+
+// FindByID returns the key with the id.
+func (r *APIRepo) FindByID(ctx context.Context, id int) (*domain.APIKey, error) {
+	return r.findKey(ctx, r.db.squirrel.
+		Select(apiKeyColumns...).
+		From("api_key").
+		Where(sq.Eq{"id": id}))
+}
+
+func (r *APIRepo) findKey(ctx context.Context, queryBuilder sq.SelectBuilder) (*domain.APIKey, error) {
+	query, args, err := queryBuilder.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "error building query")
+	}
+
+	a, err := scanAPIKey(r.db.handler.QueryRowContext(ctx, query, args...))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, domain.ErrAPIKeyNotFound
+		}
+		return nil, errors.Wrap(err, "error scanning row")
+	}
+
+	return a, nil
+}
+
+// Store a new key, only its hash and prefix are stored.
 func (r *APIRepo) Store(ctx context.Context, key *domain.APIKey) error {
+	key.Prefix = apiKeyPrefix(key.Key)
+
 	queryBuilder := r.db.squirrel.
 		Insert("api_key").
 		Columns(
 			"name",
-			"key",
+			"key_hash",
+			"key_prefix",
 			"scopes",
+			"max_data_size",
+			"max_history_depth",
+			"max_daily_upload",
+			"user_id",
+			"expires_at",
 		).
 		Values(
 			key.Name,
-			key.Key,
+			hashAPIKey(key.Key),
+			key.Prefix,
 			pq.Array(key.Scopes),
+			key.MaxDataSize,
+			key.MaxHistoryDepth,
+			key.MaxDailyUpload,
+			sql.NullInt64{Int64: int64(key.UserID), Valid: key.UserID != 0},
+			utcTimePtr(key.ExpiresAt),
 		).
-		Suffix("RETURNING created_at").RunWith(r.db.handler)
+		Suffix("RETURNING id, created_at").RunWith(r.db.handler)
 
 	var createdAt time.Time
 
-	if err := queryBuilder.QueryRowContext(ctx).Scan(&createdAt); err != nil {
+	if err := queryBuilder.QueryRowContext(ctx).Scan(&key.ID, &createdAt); err != nil {
 		return errors.Wrap(err, "error executing query")
 	}
 
@@ -83,35 +182,135 @@ func (r *APIRepo) Store(ctx context.Context, key *domain.APIKey) error {
 	return nil
 }
 
-func (r *APIRepo) Delete(ctx context.Context, key string) error {
+// Update the name, quotas, scopes and expiry of a key, nil scopes are left as they are.
+func (r *APIRepo) Update(ctx context.Context, key *domain.APIKey) error {
 	queryBuilder := r.db.squirrel.
-		Delete("api_key").
-		Where(sq.Eq{"key": key})
+		Update("api_key").
+		Set("name", key.Name).
+		Set("expires_at", utcTimePtr(key.ExpiresAt)).
+		Set("max_data_size", key.MaxDataSize).
+		Set("max_history_depth", key.MaxHistoryDepth).
+		Set("max_daily_upload", key.MaxDailyUpload).
+		Where(sq.Eq{"id": key.ID})
+
+	if key.Scopes != nil {
+		queryBuilder = queryBuilder.Set("scopes", pq.Array(key.Scopes))
+	}
 
-	query, args, err := queryBuilder.ToSql()
+	result, err := queryBuilder.
+		RunWith(r.db.handler).
+		ExecContext(ctx)
+
+	if err != nil {
+		return errors.Wrap(err, "error executing query")
+	}
+
+	if rowsAffected, err := result.RowsAffected(); err != nil {
+		return errors.Wrap(err, "error executing query")
+	} else if rowsAffected == 0 {
+		return domain.ErrAPIKeyNotFound
+	}
+
+	return nil
+}
+
+// Delete the key with its sync data, uploads, lease, devices, events and usage.
+func (r *APIRepo) Delete(ctx context.Context, id int) error {
+	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
-		return errors.Wrap(err, "error building query")
+		return errors.Wrap(err, "error starting transaction")
 	}
+	defer tx.Rollback()
 
-	_, err = r.db.handler.ExecContext(ctx, query, args...)
+	blobKeys, err := r.db.deleteAPIKeyData(ctx, tx, sq.Eq{"api_key_id": id})
 	if err != nil {
+		return err
+	}
+
+	if _, err := r.db.squirrel.
+		Delete("api_key").
+		Where(sq.Eq{"id": id}).
+		RunWith(tx).
+		ExecContext(ctx); err != nil {
 		return errors.Wrap(err, "error executing query")
 	}
 
-	r.log.Debug().Msgf("successfully deleted: %v", key)
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "error committing transaction")
+	}
+
+	r.db.deleteBlobs(ctx, blobKeys...)
+
+	r.log.Debug().Msgf("successfully deleted: %v", id)
 
 	return nil
 }
 
+// apiKeyTables are the tables with rows belonging to an api key by api_key_id,
+// the chunks of the uploads belong to it through sync_upload.
+var apiKeyTables = []string{"sync_data", "sync_data_history", "sync_upload", "sync_lease", "devices", "sync_events", "api_key_usage"}
+
+// deleteAPIKeyData deletes the rows belonging to the keys matching pred on api_key_id,
+// and returns the blob keys of their sync data to delete once tx is committed.
+// The rows are deleted explicitly, as sqlite does not enforce foreign keys.
+func (db *DB) deleteAPIKeyData(ctx context.Context, tx *Tx, pred sq.Sqlizer) ([]string, error) {
+	var blobKeys []string
+	for _, table := range blobTables {
+		keys, err := db.blobKeys(ctx, tx, table, pred)
+		if err != nil {
+			return nil, err
+		}
+		blobKeys = append(blobKeys, keys...)
+	}
+
+	uploadsSql, uploadsArgs, err := sq.
+		Select("id").
+		From("sync_upload").
+		Where(pred).
+		ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "error building query")
+	}
+
+	if _, err := db.squirrel.
+		Delete("sync_upload_chunk").
+		Where(sq.Expr("upload_id IN ("+uploadsSql+")", uploadsArgs...)).
+		RunWith(tx).
+		ExecContext(ctx); err != nil {
+		return nil, errors.Wrap(err, "error executing query")
+	}
+
+	for _, table := range apiKeyTables {
+		if _, err := db.squirrel.
+			Delete(table).
+			Where(pred).
+			RunWith(tx).
+			ExecContext(ctx); err != nil {
+			return nil, errors.Wrap(err, "error deleting %v", table)
+		}
+	}
+
+	return blobKeys, nil
+}
+
 func (r *APIRepo) GetKeys(ctx context.Context) ([]domain.APIKey, error) {
+	return r.listKeys(ctx, nil)
+}
+
+// GetUserKeys lists the keys owned by a user.
+func (r *APIRepo) GetUserKeys(ctx context.Context, userID int) ([]domain.APIKey, error) {
+	return r.listKeys(ctx, sq.Eq{"user_id": userID})
+}
+
+func (r *APIRepo) listKeys(ctx context.Context, where sq.Sqlizer) ([]domain.APIKey, error) {
 	queryBuilder := r.db.squirrel.
-		Select(
-			"name",
-			"key",
-			"scopes",
-			"created_at",
-		).
-		From("api_key")
+		Select(apiKeyColumns...).
+		From("api_key").
+		OrderBy("id")
+
+	if where != nil {
+		queryBuilder = queryBuilder.Where(where)
+	}
 
 	query, args, err := queryBuilder.ToSql()
 	if err != nil {
@@ -132,19 +331,280 @@ func (r *APIRepo) GetKeys(ctx context.Context) ([]domain.APIKey, error) {
 
 	keys := make([]domain.APIKey, 0)
 	for rows.Next() {
-		var a domain.APIKey
+		a, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, "error scanning row")
+		}
 
-		var name sql.NullString
+		keys = append(keys, *a)
+	}
+
+	return keys, nil
+}
+
+// Rotate replaces the key with the id by newKey, the old key stays valid until graceUntil.
+// The sync data stays where it is, as it is stored under the id.
+func (r *APIRepo) Rotate(ctx context.Context, id int, newKey string, graceUntil time.Time) error {
+	result, err := r.db.squirrel.
+		Update("api_key").
+		Set("previous_key_hash", sq.Expr("key_hash")).
+		Set("previous_key_expires_at", graceUntil.UTC()).
+		Set("key_hash", hashAPIKey(newKey)).
+		Set("key_prefix", apiKeyPrefix(newKey)).
+		Where(sq.Eq{"id": id}).
+		RunWith(r.db.handler).
+		ExecContext(ctx)
+
+	if err != nil {
+		return errors.Wrap(err, "error executing query")
+	}
+
+	if rowsAffected, err := result.RowsAffected(); err != nil {
+		return errors.Wrap(err, "error executing query")
+	} else if rowsAffected == 0 {
+		return domain.ErrAPIKeyNotFound
+	}
 
-		if err := rows.Scan(&name, &a.Key, pq.Array(&a.Scopes), &a.CreatedAt); err != nil {
+	return nil
+}
+
+// SetLastUsed records when and from where the key was last used.
+func (r *APIRepo) SetLastUsed(ctx context.Context, id int, at time.Time, ip string) error {
+	_, err := r.db.squirrel.
+		Update("api_key").
+		Set("last_used_at", at.UTC()).
+		Set("last_used_ip", ip).
+		Where(sq.Eq{"id": id}).
+		RunWith(r.db.handler).
+		ExecContext(ctx)
+
+	if err != nil {
+		return errors.Wrap(err, "error executing query")
+	}
+
+	return nil
+}
+
+// Add uploaded bytes to the usage of the key on day.
+func (r *APIRepo) AddUploadUsage(ctx context.Context, id int, day time.Time, bytes int64) error {
+	_, err := r.db.squirrel.
+		Insert("api_key_usage").
+		Columns("api_key_id", "day", "upload_bytes").
+		Values(id, domain.UsageDay(day), bytes).
+		Suffix("ON CONFLICT (api_key_id, day) DO UPDATE SET upload_bytes = api_key_usage.upload_bytes + excluded.upload_bytes").
+		RunWith(r.db.handler).
+		ExecContext(ctx)
+
+	if err != nil {
+		return errors.Wrap(err, "error executing query")
+	}
+
+	return nil
+}
+
+// Add uploaded bytes to the usage of the key on day unless the usage would exceed max,
+// returns false if it would. Zero max means no limit.
+// The check and the increment are one statement, so concurrent uploads cannot both pass.
+func (r *APIRepo) ChargeUploadUsage(ctx context.Context, id int, day time.Time, bytes int64, max int64) (bool, error) {
+	if max <= 0 {
+		return true, r.AddUploadUsage(ctx, id, day, bytes)
+	}
+
+	if bytes > max {
+		return false, nil
+	}
+
+	result, err := r.db.squirrel.
+		Insert("api_key_usage").
+		Columns("api_key_id", "day", "upload_bytes").
+		Values(id, domain.UsageDay(day), bytes).
+		Suffix("ON CONFLICT (api_key_id, day) DO UPDATE SET upload_bytes = api_key_usage.upload_bytes + excluded.upload_bytes "+
+			"WHERE api_key_usage.upload_bytes + excluded.upload_bytes <= ?", max).
+		RunWith(r.db.handler).
+		ExecContext(ctx)
+
+	if err != nil {
+		return false, errors.Wrap(err, "error executing query")
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "error executing query")
+	}
+
+	return rowsAffected > 0, nil
+}
+
+// List the stored bytes and uploads of all keys, uploads are counted from since to today.
+func (r *APIRepo) ListUsage(ctx context.Context, since time.Time, today time.Time) ([]domain.APIKeyUsage, error) {
+	keys, err := r.GetKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := r.sumByKey(ctx, r.db.squirrel.
+		Select("api_key_id", "SUM(size)").
+		From("sync_data").
+		GroupBy("api_key_id"))
+	if err != nil {
+		return nil, err
+	}
+
+	storedHistory, err := r.sumByKey(ctx, r.db.squirrel.
+		Select("api_key_id", "SUM(size)").
+		From("sync_data_history").
+		GroupBy("api_key_id"))
+	if err != nil {
+		return nil, err
+	}
+
+	versions, err := r.sumByKey(ctx, r.db.squirrel.
+		Select("api_key_id", "COUNT(*)").
+		From("sync_data_history").
+		GroupBy("api_key_id"))
+	if err != nil {
+		return nil, err
+	}
+
+	uploadedToday, err := r.sumByKey(ctx, r.db.squirrel.
+		Select("api_key_id", "SUM(upload_bytes)").
+		From("api_key_usage").
+		Where(sq.Eq{"day": domain.UsageDay(today)}).
+		GroupBy("api_key_id"))
+	if err != nil {
+		return nil, err
+	}
+
+	uploadedPeriod, err := r.sumByKey(ctx, r.db.squirrel.
+		Select("api_key_id", "SUM(upload_bytes)").
+		From("api_key_usage").
+		Where(sq.GtOrEq{"day": domain.UsageDay(since)}).
+		Where(sq.LtOrEq{"day": domain.UsageDay(today)}).
+		GroupBy("api_key_id"))
+	if err != nil {
+		return nil, err
+	}
+
+	usage := make([]domain.APIKeyUsage, 0, len(keys))
+	for _, k := range keys {
+		usage = append(usage, domain.APIKeyUsage{
+			ID:              k.ID,
+			Name:            k.Name,
+			Prefix:          k.Prefix,
+			StoredBytes:     stored[k.ID] + storedHistory[k.ID],
+			HistoryVersions: int(versions[k.ID]),
+			UploadedToday:   uploadedToday[k.ID],
+			UploadedPeriod:  uploadedPeriod[k.ID],
+			MaxDataSize:     k.MaxDataSize,
+			MaxHistoryDepth: k.MaxHistoryDepth,
+			MaxDailyUpload:  k.MaxDailyUpload,
+		})
+	}
+
+	return usage, nil
+}
+
+// sumByKey runs a query selecting the id of an api key and a number, and returns the numbers by key.
+func (r *APIRepo) sumByKey(ctx context.Context, query sq.SelectBuilder) (map[int]int64, error) {
+	rows, err := query.RunWith(r.db.handler).QueryContext(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "error executing query")
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			r.db.log.Error().Msgf("error closing rows: %v", err)
+		}
+	}(rows)
+
+	sums := map[int]int64{}
+	for rows.Next() {
+		var id int
+		var sum sql.NullInt64
+
+		if err := rows.Scan(&id, &sum); err != nil {
 			return nil, errors.Wrap(err, "error scanning row")
+		}
+
+		sums[id] = sum.Int64
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error rows usage")
+	}
 
+	return sums, nil
+}
+
+// hashAPIKeys hashes the keys stored in the clear by older versions.
+// Paired devices keep working, as their key is looked up by its hash.
+func (db *DB) hashAPIKeys(ctx context.Context) error {
+	rows, err := db.squirrel.
+		Select("id", "key_hash", "previous_key_hash").
+		From("api_key").
+		// hashed keys have a prefix, the migration left it empty
+		Where(sq.Eq{"key_prefix": ""}).
+		Where(sq.NotEq{"key_hash": ""}).
+		RunWith(db.handler).
+		QueryContext(ctx)
+
+	if err != nil {
+		return errors.Wrap(err, "error executing query")
+	}
+
+	type plainKey struct {
+		id          int
+		key         string
+		previousKey sql.NullString
+	}
+
+	var keys []plainKey
+	for rows.Next() {
+		var k plainKey
+		if err := rows.Scan(&k.id, &k.key, &k.previousKey); err != nil {
+			rows.Close()
+			return errors.Wrap(err, "error scanning row")
 		}
+		keys = append(keys, k)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "error rows")
+	}
 
-		a.Name = name.String
+	if len(keys) == 0 {
+		return nil
+	}
 
-		keys = append(keys, a)
+	db.log.Info().Msgf("Hashing %d api keys", len(keys))
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "error starting transaction")
 	}
+	defer tx.Rollback()
 
-	return keys, nil
+	for _, k := range keys {
+		previousKeyHash := sql.NullString{}
+		if k.previousKey.Valid && k.previousKey.String != "" {
+			previousKeyHash = sql.NullString{String: hashAPIKey(k.previousKey.String), Valid: true}
+		}
+
+		if _, err := db.squirrel.
+			Update("api_key").
+			Set("key_hash", hashAPIKey(k.key)).
+			Set("key_prefix", apiKeyPrefix(k.key)).
+			Set("previous_key_hash", previousKeyHash).
+			Where(sq.Eq{"id": k.id}).
+			RunWith(tx).
+			ExecContext(ctx); err != nil {
+			return errors.Wrap(err, "could not hash api key %d", k.id)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "error committing transaction")
+	}
+
+	return nil
 }
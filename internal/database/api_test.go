@@ -0,0 +1,216 @@
+package database
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SyncYomi/SyncYomi/internal/domain"
+	"github.com/SyncYomi/SyncYomi/internal/logger"
+)
+
+func openTestDB(t *testing.T) (*DB, string) {
+	t.Helper()
+	return openTestDBWith(t, domain.Config{})
+}
+
+// openTestDBWith opens a new sqlite database in a temporary directory with cfg.
+func openTestDBWith(t *testing.T, cfg domain.Config) (*DB, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	cfg.DatabaseType = "sqlite"
+	cfg.ConfigPath = dir
+	db, err := NewDB(&cfg, logger.Mock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db, dir
+}
+
+// storeKeyData stores a key with a row in every table belonging to it.
+func storeKeyData(t *testing.T, db *DB, userID int, name string) *domain.APIKey {
+	t.Helper()
+
+	ctx := context.Background()
+	log := logger.Mock()
+
+	key := &domain.APIKey{Name: name, Key: name + "-secret", Scopes: []string{}, UserID: userID}
+	if err := NewAPIRepo(log, db).Store(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+
+	syncRepo := NewSyncRepo(log, db)
+	for _, data := range []string{"old library", "new library"} {
+		if _, _, err := syncRepo.SetSyncData(ctx, key.ID, "phone", []byte(name+" "+data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	upload, err := syncRepo.CreateSyncUpload(ctx, key.ID, "phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := syncRepo.AppendSyncUploadChunk(ctx, key.ID, upload.ID, 0, []byte("chunk")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := syncRepo.AcquireSyncLease(ctx, key.ID, "phone", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := syncRepo.StoreSyncEvent(ctx, &domain.SyncEvent{APIKeyID: key.ID, Event: "SYNC_SUCCESS", CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewDeviceRepo(log, db).Seen(ctx, &domain.Device{APIKeyID: key.ID, ID: "phone", LastSeen: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewAPIRepo(log, db).AddUploadUsage(ctx, key.ID, time.Now(), 100); err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+// countRows counts the rows left in the tables belonging to api keys and in the blob store.
+func countRows(t *testing.T, db *DB, dir string) map[string]int {
+	t.Helper()
+
+	counts := make(map[string]int)
+	for _, table := range append([]string{"sync_upload_chunk"}, apiKeyTables...) {
+		var n int
+		if err := db.handler.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		counts[table] = n
+	}
+
+	err := filepath.Walk(filepath.Join(dir, "blobs"), func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			counts["blobs"]++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return counts
+}
+
+func TestAPIRepo_Delete(t *testing.T) {
+	ctx := context.Background()
+	log := logger.Mock()
+	db, dir := openTestDB(t)
+
+	key := storeKeyData(t, db, 0, "phone")
+	other := storeKeyData(t, db, 0, "tablet")
+	want := countRows(t, db, dir)
+
+	if err := NewAPIRepo(log, db).Delete(ctx, key.ID); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+
+	// only the rows of the other key are left
+	for table, n := range countRows(t, db, dir) {
+		if n != want[table]/2 {
+			t.Errorf("%v has %d rows left, want %d", table, n, want[table]/2)
+		}
+	}
+
+	if err := NewAPIRepo(log, db).Delete(ctx, other.ID); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+
+	for table, n := range countRows(t, db, dir) {
+		if n != 0 {
+			t.Errorf("%v has %d rows left, want 0", table, n)
+		}
+	}
+}
+
+func TestUserRepo_Delete(t *testing.T) {
+	ctx := context.Background()
+	log := logger.Mock()
+	db, dir := openTestDB(t)
+
+	userRepo := NewUserRepo(log, db)
+	if err := userRepo.Store(ctx, domain.User{Username: "reader", Password: "hash"}); err != nil {
+		t.Fatal(err)
+	}
+	user, err := userRepo.FindByUsername(ctx, "reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storeKeyData(t, db, user.ID, "phone")
+	storeKeyData(t, db, user.ID, "tablet")
+
+	if err := userRepo.Delete(ctx, user.ID); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+
+	for table, n := range countRows(t, db, dir) {
+		if n != 0 {
+			t.Errorf("%v has %d rows left, want 0", table, n)
+		}
+	}
+}
+
+func TestAPIRepo_ChargeUploadUsage(t *testing.T) {
+	ctx := context.Background()
+	db, _ := openTestDB(t)
+	repo := NewAPIRepo(logger.Mock(), db)
+
+	key := &domain.APIKey{Name: "phone", Key: "secret", Scopes: []string{}}
+	if err := repo.Store(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := repo.ChargeUploadUsage(ctx, key.ID, time.Now(), 101, 100); err != nil || ok {
+		t.Errorf("ChargeUploadUsage() over max = %v, %v, want false, nil", ok, err)
+	}
+
+	// concurrent uploads cannot both pass the quota
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	charged := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := repo.ChargeUploadUsage(ctx, key.ID, time.Now(), 10, 100)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if ok {
+				mu.Lock()
+				charged++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if charged != 10 {
+		t.Errorf("ChargeUploadUsage() passed %d times, want %d", charged, 10)
+	}
+
+	usage, err := repo.ListUsage(ctx, time.Now(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage[0].UploadedToday != 100 {
+		t.Errorf("uploaded = %d, want %d", usage[0].UploadedToday, 100)
+	}
+
+	if ok, err := repo.ChargeUploadUsage(ctx, key.ID, time.Now(), 1<<40, 0); err != nil || !ok {
+		t.Errorf("ChargeUploadUsage() without max = %v, %v, want true, nil", ok, err)
+	}
+}
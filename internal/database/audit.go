@@ -0,0 +1,160 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/SyncYomi/SyncYomi/internal/domain"
+	"github.com/SyncYomi/SyncYomi/internal/logger"
+	"github.com/SyncYomi/SyncYomi/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+func NewAuditRepo(log logger.Logger, db *DB) domain.AuditRepo {
+	return &AuditRepo{
+		log: log.With().Str("repo", "audit").Logger(),
+		db:  db,
+	}
+}
+
+type AuditRepo struct {
+	log zerolog.Logger
+	db  *DB
+}
+
+// Store an entry of the audit log.
+func (r *AuditRepo) Store(ctx context.Context, entry *domain.AuditEntry) error {
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now().UTC()
+	}
+
+	queryBuilder := r.db.squirrel.
+		Insert("audit_log").
+		Columns("actor", "ip", "action", "target", "before_value", "after_value", "created_at").
+		Values(
+			toNullString(entry.Actor),
+			toNullString(entry.IP),
+			string(entry.Action),
+			toNullString(entry.Target),
+			toNullString(string(entry.Before)),
+			toNullString(string(entry.After)),
+			entry.CreatedAt,
+		).
+		Suffix("RETURNING id").
+		RunWith(r.db.handler)
+
+	if err := queryBuilder.QueryRowContext(ctx).Scan(&entry.ID); err != nil {
+		return errors.Wrap(err, "error executing query")
+	}
+
+	return nil
+}
+
+// auditWhere applies the conditions of filter to a query on audit_log.
+func auditWhere(queryBuilder sq.SelectBuilder, filter domain.AuditFilter) sq.SelectBuilder {
+	if filter.Actor != "" {
+		queryBuilder = queryBuilder.Where(sq.Eq{"actor": filter.Actor})
+	}
+	if filter.Action != "" {
+		queryBuilder = queryBuilder.Where(sq.Eq{"action": string(filter.Action)})
+	}
+	if !filter.Since.IsZero() {
+		queryBuilder = queryBuilder.Where(sq.GtOrEq{"created_at": filter.Since.UTC()})
+	}
+	if !filter.Until.IsZero() {
+		queryBuilder = queryBuilder.Where(sq.Lt{"created_at": filter.Until.UTC()})
+	}
+	return queryBuilder
+}
+
+// List the entries matching filter, newest first,
+// and the number of entries matching it without limit and offset.
+func (r *AuditRepo) List(ctx context.Context, filter domain.AuditFilter) ([]domain.AuditEntry, int, error) {
+	var total int
+
+	err := auditWhere(r.db.squirrel.Select("COUNT(*)").From("audit_log"), filter).
+		RunWith(r.db.handler).
+		QueryRowContext(ctx).
+		Scan(&total)
+
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "error executing query")
+	}
+
+	queryBuilder := auditWhere(r.db.squirrel.
+		Select("id", "actor", "ip", "action", "target", "before_value", "after_value", "created_at").
+		From("audit_log").
+		OrderBy("created_at DESC", "id DESC"), filter)
+
+	if filter.Limit > 0 {
+		queryBuilder = queryBuilder.Limit(uint64(filter.Limit))
+	}
+	if filter.Offset > 0 {
+		queryBuilder = queryBuilder.Offset(uint64(filter.Offset))
+	}
+
+	rows, err := queryBuilder.RunWith(r.db.handler).QueryContext(ctx)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "error executing query")
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			r.log.Error().Msgf("error closing rows: %v", err)
+		}
+	}(rows)
+
+	entries := []domain.AuditEntry{}
+	for rows.Next() {
+		var e domain.AuditEntry
+		var actor, ip, target, before, after sql.NullString
+		var action string
+
+		if err := rows.Scan(&e.ID, &actor, &ip, &action, &target, &before, &after, &e.CreatedAt); err != nil {
+			return nil, 0, errors.Wrap(err, "error scanning row")
+		}
+
+		e.Actor = actor.String
+		e.IP = ip.String
+		e.Action = domain.AuditAction(action)
+		e.Target = target.String
+		if before.Valid {
+			e.Before = json.RawMessage(before.String)
+		}
+		if after.Valid {
+			e.After = json.RawMessage(after.String)
+		}
+
+		entries = append(entries, e)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, 0, errors.Wrap(err, "error rows")
+	}
+
+	return entries, total, nil
+}
+
+// Delete the entries created before, returns the number deleted.
+func (r *AuditRepo) DeleteBefore(ctx context.Context, before time.Time) (int64, error) {
+	result, err := r.db.squirrel.
+		Delete("audit_log").
+		Where(sq.Lt{"created_at": before.UTC()}).
+		RunWith(r.db.handler).
+		ExecContext(ctx)
+
+	if err != nil {
+		return 0, errors.Wrap(err, "error executing query")
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "error executing query")
+	}
+
+	return deleted, nil
+}
@@ -0,0 +1,210 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"io"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/SyncYomi/SyncYomi/pkg/errors"
+	"github.com/google/uuid"
+)
+
+// blobTables are the tables with data moved to the blob store,
+// upload chunks are short-lived and stay in the database.
+var blobTables = []string{"sync_data", "sync_data_history"}
+
+// noData is stored in the data column of rows with their data in the blob store.
+var noData = []byte{}
+
+// putBlob stores data in the blob store under a new key.
+func (db *DB) putBlob(ctx context.Context, data []byte) (string, error) {
+	key := uuid.NewString()
+
+	if err := db.blobs.Put(ctx, key, data); err != nil {
+		return "", errors.Wrap(err, "could not store blob")
+	}
+
+	return key, nil
+}
+
+// loadData returns the stored data of a row, rows without a blob key
+// were not moved to the blob store yet and keep their data in the table.
+func (db *DB) loadData(ctx context.Context, stored []byte, blobKey sql.NullString) ([]byte, error) {
+	if !blobKey.Valid {
+		return stored, nil
+	}
+
+	data, err := db.blobs.Get(ctx, blobKey.String)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not load blob %v", blobKey.String)
+	}
+
+	return data, nil
+}
+
+// openDataReader returns a reader of the data of a row, like loadData and openData.
+// Unencrypted blobs are streamed from the blob store, encrypted data has to be
+// read and decrypted as a whole.
+func (db *DB) openDataReader(ctx context.Context, stored []byte, dataKey []byte, keyID sql.NullString, blobKey sql.NullString, additionalData []byte) (io.ReadCloser, error) {
+	if blobKey.Valid && !keyID.Valid {
+		reader, err := db.blobs.Open(ctx, blobKey.String)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not load blob %v", blobKey.String)
+		}
+		return reader, nil
+	}
+
+	stored, err := db.loadData(ctx, stored, blobKey)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := db.openData(stored, dataKey, keyID, additionalData)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// blobKeys returns the blob keys of the rows of table matching pred.
+func (db *DB) blobKeys(ctx context.Context, tx *Tx, table string, pred sq.Sqlizer) ([]string, error) {
+	rows, err := db.squirrel.
+		Select("blob_key").
+		From(table).
+		Where(pred).
+		Where(sq.NotEq{"blob_key": nil}).
+		RunWith(tx).
+		QueryContext(ctx)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "error executing query")
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			db.log.Error().Msgf("error closing rows: %v", err)
+		}
+	}(rows)
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, errors.Wrap(err, "error scanning row")
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error rows %v", table)
+	}
+
+	return keys, nil
+}
+
+// deleteBlobs deletes blobs no longer referenced by any row,
+// failures are only logged as a leftover blob does no harm.
+func (db *DB) deleteBlobs(ctx context.Context, keys ...string) {
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		if err := db.blobs.Delete(ctx, key); err != nil {
+			db.log.Error().Err(err).Msgf("could not delete blob %v", key)
+		}
+	}
+}
+
+// migrateBlobs moves the sync data stored in the tables by older versions to the blob store.
+func (db *DB) migrateBlobs(ctx context.Context) error {
+	for _, table := range blobTables {
+		rows, err := db.squirrel.
+			Select("id").
+			From(table).
+			Where(sq.Eq{"blob_key": nil}).
+			OrderBy("id ASC").
+			RunWith(db.handler).
+			QueryContext(ctx)
+
+		if err != nil {
+			return errors.Wrap(err, "error executing query")
+		}
+
+		var ids []int64
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return errors.Wrap(err, "error scanning row")
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return errors.Wrap(err, "error rows")
+		}
+
+		if len(ids) == 0 {
+			continue
+		}
+
+		db.log.Info().Msgf("Moving %d rows of %v to the blob store", len(ids), table)
+
+		for _, id := range ids {
+			if err := db.migrateBlob(ctx, table, id); err != nil {
+				return errors.Wrap(err, "could not move %v row %d to the blob store", table, id)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (db *DB) migrateBlob(ctx context.Context, table string, id int64) error {
+	var stored []byte
+
+	err := db.squirrel.
+		Select("data").
+		From(table).
+		Where(sq.Eq{"id": id}).
+		Where(sq.Eq{"blob_key": nil}).
+		RunWith(db.handler).
+		QueryRowContext(ctx).
+		Scan(&stored)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			// replaced or deleted in the meantime
+			return nil
+		}
+		return errors.Wrap(err, "error executing query")
+	}
+
+	blobKey, err := db.putBlob(ctx, stored)
+	if err != nil {
+		return err
+	}
+
+	result, err := db.squirrel.
+		Update(table).
+		Set("data", noData).
+		Set("blob_key", blobKey).
+		Where(sq.Eq{"id": id}).
+		Where(sq.Eq{"blob_key": nil}).
+		RunWith(db.handler).
+		ExecContext(ctx)
+
+	if err != nil {
+		db.deleteBlobs(ctx, blobKey)
+		return errors.Wrap(err, "error executing query")
+	}
+
+	if rowsAffected, err := result.RowsAffected(); err == nil && rowsAffected == 0 {
+		db.deleteBlobs(ctx, blobKey)
+	}
+
+	return nil
+}
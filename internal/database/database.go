@@ -4,11 +4,14 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"os"
 	"sync"
 
 	sq "github.com/Masterminds/squirrel"
 	"github.com/SyncYomi/SyncYomi/internal/domain"
 	"github.com/SyncYomi/SyncYomi/internal/logger"
+	"github.com/SyncYomi/SyncYomi/internal/storage"
+	"github.com/SyncYomi/SyncYomi/pkg/envelope"
 	"github.com/SyncYomi/SyncYomi/pkg/errors"
 	"github.com/rs/zerolog"
 )
@@ -26,6 +29,18 @@ type DB struct {
 	DSN    string
 
 	squirrel sq.StatementBuilderType
+
+	// keyring encrypts sync data at rest, nil if not configured
+	keyring *envelope.Keyring
+
+	// blobs stores the sync data, the tables only keep track of it
+	blobs domain.BlobStore
+
+	// noUpgrade refuses to upgrade the schema of an existing database, see OpenExisting
+	noUpgrade bool
+
+	// readOnly opens the database without any changes, see OpenReadOnly
+	readOnly bool
 }
 
 func NewDB(cfg *domain.Config, log logger.Logger) (*DB, error) {
@@ -52,6 +67,18 @@ func NewDB(cfg *domain.Config, log logger.Logger) (*DB, error) {
 		return nil, errors.New("unsupported database: %v", cfg.DatabaseType)
 	}
 
+	keyring, err := newKeyring(cfg)
+	if err != nil {
+		return nil, err
+	}
+	db.keyring = keyring
+
+	blobs, err := storage.New(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create blob store")
+	}
+	db.blobs = blobs
+
 	return db, nil
 }
 
@@ -75,9 +102,74 @@ func (db *DB) Open() error {
 		}
 	}
 
+	if db.readOnly {
+		return nil
+	}
+
+	if err := db.hashAPIKeys(db.ctx); err != nil {
+		return errors.Wrap(err, "could not hash api keys")
+	}
+
+	if err := db.migrateBlobs(db.ctx); err != nil {
+		return errors.Wrap(err, "could not move sync data to the blob store")
+	}
+
+	return nil
+}
+
+// OpenExisting opens the database like Open, but an existing schema
+// is not upgraded, it has to be the schema version of this SyncYomi.
+// A database without a schema is initialized.
+func (db *DB) OpenExisting() error {
+	db.noUpgrade = true
+	return db.Open()
+}
+
+// OpenReadOnly opens the database to read from it, like the source of a copy.
+// Nothing is written, neither schema upgrades nor the upgrades of the data done by Open,
+// so the schema has to be the version of this SyncYomi.
+func (db *DB) OpenReadOnly() error {
+	if db.Driver == "sqlite" {
+		// opening a missing database would create it
+		if _, err := os.Stat(db.DSN); err != nil {
+			return errors.Wrap(err, "could not open database")
+		}
+	}
+
+	db.readOnly = true
+	if err := db.Open(); err != nil {
+		return err
+	}
+
+	version, latest, err := db.SchemaVersion(db.ctx)
+	if err != nil {
+		return err
+	}
+	if version != latest {
+		return errors.New("schema version %d does not match the version %d of this SyncYomi, upgrade the database by running the server on it first", version, latest)
+	}
+
 	return nil
 }
 
+// SchemaVersion returns the schema version of the database, and the latest version of its driver.
+func (db *DB) SchemaVersion(ctx context.Context) (int, int, error) {
+	var version int
+
+	switch db.Driver {
+	case "sqlite":
+		if err := db.handler.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+			return 0, 0, errors.Wrap(err, "failed to query schema version")
+		}
+		return version, len(sqliteMigrations), nil
+	default:
+		if err := db.handler.QueryRowContext(ctx, "SELECT version FROM schema_migrations").Scan(&version); err != nil {
+			return 0, 0, errors.Wrap(err, "failed to query schema version")
+		}
+		return version, len(postgresMigrations), nil
+	}
+}
+
 func (db *DB) Close() error {
 	// cancel background context
 	db.cancel()
@@ -93,6 +185,11 @@ func (db *DB) Ping() error {
 	return db.handler.Ping()
 }
 
+// Stats returns the statistics of the connection pool.
+func (db *DB) Stats() sql.DBStats {
+	return db.handler.Stats()
+}
+
 func (db *DB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*Tx, error) {
 	tx, err := db.handler.BeginTx(ctx, opts)
 	if err != nil {
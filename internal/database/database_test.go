@@ -0,0 +1,73 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/SyncYomi/SyncYomi/internal/domain"
+	"github.com/SyncYomi/SyncYomi/internal/logger"
+)
+
+func TestDB_OpenReadOnly(t *testing.T) {
+	ctx := context.Background()
+	log := logger.Mock()
+
+	db, dir := openTestDB(t)
+	if err := NewAPIRepo(log, db).Store(ctx, &domain.APIKey{Name: "phone", Key: "secret", Scopes: []string{}}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	openReadOnly := func() (*DB, error) {
+		t.Helper()
+		ro, err := NewDB(&domain.Config{DatabaseType: "sqlite", ConfigPath: dir}, log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ro.Close() })
+		return ro, ro.OpenReadOnly()
+	}
+
+	ro, err := openReadOnly()
+	if err != nil {
+		t.Fatalf("OpenReadOnly() error = %v", err)
+	}
+	keys, err := NewAPIRepo(log, ro).GetKeys(ctx)
+	if err != nil || len(keys) != 1 {
+		t.Errorf("List() = %v, %v, want 1 key", keys, err)
+	}
+	if err := NewAPIRepo(log, ro).Store(ctx, &domain.APIKey{Name: "tablet", Key: "other", Scopes: []string{}}); err == nil {
+		t.Error("Store() on a read-only database error = nil, want error")
+	}
+	ro.Close()
+
+	// a database of an older version is neither opened nor upgraded
+	raw, err := sql.Open("sqlite", filepath.Join(dir, "syncyomi.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	if _, err := raw.Exec("PRAGMA user_version = 1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := openReadOnly(); err == nil {
+		t.Error("OpenReadOnly() of an older schema error = nil, want error")
+	}
+
+	var version int
+	if err := raw.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version != 1 {
+		t.Errorf("schema version = %d after OpenReadOnly(), want %d", version, 1)
+	}
+
+	// a missing database is not created
+	dir = t.TempDir()
+	if _, err := openReadOnly(); err == nil {
+		t.Error("OpenReadOnly() of a missing database error = nil, want error")
+	}
+}
@@ -0,0 +1,161 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/SyncYomi/SyncYomi/internal/domain"
+	"github.com/SyncYomi/SyncYomi/internal/logger"
+	"github.com/SyncYomi/SyncYomi/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+func NewDeviceRepo(log logger.Logger, db *DB) domain.DeviceRepo {
+	return &DeviceRepo{
+		log: log.With().Str("repo", "device").Logger(),
+		db:  db,
+	}
+}
+
+type DeviceRepo struct {
+	log zerolog.Logger
+	db  *DB
+}
+
+// Record a request of a device, empty fields keep what was stored before.
+func (r *DeviceRepo) Seen(ctx context.Context, device *domain.Device) error {
+	_, err := r.db.squirrel.
+		Insert("devices").
+		Columns(
+			"api_key_id",
+			"device_id",
+			"device_name",
+			"user_agent",
+			"app_version",
+			"ip",
+			"last_download_etag",
+			"last_upload_etag",
+			"last_seen",
+			"created_at",
+		).
+		Values(
+			device.APIKeyID,
+			device.ID,
+			toNullString(device.Name),
+			toNullString(device.UserAgent),
+			toNullString(device.AppVersion),
+			toNullString(device.IP),
+			toNullString(device.LastDownloadETag),
+			toNullString(device.LastUploadETag),
+			device.LastSeen,
+			device.LastSeen,
+		).
+		Suffix(`ON CONFLICT (api_key_id, device_id) DO UPDATE SET
+			device_name = COALESCE(excluded.device_name, devices.device_name),
+			user_agent = COALESCE(excluded.user_agent, devices.user_agent),
+			app_version = COALESCE(excluded.app_version, devices.app_version),
+			ip = COALESCE(excluded.ip, devices.ip),
+			last_download_etag = COALESCE(excluded.last_download_etag, devices.last_download_etag),
+			last_upload_etag = COALESCE(excluded.last_upload_etag, devices.last_upload_etag),
+			last_seen = excluded.last_seen`).
+		RunWith(r.db.handler).
+		ExecContext(ctx)
+
+	if err != nil {
+		return errors.Wrap(err, "error executing query")
+	}
+
+	return nil
+}
+
+// List the devices of all keys, or of one key if apiKeyID is not 0, last seen first.
+// Devices of deleted keys are left out, sqlite does not cascade the delete.
+func (r *DeviceRepo) List(ctx context.Context, apiKeyID int) ([]domain.Device, error) {
+	queryBuilder := r.db.squirrel.
+		Select(
+			"d.api_key_id",
+			"k.name",
+			"d.device_id",
+			"d.device_name",
+			"d.user_agent",
+			"d.app_version",
+			"d.ip",
+			"d.last_download_etag",
+			"d.last_upload_etag",
+			"d.last_seen",
+			"d.created_at",
+		).
+		From("devices d").
+		Join("api_key k ON k.id = d.api_key_id").
+		OrderBy("d.last_seen DESC")
+
+	if apiKeyID != 0 {
+		queryBuilder = queryBuilder.Where(sq.Eq{"d.api_key_id": apiKeyID})
+	}
+
+	rows, err := queryBuilder.RunWith(r.db.handler).QueryContext(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "error executing query")
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			r.log.Error().Msgf("error closing rows: %v", err)
+		}
+	}(rows)
+
+	devices := []domain.Device{}
+	for rows.Next() {
+		var d domain.Device
+		var keyName, name, userAgent, appVersion, ip, downloadETag, uploadETag sql.NullString
+		var createdAt sql.NullTime
+
+		if err := rows.Scan(&d.APIKeyID, &keyName, &d.ID, &name, &userAgent, &appVersion, &ip, &downloadETag, &uploadETag, &d.LastSeen, &createdAt); err != nil {
+			return nil, errors.Wrap(err, "error scanning row")
+		}
+
+		d.APIKeyName = keyName.String
+		d.Name = name.String
+		d.UserAgent = userAgent.String
+		d.AppVersion = appVersion.String
+		d.IP = ip.String
+		d.LastDownloadETag = downloadETag.String
+		d.LastUploadETag = uploadETag.String
+		d.CreatedAt = createdAt.Time
+
+		devices = append(devices, d)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error rows")
+	}
+
+	return devices, nil
+}
+
+// Delete a device, returns false if there is no such device.
+func (r *DeviceRepo) Delete(ctx context.Context, apiKeyID int, id string) (bool, error) {
+	result, err := r.db.squirrel.
+		Delete("devices").
+		Where(sq.Eq{"api_key_id": apiKeyID}).
+		Where(sq.Eq{"device_id": id}).
+		RunWith(r.db.handler).
+		ExecContext(ctx)
+
+	if err != nil {
+		return false, errors.Wrap(err, "error executing query")
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "error executing query")
+	}
+
+	if rowsAffected > 0 {
+		r.log.Debug().Msgf("successfully deleted device: %v", id)
+	}
+
+	return rowsAffected > 0, nil
+}
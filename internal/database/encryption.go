@@ -0,0 +1,277 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/SyncYomi/SyncYomi/internal/domain"
+	"github.com/SyncYomi/SyncYomi/pkg/envelope"
+	"github.com/SyncYomi/SyncYomi/pkg/errors"
+)
+
+// defaultKeyID is the id of the master key set with encryptionKey.
+const defaultKeyID = "default"
+
+// newKeyring loads the master keys from the config,
+// it returns nil when encryption at rest is not configured.
+func newKeyring(cfg *domain.Config) (*envelope.Keyring, error) {
+	keys := map[string][]byte{}
+	current := cfg.EncryptionKeyID
+
+	if cfg.EncryptionKeyFile != "" {
+		fileKeys, last, err := envelope.ReadKeyFile(cfg.EncryptionKeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read encryption key file")
+		}
+
+		keys = fileKeys
+		if current == "" {
+			current = last
+		}
+	}
+
+	if cfg.EncryptionKey != "" {
+		key, err := envelope.ParseKey(cfg.EncryptionKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid encryption key")
+		}
+
+		id := cfg.EncryptionKeyID
+		if id == "" {
+			id = defaultKeyID
+		}
+
+		keys[id] = key
+		if current == "" {
+			current = id
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	return envelope.NewKeyring(current, keys)
+}
+
+// syncDataAD is the additional data sync data is sealed with. It binds the data to its
+// api key and etag, which are kept when the data is moved to the history, so the data
+// of another key or version stored in its place does not decrypt.
+func syncDataAD(apiKeyID int64, etag string) []byte {
+	return []byte("sync_data " + strconv.FormatInt(apiKeyID, 10) + " " + etag)
+}
+
+// uploadChunkAD is the additional data upload chunks are sealed with,
+// it binds a chunk to its upload and offset.
+func uploadChunkAD(uploadID string, offset int64) []byte {
+	return []byte("sync_upload_chunk " + uploadID + " " + strconv.FormatInt(offset, 10))
+}
+
+// sealData encrypts data to store it when encryption at rest is enabled,
+// otherwise data is stored as is with a null key id.
+// The same additional data has to be passed to openData.
+func (db *DB) sealData(data []byte, additionalData []byte) ([]byte, []byte, sql.NullString, error) {
+	if db.keyring == nil {
+		return data, nil, sql.NullString{}, nil
+	}
+
+	sealed, dataKey, keyID, err := db.keyring.Seal(data, additionalData)
+	if err != nil {
+		return nil, nil, sql.NullString{}, errors.Wrap(err, "could not encrypt data")
+	}
+
+	return sealed, dataKey, toNullString(keyID), nil
+}
+
+// openData decrypts stored data, data with a null key id is not encrypted.
+func (db *DB) openData(stored []byte, dataKey []byte, keyID sql.NullString, additionalData []byte) ([]byte, error) {
+	if !keyID.Valid {
+		return stored, nil
+	}
+
+	if db.keyring == nil {
+		return nil, errors.New("data is encrypted with key %q, but no encryption key is configured", keyID.String)
+	}
+
+	data, err := db.keyring.Open(stored, dataKey, keyID.String, additionalData)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not decrypt data")
+	}
+
+	return data, nil
+}
+
+// encryptedTables are the tables with data sealed by sealData.
+var encryptedTables = []string{"sync_data", "sync_data_history", "sync_upload_chunk"}
+
+// Encrypt the sync data stored unencrypted, and re-wrap the data keys of
+// other master keys with the current one, returns the number of rows updated.
+func (r SyncRepo) ReencryptSyncData(ctx context.Context) (int64, error) {
+	if r.db.keyring == nil {
+		return 0, errors.New("no encryption key configured")
+	}
+
+	current := r.db.keyring.CurrentKeyID()
+
+	var updated int64
+	for _, table := range encryptedTables {
+		ids, err := r.staleKeyRows(ctx, table, current)
+		if err != nil {
+			return updated, err
+		}
+
+		for _, id := range ids {
+			if err := r.reencryptRow(ctx, table, id); err != nil {
+				return updated, errors.Wrap(err, "could not re-encrypt %v row %d", table, id)
+			}
+			updated++
+		}
+
+		if len(ids) > 0 {
+			r.log.Info().Msgf("Re-encrypted %d rows in %v", len(ids), table)
+		}
+	}
+
+	return updated, nil
+}
+
+// staleKeyRows returns the ids of the rows not sealed with the current master key.
+func (r SyncRepo) staleKeyRows(ctx context.Context, table string, current string) ([]int64, error) {
+	rows, err := r.db.squirrel.
+		Select("id").
+		From(table).
+		Where(sq.Or{sq.Eq{"key_id": nil}, sq.NotEq{"key_id": current}}).
+		OrderBy("id ASC").
+		RunWith(r.db.handler).
+		QueryContext(ctx)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "error executing query")
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			r.log.Error().Msgf("error closing rows: %v", err)
+		}
+	}(rows)
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, errors.Wrap(err, "error scanning row")
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error rows")
+	}
+
+	return ids, nil
+}
+
+// reencryptRow seals a row with the current master key.
+// Encrypted rows only get their data key re-wrapped, the data stays the same.
+func (r SyncRepo) reencryptRow(ctx context.Context, table string, id int64) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "error starting transaction")
+	}
+	defer tx.Rollback()
+
+	hasBlobs := table != "sync_upload_chunk"
+
+	columns := []string{"data", "data_key", "key_id"}
+	if hasBlobs {
+		columns = append(columns, "blob_key", "api_key_id", "data_etag")
+	} else {
+		columns = append(columns, "upload_id", "chunk_offset")
+	}
+
+	var stored, dataKey []byte
+	var keyID, blobKey sql.NullString
+	var apiKeyID, chunkOffset int64
+	var etag, uploadID string
+
+	dest := []interface{}{&stored, &dataKey, &keyID}
+	if hasBlobs {
+		dest = append(dest, &blobKey, &apiKeyID, &etag)
+	} else {
+		dest = append(dest, &uploadID, &chunkOffset)
+	}
+
+	err = r.db.squirrel.
+		Select(columns...).
+		From(table).
+		Where(sq.Eq{"id": id}).
+		RunWith(tx).
+		QueryRowContext(ctx).
+		Scan(dest...)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			// replaced or deleted in the meantime
+			return nil
+		}
+		return errors.Wrap(err, "error executing query")
+	}
+
+	update := r.db.squirrel.
+		Update(table).
+		Where(sq.Eq{"id": id})
+
+	// the unencrypted blob is replaced by a new one, and deleted once the row points to it
+	var newBlobKey string
+
+	if keyID.Valid {
+		wrapped, newKeyID, err := r.db.keyring.Rewrap(dataKey, keyID.String)
+		if err != nil {
+			return err
+		}
+		update = update.Set("data_key", wrapped).Set("key_id", newKeyID)
+	} else {
+		data, err := r.db.loadData(ctx, stored, blobKey)
+		if err != nil {
+			return err
+		}
+
+		additionalData := uploadChunkAD(uploadID, chunkOffset)
+		if hasBlobs {
+			additionalData = syncDataAD(apiKeyID, etag)
+		}
+
+		sealed, wrapped, newKeyID, err := r.db.sealData(data, additionalData)
+		if err != nil {
+			return err
+		}
+
+		if hasBlobs {
+			if newBlobKey, err = r.db.putBlob(ctx, sealed); err != nil {
+				return err
+			}
+			update = update.Set("data", noData).Set("blob_key", newBlobKey)
+		} else {
+			update = update.Set("data", sealed)
+		}
+		update = update.Set("data_key", wrapped).Set("key_id", newKeyID)
+	}
+
+	if _, err := update.RunWith(tx).ExecContext(ctx); err != nil {
+		r.db.deleteBlobs(ctx, newBlobKey)
+		return errors.Wrap(err, "error executing query")
+	}
+
+	if err := tx.Commit(); err != nil {
+		r.db.deleteBlobs(ctx, newBlobKey)
+		return errors.Wrap(err, "error committing transaction")
+	}
+
+	if newBlobKey != "" {
+		r.db.deleteBlobs(ctx, blobKey.String)
+	}
+
+	return nil
+}
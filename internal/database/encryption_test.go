@@ -0,0 +1,207 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/SyncYomi/SyncYomi/internal/domain"
+	"github.com/SyncYomi/SyncYomi/internal/logger"
+)
+
+const (
+	testKeyOne = "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE="
+	testKeyTwo = "AgICAgICAgICAgICAgICAgICAgICAgICAgICAgICAgI="
+)
+
+func TestNewKeyring(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(keyFile, []byte("one "+testKeyOne+"\ntwo "+testKeyTwo+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		cfg         domain.Config
+		wantCurrent string
+		wantErr     bool
+	}{
+		{name: "not configured", cfg: domain.Config{}},
+		{name: "key", cfg: domain.Config{EncryptionKey: testKeyOne}, wantCurrent: defaultKeyID},
+		{name: "key with id", cfg: domain.Config{EncryptionKey: testKeyOne, EncryptionKeyID: "2024"}, wantCurrent: "2024"},
+		{name: "key file uses last key", cfg: domain.Config{EncryptionKeyFile: keyFile}, wantCurrent: "two"},
+		{name: "key file with id", cfg: domain.Config{EncryptionKeyFile: keyFile, EncryptionKeyID: "one"}, wantCurrent: "one"},
+		{name: "key file with unknown id", cfg: domain.Config{EncryptionKeyFile: keyFile, EncryptionKeyID: "three"}, wantErr: true},
+		{name: "invalid key", cfg: domain.Config{EncryptionKey: "c2hvcnQ="}, wantErr: true},
+		{name: "missing key file", cfg: domain.Config{EncryptionKeyFile: keyFile + ".missing"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyring, err := newKeyring(&tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newKeyring() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if tt.wantCurrent == "" {
+				if keyring != nil {
+					t.Errorf("newKeyring() = %v, want nil", keyring)
+				}
+				return
+			}
+
+			if got := keyring.CurrentKeyID(); got != tt.wantCurrent {
+				t.Errorf("CurrentKeyID() = %q, want %q", got, tt.wantCurrent)
+			}
+		})
+	}
+}
+
+func TestSyncRepo_sealedDataIsBound(t *testing.T) {
+	ctx := context.Background()
+	db, _ := openTestDBWith(t, domain.Config{EncryptionKey: testKeyOne})
+	repo := NewSyncRepo(logger.Mock(), db)
+
+	for _, data := range []string{"old library", "new library"} {
+		if _, _, err := repo.SetSyncData(ctx, 1, "phone", []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := repo.SetSyncData(ctx, 2, "tablet", []byte("other library")); err != nil {
+		t.Fatal(err)
+	}
+
+	upload, err := repo.CreateSyncUpload(ctx, 1, "phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, offset := range []int64{0, 5} {
+		if _, err := repo.AppendSyncUploadChunk(ctx, 1, upload.ID, offset, []byte("chunk")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// copySealed stores the sealed data of the row matching from in the row matching to
+	copySealed := func(fromTable string, from sq.Eq, toTable string, to sq.Eq) {
+		t.Helper()
+
+		var data, dataKey []byte
+		var keyID, blobKey sql.NullString
+
+		columns := []string{"data", "data_key", "key_id"}
+		dest := []interface{}{&data, &dataKey, &keyID}
+		if toTable != "sync_upload_chunk" {
+			columns = append(columns, "blob_key")
+			dest = append(dest, &blobKey)
+		}
+
+		err := db.squirrel.Select(columns...).From(fromTable).Where(from).RunWith(db.handler).Scan(dest...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		update := db.squirrel.Update(toTable).
+			Set("data", append([]byte{}, data...)).
+			Set("data_key", dataKey).
+			Set("key_id", keyID).
+			Where(to)
+		if toTable != "sync_upload_chunk" {
+			update = update.Set("blob_key", blobKey)
+		}
+		if _, err := update.RunWith(db.handler).Exec(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the history of the same key, stored as its current data
+	copySealed("sync_data_history", sq.Eq{"api_key_id": 1}, "sync_data", sq.Eq{"api_key_id": 1})
+	if _, _, err := repo.GetSyncDataAndETag(ctx, 1); err == nil {
+		t.Error("GetSyncDataAndETag() with the data of another version error = nil, want error")
+	}
+
+	// the data of another key
+	copySealed("sync_data", sq.Eq{"api_key_id": 2}, "sync_data", sq.Eq{"api_key_id": 1})
+	if _, _, err := repo.GetSyncDataAndETag(ctx, 1); err == nil {
+		t.Error("GetSyncDataAndETag() with the data of another key error = nil, want error")
+	}
+
+	// a chunk of the same upload, at another offset
+	copySealed("sync_upload_chunk", sq.Eq{"chunk_offset": 0}, "sync_upload_chunk", sq.Eq{"chunk_offset": 5})
+	if _, err := repo.GetSyncUploadData(ctx, 1, upload.ID); err == nil {
+		t.Error("GetSyncUploadData() with a moved chunk error = nil, want error")
+	}
+
+	// the data of key 2 is untouched
+	data, _, err := repo.GetSyncDataAndETag(ctx, 2)
+	if err != nil || string(data) != "other library" {
+		t.Errorf("GetSyncDataAndETag() = %q, %v, want %q, nil", data, err, "other library")
+	}
+}
+
+func TestSyncRepo_ReencryptSyncData(t *testing.T) {
+	ctx := context.Background()
+	plain, dir := openTestDB(t)
+	repo := NewSyncRepo(logger.Mock(), plain)
+
+	for _, data := range []string{"old library", "new library"} {
+		if _, _, err := repo.SetSyncData(ctx, 1, "phone", []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	upload, err := repo.CreateSyncUpload(ctx, 1, "phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.AppendSyncUploadChunk(ctx, 1, upload.ID, 0, []byte("chunk")); err != nil {
+		t.Fatal(err)
+	}
+	plain.Close()
+
+	db, err := NewDB(&domain.Config{DatabaseType: "sqlite", ConfigPath: dir, EncryptionKey: testKeyOne}, logger.Mock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	repo = NewSyncRepo(logger.Mock(), db)
+
+	updated, err := repo.(*SyncRepo).ReencryptSyncData(ctx)
+	if err != nil {
+		t.Fatalf("ReencryptSyncData() error = %v", err)
+	}
+	if updated != 3 {
+		t.Errorf("ReencryptSyncData() = %d, want %d", updated, 3)
+	}
+
+	var unencrypted int
+	for _, table := range encryptedTables {
+		var n int
+		if err := db.handler.QueryRow("SELECT COUNT(*) FROM " + table + " WHERE key_id IS NULL").Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		unencrypted += n
+	}
+	if unencrypted != 0 {
+		t.Errorf("%d rows are not encrypted", unencrypted)
+	}
+
+	data, _, err := repo.GetSyncDataAndETag(ctx, 1)
+	if err != nil || string(data) != "new library" {
+		t.Errorf("GetSyncDataAndETag() = %q, %v, want %q, nil", data, err, "new library")
+	}
+	old, err := repo.GetSyncDataHistory(ctx, 1, contentETag([]byte("old library")))
+	if err != nil || string(old) != "old library" {
+		t.Errorf("GetSyncDataHistory() = %q, %v, want %q, nil", old, err, "old library")
+	}
+	chunks, err := repo.GetSyncUploadData(ctx, 1, upload.ID)
+	if err != nil || string(chunks) != "chunk" {
+		t.Errorf("GetSyncUploadData() = %q, %v, want %q, nil", chunks, err, "chunk")
+	}
+}
@@ -9,8 +9,14 @@ import (
 func (db *DB) openPostgres() error {
 	var err error
 
+	dsn := db.DSN
+	if db.readOnly {
+		// every transaction of the session refuses to write
+		dsn += "&default_transaction_read_only=on"
+	}
+
 	// open database connection
-	if db.handler, err = sql.Open("postgres", db.DSN); err != nil {
+	if db.handler, err = sql.Open("postgres", dsn); err != nil {
 		db.log.Fatal().Err(err).Msg("could not open postgres connection")
 		return errors.Wrap(err, "could not open postgres connection")
 	}
@@ -21,6 +27,11 @@ func (db *DB) openPostgres() error {
 		return errors.Wrap(err, "could not ping postgres database")
 	}
 
+	// the schema version is checked by OpenReadOnly
+	if db.readOnly {
+		return nil
+	}
+
 	// migrate db
 	if err = db.migratePostgres(); err != nil {
 		db.log.Fatal().Err(err).Msg("could not migrate postgres database")
@@ -54,6 +65,8 @@ func (db *DB) migratePostgres() error {
 
 	if version == len(postgresMigrations) {
 		return nil
+	} else if version > 0 && db.noUpgrade {
+		return errors.New("schema version %d does not match the version %d of this SyncYomi, upgrade the database by running the server on it first", version, len(postgresMigrations))
 	} else if version > len(postgresMigrations) {
 		return errors.New("SyncYomi (version %d) older than schema (version: %d)", len(postgresMigrations), version)
 	}
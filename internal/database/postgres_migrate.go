@@ -6,6 +6,7 @@ CREATE TABLE users
     id         SERIAL PRIMARY KEY,
     username   TEXT NOT NULL,
     password   TEXT NOT NULL,
+    role       TEXT NOT NULL DEFAULT 'member',
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     UNIQUE (username)
@@ -14,10 +15,40 @@ CREATE TABLE users
 /*Stores information about the devices associated with each API key.*/
 CREATE TABLE api_key
 (
+    id         SERIAL PRIMARY KEY,
     name       TEXT,
-    key        TEXT PRIMARY KEY,
+    key_hash   TEXT NOT NULL UNIQUE,
+    key_prefix TEXT NOT NULL DEFAULT '',
     scopes     TEXT []   DEFAULT '{}' NOT NULL,
-    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+
+    max_data_size     BIGINT NOT NULL DEFAULT 0,
+    max_history_depth INTEGER NOT NULL DEFAULT 0,
+    max_daily_upload  BIGINT NOT NULL DEFAULT 0,
+
+    user_id INTEGER REFERENCES users (id) ON DELETE CASCADE,
+
+    expires_at   TIMESTAMP,
+    last_used_at TIMESTAMP,
+    last_used_ip TEXT,
+
+    previous_key_hash       TEXT,
+    previous_key_expires_at TIMESTAMP
+);
+
+CREATE INDEX api_key_user_id_index
+    ON api_key (user_id);
+
+CREATE INDEX api_key_previous_key_hash_index
+    ON api_key (previous_key_hash);
+
+CREATE TABLE api_key_usage
+(
+    api_key_id   INTEGER NOT NULL,
+    day          TEXT NOT NULL,
+    upload_bytes BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (api_key_id, day),
+    FOREIGN KEY (api_key_id) REFERENCES api_key (id) ON DELETE CASCADE
 );
 
 /*Manages notifications for various events*/
@@ -47,16 +78,121 @@ CREATE TABLE notification
 CREATE TABLE sync_data
 (
 	id SERIAL PRIMARY KEY,
-	user_api_key TEXT UNIQUE,
+	api_key_id INTEGER UNIQUE,
 
 	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 
 	data BYTEA NOT NULL,
 	data_etag TEXT NOT NULL,
+	device_name TEXT,
+	size BIGINT NOT NULL DEFAULT 0,
+	data_key BYTEA,
+	key_id TEXT,
+	blob_key TEXT,
+
+	FOREIGN KEY (api_key_id) REFERENCES api_key (id) ON DELETE CASCADE
+);
+
+CREATE TABLE sync_data_history
+(
+	id SERIAL PRIMARY KEY,
+	api_key_id INTEGER NOT NULL,
+
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+
+	data BYTEA NOT NULL,
+	data_etag TEXT NOT NULL,
+	device_name TEXT,
+	size BIGINT NOT NULL DEFAULT 0,
+	data_key BYTEA,
+	key_id TEXT,
+	blob_key TEXT,
+
+	FOREIGN KEY (api_key_id) REFERENCES api_key (id) ON DELETE CASCADE
+);
+
+CREATE INDEX sync_data_history_api_key_id_index
+	ON sync_data_history (api_key_id);
+
+CREATE TABLE sync_upload
+(
+	id TEXT PRIMARY KEY,
+	api_key_id INTEGER NOT NULL,
+	device_name TEXT,
+	size BIGINT NOT NULL DEFAULT 0,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (api_key_id) REFERENCES api_key (id) ON DELETE CASCADE
+);
+
+CREATE TABLE sync_upload_chunk
+(
+	id SERIAL PRIMARY KEY,
+	upload_id TEXT NOT NULL,
+	chunk_offset BIGINT NOT NULL,
+	data BYTEA NOT NULL,
+	data_key BYTEA,
+	key_id TEXT,
+	FOREIGN KEY (upload_id) REFERENCES sync_upload (id) ON DELETE CASCADE
+);
+
+CREATE INDEX sync_upload_chunk_upload_id_index
+	ON sync_upload_chunk (upload_id);
+
+CREATE TABLE sync_lease
+(
+	api_key_id   INTEGER PRIMARY KEY,
+	device_id    TEXT NOT NULL,
+	acquired_at  TIMESTAMP NOT NULL,
+	expires_at   TIMESTAMP NOT NULL,
+	FOREIGN KEY (api_key_id) REFERENCES api_key (id) ON DELETE CASCADE
+);
 
-	FOREIGN KEY (user_api_key) REFERENCES api_key (key) ON DELETE CASCADE
-)
+CREATE TABLE devices
+(
+	api_key_id         INTEGER NOT NULL,
+	device_id          TEXT NOT NULL,
+	device_name        TEXT,
+	user_agent         TEXT,
+	app_version        TEXT,
+	ip                 TEXT,
+	last_download_etag TEXT,
+	last_upload_etag   TEXT,
+	last_seen          TIMESTAMP NOT NULL,
+	created_at         TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (api_key_id, device_id),
+	FOREIGN KEY (api_key_id) REFERENCES api_key (id) ON DELETE CASCADE
+);
+
+CREATE TABLE sync_events
+(
+	id           SERIAL PRIMARY KEY,
+	api_key_id   INTEGER NOT NULL,
+	device_name  TEXT,
+	event        TEXT NOT NULL,
+	message      TEXT,
+	created_at   TIMESTAMP NOT NULL,
+	FOREIGN KEY (api_key_id) REFERENCES api_key (id) ON DELETE CASCADE
+);
+
+CREATE INDEX sync_events_api_key_id_created_at_index
+	ON sync_events (api_key_id, created_at);
+
+CREATE TABLE audit_log
+(
+	id           SERIAL PRIMARY KEY,
+	actor        TEXT,
+	ip           TEXT,
+	action       TEXT NOT NULL,
+	target       TEXT,
+	before_value TEXT,
+	after_value  TEXT,
+	created_at   TIMESTAMP NOT NULL
+);
+
+CREATE INDEX audit_log_created_at_index
+	ON audit_log (created_at);
 `
 
 var postgresMigrations = []string{
@@ -144,5 +280,303 @@ END $$;
 	DROP TABLE IF EXISTS manga_data;
 	DROP TABLE IF EXISTS manga_sync;
 	DROP TABLE IF EXISTS sync_lock;
+`,
+	`
+	ALTER TABLE sync_data
+		ADD COLUMN device_name TEXT;
+
+	CREATE TABLE sync_data_history
+	(
+		id SERIAL PRIMARY KEY,
+		user_api_key TEXT NOT NULL,
+
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+
+		data BYTEA NOT NULL,
+		data_etag TEXT NOT NULL,
+		device_name TEXT,
+		size BIGINT NOT NULL DEFAULT 0,
+
+		FOREIGN KEY (user_api_key) REFERENCES api_key (key) ON DELETE CASCADE
+	);
+
+	CREATE INDEX sync_data_history_user_api_key_index
+		ON sync_data_history (user_api_key);
+`,
+	`
+	CREATE TABLE sync_upload
+	(
+		id TEXT PRIMARY KEY,
+		user_api_key TEXT NOT NULL,
+		device_name TEXT,
+		size BIGINT NOT NULL DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_api_key) REFERENCES api_key (key) ON DELETE CASCADE
+	);
+
+	CREATE TABLE sync_upload_chunk
+	(
+		id SERIAL PRIMARY KEY,
+		upload_id TEXT NOT NULL,
+		chunk_offset BIGINT NOT NULL,
+		data BYTEA NOT NULL,
+		FOREIGN KEY (upload_id) REFERENCES sync_upload (id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX sync_upload_chunk_upload_id_index
+		ON sync_upload_chunk (upload_id);
+`,
+	`
+	ALTER TABLE sync_data
+		ADD COLUMN size BIGINT NOT NULL DEFAULT 0;
+	ALTER TABLE sync_data
+		ADD COLUMN data_key BYTEA;
+	ALTER TABLE sync_data
+		ADD COLUMN key_id TEXT;
+
+	UPDATE sync_data
+		SET size = length(data);
+
+	ALTER TABLE sync_data_history
+		ADD COLUMN data_key BYTEA;
+	ALTER TABLE sync_data_history
+		ADD COLUMN key_id TEXT;
+
+	ALTER TABLE sync_upload_chunk
+		ADD COLUMN data_key BYTEA;
+	ALTER TABLE sync_upload_chunk
+		ADD COLUMN key_id TEXT;
+`,
+	`
+	ALTER TABLE sync_data
+		ADD COLUMN blob_key TEXT;
+	ALTER TABLE sync_data_history
+		ADD COLUMN blob_key TEXT;
+`,
+	`
+	ALTER TABLE api_key
+		ADD COLUMN max_data_size BIGINT NOT NULL DEFAULT 0;
+	ALTER TABLE api_key
+		ADD COLUMN max_history_depth INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE api_key
+		ADD COLUMN max_daily_upload BIGINT NOT NULL DEFAULT 0;
+
+	CREATE TABLE api_key_usage
+	(
+		user_api_key TEXT NOT NULL,
+		day          TEXT NOT NULL,
+		upload_bytes BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY (user_api_key, day),
+		FOREIGN KEY (user_api_key) REFERENCES api_key (key) ON DELETE CASCADE
+	);
+`,
+	`
+	CREATE TABLE sync_lease
+	(
+		user_api_key TEXT PRIMARY KEY,
+		device_id    TEXT NOT NULL,
+		acquired_at  TIMESTAMP NOT NULL,
+		expires_at   TIMESTAMP NOT NULL,
+		FOREIGN KEY (user_api_key) REFERENCES api_key (key) ON DELETE CASCADE
+	);
+`,
+	`
+	CREATE TABLE devices
+	(
+		user_api_key       TEXT NOT NULL,
+		device_id          TEXT NOT NULL,
+		device_name        TEXT,
+		user_agent         TEXT,
+		app_version        TEXT,
+		ip                 TEXT,
+		last_download_etag TEXT,
+		last_upload_etag   TEXT,
+		last_seen          TIMESTAMP NOT NULL,
+		created_at         TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (user_api_key, device_id),
+		FOREIGN KEY (user_api_key) REFERENCES api_key (key) ON DELETE CASCADE
+	);
+`,
+	`
+	CREATE TABLE sync_events
+	(
+		id           SERIAL PRIMARY KEY,
+		user_api_key TEXT NOT NULL,
+		device_name  TEXT,
+		event        TEXT NOT NULL,
+		message      TEXT,
+		created_at   TIMESTAMP NOT NULL,
+		FOREIGN KEY (user_api_key) REFERENCES api_key (key) ON DELETE CASCADE
+	);
+
+	CREATE INDEX sync_events_user_api_key_created_at_index
+		ON sync_events (user_api_key, created_at);
+`,
+	`
+	CREATE TABLE audit_log
+	(
+		id           SERIAL PRIMARY KEY,
+		actor        TEXT,
+		ip           TEXT,
+		action       TEXT NOT NULL,
+		target       TEXT,
+		before_value TEXT,
+		after_value  TEXT,
+		created_at   TIMESTAMP NOT NULL
+	);
+
+	CREATE INDEX audit_log_created_at_index
+		ON audit_log (created_at);
+`,
+	`
+	ALTER TABLE api_key
+		ADD COLUMN user_id INTEGER REFERENCES users (id) ON DELETE CASCADE;
+
+	UPDATE api_key
+		SET user_id = (SELECT MIN(id) FROM users);
+
+	CREATE INDEX api_key_user_id_index
+		ON api_key (user_id);
+`,
+	`
+	ALTER TABLE users
+		ADD COLUMN role TEXT NOT NULL DEFAULT 'member';
+
+	UPDATE users
+		SET role = 'admin'
+		WHERE id = (SELECT MIN(id) FROM users);
+`,
+	`
+	UPDATE api_key
+		SET scopes = '{"sync:read","sync:write","sync:events"}';
+`,
+	`
+	ALTER TABLE api_key
+		ADD COLUMN expires_at TIMESTAMP;
+
+	ALTER TABLE api_key
+		ADD COLUMN last_used_at TIMESTAMP;
+
+	ALTER TABLE api_key
+		ADD COLUMN last_used_ip TEXT;
+
+	ALTER TABLE api_key
+		ADD COLUMN previous_key TEXT;
+
+	ALTER TABLE api_key
+		ADD COLUMN previous_key_expires_at TIMESTAMP;
+
+	CREATE INDEX api_key_previous_key_index
+		ON api_key (previous_key);
+`,
+	`
+	ALTER TABLE api_key
+		ADD COLUMN id SERIAL;
+
+	ALTER TABLE api_key_usage
+		ADD COLUMN api_key_id INTEGER;
+
+	ALTER TABLE sync_data
+		ADD COLUMN api_key_id INTEGER;
+
+	ALTER TABLE sync_data_history
+		ADD COLUMN api_key_id INTEGER;
+
+	ALTER TABLE sync_upload
+		ADD COLUMN api_key_id INTEGER;
+
+	ALTER TABLE sync_lease
+		ADD COLUMN api_key_id INTEGER;
+
+	ALTER TABLE devices
+		ADD COLUMN api_key_id INTEGER;
+
+	ALTER TABLE sync_events
+		ADD COLUMN api_key_id INTEGER;
+
+	UPDATE api_key_usage t SET api_key_id = k.id FROM api_key k WHERE k.key = t.user_api_key;
+	UPDATE sync_data t SET api_key_id = k.id FROM api_key k WHERE k.key = t.user_api_key;
+	UPDATE sync_data_history t SET api_key_id = k.id FROM api_key k WHERE k.key = t.user_api_key;
+	UPDATE sync_upload t SET api_key_id = k.id FROM api_key k WHERE k.key = t.user_api_key;
+	UPDATE sync_lease t SET api_key_id = k.id FROM api_key k WHERE k.key = t.user_api_key;
+	UPDATE devices t SET api_key_id = k.id FROM api_key k WHERE k.key = t.user_api_key;
+	UPDATE sync_events t SET api_key_id = k.id FROM api_key k WHERE k.key = t.user_api_key;
+
+	-- dropping user_api_key drops its constraints and indexes too
+	ALTER TABLE api_key_usage DROP COLUMN user_api_key;
+	ALTER TABLE sync_data DROP COLUMN user_api_key;
+	ALTER TABLE sync_data_history DROP COLUMN user_api_key;
+	ALTER TABLE sync_upload DROP COLUMN user_api_key;
+	ALTER TABLE sync_lease DROP COLUMN user_api_key;
+	ALTER TABLE devices DROP COLUMN user_api_key;
+	ALTER TABLE sync_events DROP COLUMN user_api_key;
+
+	-- keys are hashed after migrating, an empty prefix marks a key that is not hashed yet
+	ALTER TABLE api_key
+		RENAME COLUMN key TO key_hash;
+
+	ALTER TABLE api_key
+		RENAME COLUMN previous_key TO previous_key_hash;
+
+	ALTER TABLE api_key
+		ADD COLUMN key_prefix TEXT NOT NULL DEFAULT '';
+
+	ALTER TABLE api_key
+		DROP CONSTRAINT api_key_pkey;
+
+	ALTER TABLE api_key
+		ADD PRIMARY KEY (id);
+
+	ALTER TABLE api_key
+		ALTER COLUMN key_hash SET NOT NULL,
+		ADD UNIQUE (key_hash);
+
+	ALTER INDEX api_key_previous_key_index
+		RENAME TO api_key_previous_key_hash_index;
+
+	DELETE FROM api_key_usage WHERE api_key_id IS NULL;
+	DELETE FROM sync_data WHERE api_key_id IS NULL;
+	DELETE FROM sync_data_history WHERE api_key_id IS NULL;
+	DELETE FROM sync_upload WHERE api_key_id IS NULL;
+	DELETE FROM sync_lease WHERE api_key_id IS NULL;
+	DELETE FROM devices WHERE api_key_id IS NULL;
+	DELETE FROM sync_events WHERE api_key_id IS NULL;
+
+	ALTER TABLE api_key_usage
+		ALTER COLUMN api_key_id SET NOT NULL,
+		ADD PRIMARY KEY (api_key_id, day),
+		ADD FOREIGN KEY (api_key_id) REFERENCES api_key (id) ON DELETE CASCADE;
+
+	ALTER TABLE sync_data
+		ADD UNIQUE (api_key_id),
+		ADD FOREIGN KEY (api_key_id) REFERENCES api_key (id) ON DELETE CASCADE;
+
+	ALTER TABLE sync_data_history
+		ALTER COLUMN api_key_id SET NOT NULL,
+		ADD FOREIGN KEY (api_key_id) REFERENCES api_key (id) ON DELETE CASCADE;
+
+	CREATE INDEX sync_data_history_api_key_id_index
+		ON sync_data_history (api_key_id);
+
+	ALTER TABLE sync_upload
+		ALTER COLUMN api_key_id SET NOT NULL,
+		ADD FOREIGN KEY (api_key_id) REFERENCES api_key (id) ON DELETE CASCADE;
+
+	ALTER TABLE sync_lease
+		ADD PRIMARY KEY (api_key_id),
+		ADD FOREIGN KEY (api_key_id) REFERENCES api_key (id) ON DELETE CASCADE;
+
+	ALTER TABLE devices
+		ALTER COLUMN api_key_id SET NOT NULL,
+		ADD PRIMARY KEY (api_key_id, device_id),
+		ADD FOREIGN KEY (api_key_id) REFERENCES api_key (id) ON DELETE CASCADE;
+
+	ALTER TABLE sync_events
+		ALTER COLUMN api_key_id SET NOT NULL,
+		ADD FOREIGN KEY (api_key_id) REFERENCES api_key (id) ON DELETE CASCADE;
+
+	CREATE INDEX sync_events_api_key_id_created_at_index
+		ON sync_events (api_key_id, created_at);
 `,
 }
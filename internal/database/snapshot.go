@@ -0,0 +1,680 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/SyncYomi/SyncYomi/pkg/errors"
+	"github.com/lib/pq"
+)
+
+// columnKind is how a column is written to a snapshot,
+// so rows can move between the sqlite and postgres drivers.
+type columnKind int
+
+const (
+	columnText columnKind = iota
+	columnInt
+	columnBool
+	columnTime
+	columnArray
+	// columnData is the decrypted sync data, wherever it is stored
+	columnData
+)
+
+type snapshotColumn struct {
+	name string
+	kind columnKind
+}
+
+type snapshotTable struct {
+	name    string
+	columns []snapshotColumn
+	// serial tables have an id generated by a sequence on postgres
+	serial bool
+}
+
+// snapshotTables are the tables in a snapshot, in the order they are restored.
+// Chunked uploads and sync leases are left out, devices start them again.
+var snapshotTables = []snapshotTable{
+	{
+		name:   "users",
+		serial: true,
+		columns: []snapshotColumn{
+			{"id", columnInt},
+			{"username", columnText},
+			{"password", columnText},
+			{"role", columnText},
+			{"created_at", columnTime},
+			{"updated_at", columnTime},
+		},
+	},
+	{
+		name:   "api_key",
+		serial: true,
+		columns: []snapshotColumn{
+			{"id", columnInt},
+			{"name", columnText},
+			{"key_hash", columnText},
+			{"key_prefix", columnText},
+			{"scopes", columnArray},
+			{"created_at", columnTime},
+			{"max_data_size", columnInt},
+			{"max_history_depth", columnInt},
+			{"max_daily_upload", columnInt},
+			{"user_id", columnInt},
+			{"expires_at", columnTime},
+			{"last_used_at", columnTime},
+			{"last_used_ip", columnText},
+			{"previous_key_hash", columnText},
+			{"previous_key_expires_at", columnTime},
+		},
+	},
+	{
+		name: "api_key_usage",
+		columns: []snapshotColumn{
+			{"api_key_id", columnInt},
+			{"day", columnText},
+			{"upload_bytes", columnInt},
+		},
+	},
+	{
+		name: "devices",
+		columns: []snapshotColumn{
+			{"api_key_id", columnInt},
+			{"device_id", columnText},
+			{"device_name", columnText},
+			{"user_agent", columnText},
+			{"app_version", columnText},
+			{"ip", columnText},
+			{"last_download_etag", columnText},
+			{"last_upload_etag", columnText},
+			{"last_seen", columnTime},
+			{"created_at", columnTime},
+		},
+	},
+	{
+		name:   "sync_events",
+		serial: true,
+		columns: []snapshotColumn{
+			{"id", columnInt},
+			{"api_key_id", columnInt},
+			{"device_name", columnText},
+			{"event", columnText},
+			{"message", columnText},
+			{"created_at", columnTime},
+		},
+	},
+	{
+		name:   "notification",
+		serial: true,
+		columns: []snapshotColumn{
+			{"id", columnInt},
+			{"name", columnText},
+			{"type", columnText},
+			{"enabled", columnBool},
+			{"events", columnArray},
+			{"token", columnText},
+			{"api_key", columnText},
+			{"webhook", columnText},
+			{"title", columnText},
+			{"icon", columnText},
+			{"host", columnText},
+			{"username", columnText},
+			{"password", columnText},
+			{"channel", columnText},
+			{"rooms", columnText},
+			{"targets", columnText},
+			{"devices", columnText},
+			{"created_at", columnTime},
+			{"updated_at", columnTime},
+		},
+	},
+	{
+		name:   "sync_data",
+		serial: true,
+		columns: []snapshotColumn{
+			{"id", columnInt},
+			{"api_key_id", columnInt},
+			{"created_at", columnTime},
+			{"updated_at", columnTime},
+			{"data", columnData},
+			{"data_etag", columnText},
+			{"device_name", columnText},
+			{"size", columnInt},
+		},
+	},
+	{
+		name:   "sync_data_history",
+		serial: true,
+		columns: []snapshotColumn{
+			{"id", columnInt},
+			{"api_key_id", columnInt},
+			{"created_at", columnTime},
+			{"data", columnData},
+			{"data_etag", columnText},
+			{"device_name", columnText},
+			{"size", columnInt},
+		},
+	},
+	{
+		name:   "audit_log",
+		serial: true,
+		columns: []snapshotColumn{
+			{"id", columnInt},
+			{"actor", columnText},
+			{"ip", columnText},
+			{"action", columnText},
+			{"target", columnText},
+			{"before_value", columnText},
+			{"after_value", columnText},
+			{"created_at", columnTime},
+		},
+	},
+}
+
+// restoreClearedTables are cleared before a restore besides the snapshot tables,
+// children first.
+var restoreClearedTables = []string{"sync_upload_chunk", "sync_upload", "sync_lease"}
+
+// SnapshotRow is a row in a snapshot by column name.
+// Times are RFC 3339 strings and sync data is base64, as encoding/json writes them.
+type SnapshotRow map[string]interface{}
+
+// SnapshotTables returns the names of the tables in a snapshot, in the order they are restored.
+func (db *DB) SnapshotTables() []string {
+	names := make([]string, 0, len(snapshotTables))
+	for _, t := range snapshotTables {
+		names = append(names, t.name)
+	}
+	return names
+}
+
+func findSnapshotTable(name string) (*snapshotTable, bool) {
+	for i := range snapshotTables {
+		if snapshotTables[i].name == name {
+			return &snapshotTables[i], true
+		}
+	}
+	return nil, false
+}
+
+// ExportSnapshotTable passes each row of a snapshot table to fn, with the sync data decrypted.
+func (db *DB) ExportSnapshotTable(ctx context.Context, name string, fn func(row SnapshotRow) error) error {
+	table, ok := findSnapshotTable(name)
+	if !ok {
+		return errors.New("unknown snapshot table: %v", name)
+	}
+
+	var columns []string
+	for _, c := range table.columns {
+		if c.kind == columnData {
+			columns = append(columns, "data", "data_key", "key_id", "blob_key")
+		} else {
+			columns = append(columns, c.name)
+		}
+	}
+
+	query := db.squirrel.
+		Select(columns...).
+		From(table.name)
+	if table.serial {
+		query = query.OrderBy("id ASC")
+	}
+
+	rows, err := query.RunWith(db.handler).QueryContext(ctx)
+	if err != nil {
+		return errors.Wrap(err, "error executing query")
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			db.log.Error().Msgf("error closing rows: %v", err)
+		}
+	}(rows)
+
+	for rows.Next() {
+		var dest []interface{}
+		var stored, dataKey []byte
+		var keyID, blobKey sql.NullString
+
+		values := make([]interface{}, len(table.columns))
+		for i, c := range table.columns {
+			switch c.kind {
+			case columnText:
+				values[i] = &sql.NullString{}
+			case columnInt:
+				values[i] = &sql.NullInt64{}
+			case columnBool:
+				values[i] = &sql.NullBool{}
+			case columnTime:
+				values[i] = &sql.NullTime{}
+			case columnArray:
+				values[i] = &[]string{}
+			}
+
+			switch c.kind {
+			case columnData:
+				dest = append(dest, &stored, &dataKey, &keyID, &blobKey)
+			case columnArray:
+				dest = append(dest, pq.Array(values[i]))
+			default:
+				dest = append(dest, values[i])
+			}
+		}
+
+		if err := rows.Scan(dest...); err != nil {
+			return errors.Wrap(err, "error scanning row")
+		}
+
+		row := SnapshotRow{}
+		for i, c := range table.columns {
+			switch v := values[i].(type) {
+			case *sql.NullString:
+				row[c.name] = nullable(v.Valid, v.String)
+			case *sql.NullInt64:
+				row[c.name] = nullable(v.Valid, v.Int64)
+			case *sql.NullBool:
+				row[c.name] = nullable(v.Valid, v.Bool)
+			case *sql.NullTime:
+				row[c.name] = nullable(v.Valid, v.Time.UTC())
+			case *[]string:
+				row[c.name] = *v
+			}
+		}
+
+		// the data is opened last, as it is bound to the other columns of the row
+		for _, c := range table.columns {
+			if c.kind != columnData {
+				continue
+			}
+			loaded, err := db.loadData(ctx, stored, blobKey)
+			if err != nil {
+				return err
+			}
+			data, err := db.openData(loaded, dataKey, keyID, snapshotDataAD(row))
+			if err != nil {
+				return err
+			}
+			row[c.name] = data
+		}
+
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "error rows")
+	}
+
+	return nil
+}
+
+// snapshotDataAD is the additional data the sync data of a snapshot row is sealed with,
+// see syncDataAD.
+func snapshotDataAD(row SnapshotRow) []byte {
+	apiKeyID, _ := row["api_key_id"].(int64)
+	etag, _ := row["data_etag"].(string)
+	return syncDataAD(apiKeyID, etag)
+}
+
+func nullable(valid bool, v interface{}) interface{} {
+	if !valid {
+		return nil
+	}
+	return v
+}
+
+// CountSnapshotRows returns the number of rows in a snapshot table.
+func (db *DB) CountSnapshotRows(ctx context.Context, name string) (int, error) {
+	return countSnapshotRows(ctx, db, db.handler, name)
+}
+
+func countSnapshotRows(ctx context.Context, db *DB, runner sq.BaseRunner, name string) (int, error) {
+	if _, ok := findSnapshotTable(name); !ok {
+		return 0, errors.New("unknown snapshot table: %v", name)
+	}
+
+	var count int
+	err := db.squirrel.
+		Select("COUNT(*)").
+		From(name).
+		RunWith(runner).
+		QueryRowContext(ctx).
+		Scan(&count)
+
+	if err != nil {
+		return 0, errors.Wrap(err, "error executing query")
+	}
+
+	return count, nil
+}
+
+// SnapshotRestore replaces the content of the database with a snapshot,
+// nothing changes until it is committed.
+type SnapshotRestore struct {
+	db  *DB
+	ctx context.Context
+	tx  *Tx
+
+	// blobs are the blobs written by the restore, deleted if it fails
+	blobs []string
+	// oldBlobs are the blobs of the replaced sync data, deleted once it is committed
+	oldBlobs []string
+}
+
+// BeginSnapshotRestore clears the tables of a snapshot in a transaction,
+// the rows of the snapshot are then inserted with Insert.
+func (db *DB) BeginSnapshotRestore(ctx context.Context) (*SnapshotRestore, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "error starting transaction")
+	}
+
+	restore := &SnapshotRestore{db: db, ctx: ctx, tx: tx}
+
+	for _, table := range blobTables {
+		keys, err := restore.blobKeys(table)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		restore.oldBlobs = append(restore.oldBlobs, keys...)
+	}
+
+	cleared := append([]string{}, restoreClearedTables...)
+	for i := len(snapshotTables) - 1; i >= 0; i-- {
+		cleared = append(cleared, snapshotTables[i].name)
+	}
+
+	for _, table := range cleared {
+		if _, err := db.squirrel.Delete(table).RunWith(tx).ExecContext(ctx); err != nil {
+			tx.Rollback()
+			return nil, errors.Wrap(err, "could not clear table %v", table)
+		}
+	}
+
+	return restore, nil
+}
+
+func (s *SnapshotRestore) blobKeys(table string) ([]string, error) {
+	rows, err := s.db.squirrel.
+		Select("blob_key").
+		From(table).
+		Where(sq.NotEq{"blob_key": nil}).
+		RunWith(s.tx).
+		QueryContext(s.ctx)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "error executing query")
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, errors.Wrap(err, "error scanning row")
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// Insert a row of a snapshot table, the sync data is encrypted and stored like new uploads.
+// Columns the snapshot does not have get their default.
+func (s *SnapshotRestore) Insert(name string, row SnapshotRow) error {
+	table, ok := findSnapshotTable(name)
+	if !ok {
+		return errors.New("unknown table %v, the snapshot is from a newer version", name)
+	}
+
+	row, err := s.upgradeRow(name, row)
+	if err != nil {
+		return err
+	}
+	if row == nil {
+		return nil
+	}
+
+	var columns []string
+	var values []interface{}
+
+	for column := range row {
+		if _, ok := table.column(column); !ok {
+			return errors.New("unknown column %v.%v, the snapshot is from a newer version", name, column)
+		}
+	}
+
+	converted := SnapshotRow{}
+	var data []byte
+	var hasData bool
+
+	for _, c := range table.columns {
+		raw, ok := row[c.name]
+		if !ok {
+			continue
+		}
+
+		value, err := snapshotValue(c.kind, raw)
+		if err != nil {
+			return errors.Wrap(err, "invalid value of %v.%v", name, c.name)
+		}
+
+		if c.kind == columnData {
+			data, _ = value.([]byte)
+			hasData = true
+			continue
+		}
+
+		converted[c.name] = value
+		columns = append(columns, c.name)
+		values = append(values, value)
+	}
+
+	// the data is sealed last, as it is bound to the other columns of the row
+	if hasData {
+		stored, dataKey, keyID, err := s.db.sealData(data, snapshotDataAD(converted))
+		if err != nil {
+			return err
+		}
+
+		blobKey, err := s.db.putBlob(s.ctx, stored)
+		if err != nil {
+			return err
+		}
+		s.blobs = append(s.blobs, blobKey)
+
+		columns = append(columns, "data", "data_key", "key_id", "blob_key")
+		values = append(values, noData, dataKey, keyID, blobKey)
+	}
+
+	_, err = s.db.squirrel.
+		Insert(table.name).
+		Columns(columns...).
+		Values(values...).
+		RunWith(s.tx).
+		ExecContext(s.ctx)
+
+	if err != nil {
+		return errors.Wrap(err, "could not insert into %v", name)
+	}
+
+	return nil
+}
+
+// upgradeRow converts a row of a snapshot from before keys were hashed, where keys were stored
+// as is and rows of a key referenced it by the key. It returns nil for rows of a key that is
+// not in the snapshot.
+func (s *SnapshotRestore) upgradeRow(name string, row SnapshotRow) (SnapshotRow, error) {
+	key, hasKey := row["key"]
+	apiKey, hasAPIKey := row["user_api_key"]
+	if !hasKey && !hasAPIKey {
+		return row, nil
+	}
+
+	upgraded := SnapshotRow{}
+	for column, value := range row {
+		upgraded[column] = value
+	}
+
+	if name == "api_key" && hasKey {
+		raw, _ := key.(string)
+		delete(upgraded, "key")
+		upgraded["key_hash"] = hashAPIKey(raw)
+		upgraded["key_prefix"] = apiKeyPrefix(raw)
+
+		if previous, ok := upgraded["previous_key"]; ok {
+			delete(upgraded, "previous_key")
+			if raw, _ := previous.(string); raw != "" {
+				upgraded["previous_key_hash"] = hashAPIKey(raw)
+			}
+		}
+	}
+
+	if hasAPIKey {
+		raw, _ := apiKey.(string)
+		delete(upgraded, "user_api_key")
+
+		var id int64
+		err := s.db.squirrel.
+			Select("id").
+			From("api_key").
+			Where(sq.Eq{"key_hash": hashAPIKey(raw)}).
+			RunWith(s.tx).
+			QueryRowContext(s.ctx).
+			Scan(&id)
+
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil, nil
+			}
+			return nil, errors.Wrap(err, "error executing query")
+		}
+
+		upgraded["api_key_id"] = id
+	}
+
+	return upgraded, nil
+}
+
+func (t *snapshotTable) column(name string) (snapshotColumn, bool) {
+	for _, c := range t.columns {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return snapshotColumn{}, false
+}
+
+// snapshotValue converts a value decoded from json with UseNumber to the column type,
+// values of rows passed on from ExportSnapshotTable are taken as is.
+func snapshotValue(kind columnKind, raw interface{}) (interface{}, error) {
+	switch v := raw.(type) {
+	case nil:
+		if kind == columnArray {
+			return pq.Array([]string{}), nil
+		}
+		return nil, nil
+	case int64, time.Time, []byte:
+		return v, nil
+	case []string:
+		return pq.Array(v), nil
+	}
+
+	switch kind {
+	case columnText:
+		if v, ok := raw.(string); ok {
+			return v, nil
+		}
+	case columnInt:
+		if v, ok := raw.(json.Number); ok {
+			return v.Int64()
+		}
+	case columnBool:
+		if v, ok := raw.(bool); ok {
+			return v, nil
+		}
+	case columnTime:
+		if v, ok := raw.(string); ok {
+			return time.Parse(time.RFC3339Nano, v)
+		}
+	case columnArray:
+		if v, ok := raw.([]interface{}); ok {
+			array := make([]string, 0, len(v))
+			for _, item := range v {
+				s, ok := item.(string)
+				if !ok {
+					return nil, errors.New("array item %v is not a string", item)
+				}
+				array = append(array, s)
+			}
+			return pq.Array(array), nil
+		}
+	case columnData:
+		if v, ok := raw.(string); ok {
+			return base64.StdEncoding.DecodeString(v)
+		}
+	}
+
+	return nil, errors.New("unexpected value %v", raw)
+}
+
+// Count returns the number of rows in a snapshot table as restored so far.
+func (s *SnapshotRestore) Count(name string) (int, error) {
+	return countSnapshotRows(s.ctx, s.db, s.tx, name)
+}
+
+// Commit the restore, and delete the blobs of the replaced sync data.
+func (s *SnapshotRestore) Commit() error {
+	// snapshots from older versions have no admin, key owners or key scopes,
+	// they are set up like the migrations do
+	for _, query := range []string{
+		"UPDATE users SET role = 'admin' WHERE id = (SELECT MIN(id) FROM users) AND NOT EXISTS (SELECT 1 FROM users WHERE role = 'admin')",
+		"UPDATE api_key SET user_id = (SELECT MIN(id) FROM users) WHERE user_id IS NULL",
+		`UPDATE api_key SET scopes = '{"sync:read","sync:write","sync:events"}' WHERE scopes = '{}'`,
+	} {
+		if _, err := s.tx.ExecContext(s.ctx, query); err != nil {
+			s.Rollback()
+			return errors.Wrap(err, "could not upgrade the restored rows")
+		}
+	}
+
+	if s.db.Driver == "postgres" {
+		for _, table := range snapshotTables {
+			if !table.serial {
+				continue
+			}
+
+			// the ids were inserted as is, so the sequence has to continue after them
+			_, err := s.tx.ExecContext(s.ctx, "SELECT setval(pg_get_serial_sequence($1, 'id'), COALESCE((SELECT MAX(id) FROM "+table.name+"), 0) + 1, false)", table.name)
+			if err != nil {
+				s.Rollback()
+				return errors.Wrap(err, "could not reset the sequence of %v", table.name)
+			}
+		}
+	}
+
+	if err := s.tx.Commit(); err != nil {
+		s.Rollback()
+		return errors.Wrap(err, "error committing transaction")
+	}
+
+	s.db.deleteBlobs(s.ctx, s.oldBlobs...)
+
+	return nil
+}
+
+// Rollback the restore, and delete the blobs it wrote.
+func (s *SnapshotRestore) Rollback() {
+	s.tx.Rollback()
+	s.db.deleteBlobs(s.ctx, s.blobs...)
+	s.blobs = nil
+}
@@ -14,12 +14,23 @@ func (db *DB) openSQLite() error {
 
 	var err error
 
+	dsn := db.DSN + "?_pragma=busy_timeout%3d1000"
+	if db.readOnly {
+		// every connection refuses to write
+		dsn += "&_pragma=query_only%3d1"
+	}
+
 	// open database connection
-	if db.handler, err = sql.Open("sqlite", db.DSN+"?_pragma=busy_timeout%3d1000"); err != nil {
+	if db.handler, err = sql.Open("sqlite", dsn); err != nil {
 		db.log.Fatal().Err(err).Msg("could not open db connection")
 		return err
 	}
 
+	// the schema version is checked by OpenReadOnly
+	if db.readOnly {
+		return nil
+	}
+
 	// Set busy timeout
 	//if _, err = db.handler.Exec(`PRAGMA busy_timeout = 5000;`); err != nil {
 	//	return errors.New("busy timeout pragma: %w", err)
@@ -68,6 +79,8 @@ func (db *DB) migrateSQLite() error {
 
 	if version == len(sqliteMigrations) {
 		return nil
+	} else if version > 0 && db.noUpgrade {
+		return errors.New("schema version %d does not match the version %d of this SyncYomi, upgrade the database by running the server on it first", version, len(sqliteMigrations))
 	} else if version > len(sqliteMigrations) {
 		return errors.New("SyncYomi (version %d) older than schema (version: %d)", len(sqliteMigrations), version)
 	}
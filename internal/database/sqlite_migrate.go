@@ -6,6 +6,7 @@ CREATE TABLE users
     id         INTEGER PRIMARY KEY,
     username   TEXT NOT NULL,
     password   TEXT NOT NULL,
+    role       TEXT NOT NULL DEFAULT 'member',
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     UNIQUE (username)
@@ -13,10 +14,40 @@ CREATE TABLE users
 
 CREATE TABLE api_key
 (
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
     name       TEXT,
-    key        TEXT PRIMARY KEY,
+    key_hash   TEXT NOT NULL UNIQUE,
+    key_prefix TEXT NOT NULL DEFAULT '',
     scopes     TEXT []   DEFAULT '{}' NOT NULL,
-    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+
+    max_data_size     INTEGER NOT NULL DEFAULT 0,
+    max_history_depth INTEGER NOT NULL DEFAULT 0,
+    max_daily_upload  INTEGER NOT NULL DEFAULT 0,
+
+    user_id INTEGER REFERENCES users (id) ON DELETE CASCADE,
+
+    expires_at   TIMESTAMP,
+    last_used_at TIMESTAMP,
+    last_used_ip TEXT,
+
+    previous_key_hash       TEXT,
+    previous_key_expires_at TIMESTAMP
+);
+
+CREATE INDEX api_key_user_id_index
+    ON api_key (user_id);
+
+CREATE INDEX api_key_previous_key_hash_index
+    ON api_key (previous_key_hash);
+
+CREATE TABLE api_key_usage
+(
+    api_key_id   INTEGER NOT NULL,
+    day          TEXT NOT NULL,
+    upload_bytes INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (api_key_id, day),
+    FOREIGN KEY (api_key_id) REFERENCES api_key (id) ON DELETE CASCADE
 );
 
 CREATE TABLE notification
@@ -45,16 +76,121 @@ CREATE TABLE notification
 CREATE TABLE sync_data
 (
     id INTEGER PRIMARY KEY,
-    user_api_key TEXT UNIQUE,
+    api_key_id INTEGER UNIQUE,
 
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 
     data BLOB NOT NULL,
     data_etag TEXT NOT NULL,
+    device_name TEXT,
+    size INTEGER NOT NULL DEFAULT 0,
+    data_key BLOB,
+    key_id TEXT,
+    blob_key TEXT,
+
+    FOREIGN KEY (api_key_id) REFERENCES api_key (id) ON DELETE CASCADE
+);
+
+CREATE TABLE sync_data_history
+(
+    id INTEGER PRIMARY KEY,
+    api_key_id INTEGER NOT NULL,
+
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+
+    data BLOB NOT NULL,
+    data_etag TEXT NOT NULL,
+    device_name TEXT,
+    size INTEGER NOT NULL DEFAULT 0,
+    data_key BLOB,
+    key_id TEXT,
+    blob_key TEXT,
+
+    FOREIGN KEY (api_key_id) REFERENCES api_key (id) ON DELETE CASCADE
+);
+
+CREATE INDEX sync_data_history_api_key_id_index
+    ON sync_data_history (api_key_id);
+
+CREATE TABLE sync_upload
+(
+    id TEXT PRIMARY KEY,
+    api_key_id INTEGER NOT NULL,
+    device_name TEXT,
+    size INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (api_key_id) REFERENCES api_key (id) ON DELETE CASCADE
+);
+
+CREATE TABLE sync_upload_chunk
+(
+    id INTEGER PRIMARY KEY,
+    upload_id TEXT NOT NULL,
+    chunk_offset INTEGER NOT NULL,
+    data BLOB NOT NULL,
+    data_key BLOB,
+    key_id TEXT,
+    FOREIGN KEY (upload_id) REFERENCES sync_upload (id) ON DELETE CASCADE
+);
+
+CREATE INDEX sync_upload_chunk_upload_id_index
+    ON sync_upload_chunk (upload_id);
+
+CREATE TABLE sync_lease
+(
+	api_key_id   INTEGER PRIMARY KEY,
+	device_id    TEXT NOT NULL,
+	acquired_at  TIMESTAMP NOT NULL,
+	expires_at   TIMESTAMP NOT NULL,
+	FOREIGN KEY (api_key_id) REFERENCES api_key (id) ON DELETE CASCADE
+);
+
+CREATE TABLE devices
+(
+	api_key_id         INTEGER NOT NULL,
+	device_id          TEXT NOT NULL,
+	device_name        TEXT,
+	user_agent         TEXT,
+	app_version        TEXT,
+	ip                 TEXT,
+	last_download_etag TEXT,
+	last_upload_etag   TEXT,
+	last_seen          TIMESTAMP NOT NULL,
+	created_at         TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (api_key_id, device_id),
+	FOREIGN KEY (api_key_id) REFERENCES api_key (id) ON DELETE CASCADE
+);
+
+CREATE TABLE sync_events
+(
+	id           INTEGER PRIMARY KEY,
+	api_key_id   INTEGER NOT NULL,
+	device_name  TEXT,
+	event        TEXT NOT NULL,
+	message      TEXT,
+	created_at   TIMESTAMP NOT NULL,
+	FOREIGN KEY (api_key_id) REFERENCES api_key (id) ON DELETE CASCADE
+);
+
+CREATE INDEX sync_events_api_key_id_created_at_index
+	ON sync_events (api_key_id, created_at);
+
+CREATE TABLE audit_log
+(
+	id           INTEGER PRIMARY KEY,
+	actor        TEXT,
+	ip           TEXT,
+	action       TEXT NOT NULL,
+	target       TEXT,
+	before_value TEXT,
+	after_value  TEXT,
+	created_at   TIMESTAMP NOT NULL
+);
 
-    FOREIGN KEY (user_api_key) REFERENCES api_key (key) ON DELETE CASCADE
-)
+CREATE INDEX audit_log_created_at_index
+	ON audit_log (created_at);
 `
 
 var sqliteMigrations = []string{
@@ -167,5 +303,372 @@ var sqliteMigrations = []string{
 	DROP TABLE IF EXISTS manga_data;
 	DROP TABLE IF EXISTS manga_sync;
 	DROP TABLE IF EXISTS sync_lock;
+`,
+	`
+	ALTER TABLE sync_data
+		ADD COLUMN device_name TEXT;
+
+	CREATE TABLE sync_data_history
+	(
+		id INTEGER PRIMARY KEY,
+		user_api_key TEXT NOT NULL,
+
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+
+		data BLOB NOT NULL,
+		data_etag TEXT NOT NULL,
+		device_name TEXT,
+		size INTEGER NOT NULL DEFAULT 0,
+
+		FOREIGN KEY (user_api_key) REFERENCES api_key (key) ON DELETE CASCADE
+	);
+
+	CREATE INDEX sync_data_history_user_api_key_index
+		ON sync_data_history (user_api_key);
+`,
+	`
+	CREATE TABLE sync_upload
+	(
+		id TEXT PRIMARY KEY,
+		user_api_key TEXT NOT NULL,
+		device_name TEXT,
+		size INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_api_key) REFERENCES api_key (key) ON DELETE CASCADE
+	);
+
+	CREATE TABLE sync_upload_chunk
+	(
+		id INTEGER PRIMARY KEY,
+		upload_id TEXT NOT NULL,
+		chunk_offset INTEGER NOT NULL,
+		data BLOB NOT NULL,
+		FOREIGN KEY (upload_id) REFERENCES sync_upload (id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX sync_upload_chunk_upload_id_index
+		ON sync_upload_chunk (upload_id);
+`,
+	`
+	ALTER TABLE sync_data
+		ADD COLUMN size INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE sync_data
+		ADD COLUMN data_key BLOB;
+	ALTER TABLE sync_data
+		ADD COLUMN key_id TEXT;
+
+	UPDATE sync_data
+		SET size = length(data);
+
+	ALTER TABLE sync_data_history
+		ADD COLUMN data_key BLOB;
+	ALTER TABLE sync_data_history
+		ADD COLUMN key_id TEXT;
+
+	ALTER TABLE sync_upload_chunk
+		ADD COLUMN data_key BLOB;
+	ALTER TABLE sync_upload_chunk
+		ADD COLUMN key_id TEXT;
+`,
+	`
+	ALTER TABLE sync_data
+		ADD COLUMN blob_key TEXT;
+	ALTER TABLE sync_data_history
+		ADD COLUMN blob_key TEXT;
+`,
+	`
+	ALTER TABLE api_key
+		ADD COLUMN max_data_size INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE api_key
+		ADD COLUMN max_history_depth INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE api_key
+		ADD COLUMN max_daily_upload INTEGER NOT NULL DEFAULT 0;
+
+	CREATE TABLE api_key_usage
+	(
+		user_api_key TEXT NOT NULL,
+		day          TEXT NOT NULL,
+		upload_bytes INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (user_api_key, day),
+		FOREIGN KEY (user_api_key) REFERENCES api_key (key) ON DELETE CASCADE
+	);
+`,
+	`
+	CREATE TABLE sync_lease
+	(
+		user_api_key TEXT PRIMARY KEY,
+		device_id    TEXT NOT NULL,
+		acquired_at  TIMESTAMP NOT NULL,
+		expires_at   TIMESTAMP NOT NULL,
+		FOREIGN KEY (user_api_key) REFERENCES api_key (key) ON DELETE CASCADE
+	);
+`,
+	`
+	CREATE TABLE devices
+	(
+		user_api_key       TEXT NOT NULL,
+		device_id          TEXT NOT NULL,
+		device_name        TEXT,
+		user_agent         TEXT,
+		app_version        TEXT,
+		ip                 TEXT,
+		last_download_etag TEXT,
+		last_upload_etag   TEXT,
+		last_seen          TIMESTAMP NOT NULL,
+		created_at         TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (user_api_key, device_id),
+		FOREIGN KEY (user_api_key) REFERENCES api_key (key) ON DELETE CASCADE
+	);
+`,
+	`
+	CREATE TABLE sync_events
+	(
+		id           INTEGER PRIMARY KEY,
+		user_api_key TEXT NOT NULL,
+		device_name  TEXT,
+		event        TEXT NOT NULL,
+		message      TEXT,
+		created_at   TIMESTAMP NOT NULL,
+		FOREIGN KEY (user_api_key) REFERENCES api_key (key) ON DELETE CASCADE
+	);
+
+	CREATE INDEX sync_events_user_api_key_created_at_index
+		ON sync_events (user_api_key, created_at);
+`,
+	`
+	CREATE TABLE audit_log
+	(
+		id           INTEGER PRIMARY KEY,
+		actor        TEXT,
+		ip           TEXT,
+		action       TEXT NOT NULL,
+		target       TEXT,
+		before_value TEXT,
+		after_value  TEXT,
+		created_at   TIMESTAMP NOT NULL
+	);
+
+	CREATE INDEX audit_log_created_at_index
+		ON audit_log (created_at);
+`,
+	`
+	ALTER TABLE api_key
+		ADD COLUMN user_id INTEGER REFERENCES users (id) ON DELETE CASCADE;
+
+	UPDATE api_key
+		SET user_id = (SELECT MIN(id) FROM users);
+
+	CREATE INDEX api_key_user_id_index
+		ON api_key (user_id);
+`,
+	`
+	ALTER TABLE users
+		ADD COLUMN role TEXT NOT NULL DEFAULT 'member';
+
+	UPDATE users
+		SET role = 'admin'
+		WHERE id = (SELECT MIN(id) FROM users);
+`,
+	`
+	UPDATE api_key
+		SET scopes = '{"sync:read","sync:write","sync:events"}';
+`,
+	`
+	ALTER TABLE api_key
+		ADD COLUMN expires_at TIMESTAMP;
+
+	ALTER TABLE api_key
+		ADD COLUMN last_used_at TIMESTAMP;
+
+	ALTER TABLE api_key
+		ADD COLUMN last_used_ip TEXT;
+
+	ALTER TABLE api_key
+		ADD COLUMN previous_key TEXT;
+
+	ALTER TABLE api_key
+		ADD COLUMN previous_key_expires_at TIMESTAMP;
+
+	CREATE INDEX api_key_previous_key_index
+		ON api_key (previous_key);
+`,
+	`
+	CREATE TABLE _api_key_new
+	(
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		name       TEXT,
+		key_hash   TEXT NOT NULL UNIQUE,
+		key_prefix TEXT NOT NULL DEFAULT '',
+		scopes     TEXT []   DEFAULT '{}' NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+
+		max_data_size     INTEGER NOT NULL DEFAULT 0,
+		max_history_depth INTEGER NOT NULL DEFAULT 0,
+		max_daily_upload  INTEGER NOT NULL DEFAULT 0,
+
+		user_id INTEGER REFERENCES users (id) ON DELETE CASCADE,
+
+		expires_at   TIMESTAMP,
+		last_used_at TIMESTAMP,
+		last_used_ip TEXT,
+
+		previous_key_hash       TEXT,
+		previous_key_expires_at TIMESTAMP
+	);
+
+	-- keys are hashed after migrating, an empty prefix marks a key that is not hashed yet
+	INSERT INTO _api_key_new (name, key_hash, key_prefix, scopes, created_at, max_data_size, max_history_depth, max_daily_upload, user_id, expires_at, last_used_at, last_used_ip, previous_key_hash, previous_key_expires_at)
+		SELECT name, key, '', scopes, created_at, max_data_size, max_history_depth, max_daily_upload, user_id, expires_at, last_used_at, last_used_ip, previous_key, previous_key_expires_at FROM api_key;
+
+	CREATE TABLE _api_key_usage_new
+	(
+		api_key_id   INTEGER NOT NULL,
+		day          TEXT NOT NULL,
+		upload_bytes INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (api_key_id, day),
+		FOREIGN KEY (api_key_id) REFERENCES api_key (id) ON DELETE CASCADE
+	);
+
+	INSERT INTO _api_key_usage_new (api_key_id, day, upload_bytes)
+		SELECT k.id, u.day, u.upload_bytes FROM api_key_usage u JOIN _api_key_new k ON k.key_hash = u.user_api_key;
+
+	DROP TABLE api_key_usage;
+	ALTER TABLE _api_key_usage_new RENAME TO api_key_usage;
+
+	CREATE TABLE _sync_data_new
+	(
+		id INTEGER PRIMARY KEY,
+		api_key_id INTEGER UNIQUE,
+
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+
+		data BLOB NOT NULL,
+		data_etag TEXT NOT NULL,
+		device_name TEXT,
+		size INTEGER NOT NULL DEFAULT 0,
+		data_key BLOB,
+		key_id TEXT,
+		blob_key TEXT,
+
+		FOREIGN KEY (api_key_id) REFERENCES api_key (id) ON DELETE CASCADE
+	);
+
+	INSERT INTO _sync_data_new (id, api_key_id, created_at, updated_at, data, data_etag, device_name, size, data_key, key_id, blob_key)
+		SELECT d.id, k.id, d.created_at, d.updated_at, d.data, d.data_etag, d.device_name, d.size, d.data_key, d.key_id, d.blob_key FROM sync_data d JOIN _api_key_new k ON k.key_hash = d.user_api_key;
+
+	DROP TABLE sync_data;
+	ALTER TABLE _sync_data_new RENAME TO sync_data;
+
+	CREATE TABLE _sync_data_history_new
+	(
+		id INTEGER PRIMARY KEY,
+		api_key_id INTEGER NOT NULL,
+
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+
+		data BLOB NOT NULL,
+		data_etag TEXT NOT NULL,
+		device_name TEXT,
+		size INTEGER NOT NULL DEFAULT 0,
+		data_key BLOB,
+		key_id TEXT,
+		blob_key TEXT,
+
+		FOREIGN KEY (api_key_id) REFERENCES api_key (id) ON DELETE CASCADE
+	);
+
+	INSERT INTO _sync_data_history_new (id, api_key_id, created_at, data, data_etag, device_name, size, data_key, key_id, blob_key)
+		SELECT h.id, k.id, h.created_at, h.data, h.data_etag, h.device_name, h.size, h.data_key, h.key_id, h.blob_key FROM sync_data_history h JOIN _api_key_new k ON k.key_hash = h.user_api_key;
+
+	DROP TABLE sync_data_history;
+	ALTER TABLE _sync_data_history_new RENAME TO sync_data_history;
+
+	CREATE INDEX sync_data_history_api_key_id_index
+		ON sync_data_history (api_key_id);
+
+	CREATE TABLE _sync_upload_new
+	(
+		id TEXT PRIMARY KEY,
+		api_key_id INTEGER NOT NULL,
+		device_name TEXT,
+		size INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (api_key_id) REFERENCES api_key (id) ON DELETE CASCADE
+	);
+
+	INSERT INTO _sync_upload_new (id, api_key_id, device_name, size, created_at, updated_at)
+		SELECT u.id, k.id, u.device_name, u.size, u.created_at, u.updated_at FROM sync_upload u JOIN _api_key_new k ON k.key_hash = u.user_api_key;
+
+	DROP TABLE sync_upload;
+	ALTER TABLE _sync_upload_new RENAME TO sync_upload;
+
+	CREATE TABLE _sync_lease_new
+	(
+		api_key_id   INTEGER PRIMARY KEY,
+		device_id    TEXT NOT NULL,
+		acquired_at  TIMESTAMP NOT NULL,
+		expires_at   TIMESTAMP NOT NULL,
+		FOREIGN KEY (api_key_id) REFERENCES api_key (id) ON DELETE CASCADE
+	);
+
+	INSERT INTO _sync_lease_new (api_key_id, device_id, acquired_at, expires_at)
+		SELECT k.id, l.device_id, l.acquired_at, l.expires_at FROM sync_lease l JOIN _api_key_new k ON k.key_hash = l.user_api_key;
+
+	DROP TABLE sync_lease;
+	ALTER TABLE _sync_lease_new RENAME TO sync_lease;
+
+	CREATE TABLE _devices_new
+	(
+		api_key_id         INTEGER NOT NULL,
+		device_id          TEXT NOT NULL,
+		device_name        TEXT,
+		user_agent         TEXT,
+		app_version        TEXT,
+		ip                 TEXT,
+		last_download_etag TEXT,
+		last_upload_etag   TEXT,
+		last_seen          TIMESTAMP NOT NULL,
+		created_at         TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (api_key_id, device_id),
+		FOREIGN KEY (api_key_id) REFERENCES api_key (id) ON DELETE CASCADE
+	);
+
+	INSERT INTO _devices_new (api_key_id, device_id, device_name, user_agent, app_version, ip, last_download_etag, last_upload_etag, last_seen, created_at)
+		SELECT k.id, d.device_id, d.device_name, d.user_agent, d.app_version, d.ip, d.last_download_etag, d.last_upload_etag, d.last_seen, d.created_at FROM devices d JOIN _api_key_new k ON k.key_hash = d.user_api_key;
+
+	DROP TABLE devices;
+	ALTER TABLE _devices_new RENAME TO devices;
+
+	CREATE TABLE _sync_events_new
+	(
+		id           INTEGER PRIMARY KEY,
+		api_key_id   INTEGER NOT NULL,
+		device_name  TEXT,
+		event        TEXT NOT NULL,
+		message      TEXT,
+		created_at   TIMESTAMP NOT NULL,
+		FOREIGN KEY (api_key_id) REFERENCES api_key (id) ON DELETE CASCADE
+	);
+
+	INSERT INTO _sync_events_new (id, api_key_id, device_name, event, message, created_at)
+		SELECT e.id, k.id, e.device_name, e.event, e.message, e.created_at FROM sync_events e JOIN _api_key_new k ON k.key_hash = e.user_api_key;
+
+	DROP TABLE sync_events;
+	ALTER TABLE _sync_events_new RENAME TO sync_events;
+
+	CREATE INDEX sync_events_api_key_id_created_at_index
+		ON sync_events (api_key_id, created_at);
+
+	DROP TABLE api_key;
+	ALTER TABLE _api_key_new RENAME TO api_key;
+
+	CREATE INDEX api_key_user_id_index
+		ON api_key (user_id);
+
+	CREATE INDEX api_key_previous_key_hash_index
+		ON api_key (previous_key_hash);
 `,
 }
@@ -2,14 +2,17 @@ package database
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"io"
+	"strconv"
 	"time"
 
 	sq "github.com/Masterminds/squirrel"
 	"github.com/SyncYomi/SyncYomi/internal/domain"
 	"github.com/SyncYomi/SyncYomi/internal/logger"
 	"github.com/SyncYomi/SyncYomi/pkg/errors"
-	"github.com/google/uuid"
 	"github.com/rs/zerolog"
 )
 
@@ -27,13 +30,13 @@ type SyncRepo struct {
 
 // Get etag of sync data.
 // For avoid memory usage, only the etag will be returned.
-func (r SyncRepo) GetSyncDataETag(ctx context.Context, apiKey string) (*string, error) {
+func (r SyncRepo) GetSyncDataETag(ctx context.Context, apiKeyID int) (*string, error) {
 	var etag string
 
 	err := r.db.squirrel.
 		Select("data_etag").
 		From("sync_data").
-		Where(sq.Eq{"user_api_key": apiKey}).
+		Where(sq.Eq{"api_key_id": apiKeyID}).
 		Limit(1).
 		RunWith(r.db.handler).
 		Scan(&etag)
@@ -49,17 +52,18 @@ func (r SyncRepo) GetSyncDataETag(ctx context.Context, apiKey string) (*string,
 }
 
 // Get sync data and etag
-func (r SyncRepo) GetSyncDataAndETag(ctx context.Context, apiKey string) ([]byte, *string, error) {
+func (r SyncRepo) GetSyncDataAndETag(ctx context.Context, apiKeyID int) ([]byte, *string, error) {
 	var etag string
-	var data []byte
+	var stored, dataKey []byte
+	var keyID, blobKey sql.NullString
 
 	err := r.db.squirrel.
-		Select("data", "data_etag").
+		Select("data", "data_key", "key_id", "blob_key", "data_etag").
 		From("sync_data").
-		Where(sq.Eq{"user_api_key": apiKey}).
+		Where(sq.Eq{"api_key_id": apiKeyID}).
 		Limit(1).
 		RunWith(r.db.handler).
-		Scan(&data, &etag)
+		Scan(&stored, &dataKey, &keyID, &blobKey, &etag)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -68,94 +72,454 @@ func (r SyncRepo) GetSyncDataAndETag(ctx context.Context, apiKey string) ([]byte
 		return nil, nil, errors.Wrap(err, "error executing query")
 	}
 
+	if stored, err = r.db.loadData(ctx, stored, blobKey); err != nil {
+		return nil, nil, err
+	}
+
+	data, err := r.db.openData(stored, dataKey, keyID, syncDataAD(int64(apiKeyID), etag))
+	if err != nil {
+		return nil, nil, err
+	}
+
 	return data, &etag, nil
 }
 
-// Create or replace sync data, returns the new etag.
-func (r SyncRepo) SetSyncData(ctx context.Context, apiKey string, data []byte) (*string, error) {
+// Pass the etag, size and a reader of the sync data to fn, returns false if there is no sync data.
+// Unencrypted data is streamed from the blob store, encrypted data is decrypted
+// in memory first, as AES-GCM only authenticates the message as a whole.
+// The reader is only valid until fn returns.
+func (r SyncRepo) WriteSyncDataTo(ctx context.Context, apiKeyID int, fn func(etag string, size int64, data io.Reader) error) (bool, error) {
+	var etag string
+	var size int64
+	var stored, dataKey []byte
+	var keyID, blobKey sql.NullString
+
+	err := r.db.squirrel.
+		Select("data", "data_key", "key_id", "blob_key", "data_etag", "size").
+		From("sync_data").
+		Where(sq.Eq{"api_key_id": apiKeyID}).
+		Limit(1).
+		RunWith(r.db.handler).
+		Scan(&stored, &dataKey, &keyID, &blobKey, &etag, &size)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "error executing query")
+	}
+
+	data, err := r.db.openDataReader(ctx, stored, dataKey, keyID, blobKey, syncDataAD(int64(apiKeyID), etag))
+	if err != nil {
+		return false, err
+	}
+	defer data.Close()
+
+	return true, fn(etag, size, data)
+}
+
+// Create or replace sync data, returns the new etag and whether it was written.
+// The replaced data is moved to the history.
+// Uploading the data that is already stored is a no-op.
+func (r SyncRepo) SetSyncData(ctx context.Context, apiKeyID int, deviceName string, data []byte) (*string, bool, error) {
+	return r.setSyncData(ctx, apiKeyID, deviceName, data, contentETag(data))
+}
+
+// Replace sync data with a previous version, returns the new etag and whether it was written.
+// The etag is the one of the content with a new restore generation, so it differs from the
+// etag of the version, which devices may still have. Restoring the data that is already
+// stored is a no-op.
+func (r SyncRepo) RestoreSyncData(ctx context.Context, apiKeyID int, deviceName string, data []byte) (*string, bool, error) {
+	return r.setSyncData(ctx, apiKeyID, deviceName, data, restoredETag(data, time.Now()))
+}
+
+// setSyncData creates or replaces sync data with the etag newEtag of data.
+func (r SyncRepo) setSyncData(ctx context.Context, apiKeyID int, deviceName string, data []byte, newEtag string) (*string, bool, error) {
 	now := time.Now()
-	// the better way is use hash like sha1
-	// but uuid is faster than sha1
-	newEtag := "uuid=" + uuid.NewString()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "error starting transaction")
+	}
+	defer tx.Rollback()
+
+	if stored, err := r.storedETag(ctx, tx, apiKeyID, data); err != nil {
+		return nil, false, err
+	} else if stored != nil {
+		r.log.Debug().Msgf("Sync data unchanged: api_key=\"%v\", etag=\"%v\"", "REDACTED", *stored)
+		return stored, false, nil
+	}
+
+	stored, dataKey, keyID, err := r.db.sealData(data, syncDataAD(int64(apiKeyID), newEtag))
+	if err != nil {
+		return nil, false, err
+	}
+
+	blobKey, err := r.db.putBlob(ctx, stored)
+	if err != nil {
+		return nil, false, err
+	}
+
+	committed := false
+	defer func() {
+		if !committed {
+			r.db.deleteBlobs(ctx, blobKey)
+		}
+	}()
+
+	if err := r.archiveSyncData(ctx, tx, sq.Eq{"api_key_id": apiKeyID}); err != nil {
+		return nil, false, err
+	}
 
 	updateResult, err := r.db.squirrel.
 		Update("sync_data").
 		Set("updated_at", now).
-		Set("data", data).
+		Set("data", noData).
+		Set("data_key", dataKey).
+		Set("key_id", keyID).
+		Set("blob_key", blobKey).
+		Set("size", len(data)).
 		Set("data_etag", newEtag).
-		Where(sq.Eq{"user_api_key": apiKey}).
-		RunWith(r.db.handler).ExecContext(ctx)
+		Set("device_name", toNullString(deviceName)).
+		Where(sq.Eq{"api_key_id": apiKeyID}).
+		RunWith(tx).ExecContext(ctx)
 
 	if err != nil {
 		r.log.Err(err).Msgf("Error when updating sync data")
-		return nil, errors.Wrap(err, "error executing query")
+		return nil, false, errors.Wrap(err, "error executing query")
 	}
 
 	if rowsAffected, err := updateResult.RowsAffected(); err != nil {
-		return nil, errors.Wrap(err, "error executing query")
+		return nil, false, errors.Wrap(err, "error executing query")
 	} else if rowsAffected == 0 {
 		// new item
 		insertResult, err := r.db.squirrel.
 			Insert("sync_data").
 			Columns(
-				"user_api_key",
+				"api_key_id",
 				"updated_at",
 				"data",
+				"data_key",
+				"key_id",
+				"blob_key",
+				"size",
 				"data_etag",
+				"device_name",
 			).
-			Values(apiKey, now, data, newEtag).
-			RunWith(r.db.handler).ExecContext(ctx)
+			Values(apiKeyID, now, noData, dataKey, keyID, blobKey, len(data), newEtag, toNullString(deviceName)).
+			RunWith(tx).ExecContext(ctx)
 
 		if err != nil {
 			r.log.Err(err).Msgf("Error when inserting sync data")
-			return nil, errors.Wrap(err, "error executing query")
+			return nil, false, errors.Wrap(err, "error executing query")
 		}
 
 		if rowsAffected, err := insertResult.RowsAffected(); err != nil {
-			return nil, errors.Wrap(err, "error executing query")
+			return nil, false, errors.Wrap(err, "error executing query")
 
 		} else if rowsAffected == 0 {
 			// multi devices race condition
-			return nil, errors.New("no rows affected")
+			return nil, false, errors.New("no rows affected")
 		}
 	}
 
+	if err := tx.Commit(); err != nil {
+		return nil, false, errors.Wrap(err, "error committing transaction")
+	}
+	committed = true
+
 	r.log.Debug().Msgf("Sync data upsert: api_key=\"%v\"", "REDACTED")
-	return &newEtag, nil
+	return &newEtag, true, nil
 }
 
 // Replace sync data only if the etag matches,
-// returns the new etag if updated, or nil if not.
-func (r SyncRepo) SetSyncDataIfMatch(ctx context.Context, apiKey string, etag string, data []byte) (*string, error) {
+// returns the new etag and whether it was written, or nil if the etag does not match.
+// The replaced data is moved to the history.
+// Uploading the data that is already stored is a no-op, even when the etag does not match.
+func (r SyncRepo) SetSyncDataIfMatch(ctx context.Context, apiKeyID int, etag string, deviceName string, data []byte) (*string, bool, error) {
 	now := time.Now()
-	// the better way is use hash like sha1
-	// but uuid is faster than sha1
-	newEtag := "uuid=" + uuid.NewString()
+	newEtag := contentETag(data)
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "error starting transaction")
+	}
+	defer tx.Rollback()
+
+	if stored, err := r.storedETag(ctx, tx, apiKeyID, data); err != nil {
+		return nil, false, err
+	} else if stored != nil {
+		r.log.Debug().Msgf("Sync data unchanged: api_key=\"%v\", etag=\"%v\"", "REDACTED", *stored)
+		return stored, false, nil
+	}
+
+	stored, dataKey, keyID, err := r.db.sealData(data, syncDataAD(int64(apiKeyID), newEtag))
+	if err != nil {
+		return nil, false, err
+	}
+
+	blobKey, err := r.db.putBlob(ctx, stored)
+	if err != nil {
+		return nil, false, err
+	}
+
+	committed := false
+	defer func() {
+		if !committed {
+			r.db.deleteBlobs(ctx, blobKey)
+		}
+	}()
+
+	if err := r.archiveSyncData(ctx, tx, sq.Eq{"api_key_id": apiKeyID, "data_etag": etag}); err != nil {
+		return nil, false, err
+	}
 
 	result, err := r.db.squirrel.
 		Update("sync_data").
 		Set("updated_at", now).
-		Set("data", data).
+		Set("data", noData).
+		Set("data_key", dataKey).
+		Set("key_id", keyID).
+		Set("blob_key", blobKey).
+		Set("size", len(data)).
 		Set("data_etag", newEtag).
-		Where(sq.Eq{"user_api_key": apiKey}).
+		Set("device_name", toNullString(deviceName)).
+		Where(sq.Eq{"api_key_id": apiKeyID}).
 		Where(sq.Eq{"data_etag": etag}).
-		RunWith(r.db.handler).ExecContext(ctx)
+		RunWith(tx).ExecContext(ctx)
 
 	if err != nil {
-		return nil, errors.Wrap(err, "error executing query")
+		return nil, false, errors.Wrap(err, "error executing query")
 	}
 
 	if rowsAffected, err := result.RowsAffected(); err != nil {
-		return nil, errors.Wrap(err, "error executing query")
+		return nil, false, errors.Wrap(err, "error executing query")
 
 	} else if rowsAffected == 0 {
 		r.log.Debug().Msgf(
 			"ETag mismatch detected for api_key=\"%v\". This indicates remote data has been modified since last fetched. Aborting update to avoid overwriting recent changes. Expected ETag=\"%v\", found different ETag on server.",
 			"REDACTED", etag)
-		return nil, nil
+		return nil, false, nil
+	}
 
-	} else {
-		r.log.Debug().Msgf("Sync data replaced: api_key=\"%v\", etag=\"%v\"", "REDACTED", etag)
-		return &newEtag, nil
+	if err := tx.Commit(); err != nil {
+		return nil, false, errors.Wrap(err, "error committing transaction")
 	}
+	committed = true
+
+	r.log.Debug().Msgf("Sync data replaced: api_key=\"%v\", etag=\"%v\"", "REDACTED", etag)
+	return &newEtag, true, nil
+}
+
+// contentETag derives the etag from the data,
+// so uploading the same data twice gives the same etag.
+func contentETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256=" + hex.EncodeToString(sum[:])
+}
+
+// restoreSeparator separates the restore generation from the content etag in the etag of restored data.
+const restoreSeparator = "-r"
+
+// restoredETag is the etag of data restored from the history at time at,
+// the content etag with the time as restore generation.
+func restoredETag(data []byte, at time.Time) string {
+	return contentETag(data) + restoreSeparator + strconv.FormatInt(at.UnixNano(), 36)
+}
+
+// storedETag returns the etag of the stored sync data if it is data,
+// restored or not, or nil if it is not.
+func (r SyncRepo) storedETag(ctx context.Context, tx *Tx, apiKeyID int, data []byte) (*string, error) {
+	var etag string
+
+	content := contentETag(data)
+
+	err := r.db.squirrel.
+		Select("data_etag").
+		From("sync_data").
+		Where(sq.Eq{"api_key_id": apiKeyID}).
+		Where(sq.Or{
+			sq.Eq{"data_etag": content},
+			sq.Like{"data_etag": content + restoreSeparator + "%"},
+		}).
+		RunWith(tx).
+		QueryRowContext(ctx).
+		Scan(&etag)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "error executing query")
+	}
+
+	return &etag, nil
+}
+
+// archiveSyncData copies the sync data matching pred into the history,
+// it is a no-op when nothing matches.
+// The history takes over the blob, the sync data gets a new one.
+func (r SyncRepo) archiveSyncData(ctx context.Context, tx *Tx, pred sq.Eq) error {
+	_, err := r.db.squirrel.
+		Insert("sync_data_history").
+		Columns(
+			"api_key_id",
+			"created_at",
+			"data",
+			"data_key",
+			"key_id",
+			"blob_key",
+			"data_etag",
+			"device_name",
+			"size",
+		).
+		Select(sq.
+			Select(
+				"api_key_id",
+				"updated_at",
+				"data",
+				"data_key",
+				"key_id",
+				"blob_key",
+				"data_etag",
+				"device_name",
+				"size",
+			).
+			From("sync_data").
+			Where(pred)).
+		RunWith(tx).ExecContext(ctx)
+
+	if err != nil {
+		r.log.Err(err).Msgf("Error when archiving sync data")
+		return errors.Wrap(err, "error executing query")
+	}
+
+	return nil
+}
+
+// List the previous versions of sync data, newest first.
+func (r SyncRepo) ListSyncDataHistory(ctx context.Context, apiKeyID int) ([]domain.SyncDataHistory, error) {
+	rows, err := r.db.squirrel.
+		Select("data_etag", "device_name", "size", "created_at").
+		From("sync_data_history").
+		Where(sq.Eq{"api_key_id": apiKeyID}).
+		OrderBy("id DESC").
+		RunWith(r.db.handler).
+		QueryContext(ctx)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "error executing query")
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			r.log.Error().Msgf("error closing rows: %v", err)
+		}
+	}(rows)
+
+	history := make([]domain.SyncDataHistory, 0)
+	for rows.Next() {
+		var h domain.SyncDataHistory
+
+		var deviceName sql.NullString
+
+		if err := rows.Scan(&h.ETag, &deviceName, &h.Size, &h.CreatedAt); err != nil {
+			return nil, errors.Wrap(err, "error scanning row")
+		}
+
+		h.DeviceName = deviceName.String
+
+		history = append(history, h)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error rows history")
+	}
+
+	return history, nil
+}
+
+// Get a previous version of sync data by its etag, returns nil if not found.
+func (r SyncRepo) GetSyncDataHistory(ctx context.Context, apiKeyID int, etag string) ([]byte, error) {
+	var stored, dataKey []byte
+	var keyID, blobKey sql.NullString
+
+	err := r.db.squirrel.
+		Select("data", "data_key", "key_id", "blob_key").
+		From("sync_data_history").
+		Where(sq.Eq{"api_key_id": apiKeyID}).
+		Where(sq.Eq{"data_etag": etag}).
+		OrderBy("id DESC").
+		Limit(1).
+		RunWith(r.db.handler).
+		Scan(&stored, &dataKey, &keyID, &blobKey)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "error executing query")
+	}
+
+	if stored, err = r.db.loadData(ctx, stored, blobKey); err != nil {
+		return nil, err
+	}
+
+	return r.db.openData(stored, dataKey, keyID, syncDataAD(int64(apiKeyID), etag))
+}
+
+// Delete all but the newest keep versions of sync data.
+func (r SyncRepo) PruneSyncDataHistory(ctx context.Context, apiKeyID int, keep int) error {
+	if keep < 0 {
+		keep = 0
+	}
+
+	newest := sq.
+		Select("id").
+		From("sync_data_history").
+		Where(sq.Eq{"api_key_id": apiKeyID}).
+		OrderBy("id DESC").
+		Limit(uint64(keep))
+
+	newestSql, newestArgs, err := newest.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "error building query")
+	}
+
+	pruned := sq.And{
+		sq.Eq{"api_key_id": apiKeyID},
+		sq.Expr("id NOT IN ("+newestSql+")", newestArgs...),
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "error starting transaction")
+	}
+	defer tx.Rollback()
+
+	blobKeys, err := r.db.blobKeys(ctx, tx, "sync_data_history", pruned)
+	if err != nil {
+		return err
+	}
+
+	result, err := r.db.squirrel.
+		Delete("sync_data_history").
+		Where(pruned).
+		RunWith(tx).ExecContext(ctx)
+
+	if err != nil {
+		return errors.Wrap(err, "error executing query")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "error committing transaction")
+	}
+
+	r.db.deleteBlobs(ctx, blobKeys...)
+
+	if rowsAffected, err := result.RowsAffected(); err == nil && rowsAffected > 0 {
+		r.log.Debug().Msgf("Sync data history pruned: api_key=\"%v\", removed=%d", "REDACTED", rowsAffected)
+	}
+
+	return nil
 }
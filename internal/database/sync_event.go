@@ -0,0 +1,244 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/SyncYomi/SyncYomi/internal/domain"
+	"github.com/SyncYomi/SyncYomi/pkg/errors"
+)
+
+// Store a sync event reported by a device.
+func (r SyncRepo) StoreSyncEvent(ctx context.Context, event *domain.SyncEvent) error {
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now().UTC()
+	}
+
+	queryBuilder := r.db.squirrel.
+		Insert("sync_events").
+		Columns("api_key_id", "device_name", "event", "message", "created_at").
+		Values(event.APIKeyID, toNullString(event.DeviceName), string(event.Event), toNullString(event.Message), event.CreatedAt).
+		Suffix("RETURNING id").
+		RunWith(r.db.handler)
+
+	if err := queryBuilder.QueryRowContext(ctx).Scan(&event.ID); err != nil {
+		return errors.Wrap(err, "error executing query")
+	}
+
+	return nil
+}
+
+// syncEventsWhere applies the conditions of filter to a query on sync_events e joined with api_key k.
+func syncEventsWhere(queryBuilder sq.SelectBuilder, filter domain.SyncEventFilter) sq.SelectBuilder {
+	if filter.APIKeyID != 0 {
+		queryBuilder = queryBuilder.Where(sq.Eq{"e.api_key_id": filter.APIKeyID})
+	}
+	if filter.UserID != 0 {
+		queryBuilder = queryBuilder.Where(sq.Eq{"k.user_id": filter.UserID})
+	}
+	if filter.DeviceName != "" {
+		queryBuilder = queryBuilder.Where(sq.Eq{"e.device_name": filter.DeviceName})
+	}
+	if filter.Event != "" {
+		queryBuilder = queryBuilder.Where(sq.Eq{"e.event": string(filter.Event)})
+	}
+	if !filter.Since.IsZero() {
+		queryBuilder = queryBuilder.Where(sq.GtOrEq{"e.created_at": filter.Since.UTC()})
+	}
+	if !filter.Until.IsZero() {
+		queryBuilder = queryBuilder.Where(sq.Lt{"e.created_at": filter.Until.UTC()})
+	}
+	return queryBuilder
+}
+
+// List the sync events matching filter, newest first,
+// and the number of events matching it without limit and offset.
+// Events of deleted keys are left out, sqlite does not cascade the delete.
+func (r SyncRepo) ListSyncEvents(ctx context.Context, filter domain.SyncEventFilter) ([]domain.SyncEvent, int, error) {
+	var total int
+
+	err := syncEventsWhere(r.db.squirrel.
+		Select("COUNT(*)").
+		From("sync_events e").
+		Join("api_key k ON k.id = e.api_key_id"), filter).
+		RunWith(r.db.handler).
+		QueryRowContext(ctx).
+		Scan(&total)
+
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "error executing query")
+	}
+
+	queryBuilder := syncEventsWhere(r.db.squirrel.
+		Select("e.id", "e.api_key_id", "k.name", "e.device_name", "e.event", "e.message", "e.created_at").
+		From("sync_events e").
+		Join("api_key k ON k.id = e.api_key_id").
+		OrderBy("e.created_at DESC", "e.id DESC"), filter)
+
+	if filter.Limit > 0 {
+		queryBuilder = queryBuilder.Limit(uint64(filter.Limit))
+	}
+	if filter.Offset > 0 {
+		queryBuilder = queryBuilder.Offset(uint64(filter.Offset))
+	}
+
+	rows, err := queryBuilder.RunWith(r.db.handler).QueryContext(ctx)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "error executing query")
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			r.log.Error().Msgf("error closing rows: %v", err)
+		}
+	}(rows)
+
+	events := []domain.SyncEvent{}
+	for rows.Next() {
+		var e domain.SyncEvent
+		var keyName, deviceName, message sql.NullString
+		var event string
+
+		if err := rows.Scan(&e.ID, &e.APIKeyID, &keyName, &deviceName, &event, &message, &e.CreatedAt); err != nil {
+			return nil, 0, errors.Wrap(err, "error scanning row")
+		}
+
+		e.APIKeyName = keyName.String
+		e.DeviceName = deviceName.String
+		e.Event = domain.NotificationEvent(event)
+		e.Message = message.String
+
+		events = append(events, e)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, 0, errors.Wrap(err, "error rows")
+	}
+
+	return events, total, nil
+}
+
+// Count the sync events matching filter by device and event type, limit and offset are ignored.
+//
+// The time of the last event of a group is looked up by its id, as sqlite
+// returns MAX of a timestamp column as a string which does not scan into a time.
+func (r SyncRepo) CountSyncEvents(ctx context.Context, filter domain.SyncEventFilter) ([]domain.SyncEventCount, error) {
+	rows, err := syncEventsWhere(r.db.squirrel.
+		Select("e.api_key_id", "k.name", "COALESCE(e.device_name, '')", "e.event", "COUNT(*)", "MAX(e.id)").
+		From("sync_events e").
+		Join("api_key k ON k.id = e.api_key_id").
+		GroupBy("e.api_key_id", "k.name", "COALESCE(e.device_name, '')", "e.event"), filter).
+		RunWith(r.db.handler).
+		QueryContext(ctx)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "error executing query")
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			r.log.Error().Msgf("error closing rows: %v", err)
+		}
+	}(rows)
+
+	counts := []domain.SyncEventCount{}
+	lastIDs := []int64{}
+	for rows.Next() {
+		var c domain.SyncEventCount
+		var keyName sql.NullString
+		var event string
+		var lastID int64
+
+		if err := rows.Scan(&c.APIKeyID, &keyName, &c.DeviceName, &event, &c.Count, &lastID); err != nil {
+			return nil, errors.Wrap(err, "error scanning row")
+		}
+
+		c.APIKeyName = keyName.String
+		c.Event = domain.NotificationEvent(event)
+
+		counts = append(counts, c)
+		lastIDs = append(lastIDs, lastID)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error rows")
+	}
+
+	if len(counts) == 0 {
+		return counts, nil
+	}
+
+	times, err := r.syncEventTimes(ctx, lastIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range counts {
+		counts[i].LastAt = times[lastIDs[i]]
+	}
+
+	return counts, nil
+}
+
+// syncEventTimes returns the created_at of the events with the given ids.
+func (r SyncRepo) syncEventTimes(ctx context.Context, ids []int64) (map[int64]time.Time, error) {
+	rows, err := r.db.squirrel.
+		Select("id", "created_at").
+		From("sync_events").
+		Where(sq.Eq{"id": ids}).
+		RunWith(r.db.handler).
+		QueryContext(ctx)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "error executing query")
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			r.log.Error().Msgf("error closing rows: %v", err)
+		}
+	}(rows)
+
+	times := make(map[int64]time.Time, len(ids))
+	for rows.Next() {
+		var id int64
+		var createdAt time.Time
+
+		if err := rows.Scan(&id, &createdAt); err != nil {
+			return nil, errors.Wrap(err, "error scanning row")
+		}
+
+		times[id] = createdAt
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error rows")
+	}
+
+	return times, nil
+}
+
+// Delete the sync events created before, returns the number deleted.
+func (r SyncRepo) DeleteSyncEvents(ctx context.Context, before time.Time) (int64, error) {
+	result, err := r.db.squirrel.
+		Delete("sync_events").
+		Where(sq.Lt{"created_at": before.UTC()}).
+		RunWith(r.db.handler).
+		ExecContext(ctx)
+
+	if err != nil {
+		return 0, errors.Wrap(err, "error executing query")
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "error executing query")
+	}
+
+	return deleted, nil
+}
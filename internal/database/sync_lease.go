@@ -0,0 +1,155 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/SyncYomi/SyncYomi/internal/domain"
+	"github.com/SyncYomi/SyncYomi/pkg/errors"
+)
+
+// Acquire the sync lease for a device until now+ttl, or extend it if the device holds it.
+// Returns false and the current lease if another device holds it.
+//
+// Every step only changes the lease if it still is as expected,
+// so of two devices acquiring at the same time only one gets it.
+func (r SyncRepo) AcquireSyncLease(ctx context.Context, apiKeyID int, deviceID string, ttl time.Duration) (*domain.SyncLease, bool, error) {
+	lease, err := r.ExtendSyncLease(ctx, apiKeyID, deviceID, ttl)
+	if err != nil || lease != nil {
+		return lease, lease != nil, err
+	}
+
+	now := time.Now().UTC()
+	lease = &domain.SyncLease{DeviceID: deviceID, AcquiredAt: now, ExpiresAt: now.Add(ttl)}
+
+	// take over an expired lease
+	result, err := r.db.squirrel.
+		Update("sync_lease").
+		Set("device_id", deviceID).
+		Set("acquired_at", lease.AcquiredAt).
+		Set("expires_at", lease.ExpiresAt).
+		Where(sq.Eq{"api_key_id": apiKeyID}).
+		Where(sq.LtOrEq{"expires_at": now}).
+		RunWith(r.db.handler).ExecContext(ctx)
+
+	if err != nil {
+		return nil, false, errors.Wrap(err, "error executing query")
+	}
+	if rowsAffected, err := result.RowsAffected(); err != nil {
+		return nil, false, errors.Wrap(err, "error executing query")
+	} else if rowsAffected > 0 {
+		r.log.Debug().Msgf("Sync lease acquired: device=\"%v\"", deviceID)
+		return lease, true, nil
+	}
+
+	result, err = r.db.squirrel.
+		Insert("sync_lease").
+		Columns("api_key_id", "device_id", "acquired_at", "expires_at").
+		Values(apiKeyID, deviceID, lease.AcquiredAt, lease.ExpiresAt).
+		Suffix("ON CONFLICT (api_key_id) DO NOTHING").
+		RunWith(r.db.handler).ExecContext(ctx)
+
+	if err != nil {
+		return nil, false, errors.Wrap(err, "error executing query")
+	}
+	if rowsAffected, err := result.RowsAffected(); err != nil {
+		return nil, false, errors.Wrap(err, "error executing query")
+	} else if rowsAffected > 0 {
+		r.log.Debug().Msgf("Sync lease acquired: device=\"%v\"", deviceID)
+		return lease, true, nil
+	}
+
+	// held by another device
+	current, err := r.GetSyncLease(ctx, apiKeyID)
+	if err != nil {
+		return nil, false, err
+	}
+	if current == nil {
+		// released or expired in the meantime
+		return r.AcquireSyncLease(ctx, apiKeyID, deviceID, ttl)
+	}
+
+	return current, false, nil
+}
+
+// Extend the sync lease to now+ttl, returns nil if the device does not hold it.
+func (r SyncRepo) ExtendSyncLease(ctx context.Context, apiKeyID int, deviceID string, ttl time.Duration) (*domain.SyncLease, error) {
+	now := time.Now().UTC()
+
+	result, err := r.db.squirrel.
+		Update("sync_lease").
+		Set("expires_at", now.Add(ttl)).
+		Where(sq.Eq{"api_key_id": apiKeyID}).
+		Where(sq.Eq{"device_id": deviceID}).
+		Where(sq.Gt{"expires_at": now}).
+		RunWith(r.db.handler).ExecContext(ctx)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "error executing query")
+	}
+	if rowsAffected, err := result.RowsAffected(); err != nil {
+		return nil, errors.Wrap(err, "error executing query")
+	} else if rowsAffected == 0 {
+		return nil, nil
+	}
+
+	lease, err := r.GetSyncLease(ctx, apiKeyID)
+	if err != nil {
+		return nil, err
+	}
+	if lease == nil || lease.DeviceID != deviceID {
+		return nil, nil
+	}
+
+	return lease, nil
+}
+
+// Release the sync lease, returns false if the device does not hold it.
+func (r SyncRepo) ReleaseSyncLease(ctx context.Context, apiKeyID int, deviceID string) (bool, error) {
+	result, err := r.db.squirrel.
+		Delete("sync_lease").
+		Where(sq.Eq{"api_key_id": apiKeyID}).
+		Where(sq.Eq{"device_id": deviceID}).
+		Where(sq.Gt{"expires_at": time.Now().UTC()}).
+		RunWith(r.db.handler).ExecContext(ctx)
+
+	if err != nil {
+		return false, errors.Wrap(err, "error executing query")
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "error executing query")
+	}
+
+	if rowsAffected > 0 {
+		r.log.Debug().Msgf("Sync lease released: device=\"%v\"", deviceID)
+	}
+
+	return rowsAffected > 0, nil
+}
+
+// Get the sync lease, returns nil if no device holds it.
+func (r SyncRepo) GetSyncLease(ctx context.Context, apiKeyID int) (*domain.SyncLease, error) {
+	var lease domain.SyncLease
+
+	err := r.db.squirrel.
+		Select("device_id", "acquired_at", "expires_at").
+		From("sync_lease").
+		Where(sq.Eq{"api_key_id": apiKeyID}).
+		Where(sq.Gt{"expires_at": time.Now().UTC()}).
+		RunWith(r.db.handler).
+		QueryRowContext(ctx).
+		Scan(&lease.DeviceID, &lease.AcquiredAt, &lease.ExpiresAt)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "error executing query")
+	}
+
+	return &lease, nil
+}
@@ -0,0 +1,73 @@
+package database
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/SyncYomi/SyncYomi/internal/domain"
+	"github.com/SyncYomi/SyncYomi/internal/logger"
+)
+
+func TestContentETag(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want string
+	}{
+		{name: "empty", in: nil, want: "sha256=e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{name: "data", in: []byte("syncyomi"), want: "sha256=821fd64371f573b139b4ccba7d18a40c7d083ce8443d82f803a8679483f3a3da"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := contentETag(tt.in); got != tt.want {
+				t.Errorf("contentETag(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+
+	if contentETag([]byte("a")) == contentETag([]byte("b")) {
+		t.Error("contentETag() is the same for different data")
+	}
+}
+
+func TestSyncRepo_WriteSyncDataTo(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  domain.Config
+	}{
+		{name: "streamed from blob store"},
+		{name: "encrypted", cfg: domain.Config{EncryptionKey: testKeyOne}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			db, _ := openTestDBWith(t, tt.cfg)
+			repo := NewSyncRepo(logger.Mock(), db)
+
+			found, err := repo.WriteSyncDataTo(ctx, 1, func(string, int64, io.Reader) error { return nil })
+			if err != nil || found {
+				t.Fatalf("WriteSyncDataTo() no data = %v, %v, want false, nil", found, err)
+			}
+
+			etag, _, err := repo.SetSyncData(ctx, 1, "phone", []byte("library"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			found, err = repo.WriteSyncDataTo(ctx, 1, func(gotEtag string, size int64, data io.Reader) error {
+				got, err := io.ReadAll(data)
+				if err != nil {
+					return err
+				}
+				if gotEtag != *etag || size != int64(len("library")) || string(got) != "library" {
+					t.Errorf("WriteSyncDataTo() = %q, %d, %q, want %q, %d, %q", gotEtag, size, got, *etag, len("library"), "library")
+				}
+				return nil
+			})
+			if err != nil || !found {
+				t.Fatalf("WriteSyncDataTo() = %v, %v, want true, nil", found, err)
+			}
+		})
+	}
+}
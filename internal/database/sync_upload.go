@@ -0,0 +1,236 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/SyncYomi/SyncYomi/internal/domain"
+	"github.com/SyncYomi/SyncYomi/pkg/errors"
+	"github.com/google/uuid"
+)
+
+// Start a chunked upload of sync data.
+func (r SyncRepo) CreateSyncUpload(ctx context.Context, apiKeyID int, deviceName string) (*domain.SyncUpload, error) {
+	now := time.Now()
+	upload := domain.SyncUpload{
+		ID:         uuid.NewString(),
+		DeviceName: deviceName,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+
+	_, err := r.db.squirrel.
+		Insert("sync_upload").
+		Columns(
+			"id",
+			"api_key_id",
+			"device_name",
+			"size",
+			"created_at",
+			"updated_at",
+		).
+		Values(upload.ID, apiKeyID, toNullString(deviceName), 0, now, now).
+		RunWith(r.db.handler).ExecContext(ctx)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "error executing query")
+	}
+
+	r.log.Debug().Msgf("Sync upload created: id=\"%v\"", upload.ID)
+	return &upload, nil
+}
+
+// Get a chunked upload, returns nil if not found.
+func (r SyncRepo) GetSyncUpload(ctx context.Context, apiKeyID int, id string) (*domain.SyncUpload, error) {
+	var upload domain.SyncUpload
+	var deviceName sql.NullString
+
+	err := r.db.squirrel.
+		Select("id", "device_name", "size", "created_at", "updated_at").
+		From("sync_upload").
+		Where(sq.Eq{"id": id}).
+		Where(sq.Eq{"api_key_id": apiKeyID}).
+		RunWith(r.db.handler).
+		Scan(&upload.ID, &deviceName, &upload.Offset, &upload.CreatedAt, &upload.UpdatedAt)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "error executing query")
+	}
+
+	upload.DeviceName = deviceName.String
+
+	return &upload, nil
+}
+
+// Append a chunk to an upload if offset is where the upload ends,
+// returns false if the upload does not exist or ends elsewhere.
+func (r SyncRepo) AppendSyncUploadChunk(ctx context.Context, apiKeyID int, id string, offset int64, data []byte) (bool, error) {
+	stored, dataKey, keyID, err := r.db.sealData(data, uploadChunkAD(id, offset))
+	if err != nil {
+		return false, err
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, errors.Wrap(err, "error starting transaction")
+	}
+	defer tx.Rollback()
+
+	// moving the end first makes concurrent writes to the same offset fail
+	result, err := r.db.squirrel.
+		Update("sync_upload").
+		Set("size", offset+int64(len(data))).
+		Set("updated_at", time.Now()).
+		Where(sq.Eq{"id": id}).
+		Where(sq.Eq{"api_key_id": apiKeyID}).
+		Where(sq.Eq{"size": offset}).
+		RunWith(tx).ExecContext(ctx)
+
+	if err != nil {
+		return false, errors.Wrap(err, "error executing query")
+	}
+
+	if rowsAffected, err := result.RowsAffected(); err != nil {
+		return false, errors.Wrap(err, "error executing query")
+	} else if rowsAffected == 0 {
+		return false, nil
+	}
+
+	_, err = r.db.squirrel.
+		Insert("sync_upload_chunk").
+		Columns("upload_id", "chunk_offset", "data", "data_key", "key_id").
+		Values(id, offset, stored, dataKey, keyID).
+		RunWith(tx).ExecContext(ctx)
+
+	if err != nil {
+		return false, errors.Wrap(err, "error executing query")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, errors.Wrap(err, "error committing transaction")
+	}
+
+	return true, nil
+}
+
+// Get the data of an upload, returns nil if not found.
+func (r SyncRepo) GetSyncUploadData(ctx context.Context, apiKeyID int, id string) ([]byte, error) {
+	upload, err := r.GetSyncUpload(ctx, apiKeyID, id)
+	if err != nil || upload == nil {
+		return nil, err
+	}
+
+	rows, err := r.db.squirrel.
+		Select("data", "data_key", "key_id", "chunk_offset").
+		From("sync_upload_chunk").
+		Where(sq.Eq{"upload_id": id}).
+		OrderBy("chunk_offset ASC").
+		RunWith(r.db.handler).
+		QueryContext(ctx)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "error executing query")
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			r.log.Error().Msgf("error closing rows: %v", err)
+		}
+	}(rows)
+
+	data := make([]byte, 0, upload.Offset)
+	for rows.Next() {
+		var stored, dataKey sql.RawBytes
+		var keyID sql.NullString
+		var offset int64
+
+		if err := rows.Scan(&stored, &dataKey, &keyID, &offset); err != nil {
+			return nil, errors.Wrap(err, "error scanning row")
+		}
+
+		chunk, err := r.db.openData(stored, dataKey, keyID, uploadChunkAD(id, offset))
+		if err != nil {
+			return nil, err
+		}
+
+		data = append(data, chunk...)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error rows upload chunks")
+	}
+
+	if int64(len(data)) != upload.Offset {
+		return nil, errors.New("sync upload %v is incomplete: have %d of %d bytes", id, len(data), upload.Offset)
+	}
+
+	return data, nil
+}
+
+// Delete an upload and its chunks.
+func (r SyncRepo) DeleteSyncUpload(ctx context.Context, apiKeyID int, id string) error {
+	if _, err := r.deleteSyncUploads(ctx, sq.Eq{"id": id, "api_key_id": apiKeyID}); err != nil {
+		return err
+	}
+
+	r.log.Debug().Msgf("Sync upload deleted: id=\"%v\"", id)
+	return nil
+}
+
+// Delete the uploads not written to since before, returns the number deleted.
+func (r SyncRepo) DeleteExpiredSyncUploads(ctx context.Context, before time.Time) (int64, error) {
+	return r.deleteSyncUploads(ctx, sq.Lt{"updated_at": before})
+}
+
+// deleteSyncUploads deletes the uploads matching pred with their chunks.
+// The chunks are deleted explicitly, as sqlite does not enforce foreign keys.
+func (r SyncRepo) deleteSyncUploads(ctx context.Context, pred sq.Sqlizer) (int64, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, errors.Wrap(err, "error starting transaction")
+	}
+	defer tx.Rollback()
+
+	uploadsSql, uploadsArgs, err := sq.
+		Select("id").
+		From("sync_upload").
+		Where(pred).
+		ToSql()
+	if err != nil {
+		return 0, errors.Wrap(err, "error building query")
+	}
+
+	_, err = r.db.squirrel.
+		Delete("sync_upload_chunk").
+		Where(sq.Expr("upload_id IN ("+uploadsSql+")", uploadsArgs...)).
+		RunWith(tx).ExecContext(ctx)
+
+	if err != nil {
+		return 0, errors.Wrap(err, "error executing query")
+	}
+
+	result, err := r.db.squirrel.
+		Delete("sync_upload").
+		Where(pred).
+		RunWith(tx).ExecContext(ctx)
+
+	if err != nil {
+		return 0, errors.Wrap(err, "error executing query")
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "error executing query")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, errors.Wrap(err, "error committing transaction")
+	}
+
+	return rowsAffected, nil
+}
@@ -46,7 +46,7 @@ func (r *UserRepo) GetUserCount(ctx context.Context) (int, error) {
 func (r *UserRepo) FindByUsername(ctx context.Context, username string) (*domain.User, error) {
 
 	queryBuilder := r.db.squirrel.
-		Select("id", "username", "password").
+		Select("id", "username", "password", "role").
 		From("users").
 		Where(sq.Eq{"username": username})
 
@@ -62,7 +62,7 @@ func (r *UserRepo) FindByUsername(ctx context.Context, username string) (*domain
 
 	var user domain.User
 
-	if err := row.Scan(&user.ID, &user.Username, &user.Password); err != nil {
+	if err := row.Scan(&user.ID, &user.Username, &user.Password, &user.Role); err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
 		}
@@ -79,8 +79,8 @@ func (r *UserRepo) Store(ctx context.Context, user domain.User) error {
 
 	queryBuilder := r.db.squirrel.
 		Insert("users").
-		Columns("username", "password").
-		Values(user.Username, user.Password)
+		Columns("username", "password", "role").
+		Values(user.Username, user.Password, user.Role)
 
 	query, args, err := queryBuilder.ToSql()
 	if err != nil {
@@ -103,6 +103,7 @@ func (r *UserRepo) Update(ctx context.Context, user domain.User) error {
 		Update("users").
 		Set("username", user.Username).
 		Set("password", user.Password).
+		Set("role", user.Role).
 		Where(sq.Eq{"username": user.Username})
 
 	query, args, err := queryBuilder.ToSql()
@@ -117,3 +118,110 @@ func (r *UserRepo) Update(ctx context.Context, user domain.User) error {
 
 	return err
 }
+
+func (r *UserRepo) FindByID(ctx context.Context, id int) (*domain.User, error) {
+	var user domain.User
+
+	err := r.db.squirrel.
+		Select("id", "username", "password", "role").
+		From("users").
+		Where(sq.Eq{"id": id}).
+		RunWith(r.db.handler).
+		QueryRowContext(ctx).
+		Scan(&user.ID, &user.Username, &user.Password, &user.Role)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+
+		return nil, errors.Wrap(err, "error scanning row")
+	}
+
+	return &user, nil
+}
+
+func (r *UserRepo) List(ctx context.Context) ([]domain.User, error) {
+	rows, err := r.db.squirrel.
+		Select("id", "username", "role").
+		From("users").
+		OrderBy("id").
+		RunWith(r.db.handler).
+		QueryContext(ctx)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "error executing query")
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			r.log.Error().Msgf("error closing rows: %v", err)
+		}
+	}(rows)
+
+	users := make([]domain.User, 0)
+	for rows.Next() {
+		var user domain.User
+
+		if err := rows.Scan(&user.ID, &user.Username, &user.Role); err != nil {
+			return nil, errors.Wrap(err, "error scanning row")
+		}
+
+		users = append(users, user)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error rows")
+	}
+
+	return users, nil
+}
+
+// Delete the user and the api keys it owns with their data.
+// Foreign keys are not enforced on sqlite, so the keys are deleted here.
+func (r *UserRepo) Delete(ctx context.Context, id int) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "error starting transaction")
+	}
+	defer tx.Rollback()
+
+	keysSql, keysArgs, err := sq.
+		Select("id").
+		From("api_key").
+		Where(sq.Eq{"user_id": id}).
+		ToSql()
+	if err != nil {
+		return errors.Wrap(err, "error building query")
+	}
+
+	blobKeys, err := r.db.deleteAPIKeyData(ctx, tx, sq.Expr("api_key_id IN ("+keysSql+")", keysArgs...))
+	if err != nil {
+		return err
+	}
+
+	if _, err := r.db.squirrel.
+		Delete("api_key").
+		Where(sq.Eq{"user_id": id}).
+		RunWith(tx).
+		ExecContext(ctx); err != nil {
+		return errors.Wrap(err, "error deleting api keys")
+	}
+
+	if _, err := r.db.squirrel.
+		Delete("users").
+		Where(sq.Eq{"id": id}).
+		RunWith(tx).
+		ExecContext(ctx); err != nil {
+		return errors.Wrap(err, "error executing query")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "error committing transaction")
+	}
+
+	r.db.deleteBlobs(ctx, blobKeys...)
+
+	return nil
+}
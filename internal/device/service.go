@@ -0,0 +1,55 @@
+package device
+
+import (
+	"context"
+	"errors"
+
+	"github.com/SyncYomi/SyncYomi/internal/domain"
+	"github.com/SyncYomi/SyncYomi/internal/logger"
+	"github.com/rs/zerolog"
+)
+
+// ErrDeviceNotFound is returned by Delete when there is no such device.
+var ErrDeviceNotFound = errors.New("device not found")
+
+type Service interface {
+	// Record a request of a device, empty fields keep what was stored before.
+	Seen(ctx context.Context, device *domain.Device) error
+	// List the devices of all keys, or of one key if apiKeyID is not 0, last seen first.
+	List(ctx context.Context, apiKeyID int) ([]domain.Device, error)
+	// Delete a device, it shows up again when it syncs.
+	Delete(ctx context.Context, apiKeyID int, id string) error
+}
+
+type service struct {
+	log  zerolog.Logger
+	repo domain.DeviceRepo
+}
+
+func NewService(log logger.Logger, repo domain.DeviceRepo) Service {
+	return &service{
+		log:  log.With().Str("module", "device").Logger(),
+		repo: repo,
+	}
+}
+
+func (s *service) Seen(ctx context.Context, device *domain.Device) error {
+	return s.repo.Seen(ctx, device)
+}
+
+func (s *service) List(ctx context.Context, apiKeyID int) ([]domain.Device, error) {
+	return s.repo.List(ctx, apiKeyID)
+}
+
+func (s *service) Delete(ctx context.Context, apiKeyID int, id string) error {
+	deleted, err := s.repo.Delete(ctx, apiKeyID, id)
+	if err != nil {
+		return err
+	}
+
+	if !deleted {
+		return ErrDeviceNotFound
+	}
+
+	return nil
+}
@@ -2,19 +2,121 @@ package domain
 
 import (
 	"context"
+	"errors"
+	"slices"
 	"time"
 )
 
+// ErrAPIKeyNotFound is returned by APIRepo if there is no such key.
+var ErrAPIKeyNotFound = errors.New("api key not found")
+
+// Scopes of api keys, they limit which part of the API a key can call.
+const (
+	// ScopeSyncRead downloads sync data and its history.
+	ScopeSyncRead = "sync:read"
+	// ScopeSyncWrite uploads and restores sync data, and takes the sync lease.
+	ScopeSyncWrite = "sync:write"
+	// ScopeSyncEvents reports and lists sync events.
+	ScopeSyncEvents = "sync:events"
+	// ScopeAdmin calls the API of the web interface with the role of the owner.
+	ScopeAdmin = "admin"
+)
+
+// DefaultScopes are the scopes of keys created without any, enough for a device to sync.
+var DefaultScopes = []string{ScopeSyncRead, ScopeSyncWrite, ScopeSyncEvents}
+
+// ValidScope reports whether scope is a known scope.
+func ValidScope(scope string) bool {
+	switch scope {
+	case ScopeSyncRead, ScopeSyncWrite, ScopeSyncEvents, ScopeAdmin:
+		return true
+	}
+	return false
+}
+
+// APIRepo stores api keys hashed, the key itself is only known when it is created or rotated.
+// Keys are identified by their ID everywhere else.
 type APIRepo interface {
+	// Store a new key, sets its ID and prefix.
 	Store(ctx context.Context, key *APIKey) error
-	Delete(ctx context.Context, key string) error
+	// Update the name, quotas, scopes and expiry of a key, nil scopes are left as they are.
+	Update(ctx context.Context, key *APIKey) error
+	Delete(ctx context.Context, id int) error
 	GetKeys(ctx context.Context) ([]APIKey, error)
+	// GetUserKeys lists the keys owned by a user.
+	GetUserKeys(ctx context.Context, userID int) ([]APIKey, error)
+	// Get the key, a rotated key in its grace period returns the key it was replaced by.
 	Get(ctx context.Context, key string) (*APIKey, error)
+	// FindByID returns the key with the id.
+	FindByID(ctx context.Context, id int) (*APIKey, error)
+	// Rotate replaces the key with the id by newKey, the old key stays valid until graceUntil.
+	Rotate(ctx context.Context, id int, newKey string, graceUntil time.Time) error
+	// SetLastUsed records when and from where the key was last used.
+	SetLastUsed(ctx context.Context, id int, at time.Time, ip string) error
+	// Add uploaded bytes to the usage of the key on day.
+	AddUploadUsage(ctx context.Context, id int, day time.Time, bytes int64) error
+	// Add uploaded bytes to the usage of the key on day unless the usage would exceed max,
+	// returns false if it would. Zero max means no limit.
+	ChargeUploadUsage(ctx context.Context, id int, day time.Time, bytes int64, max int64) (bool, error)
+	// List the stored bytes and uploads of all keys, uploads are counted from since to today.
+	ListUsage(ctx context.Context, since time.Time, today time.Time) ([]APIKeyUsage, error)
 }
 
 type APIKey struct {
-	Name      string     `json:"name,omitempty"`
-	Key       string     `json:"key,omitempty"`
+	// ID identifies the key, the sync data of the key is stored under it.
+	ID   int    `json:"id"`
+	Name string `json:"name,omitempty"`
+	// Key is only set when the key is created or rotated, only its hash is stored.
+	Key string `json:"key,omitempty"`
+	// Prefix is the start of the key, to tell keys apart.
+	Prefix    string     `json:"prefix"`
 	Scopes    []string   `json:"scopes,omitempty"`
 	CreatedAt *time.Time `json:"created_at,omitempty"`
+	// UserID is the user owning the key.
+	UserID int `json:"user_id,omitempty"`
+	// ExpiresAt is when the key stops working, nil for never.
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	LastUsedIP string     `json:"last_used_ip,omitempty"`
+
+	// PreviousKeyExpiresAt is when the key this one replaced by a rotation stops working.
+	PreviousKeyExpiresAt *time.Time `json:"previous_key_expires_at,omitempty"`
+
+	// Quotas, 0 means no limit.
+	// MaxDataSize is the max size of the sync data in bytes.
+	MaxDataSize int64 `json:"max_data_size"`
+	// MaxHistoryDepth lowers the number of versions kept in the history below syncHistoryDepth.
+	MaxHistoryDepth int `json:"max_history_depth"`
+	// MaxDailyUpload is the max number of bytes uploaded per day (UTC).
+	MaxDailyUpload int64 `json:"max_daily_upload"`
+}
+
+// Expired reports whether the key has expired at now.
+func (k APIKey) Expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
+}
+
+// HasScope reports whether the key has scope.
+func (k APIKey) HasScope(scope string) bool {
+	return slices.Contains(k.Scopes, scope)
+}
+
+// APIKeyUsage is what an API key stores and uploads.
+type APIKeyUsage struct {
+	ID              int    `json:"id"`
+	Name            string `json:"name"`
+	Prefix          string `json:"prefix"`
+	StoredBytes     int64  `json:"stored_bytes"`
+	HistoryVersions int    `json:"history_versions"`
+	UploadedToday   int64  `json:"uploaded_bytes_today"`
+	UploadedPeriod  int64  `json:"uploaded_bytes_period"`
+
+	MaxDataSize     int64 `json:"max_data_size"`
+	MaxHistoryDepth int   `json:"max_history_depth"`
+	MaxDailyUpload  int64 `json:"max_daily_upload"`
+}
+
+// UsageDay formats the day usage is accounted on, days are in UTC.
+func UsageDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
 }
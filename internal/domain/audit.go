@@ -0,0 +1,61 @@
+package domain
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+type AuditRepo interface {
+	// Store an entry of the audit log.
+	Store(ctx context.Context, entry *AuditEntry) error
+	// List the entries matching filter, newest first,
+	// and the number of entries matching it without limit and offset.
+	List(ctx context.Context, filter AuditFilter) ([]AuditEntry, int, error)
+	// Delete the entries created before, returns the number deleted.
+	DeleteBefore(ctx context.Context, before time.Time) (int64, error)
+}
+
+// AuditAction is what an administrative action changed.
+type AuditAction string
+
+const (
+	AuditActionLogin              AuditAction = "auth.login"
+	AuditActionLoginFailed        AuditAction = "auth.login_failed"
+	AuditActionLogout             AuditAction = "auth.logout"
+	AuditActionOnboard            AuditAction = "auth.onboard"
+	AuditActionAPIKeyCreate       AuditAction = "api_key.create"
+	AuditActionAPIKeyUpdate       AuditAction = "api_key.update"
+	AuditActionAPIKeyDelete       AuditAction = "api_key.delete"
+	AuditActionAPIKeyRotate       AuditAction = "api_key.rotate"
+	AuditActionNotificationCreate AuditAction = "notification.create"
+	AuditActionNotificationUpdate AuditAction = "notification.update"
+	AuditActionNotificationDelete AuditAction = "notification.delete"
+	AuditActionConfigUpdate       AuditAction = "config.update"
+	AuditActionUserCreate         AuditAction = "user.create"
+	AuditActionUserUpdate         AuditAction = "user.update"
+	AuditActionUserDelete         AuditAction = "user.delete"
+)
+
+// AuditEntry records who did an administrative action, from where and on what.
+// Before and After hold the changed values as json for actions that have them.
+type AuditEntry struct {
+	ID        int64           `json:"id"`
+	Actor     string          `json:"actor"`
+	IP        string          `json:"ip"`
+	Action    AuditAction     `json:"action"`
+	Target    string          `json:"target"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// AuditFilter selects audit log entries, empty fields match all entries.
+type AuditFilter struct {
+	Actor  string
+	Action AuditAction
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+	Offset int
+}
@@ -0,0 +1,23 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// ErrBlobNotFound is returned by BlobStore.Get if there is no blob with the key.
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore stores the sync data outside of the database, by key.
+type BlobStore interface {
+	// Store data under key, replacing what is stored there.
+	Put(ctx context.Context, key string, data []byte) error
+	// Get the data stored under key, returns ErrBlobNotFound if there is none.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Open the data stored under key for reading, returns ErrBlobNotFound if there is none.
+	// The caller has to close the reader.
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete the data stored under key, deleting a missing blob is not an error.
+	Delete(ctx context.Context, key string) error
+}
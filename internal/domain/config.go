@@ -20,6 +20,41 @@ type Config struct {
 	PostgresUser     string `toml:"postgresUser"`
 	PostgresPass     string `toml:"postgresPass"`
 	PostgresSslMode  string `toml:"postgresSslMode"`
+	SyncHistoryDepth int    `toml:"syncHistoryDepth"`
+	EnforceSyncLease bool   `toml:"enforceSyncLease"`
+
+	SyncEventRetention int `toml:"syncEventRetention"`
+	AuditLogRetention  int `toml:"auditLogRetention"`
+
+	MetricsEnabled bool   `toml:"metricsEnabled"`
+	MetricsAPIKey  string `toml:"metricsApiKey"`
+
+	MaxSyncPayloadSize int `toml:"maxSyncPayloadSize"`
+	ReadTimeout        int `toml:"readTimeout"`
+	WriteTimeout       int `toml:"writeTimeout"`
+	IdleTimeout        int `toml:"idleTimeout"`
+
+	EncryptionKey     string `toml:"encryptionKey"`
+	EncryptionKeyID   string `toml:"encryptionKeyId"`
+	EncryptionKeyFile string `toml:"encryptionKeyFile"`
+
+	BlobStorage       string `toml:"blobStorage"`
+	BlobStoragePath   string `toml:"blobStoragePath"`
+	S3Endpoint        string `toml:"s3Endpoint"`
+	S3Region          string `toml:"s3Region"`
+	S3Bucket          string `toml:"s3Bucket"`
+	S3Prefix          string `toml:"s3Prefix"`
+	S3AccessKeyID     string `toml:"s3AccessKeyId"`
+	S3SecretAccessKey string `toml:"s3SecretAccessKey"`
+	S3PathStyle       bool   `toml:"s3PathStyle"`
+}
+
+// MaxSyncPayloadBytes returns the sync payload limit in bytes, or 0 if there is no limit.
+func (c *Config) MaxSyncPayloadBytes() int64 {
+	if c.MaxSyncPayloadSize <= 0 {
+		return 0
+	}
+	return int64(c.MaxSyncPayloadSize) * 1024 * 1024
 }
 
 type ConfigUpdate struct {
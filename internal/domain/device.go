@@ -0,0 +1,34 @@
+package domain
+
+import (
+	"context"
+	"time"
+)
+
+type DeviceRepo interface {
+	// Record a request of a device, empty fields keep what was stored before.
+	Seen(ctx context.Context, device *Device) error
+	// List the devices of all keys, or of one key if apiKeyID is not 0, last seen first.
+	List(ctx context.Context, apiKeyID int) ([]Device, error)
+	// Delete a device, returns false if there is no such device.
+	Delete(ctx context.Context, apiKeyID int, id string) (bool, error)
+}
+
+// Device is a device syncing with an API key, identified by X-Device-Id,
+// or by X-Device-Name for devices that do not send an id.
+type Device struct {
+	APIKeyID   int    `json:"api_key_id"`
+	APIKeyName string `json:"api_key_name"`
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	UserAgent  string `json:"user_agent"`
+	AppVersion string `json:"app_version"`
+	IP         string `json:"ip"`
+
+	// LastDownloadETag is the etag of the sync data the device last downloaded,
+	// LastUploadETag of the sync data it last uploaded.
+	LastDownloadETag string    `json:"last_download_etag"`
+	LastUploadETag   string    `json:"last_upload_etag"`
+	LastSeen         time.Time `json:"last_seen"`
+	CreatedAt        time.Time `json:"created_at"`
+}
@@ -2,17 +2,158 @@ package domain
 
 import (
 	"context"
+	"io"
+	"time"
 )
 
 type SyncRepo interface {
 	// Get etag of sync data.
 	// For avoid memory usage, only the etag will be returned.
-	GetSyncDataETag(ctx context.Context, apiKey string) (*string, error)
+	GetSyncDataETag(ctx context.Context, apiKeyID int) (*string, error)
 	// Get sync data and etag
-	GetSyncDataAndETag(ctx context.Context, apiKey string) ([]byte, *string, error)
-	// Create or replace sync data, returns the new etag.
-	SetSyncData(ctx context.Context, apiKey string, data []byte) (*string, error)
+	GetSyncDataAndETag(ctx context.Context, apiKeyID int) ([]byte, *string, error)
+	// Pass the etag, size and a reader of the sync data to fn, returns false if there is no sync data.
+	// The data is streamed from the blob store when it is not encrypted.
+	// The reader is only valid until fn returns.
+	WriteSyncDataTo(ctx context.Context, apiKeyID int, fn func(etag string, size int64, data io.Reader) error) (bool, error)
+	// Create or replace sync data, returns the new etag and whether it was written,
+	// uploading the data that is already stored writes nothing.
+	// The replaced data is moved to the history.
+	SetSyncData(ctx context.Context, apiKeyID int, deviceName string, data []byte) (*string, bool, error)
 	// Replace sync data only if the etag matches,
-	// returns the new etag if updated, or nil if not.
-	SetSyncDataIfMatch(ctx context.Context, apiKey string, etag string, data []byte) (*string, error)
+	// returns the new etag and whether it was written, or nil if the etag does not match.
+	// The replaced data is moved to the history.
+	SetSyncDataIfMatch(ctx context.Context, apiKeyID int, etag string, deviceName string, data []byte) (*string, bool, error)
+	// Replace sync data with a previous version, returns the new etag and whether it was written.
+	// The etag differs from the one of the version, restoring the data that is already stored writes nothing.
+	// The replaced data is moved to the history.
+	RestoreSyncData(ctx context.Context, apiKeyID int, deviceName string, data []byte) (*string, bool, error)
+	// List the previous versions of sync data, newest first.
+	ListSyncDataHistory(ctx context.Context, apiKeyID int) ([]SyncDataHistory, error)
+	// Get a previous version of sync data by its etag, returns nil if not found.
+	GetSyncDataHistory(ctx context.Context, apiKeyID int, etag string) ([]byte, error)
+	// Delete all but the newest keep versions of sync data.
+	PruneSyncDataHistory(ctx context.Context, apiKeyID int, keep int) error
+
+	// Start a chunked upload of sync data.
+	CreateSyncUpload(ctx context.Context, apiKeyID int, deviceName string) (*SyncUpload, error)
+	// Get a chunked upload, returns nil if not found.
+	GetSyncUpload(ctx context.Context, apiKeyID int, id string) (*SyncUpload, error)
+	// Append a chunk to an upload if offset is where the upload ends,
+	// returns false if the upload does not exist or ends elsewhere.
+	AppendSyncUploadChunk(ctx context.Context, apiKeyID int, id string, offset int64, data []byte) (bool, error)
+	// Get the data of an upload, returns nil if not found.
+	GetSyncUploadData(ctx context.Context, apiKeyID int, id string) ([]byte, error)
+	// Delete an upload and its chunks.
+	DeleteSyncUpload(ctx context.Context, apiKeyID int, id string) error
+	// Delete the uploads not written to since before, returns the number deleted.
+	DeleteExpiredSyncUploads(ctx context.Context, before time.Time) (int64, error)
+
+	// Encrypt the sync data stored unencrypted, and re-wrap the data keys of
+	// other master keys with the current one, returns the number of rows updated.
+	ReencryptSyncData(ctx context.Context) (int64, error)
+
+	// Acquire the sync lease for a device until now+ttl, or extend it if the device holds it.
+	// Returns false and the current lease if another device holds it.
+	AcquireSyncLease(ctx context.Context, apiKeyID int, deviceID string, ttl time.Duration) (*SyncLease, bool, error)
+	// Extend the sync lease to now+ttl, returns nil if the device does not hold it.
+	ExtendSyncLease(ctx context.Context, apiKeyID int, deviceID string, ttl time.Duration) (*SyncLease, error)
+	// Release the sync lease, returns false if the device does not hold it.
+	ReleaseSyncLease(ctx context.Context, apiKeyID int, deviceID string) (bool, error)
+	// Get the sync lease, returns nil if no device holds it.
+	GetSyncLease(ctx context.Context, apiKeyID int) (*SyncLease, error)
+
+	// Store a sync event reported by a device.
+	StoreSyncEvent(ctx context.Context, event *SyncEvent) error
+	// List the sync events matching filter, newest first,
+	// and the number of events matching it without limit and offset.
+	ListSyncEvents(ctx context.Context, filter SyncEventFilter) ([]SyncEvent, int, error)
+	// Count the sync events matching filter by device and event type, limit and offset are ignored.
+	CountSyncEvents(ctx context.Context, filter SyncEventFilter) ([]SyncEventCount, error)
+	// Delete the sync events created before, returns the number deleted.
+	DeleteSyncEvents(ctx context.Context, before time.Time) (int64, error)
+}
+
+// SyncDataHistory describes a previous version of sync data.
+// The data itself is only loaded on demand.
+type SyncDataHistory struct {
+	ETag       string    `json:"etag"`
+	DeviceName string    `json:"device_name"`
+	Size       int64     `json:"size"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// SyncLease is held by a device while it syncs,
+// so other devices wait instead of writing over its changes.
+type SyncLease struct {
+	DeviceID   string    `json:"device_id"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// SyncUpload is sync data uploaded in chunks,
+// which only replaces the sync data once it is committed.
+type SyncUpload struct {
+	ID         string    `json:"id"`
+	DeviceName string    `json:"device_name"`
+	Offset     int64     `json:"offset"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// SyncEvent is a sync event reported by a device, like a started or failed sync.
+type SyncEvent struct {
+	ID         int64             `json:"id"`
+	APIKeyID   int               `json:"api_key_id"`
+	APIKeyName string            `json:"api_key_name"`
+	DeviceName string            `json:"device_name"`
+	Event      NotificationEvent `json:"event"`
+	Message    string            `json:"message"`
+	CreatedAt  time.Time         `json:"created_at"`
+}
+
+// SyncEventFilter selects sync events, empty fields match all events.
+type SyncEventFilter struct {
+	APIKeyID   int
+	DeviceName string
+	Event      NotificationEvent
+	Since      time.Time
+	Until      time.Time
+	Limit      int
+	Offset     int
+
+	// UserID selects the events of the keys owned by a user.
+	UserID int
+}
+
+// SyncEventCount is the number of events of one type reported by a device.
+type SyncEventCount struct {
+	APIKeyID   int
+	APIKeyName string
+	DeviceName string
+	Event      NotificationEvent
+	Count      int
+	LastAt     time.Time
+}
+
+// SyncEventStats sums up sync events, failures count both failed syncs and errors.
+type SyncEventStats struct {
+	Total       int                    `json:"total"`
+	Successes   int                    `json:"successes"`
+	Failures    int                    `json:"failures"`
+	SuccessRate float64                `json:"success_rate"`
+	Devices     []SyncEventDeviceStats `json:"devices"`
+}
+
+// SyncEventDeviceStats sums up the sync events of one device.
+type SyncEventDeviceStats struct {
+	APIKeyID      int        `json:"api_key_id"`
+	APIKeyName    string     `json:"api_key_name"`
+	DeviceName    string     `json:"device_name"`
+	Total         int        `json:"total"`
+	Successes     int        `json:"successes"`
+	Failures      int        `json:"failures"`
+	SuccessRate   float64    `json:"success_rate"`
+	LastEventAt   time.Time  `json:"last_event_at"`
+	LastFailureAt *time.Time `json:"last_failure_at"`
 }
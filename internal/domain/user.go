@@ -1,16 +1,53 @@
 package domain
 
-import "context"
+import (
+	"context"
+	"errors"
+)
+
+var (
+	// ErrUserExists is returned when a username is taken.
+	ErrUserExists = errors.New("user already exists")
+	// ErrUserNotFound is returned when there is no such user.
+	ErrUserNotFound = errors.New("user not found")
+)
 
 type UserRepo interface {
 	GetUserCount(ctx context.Context) (int, error)
 	FindByUsername(ctx context.Context, username string) (*User, error)
+	FindByID(ctx context.Context, id int) (*User, error)
+	List(ctx context.Context) ([]User, error)
 	Store(ctx context.Context, user User) error
+	// Update the username, password and role of the user with the username.
 	Update(ctx context.Context, user User) error
+	// Delete the user and the api keys it owns.
+	Delete(ctx context.Context, id int) error
+}
+
+// Role is what a user may do in the web interface.
+type Role string
+
+const (
+	// RoleAdmin manages users, notifications and the config.
+	RoleAdmin Role = "admin"
+	// RoleMember manages their own api keys and sync data.
+	RoleMember Role = "member"
+	// RoleReadOnly sees everything a member does, but cannot change anything.
+	RoleReadOnly Role = "read_only"
+)
+
+// Valid reports whether r is a known role.
+func (r Role) Valid() bool {
+	switch r {
+	case RoleAdmin, RoleMember, RoleReadOnly:
+		return true
+	}
+	return false
 }
 
 type User struct {
 	ID       int    `json:"id"`
 	Username string `json:"username"`
 	Password string `json:"password"`
+	Role     Role   `json:"role"`
 }
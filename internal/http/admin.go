@@ -0,0 +1,58 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/SyncYomi/SyncYomi/internal/database"
+	"github.com/SyncYomi/SyncYomi/internal/domain"
+	"github.com/SyncYomi/SyncYomi/internal/snapshot"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+)
+
+type adminHandler struct {
+	encoder encoder
+	log     zerolog.Logger
+	db      *database.DB
+	config  *domain.Config
+	version string
+}
+
+func newAdminHandler(encoder encoder, log zerolog.Logger, db *database.DB, config *domain.Config, version string) *adminHandler {
+	return &adminHandler{
+		encoder: encoder,
+		log:     log,
+		db:      db,
+		config:  config,
+		version: version,
+	}
+}
+
+func (h adminHandler) Routes(r chi.Router) {
+	r.Get("/backup", h.backup)
+}
+
+// backup streams a snapshot of the instance, the same archive as `syncyomi backup create`.
+func (h adminHandler) backup(w http.ResponseWriter, r *http.Request) {
+	// the archive is as large as all the sync data, so the server write timeout must not apply
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		h.log.Debug().Err(err).Msg("could not clear write deadline for backup")
+	}
+
+	filename := fmt.Sprintf("syncyomi-backup-%s.tar.gz", time.Now().Format("20060102-150405"))
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("Cache-Control", "no-store")
+
+	manifest, err := snapshot.Create(r.Context(), w, h.db, h.config.ConfigPath, h.version)
+	if err != nil {
+		// the status is sent with the first bytes, the client gets a truncated archive
+		h.log.Error().Err(err).Msg("could not create backup")
+		return
+	}
+
+	h.log.Info().Msgf("Backup created with %s", manifest.Summary())
+}
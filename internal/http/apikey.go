@@ -3,41 +3,73 @@ package http
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"github.com/SyncYomi/SyncYomi/internal/api"
 	"github.com/SyncYomi/SyncYomi/internal/domain"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/render"
+	"io"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 type apikeyService interface {
 	Get(ctx context.Context, key string) (*domain.APIKey, error)
+	FindByID(ctx context.Context, id int) (*domain.APIKey, error)
 	List(ctx context.Context) ([]domain.APIKey, error)
+	ListByUser(ctx context.Context, userID int) ([]domain.APIKey, error)
 	Store(ctx context.Context, key *domain.APIKey) error
 	Update(ctx context.Context, key *domain.APIKey) error
-	Delete(ctx context.Context, key string) error
-	ValidateAPIKey(ctx context.Context, token string) bool
+	Delete(ctx context.Context, id int) error
+	Rotate(ctx context.Context, id int, grace time.Duration) (*domain.APIKey, error)
+	ValidateAPIKey(ctx context.Context, token string, ip string) bool
+	Usage(ctx context.Context) ([]domain.APIKeyUsage, error)
 }
 
 type apikeyHandler struct {
 	encoder encoder
 	service apikeyService
+	users   userService
+	audit   auditService
 }
 
-func newAPIKeyHandler(encoder encoder, service apikeyService) *apikeyHandler {
+func newAPIKeyHandler(encoder encoder, service apikeyService, users userService, audit auditService) *apikeyHandler {
 	return &apikeyHandler{
 		encoder: encoder,
 		service: service,
+		users:   users,
+		audit:   audit,
 	}
 }
 
 func (h apikeyHandler) Routes(r chi.Router) {
 	r.Get("/", h.list)
 	r.Post("/", h.store)
-	r.Delete("/{apikey}", h.delete)
+	r.Get("/usage", h.usage)
+	r.Put("/{keyID}", h.update)
+	r.Post("/{keyID}/rotate", h.rotate)
+	r.Delete("/{keyID}", h.delete)
 }
 
+// ownedKey returns the key of the url if the user of the request owns it,
+// keys of other users are reported as not found.
+func (h apikeyHandler) ownedKey(r *http.Request) (*domain.APIKey, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "keyID"))
+	if err != nil {
+		return nil, false
+	}
+
+	apiKey, err := h.service.FindByID(r.Context(), id)
+	if err != nil || apiKey == nil || apiKey.UserID != requestUserID(r.Context()) {
+		return nil, false
+	}
+	return apiKey, true
+}
+
+// list the keys of the user of the request.
 func (h apikeyHandler) list(w http.ResponseWriter, r *http.Request) {
-	keys, err := h.service.List(r.Context())
+	keys, err := h.service.ListByUser(r.Context(), requestUserID(r.Context()))
 	if err != nil {
 		h.encoder.Error(w, err)
 		return
@@ -59,19 +91,177 @@ func (h apikeyHandler) store(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	data.UserID = requestUserID(ctx)
+
 	if err := h.service.Store(ctx, &data); err != nil {
+		if errors.Is(err, api.ErrInvalidQuota) {
+			h.encoder.StatusResponse(ctx, w, map[string]string{"message": "quotas must not be negative"}, http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, api.ErrInvalidScope) {
+			h.encoder.StatusResponse(ctx, w, map[string]string{"message": "unknown scope"}, http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, api.ErrInvalidExpiry) {
+			h.encoder.StatusResponse(ctx, w, map[string]string{"message": "expires_at must be in the future"}, http.StatusBadRequest)
+			return
+		}
 		// encode error
 		h.encoder.StatusInternalError(w)
 		return
 	}
 
+	h.audit.Record(ctx, newAuditEntry(r, domain.AuditActionAPIKeyCreate, data.Name))
+
+	// the only response with the key, it is stored hashed
 	h.encoder.StatusResponse(ctx, w, data, http.StatusCreated)
 }
 
+// update sets the name, quotas, scopes and expiry of a key.
+func (h apikeyHandler) update(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context()
+		data domain.APIKey
+	)
+
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		h.encoder.StatusResponse(ctx, w, map[string]string{"message": "invalid request body"}, http.StatusBadRequest)
+		return
+	}
+
+	owned, ok := h.ownedKey(r)
+	if !ok {
+		h.encoder.StatusNotFound(ctx, w)
+		return
+	}
+
+	data.ID = owned.ID
+
+	if err := h.service.Update(ctx, &data); err != nil {
+		switch {
+		case errors.Is(err, api.ErrInvalidQuota):
+			h.encoder.StatusResponse(ctx, w, map[string]string{"message": "quotas must not be negative"}, http.StatusBadRequest)
+		case errors.Is(err, api.ErrInvalidScope):
+			h.encoder.StatusResponse(ctx, w, map[string]string{"message": "unknown scope"}, http.StatusBadRequest)
+		case errors.Is(err, api.ErrInvalidExpiry):
+			h.encoder.StatusResponse(ctx, w, map[string]string{"message": "expires_at must be in the future"}, http.StatusBadRequest)
+		case errors.Is(err, domain.ErrAPIKeyNotFound):
+			h.encoder.StatusNotFound(ctx, w)
+		default:
+			h.encoder.StatusInternalError(w)
+		}
+		return
+	}
+
+	key, err := h.service.FindByID(ctx, data.ID)
+	if err != nil {
+		h.encoder.StatusInternalError(w)
+		return
+	}
+
+	h.audit.Record(ctx, newAuditEntry(r, domain.AuditActionAPIKeyUpdate, key.Name))
+
+	h.encoder.StatusResponse(ctx, w, key, http.StatusOK)
+}
+
+// rotate replaces a key by a new one for the same sync data, which is only in this response.
+// The old key keeps working for grace_hours of the optional body, 24 by default, so devices can switch over.
+func (h apikeyHandler) rotate(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var data struct {
+		GraceHours *float64 `json:"grace_hours"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil && !errors.Is(err, io.EOF) {
+		h.encoder.StatusResponse(ctx, w, map[string]string{"message": "invalid request body"}, http.StatusBadRequest)
+		return
+	}
+
+	grace := api.DefaultRotationGrace
+	if data.GraceHours != nil {
+		grace = time.Duration(*data.GraceHours * float64(time.Hour))
+	}
+
+	old, ok := h.ownedKey(r)
+	if !ok {
+		h.encoder.StatusNotFound(ctx, w)
+		return
+	}
+
+	key, err := h.service.Rotate(ctx, old.ID, grace)
+	if err != nil {
+		switch {
+		case errors.Is(err, api.ErrInvalidGrace):
+			h.encoder.StatusResponse(ctx, w, map[string]string{"message": "grace_hours must not be negative"}, http.StatusBadRequest)
+		case errors.Is(err, domain.ErrAPIKeyNotFound):
+			h.encoder.StatusNotFound(ctx, w)
+		default:
+			h.encoder.StatusInternalError(w)
+		}
+		return
+	}
+
+	h.audit.Record(ctx, newAuditEntry(r, domain.AuditActionAPIKeyRotate, key.Name))
+
+	h.encoder.StatusResponse(ctx, w, key, http.StatusOK)
+}
+
+// usage lists what each key stores and uploads, admins see every key
+// to find out what takes up the storage, other users only their own keys.
+func (h apikeyHandler) usage(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	user, err := h.users.FindByID(ctx, requestUserID(ctx))
+	if err != nil {
+		h.encoder.StatusInternalError(w)
+		return
+	}
+
+	usage, err := h.service.Usage(ctx)
+	if err != nil {
+		h.encoder.StatusInternalError(w)
+		return
+	}
+
+	if user != nil && user.Role == domain.RoleAdmin {
+		h.encoder.StatusResponse(ctx, w, usage, http.StatusOK)
+		return
+	}
+
+	keys, err := h.service.ListByUser(ctx, requestUserID(ctx))
+	if err != nil {
+		h.encoder.StatusInternalError(w)
+		return
+	}
+
+	owned := make(map[int]bool, len(keys))
+	for _, key := range keys {
+		owned[key.ID] = true
+	}
+
+	userUsage := make([]domain.APIKeyUsage, 0, len(keys))
+	for _, u := range usage {
+		if owned[u.ID] {
+			userUsage = append(userUsage, u)
+		}
+	}
+
+	h.encoder.StatusResponse(ctx, w, userUsage, http.StatusOK)
+}
+
 func (h apikeyHandler) delete(w http.ResponseWriter, r *http.Request) {
-	if err := h.service.Delete(r.Context(), chi.URLParam(r, "apikey")); err != nil {
+	key, ok := h.ownedKey(r)
+	if !ok {
+		h.encoder.StatusNotFound(r.Context(), w)
+		return
+	}
+
+	if err := h.service.Delete(r.Context(), key.ID); err != nil {
 		h.encoder.StatusInternalError(w)
 		return
 	}
+
+	h.audit.Record(r.Context(), newAuditEntry(r, domain.AuditActionAPIKeyDelete, key.Name))
+
 	h.encoder.NoContent(w)
 }
@@ -0,0 +1,144 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SyncYomi/SyncYomi/internal/domain"
+	"github.com/go-chi/chi/v5"
+)
+
+// memberUsers has user 1, the user the requests of the tests come from, as member.
+func memberUsers() *mockUserService {
+	return &mockUserService{users: []domain.User{{ID: 1, Role: domain.RoleMember}}}
+}
+
+func TestAPIKeyHandler_scopedToUser(t *testing.T) {
+	api := &mockAPIKeyService{keys: []domain.APIKey{
+		{ID: 1, Name: "phone", Prefix: "mine", UserID: 1},
+		{ID: 2, Name: "tablet", Prefix: "theirs", UserID: 2},
+	}}
+
+	r := chi.NewRouter()
+	r.With(withUser(1)).Route("/", newAPIKeyHandler(encoder{}, api, memberUsers(), &mockAuditService{}).Routes)
+
+	for _, target := range []string{"/", "/usage"} {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if body := rec.Body.String(); !strings.Contains(body, "mine") || strings.Contains(body, "theirs") {
+			t.Errorf("GET %v = %s, want only the keys of the user", target, body)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/2", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("delete of a key of another user status = %v, want %v", rec.Code, http.StatusNotFound)
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/1", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("delete of an own key status = %v, want %v", rec.Code, http.StatusNoContent)
+	}
+	if len(api.deleted) != 1 || api.deleted[0] != 1 {
+		t.Errorf("deleted = %v, want [1]", api.deleted)
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"name":"laptop"}`)))
+	if got := api.keys[len(api.keys)-1]; rec.Code != http.StatusCreated || got.UserID != 1 {
+		t.Errorf("store status = %v with owner %v, want %v with owner 1", rec.Code, got.UserID, http.StatusCreated)
+	}
+	if body := rec.Body.String(); !strings.Contains(body, `"key":"generated"`) {
+		t.Errorf("store = %s, want the new key", body)
+	}
+
+	// the key is only shown when it is created
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if body := rec.Body.String(); strings.Contains(body, `"key":`) || !strings.Contains(body, `"prefix":"generate"`) {
+		t.Errorf("list = %s, want the prefix but no key", body)
+	}
+}
+
+func TestAPIKeyHandler_usage(t *testing.T) {
+	api := &mockAPIKeyService{keys: []domain.APIKey{
+		{ID: 1, Name: "phone", Prefix: "mine", UserID: 1},
+		{ID: 2, Name: "tablet", Prefix: "theirs", UserID: 2},
+	}}
+	users := &mockUserService{users: []domain.User{
+		{ID: 1, Role: domain.RoleAdmin},
+		{ID: 2, Role: domain.RoleMember},
+		{ID: 3, Role: domain.RoleReadOnly},
+	}}
+
+	tests := []struct {
+		name   string
+		userID int
+		want   []string
+		hidden []string
+	}{
+		{name: "admin sees every key", userID: 1, want: []string{"mine", "theirs"}},
+		{name: "member sees own keys", userID: 2, want: []string{"theirs"}, hidden: []string{"mine"}},
+		{name: "read-only user without keys", userID: 3, hidden: []string{"mine", "theirs"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := chi.NewRouter()
+			r.With(withUser(tt.userID)).Route("/", newAPIKeyHandler(encoder{}, api, users, &mockAuditService{}).Routes)
+
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/usage", nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("GET /usage status = %v, want %v", rec.Code, http.StatusOK)
+			}
+
+			body := rec.Body.String()
+			for _, prefix := range tt.want {
+				if !strings.Contains(body, prefix) {
+					t.Errorf("GET /usage = %s, want the usage of %q", body, prefix)
+				}
+			}
+			for _, prefix := range tt.hidden {
+				if strings.Contains(body, prefix) {
+					t.Errorf("GET /usage = %s, want no usage of %q", body, prefix)
+				}
+			}
+		})
+	}
+}
+
+func TestAPIKeyHandler_rotate(t *testing.T) {
+	api := &mockAPIKeyService{keys: []domain.APIKey{
+		{ID: 1, Name: "phone", Prefix: "mine", UserID: 1},
+		{ID: 2, Name: "tablet", Prefix: "theirs", UserID: 2},
+	}}
+
+	r := chi.NewRouter()
+	r.With(withUser(1)).Route("/", newAPIKeyHandler(encoder{}, api, memberUsers(), &mockAuditService{}).Routes)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/2/rotate", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("rotate of a key of another user status = %v, want %v", rec.Code, http.StatusNotFound)
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/1/rotate", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "rotated-mine") {
+		t.Errorf("rotate status = %v with %s, want %v with the new key", rec.Code, rec.Body.String(), http.StatusOK)
+	}
+	if api.grace != 24*time.Hour {
+		t.Errorf("grace = %v, want the default of 24h", api.grace)
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/1/rotate", strings.NewReader(`{"grace_hours":0.5}`)))
+	if rec.Code != http.StatusOK || api.grace != 30*time.Minute {
+		t.Errorf("rotate status = %v with grace %v, want %v with 30m", rec.Code, api.grace, http.StatusOK)
+	}
+}
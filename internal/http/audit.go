@@ -0,0 +1,134 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/SyncYomi/SyncYomi/internal/audit"
+	"github.com/SyncYomi/SyncYomi/internal/domain"
+	"github.com/go-chi/chi/v5"
+)
+
+type auditService interface {
+	Record(ctx context.Context, entry domain.AuditEntry)
+	List(ctx context.Context, filter domain.AuditFilter) ([]domain.AuditEntry, int, error)
+}
+
+type auditHandler struct {
+	encoder encoder
+	service auditService
+}
+
+func newAuditHandler(encoder encoder, service auditService) *auditHandler {
+	return &auditHandler{
+		encoder: encoder,
+		service: service,
+	}
+}
+
+func (h auditHandler) Routes(r chi.Router) {
+	r.Get("/", h.list)
+}
+
+// auditResponse is the body of GET /api/audit.
+type auditResponse struct {
+	Entries []domain.AuditEntry `json:"entries"`
+	Total   int                 `json:"total"`
+	Limit   int                 `json:"limit"`
+	Offset  int                 `json:"offset"`
+}
+
+func (h auditHandler) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	filter := domain.AuditFilter{
+		Actor:  query.Get("actor"),
+		Action: domain.AuditAction(query.Get("action")),
+	}
+
+	badRequest := func(message string) {
+		h.encoder.StatusResponse(r.Context(), w, map[string]string{"message": message}, http.StatusBadRequest)
+	}
+
+	for _, param := range []struct {
+		name  string
+		value *time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		if s := query.Get(param.name); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				badRequest(fmt.Sprintf("%v must be an RFC 3339 time", param.name))
+				return
+			}
+			*param.value = t
+		}
+	}
+
+	for _, param := range []struct {
+		name  string
+		value *int
+	}{{"limit", &filter.Limit}, {"offset", &filter.Offset}} {
+		if s := query.Get(param.name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				badRequest(fmt.Sprintf("%v must be a positive number", param.name))
+				return
+			}
+			*param.value = n
+		}
+	}
+
+	entries, total, err := h.service.List(r.Context(), filter)
+	if err != nil {
+		h.encoder.StatusInternalError(w)
+		return
+	}
+
+	h.encoder.StatusResponse(r.Context(), w, auditResponse{
+		Entries: entries,
+		Total:   total,
+		Limit:   audit.Limit(filter.Limit),
+		Offset:  filter.Offset,
+	}, http.StatusOK)
+}
+
+type actorContextKey struct{}
+
+// requestActor returns who makes an authenticated request, set by IsAuthenticated:
+// the username of the session, or the start of the api key.
+func requestActor(ctx context.Context) string {
+	actor, _ := ctx.Value(actorContextKey{}).(string)
+	return actor
+}
+
+// apiKeyActor identifies a request made with an api key,
+// without writing the whole key to the audit log.
+func apiKeyActor(key string) string {
+	if len(key) > 8 {
+		key = key[:8]
+	}
+	return "apikey:" + key
+}
+
+// newAuditEntry describes an action of the request on target.
+func newAuditEntry(r *http.Request, action domain.AuditAction, target string) domain.AuditEntry {
+	return domain.AuditEntry{
+		Actor:  requestActor(r.Context()),
+		IP:     ReadUserIP(r),
+		Action: action,
+		Target: target,
+	}
+}
+
+// auditValue encodes the value before or after an action for the audit log.
+func auditValue(v interface{}) json.RawMessage {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return data
+}
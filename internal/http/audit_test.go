@@ -0,0 +1,166 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/SyncYomi/SyncYomi/internal/domain"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+)
+
+type mockAuditService struct {
+	recorded []domain.AuditEntry
+	entries  []domain.AuditEntry
+	filter   domain.AuditFilter
+	listErr  error
+}
+
+func (m *mockAuditService) Record(ctx context.Context, entry domain.AuditEntry) {
+	m.recorded = append(m.recorded, entry)
+}
+
+func (m *mockAuditService) List(ctx context.Context, filter domain.AuditFilter) ([]domain.AuditEntry, int, error) {
+	m.filter = filter
+	if m.listErr != nil {
+		return nil, 0, m.listErr
+	}
+	return m.entries, len(m.entries), nil
+}
+
+func TestAuditHandler_list(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		mock       *mockAuditService
+		wantStatus int
+		wantBody   string
+		wantFilter *domain.AuditFilter
+	}{
+		{
+			name:  "200 with filters of the query",
+			query: "actor=admin&action=api_key.delete&limit=5&offset=10",
+			mock: &mockAuditService{entries: []domain.AuditEntry{
+				{ID: 1, Actor: "admin", Action: domain.AuditActionAPIKeyDelete, Target: "phone"},
+			}},
+			wantStatus: http.StatusOK,
+			wantBody:   `"total":1,"limit":5,"offset":10`,
+			wantFilter: &domain.AuditFilter{Actor: "admin", Action: domain.AuditActionAPIKeyDelete, Limit: 5, Offset: 10},
+		},
+		{
+			name:       "200 with the default limit",
+			mock:       &mockAuditService{},
+			wantStatus: http.StatusOK,
+			wantBody:   `"limit":50`,
+		},
+		{
+			name:       "400 when until is not a time",
+			query:      "until=soon",
+			mock:       &mockAuditService{},
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "until must be an RFC 3339 time",
+		},
+		{
+			name:       "400 when offset is not a number",
+			query:      "offset=x",
+			mock:       &mockAuditService{},
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "offset must be a positive number",
+		},
+		{
+			name:       "500 on service error",
+			mock:       &mockAuditService{listErr: errTest},
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := chi.NewRouter()
+			r.Route("/", newAuditHandler(encoder{}, tt.mock).Routes)
+
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?"+tt.query, nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("list() status = %v, want %v", rec.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("body %q does not contain %q", rec.Body.String(), tt.wantBody)
+			}
+			if tt.wantFilter != nil && tt.mock.filter != *tt.wantFilter {
+				t.Errorf("filter = %+v, want %+v", tt.mock.filter, *tt.wantFilter)
+			}
+		})
+	}
+}
+
+func TestAuthHandler_audit(t *testing.T) {
+	cfg := &domain.Config{BaseURL: "/", SessionSecret: "test-secret"}
+	store := newCookieStore(cfg)
+	audit := &mockAuditService{}
+	svc := &mockAuthService{loginUser: &domain.User{Username: "u"}}
+
+	r := chi.NewRouter()
+	r.Route("/", newAuthHandler(encoder{}, zerolog.Nop(), cfg, store, svc, audit).Routes)
+
+	req := loginRequest("")
+	req.Header.Set("X-Real-Ip", "10.0.0.1")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	sessionCookie := rec.Header().Get("Set-Cookie")
+
+	svc.loginErr = errTest
+	r.ServeHTTP(httptest.NewRecorder(), loginRequest(""))
+
+	req = httptest.NewRequest(http.MethodPost, "/logout", nil)
+	req.Header.Set("Cookie", sessionCookie)
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	want := []domain.AuditAction{domain.AuditActionLogin, domain.AuditActionLoginFailed, domain.AuditActionLogout}
+	if len(audit.recorded) != len(want) {
+		t.Fatalf("recorded %+v, want actions %v", audit.recorded, want)
+	}
+	for i, action := range want {
+		if got := audit.recorded[i]; got.Action != action || got.Actor != "u" {
+			t.Errorf("recorded[%d] = %v by %q, want %v by %q", i, got.Action, got.Actor, action, "u")
+		}
+	}
+	if ip := audit.recorded[0].IP; ip != "10.0.0.1" {
+		t.Errorf("recorded IP = %q, want %q", ip, "10.0.0.1")
+	}
+}
+
+func TestServer_IsAuthenticatedActor(t *testing.T) {
+	cfg := &domain.Config{BaseURL: "/", SessionSecret: "test-secret"}
+	s := Server{apiService: &mockAPIKeyService{validKey: "0123456789abcdef"}, cookieStore: newCookieStore(cfg)}
+
+	var actor string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actor = requestActor(r.Context())
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-API-Token", "0123456789abcdef")
+	s.IsAuthenticated(next).ServeHTTP(httptest.NewRecorder(), req)
+	if actor != "apikey:01234567" {
+		t.Errorf("actor with api key = %q, want %q", actor, "apikey:01234567")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	sess, _ := s.cookieStore.Get(req, "user_session")
+	sess.Values["authenticated"] = true
+	sess.Values["username"] = "admin"
+	sess.Values["user_id"] = 1
+	w := httptest.NewRecorder()
+	if err := sess.Save(req, w); err != nil {
+		t.Fatalf("saving session: %v", err)
+	}
+	req.Header.Set("Cookie", w.Header().Get("Set-Cookie"))
+	s.IsAuthenticated(next).ServeHTTP(httptest.NewRecorder(), req)
+	if actor != "admin" {
+		t.Errorf("actor with session = %q, want %q", actor, "admin")
+	}
+}
@@ -13,7 +13,7 @@ import (
 type authService interface {
 	GetUserCount(ctx context.Context) (int, error)
 	Login(ctx context.Context, username, password string) (*domain.User, error)
-	CreateUser(ctx context.Context, username, password string) error
+	CreateUser(ctx context.Context, username, password string, role domain.Role) error
 }
 
 type authHandler struct {
@@ -21,16 +21,18 @@ type authHandler struct {
 	encoder encoder
 	config  *domain.Config
 	service authService
+	audit   auditService
 
 	cookieStore *sessions.CookieStore
 }
 
-func newAuthHandler(encoder encoder, log zerolog.Logger, config *domain.Config, cookieStore *sessions.CookieStore, service authService) *authHandler {
+func newAuthHandler(encoder encoder, log zerolog.Logger, config *domain.Config, cookieStore *sessions.CookieStore, service authService, audit auditService) *authHandler {
 	return &authHandler{
 		log:         log,
 		encoder:     encoder,
 		config:      config,
 		service:     service,
+		audit:       audit,
 		cookieStore: cookieStore,
 	}
 }
@@ -78,17 +80,27 @@ func (h authHandler) login(w http.ResponseWriter, r *http.Request) {
 		SameSite: sameSite,
 	}
 
-	_, err := h.service.Login(ctx, data.Username, data.Password)
+	entry := domain.AuditEntry{Actor: data.Username, IP: ReadUserIP(r), Action: domain.AuditActionLogin}
+
+	user, err := h.service.Login(ctx, data.Username, data.Password)
 	if err != nil {
 		h.log.Error().Err(err).Msgf("Auth: Failed login attempt username: [%s] ip: %s", data.Username, ReadUserIP(r))
+		entry.Action = domain.AuditActionLoginFailed
+		h.audit.Record(ctx, entry)
 		h.encoder.StatusResponse(ctx, w, nil, http.StatusUnauthorized)
 		return
 	}
 
 	// Set user as authenticated
 	session.Values["authenticated"] = true
+	session.Values["username"] = data.Username
+	if user != nil {
+		session.Values["user_id"] = user.ID
+	}
 	session.Save(r, w)
 
+	h.audit.Record(ctx, entry)
+
 	h.encoder.StatusResponse(ctx, w, nil, http.StatusNoContent)
 }
 
@@ -97,8 +109,15 @@ func (h authHandler) logout(w http.ResponseWriter, r *http.Request) {
 
 	session, _ := h.cookieStore.Get(r, "user_session")
 
+	if auth, ok := session.Values["authenticated"].(bool); ok && auth {
+		username, _ := session.Values["username"].(string)
+		h.audit.Record(ctx, domain.AuditEntry{Actor: username, IP: ReadUserIP(r), Action: domain.AuditActionLogout})
+	}
+
 	// Revoke users authentication
 	session.Values["authenticated"] = false
+	delete(session.Values, "username")
+	delete(session.Values, "user_id")
 	session.Save(r, w)
 
 	h.encoder.StatusResponse(ctx, w, nil, http.StatusNoContent)
@@ -121,12 +140,26 @@ func (h authHandler) onboard(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := h.service.CreateUser(ctx, data.Username, data.Password)
+	// onboarding creates the first user, the others are added by logged in users
+	userCount, err := h.service.GetUserCount(ctx)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if userCount > 0 {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	err = h.service.CreateUser(ctx, data.Username, data.Password, domain.RoleAdmin)
 	if err != nil {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
 
+	h.audit.Record(ctx, domain.AuditEntry{Actor: data.Username, IP: ReadUserIP(r), Action: domain.AuditActionOnboard, Target: data.Username})
+
 	// send empty response as ok
 	h.encoder.StatusResponse(ctx, w, nil, http.StatusNoContent)
 }
@@ -160,6 +193,11 @@ func (h authHandler) validate(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Forbidden", http.StatusUnauthorized)
 		return
 	}
+	// sessions from before users owned their keys have to log in again
+	if _, ok := session.Values["user_id"].(int); !ok {
+		http.Error(w, "Forbidden", http.StatusUnauthorized)
+		return
+	}
 
 	// send empty response as ok
 	h.encoder.StatusResponse(ctx, w, nil, http.StatusNoContent)
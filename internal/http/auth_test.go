@@ -23,6 +23,7 @@ type mockAuthService struct {
 	loginUser    *domain.User
 	loginErr     error
 	createErr    error
+	createdRole  domain.Role
 }
 
 func (m *mockAuthService) GetUserCount(ctx context.Context) (int, error) {
@@ -39,7 +40,8 @@ func (m *mockAuthService) Login(ctx context.Context, username, password string)
 	return m.loginUser, nil
 }
 
-func (m *mockAuthService) CreateUser(ctx context.Context, username, password string) error {
+func (m *mockAuthService) CreateUser(ctx context.Context, username, password string, role domain.Role) error {
+	m.createdRole = role
 	return m.createErr
 }
 
@@ -53,7 +55,7 @@ func newTestAuthRouter(cfg *domain.Config, svc authService) (chi.Router, *sessio
 
 	r := chi.NewRouter()
 	r.Route("/", func(r chi.Router) {
-		newAuthHandler(encoder{}, zerolog.Nop(), cfg, store, svc).Routes(r)
+		newAuthHandler(encoder{}, zerolog.Nop(), cfg, store, svc, &mockAuditService{}).Routes(r)
 	})
 	return r, store
 }
@@ -283,7 +285,7 @@ func TestAuthHandler_canOnboard(t *testing.T) {
 
 func TestAuthHandler_validate(t *testing.T) {
 	cfg := &domain.Config{BaseURL: "/"}
-	r, _ := newTestAuthRouter(cfg, &mockAuthService{})
+	r, store := newTestAuthRouter(cfg, &mockAuthService{loginUser: &domain.User{ID: 1, Username: "u"}})
 
 	// No session cookie at all.
 	rec := httptest.NewRecorder()
@@ -304,6 +306,48 @@ func TestAuthHandler_validate(t *testing.T) {
 	if rec.Code != http.StatusNoContent {
 		t.Errorf("validate() with session status = %v, want %v", rec.Code, http.StatusNoContent)
 	}
+
+	// A session from before users owned their keys has no user id.
+	req = httptest.NewRequest(http.MethodGet, "/validate", nil)
+	sess, _ := store.Get(req, "user_session")
+	sess.Values["authenticated"] = true
+	w := httptest.NewRecorder()
+	if err := sess.Save(req, w); err != nil {
+		t.Fatalf("saving session: %v", err)
+	}
+	req.Header.Set("Cookie", w.Header().Get("Set-Cookie"))
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("validate() without user id status = %v, want %v", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestAuthHandler_onboard(t *testing.T) {
+	tests := []struct {
+		name       string
+		mock       *mockAuthService
+		wantStatus int
+	}{
+		{name: "first user is created", mock: &mockAuthService{}, wantStatus: http.StatusNoContent},
+		{name: "existing users forbid onboarding", mock: &mockAuthService{userCount: 1}, wantStatus: http.StatusForbidden},
+		{name: "500 when users cannot be counted", mock: &mockAuthService{userCountErr: errTest}, wantStatus: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := newTestAuthRouter(&domain.Config{BaseURL: "/"}, tt.mock)
+
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/onboard", strings.NewReader(`{"username":"u","password":"p"}`)))
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("onboard() status = %v, want %v", rec.Code, tt.wantStatus)
+			}
+			if rec.Code == http.StatusNoContent && tt.mock.createdRole != domain.RoleAdmin {
+				t.Errorf("onboard() created role %q, want %q", tt.mock.createdRole, domain.RoleAdmin)
+			}
+		})
+	}
 }
 
 func TestReadUserIP(t *testing.T) {
@@ -61,6 +61,21 @@ func (h configHandler) getConfig(w http.ResponseWriter, r *http.Request) {
 	render.JSON(w, r, conf)
 }
 
+// auditConfig are the settings updateConfig changes, as written to the audit log.
+type auditConfig struct {
+	CheckForUpdates bool   `json:"check_for_updates"`
+	LogLevel        string `json:"log_level"`
+	LogPath         string `json:"log_path"`
+}
+
+func (h configHandler) auditConfig() auditConfig {
+	return auditConfig{
+		CheckForUpdates: h.cfg.Config.CheckForUpdates,
+		LogLevel:        h.cfg.Config.LogLevel,
+		LogPath:         h.cfg.Config.LogPath,
+	}
+}
+
 func (h configHandler) updateConfig(w http.ResponseWriter, r *http.Request) {
 	var data domain.ConfigUpdate
 
@@ -69,6 +84,8 @@ func (h configHandler) updateConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	before := h.auditConfig()
+
 	if data.CheckForUpdates != nil {
 		h.cfg.Config.CheckForUpdates = *data.CheckForUpdates
 	}
@@ -90,5 +107,10 @@ func (h configHandler) updateConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	entry := newAuditEntry(r, domain.AuditActionConfigUpdate, "config")
+	entry.Before = auditValue(before)
+	entry.After = auditValue(h.auditConfig())
+	h.server.auditService.Record(r.Context(), entry)
+
 	render.NoContent(w, r)
 }
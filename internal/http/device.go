@@ -0,0 +1,186 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SyncYomi/SyncYomi/internal/device"
+	"github.com/SyncYomi/SyncYomi/internal/domain"
+	"github.com/go-chi/chi/v5"
+)
+
+type deviceService interface {
+	Seen(ctx context.Context, device *domain.Device) error
+	List(ctx context.Context, apiKeyID int) ([]domain.Device, error)
+	Delete(ctx context.Context, apiKeyID int, id string) error
+}
+
+type deviceHandler struct {
+	encoder encoder
+	service deviceService
+	keys    apikeyService
+}
+
+func newDeviceHandler(encoder encoder, service deviceService, keys apikeyService) *deviceHandler {
+	return &deviceHandler{
+		encoder: encoder,
+		service: service,
+		keys:    keys,
+	}
+}
+
+func (h deviceHandler) Routes(r chi.Router) {
+	r.Get("/", h.list)
+	r.Delete("/{keyID}/{id}", h.delete)
+}
+
+// ownedKeys returns the keys owned by the user of the request.
+func (h deviceHandler) ownedKeys(ctx context.Context) (map[int]bool, error) {
+	keys, err := h.keys.ListByUser(ctx, requestUserID(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	owned := make(map[int]bool, len(keys))
+	for _, key := range keys {
+		owned[key.ID] = true
+	}
+	return owned, nil
+}
+
+// list the devices of the keys of the user of the request.
+func (h deviceHandler) list(w http.ResponseWriter, r *http.Request) {
+	owned, err := h.ownedKeys(r.Context())
+	if err != nil {
+		h.encoder.StatusInternalError(w)
+		return
+	}
+
+	devices, err := h.service.List(r.Context(), 0)
+	if err != nil {
+		h.encoder.StatusInternalError(w)
+		return
+	}
+
+	userDevices := make([]domain.Device, 0, len(devices))
+	for _, d := range devices {
+		if owned[d.APIKeyID] {
+			userDevices = append(userDevices, d)
+		}
+	}
+
+	h.encoder.StatusResponse(r.Context(), w, userDevices, http.StatusOK)
+}
+
+func (h deviceHandler) delete(w http.ResponseWriter, r *http.Request) {
+	owned, err := h.ownedKeys(r.Context())
+	if err != nil {
+		h.encoder.StatusInternalError(w)
+		return
+	}
+
+	apiKeyID, _ := strconv.Atoi(chi.URLParam(r, "keyID"))
+	if !owned[apiKeyID] {
+		h.encoder.StatusNotFound(r.Context(), w)
+		return
+	}
+
+	if err := h.service.Delete(r.Context(), apiKeyID, chi.URLParam(r, "id")); err != nil {
+		if errors.Is(err, device.ErrDeviceNotFound) {
+			h.encoder.StatusNotFound(r.Context(), w)
+			return
+		}
+		h.encoder.StatusInternalError(w)
+		return
+	}
+
+	h.encoder.NoContent(w)
+}
+
+type deviceContextKey struct{}
+
+// requestDevice returns the device making a sync request, set by TrackDevice.
+// Handlers fill in what the device sends in the body instead of headers.
+func requestDevice(ctx context.Context) *domain.Device {
+	d, _ := ctx.Value(deviceContextKey{}).(*domain.Device)
+	return d
+}
+
+// setDeviceName sets the name of the device making a request,
+// which is also its id if it did not send one.
+func setDeviceName(ctx context.Context, name string) {
+	d := requestDevice(ctx)
+	if d == nil || name == "" {
+		return
+	}
+
+	if d.Name == "" {
+		d.Name = name
+	}
+	if d.ID == "" {
+		d.ID = name
+	}
+}
+
+// deviceFromRequest returns the device making a sync request, its id is empty
+// if the headers do not identify it. Returns nil if there is no API key.
+func deviceFromRequest(r *http.Request) *domain.Device {
+	apiKeyID := requestAPIKeyID(r.Context())
+	name := r.Header.Get("X-Device-Name")
+
+	id := r.Header.Get("X-Device-Id")
+	if id == "" {
+		// older devices only send their name
+		id = name
+	}
+
+	if apiKeyID == 0 {
+		return nil
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// RealIP sets the address without a port
+		ip = r.RemoteAddr
+	}
+
+	return &domain.Device{
+		APIKeyID:   apiKeyID,
+		ID:         id,
+		Name:       name,
+		UserAgent:  r.UserAgent(),
+		AppVersion: r.Header.Get("X-App-Version"),
+		IP:         ip,
+		LastSeen:   time.Now().UTC(),
+	}
+}
+
+// syncedETags returns the etags a device downloaded or uploaded with a sync request.
+func syncedETags(r *http.Request, status int, header http.Header) (download string, upload string) {
+	pattern := chi.RouteContext(r.Context()).RoutePattern()
+
+	switch {
+	case r.Method == http.MethodGet && strings.HasSuffix(pattern, "/content"):
+		if status == http.StatusOK {
+			return header.Get("ETag"), ""
+		}
+		if status == http.StatusNotModified {
+			// the device already has the current sync data
+			return r.Header.Get("If-None-Match"), ""
+		}
+
+	case (r.Method == http.MethodPut || r.Method == http.MethodPatch) && strings.HasSuffix(pattern, "/content"),
+		r.Method == http.MethodPost && strings.HasSuffix(pattern, "/restore"),
+		r.Method == http.MethodPost && strings.HasSuffix(pattern, "/commit"):
+		if status == http.StatusOK {
+			return "", header.Get("ETag")
+		}
+	}
+
+	return "", ""
+}
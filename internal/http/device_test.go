@@ -0,0 +1,161 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/SyncYomi/SyncYomi/internal/domain"
+	"github.com/go-chi/chi/v5"
+)
+
+type mockDeviceService struct {
+	seen    []domain.Device
+	deleted []string
+}
+
+func (m *mockDeviceService) Seen(ctx context.Context, device *domain.Device) error {
+	m.seen = append(m.seen, *device)
+	return nil
+}
+
+func (m *mockDeviceService) List(ctx context.Context, apiKeyID int) ([]domain.Device, error) {
+	return m.seen, nil
+}
+
+func (m *mockDeviceService) Delete(ctx context.Context, apiKeyID int, id string) error {
+	m.deleted = append(m.deleted, strconv.Itoa(apiKeyID)+"/"+id)
+	return nil
+}
+
+func TestDeviceHandler_scopedToUser(t *testing.T) {
+	devices := &mockDeviceService{seen: []domain.Device{
+		{APIKeyID: 1, ID: "phone"},
+		{APIKeyID: 2, ID: "tablet"},
+	}}
+	api := &mockAPIKeyService{keys: []domain.APIKey{
+		{ID: 1, UserID: 1},
+		{ID: 2, UserID: 2},
+	}}
+
+	r := chi.NewRouter()
+	r.With(withUser(1)).Route("/", newDeviceHandler(encoder{}, devices, api).Routes)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if body := rec.Body.String(); !strings.Contains(body, "phone") || strings.Contains(body, "tablet") {
+		t.Errorf("list = %s, want only the devices of the keys of the user", body)
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/2/tablet", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("delete of a device of another user status = %v, want %v", rec.Code, http.StatusNotFound)
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/1/phone", nil))
+	if rec.Code != http.StatusNoContent || len(devices.deleted) != 1 || devices.deleted[0] != "1/phone" {
+		t.Errorf("delete of an own device status = %v, deleted %v", rec.Code, devices.deleted)
+	}
+}
+
+func TestServer_TrackDevice(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		path         string
+		headers      map[string]string
+		body         string
+		mock         *mockSyncService
+		wantID       string
+		wantName     string
+		wantDownload string
+		wantUpload   string
+	}{
+		{
+			name:         "download records the etag",
+			method:       http.MethodGet,
+			path:         "/sync/content",
+			headers:      map[string]string{"X-Device-Id": "id1", "X-Device-Name": "phone"},
+			mock:         &mockSyncService{getData: []byte("data"), getDataETag: strPtr("etag-1")},
+			wantID:       "id1",
+			wantName:     "phone",
+			wantDownload: "etag-1",
+		},
+		{
+			name:         "not modified records the etag the device has",
+			method:       http.MethodGet,
+			path:         "/sync/content",
+			headers:      map[string]string{"X-Device-Id": "id1", "If-None-Match": "etag-1"},
+			mock:         &mockSyncService{getETag: strPtr("etag-1")},
+			wantID:       "id1",
+			wantDownload: "etag-1",
+		},
+		{
+			name:       "upload records the etag, the name is the id without one",
+			method:     http.MethodPut,
+			path:       "/sync/content",
+			headers:    map[string]string{"X-Device-Name": "phone"},
+			body:       "data",
+			mock:       &mockSyncService{setDataEtag: strPtr("etag-2")},
+			wantID:     "phone",
+			wantName:   "phone",
+			wantUpload: "etag-2",
+		},
+		{
+			name:     "event records the device name of the body",
+			method:   http.MethodPost,
+			path:     "/sync/event",
+			body:     `{"event": "sync_success", "device_name": "tablet"}`,
+			mock:     &mockSyncService{},
+			wantID:   "tablet",
+			wantName: "tablet",
+		},
+		{
+			name:   "unidentified device is not recorded",
+			method: http.MethodGet,
+			path:   "/sync/content",
+			mock:   &mockSyncService{getData: []byte("data"), getDataETag: strPtr("etag-1")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			devices := &mockDeviceService{}
+			s := Server{deviceService: devices}
+
+			r := chi.NewRouter()
+			r.With(s.TrackDevice).Route("/sync", newSyncHandler(encoder{}, &domain.Config{}, tt.mock).Routes)
+
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req = withAPIKey(req, 1)
+			req.Header.Set("User-Agent", "Tachiyomi")
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+
+			if tt.wantID == "" {
+				if len(devices.seen) != 0 {
+					t.Errorf("recorded devices = %+v, want none", devices.seen)
+				}
+				return
+			}
+
+			if len(devices.seen) != 1 {
+				t.Fatalf("recorded devices = %+v, want one", devices.seen)
+			}
+			d := devices.seen[0]
+			if d.APIKeyID != 1 || d.ID != tt.wantID || d.Name != tt.wantName || d.UserAgent != "Tachiyomi" {
+				t.Errorf("recorded device = %+v", d)
+			}
+			if d.LastDownloadETag != tt.wantDownload || d.LastUploadETag != tt.wantUpload {
+				t.Errorf("recorded etags = %q, %q, want %q, %q", d.LastDownloadETag, d.LastUploadETag, tt.wantDownload, tt.wantUpload)
+			}
+		})
+	}
+}
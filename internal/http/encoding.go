@@ -0,0 +1,87 @@
+package http
+
+import (
+	"compress/gzip"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/SyncYomi/SyncYomi/pkg/errors"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Content encodings supported for sync transfers, in order of preference.
+const (
+	encodingZstd     = "zstd"
+	encodingGzip     = "gzip"
+	encodingIdentity = "identity"
+)
+
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// negotiateEncoding picks the content encoding for a response from Accept-Encoding,
+// zstd is preferred over gzip when both are accepted equally.
+func negotiateEncoding(acceptEncoding string) string {
+	best, bestQ := encodingIdentity, 0.0
+
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != encodingZstd && name != encodingGzip {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q <= 0 {
+			// q=0 means the encoding is not acceptable
+			continue
+		}
+
+		if q > bestQ || (q == bestQ && name == encodingZstd) {
+			best, bestQ = name, q
+		}
+	}
+
+	return best
+}
+
+// encodeWriter wraps w to compress what is written with the content encoding.
+func encodeWriter(w io.Writer, encoding string) (io.WriteCloser, error) {
+	switch encoding {
+	case encodingZstd:
+		return zstd.NewWriter(w)
+	case encodingGzip:
+		return gzip.NewWriter(w), nil
+	default:
+		return nil, errUnsupportedEncoding
+	}
+}
+
+// decodeReader wraps r to decompress a body with the content encoding,
+// close releases the decoder.
+func decodeReader(r io.Reader, encoding string) (io.Reader, func(), error) {
+	switch strings.ToLower(encoding) {
+	case "", encodingIdentity:
+		return r, func() {}, nil
+	case encodingZstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return d, d.Close, nil
+	case encodingGzip:
+		d, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return d, func() { d.Close() }, nil
+	default:
+		return nil, nil, errUnsupportedEncoding
+	}
+}
@@ -0,0 +1,28 @@
+package http
+
+import (
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		want           string
+	}{
+		{name: "none", acceptEncoding: "", want: "identity"},
+		{name: "gzip", acceptEncoding: "gzip, deflate", want: "gzip"},
+		{name: "zstd preferred", acceptEncoding: "gzip, zstd", want: "zstd"},
+		{name: "quality", acceptEncoding: "zstd;q=0.5, gzip", want: "gzip"},
+		{name: "refused", acceptEncoding: "zstd;q=0, gzip;q=0", want: "identity"},
+		{name: "unsupported", acceptEncoding: "br, deflate", want: "identity"},
+		{name: "case insensitive", acceptEncoding: "GZIP", want: "gzip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := negotiateEncoding(tt.acceptEncoding); got != tt.want {
+				t.Errorf("negotiateEncoding(%q) = %q, want %q", tt.acceptEncoding, got, tt.want)
+			}
+		})
+	}
+}
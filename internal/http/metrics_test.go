@@ -0,0 +1,80 @@
+package http
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/SyncYomi/SyncYomi/internal/config"
+	"github.com/SyncYomi/SyncYomi/internal/domain"
+	"github.com/SyncYomi/SyncYomi/internal/metrics"
+)
+
+func TestServer_MetricsAuth(t *testing.T) {
+	tests := []struct {
+		name       string
+		apiKey     string
+		header     string
+		value      string
+		query      string
+		wantStatus int
+	}{
+		{name: "open without a key in the config", wantStatus: http.StatusOK},
+		{name: "bearer token", apiKey: "secret", header: "Authorization", value: "Bearer secret", wantStatus: http.StatusOK},
+		{name: "api token header", apiKey: "secret", header: "X-API-Token", value: "secret", wantStatus: http.StatusOK},
+		{name: "query param", apiKey: "secret", query: "?apikey=secret", wantStatus: http.StatusOK},
+		{name: "wrong token", apiKey: "secret", header: "Authorization", value: "Bearer nope", wantStatus: http.StatusUnauthorized},
+		{name: "missing token", apiKey: "secret", wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := Server{config: &config.AppConfig{Config: &domain.Config{MetricsAPIKey: tt.apiKey}}}
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/metrics"+tt.query, nil)
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+
+			rec := httptest.NewRecorder()
+			s.MetricsAuth(next).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("MetricsAuth() status = %v, want %v", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestServer_SyncMetrics(t *testing.T) {
+	m := metrics.New()
+	s := Server{apiService: &mockAPIKeyService{}, metrics: m}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusPreconditionFailed)
+		_, _ = w.Write([]byte("conflict"))
+	})
+
+	req := httptest.NewRequest(http.MethodPut, "/api/sync/content", strings.NewReader("data"))
+	s.SyncMetrics(next).ServeHTTP(httptest.NewRecorder(), req)
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	for _, want := range []string{
+		`syncyomi_sync_requests_total{method="PUT",status="412"} 1`,
+		`syncyomi_sync_bytes_total{direction="in",key="unknown"} 4`,
+		`syncyomi_sync_bytes_total{direction="out",key="unknown"} 8`,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("metrics do not contain %q", want)
+		}
+	}
+}
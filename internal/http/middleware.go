@@ -1,29 +1,44 @@
 package http
 
 import (
+	"context"
+	"crypto/subtle"
+	"github.com/SyncYomi/SyncYomi/internal/domain"
+	"github.com/SyncYomi/SyncYomi/internal/metrics"
+	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/rs/zerolog"
+	"io"
 	"net/http"
 	"runtime/debug"
+	"slices"
 	"strings"
 	"time"
 )
 
 func (s Server) IsAuthenticated(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var actor string
+		var userID int
+		var apiKey *domain.APIKey
+
 		if token := r.Header.Get("X-API-Token"); token != "" {
 			// check header
-			if !s.apiService.ValidateAPIKey(r.Context(), token) {
+			if !s.apiService.ValidateAPIKey(r.Context(), token, ReadUserIP(r)) {
 				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 				return
 			}
+			actor = apiKeyActor(token)
+			apiKey = s.validatedAPIKey(r.Context(), token)
 
 		} else if key := r.URL.Query().Get("apikey"); key != "" {
 			// check query param lke ?apikey=TOKEN
-			if !s.apiService.ValidateAPIKey(r.Context(), key) {
+			if !s.apiService.ValidateAPIKey(r.Context(), key, ReadUserIP(r)) {
 				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 				return
 			}
+			actor = apiKeyActor(key)
+			apiKey = s.validatedAPIKey(r.Context(), key)
 		} else {
 			// check session
 			session, _ := s.cookieStore.Get(r, "user_session")
@@ -33,13 +48,259 @@ func (s Server) IsAuthenticated(next http.Handler) http.Handler {
 				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 				return
 			}
+
+			// sessions from before users owned their keys have to log in again
+			id, ok := session.Values["user_id"].(int)
+			if !ok {
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			userID = id
+			actor, _ = session.Values["username"].(string)
+		}
+
+		if apiKey != nil {
+			userID = apiKey.UserID
+		}
+
+		ctx := context.WithValue(r.Context(), actorContextKey{}, actor)
+		ctx = context.WithValue(ctx, userIDContextKey{}, userID)
+		ctx = context.WithValue(ctx, apiKeyContextKey{}, apiKey)
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// validatedAPIKey looks up a key that passed ValidateAPIKey. A key that cannot be
+// read has no scopes and no sync data, so it is never mistaken for a session.
+func (s Server) validatedAPIKey(ctx context.Context, key string) *domain.APIKey {
+	apiKey, err := s.apiService.Get(ctx, key)
+	if err != nil || apiKey == nil {
+		return &domain.APIKey{}
+	}
+	return apiKey
+}
+
+type apiKeyContextKey struct{}
+
+// requestAPIKey returns the api key of an authenticated request, set by IsAuthenticated.
+// It is nil for requests of a session.
+func requestAPIKey(ctx context.Context) *domain.APIKey {
+	key, _ := ctx.Value(apiKeyContextKey{}).(*domain.APIKey)
+	return key
+}
+
+// requestAPIKeyID returns the id of the api key of a request, which addresses its sync data.
+// A rotated key in its grace period has the id of the key it was replaced by.
+// It is 0 for requests of a session.
+func requestAPIKeyID(ctx context.Context) int {
+	if key := requestAPIKey(ctx); key != nil {
+		return key.ID
+	}
+	return 0
+}
+
+// RequireScope only lets through api keys with the scope, sessions are limited by roles instead.
+func (s Server) RequireScope(scope string) func(next http.Handler) http.Handler {
+	return s.requireScope(func(r *http.Request) string { return scope })
+}
+
+// RequireSyncScope lets through api keys with the scope the sync request needs:
+// sync:events for sync events, sync:read to read and sync:write for everything else.
+// Sessions are rejected, the sync data, uploads and leases belong to an api key.
+func (s Server) RequireSyncScope(next http.Handler) http.Handler {
+	next = s.requireScope(syncScope)(next)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requestAPIKey(r.Context()) == nil {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
 		}
 
 		next.ServeHTTP(w, r)
 	})
 }
 
-func LoggerMiddleware(logger *zerolog.Logger) func(next http.Handler) http.Handler {
+func syncScope(r *http.Request) string {
+	if strings.HasSuffix(r.URL.Path, "/sync/event") || strings.HasSuffix(r.URL.Path, "/sync/events") {
+		return domain.ScopeSyncEvents
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return domain.ScopeSyncRead
+	}
+	return domain.ScopeSyncWrite
+}
+
+func (s Server) requireScope(scope func(r *http.Request) string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if key := requestAPIKey(r.Context()); key != nil && !key.HasScope(scope(r)) {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireSession only lets through users logged in to the web interface,
+// API keys are for syncing devices and cannot use the admin endpoints.
+func (s Server) RequireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, _ := s.cookieStore.Get(r, "user_session")
+
+		if auth, ok := session.Values["authenticated"].(bool); !ok || !auth {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireRole only lets through users with one of the roles,
+// api keys act with the role of the user owning them.
+func (s Server) RequireRole(roles ...domain.Role) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, err := s.userService.FindByID(r.Context(), requestUserID(r.Context()))
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+
+			if user == nil || !slices.Contains(roles, user.Role) {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// DenyReadOnly rejects requests that change something from read-only users.
+func (s Server) DenyReadOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, err := s.userService.FindByID(r.Context(), requestUserID(r.Context()))
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if user != nil && user.Role == domain.RoleReadOnly {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// TrackDevice records the device making a sync request in the device registry,
+// with the etags it downloaded or uploaded.
+func (s Server) TrackDevice(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		device := deviceFromRequest(r)
+		if device == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), deviceContextKey{}, device))
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		if device.ID == "" {
+			return
+		}
+
+		device.LastDownloadETag, device.LastUploadETag = syncedETags(r, ww.Status(), ww.Header())
+
+		// the device may be gone already, it was still seen
+		if err := s.deviceService.Seen(context.WithoutCancel(r.Context()), device); err != nil {
+			s.log.Error().Err(err).Msg("could not record device")
+		}
+	})
+}
+
+// MetricsAuth requires the metricsApiKey of the config when it is set.
+func (s Server) MetricsAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		want := s.config.Config.MetricsAPIKey
+		if want == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" {
+			token = r.Header.Get("X-API-Token")
+		}
+		if token == "" {
+			token = r.URL.Query().Get("apikey")
+		}
+
+		if subtle.ConstantTimeCompare([]byte(token), []byte(want)) != 1 {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// SyncMetrics counts sync requests and the bytes they move per api key,
+// it does nothing when metrics are disabled.
+func (s Server) SyncMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.metrics == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		if strings.HasSuffix(r.URL.Path, "/sync/content") {
+			s.metrics.ObserveSync(r.Method, ww.Status())
+		}
+
+		keyName := "unknown"
+		if key := requestAPIKey(r.Context()); key != nil && key.Name != "" {
+			keyName = key.Name
+		}
+
+		s.metrics.AddSyncBytes(keyName, body.n, int64(ww.BytesWritten()))
+	})
+}
+
+func LoggerMiddleware(logger *zerolog.Logger, metrics *metrics.Metrics) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
 			log := logger.With().Logger()
@@ -61,6 +322,12 @@ func LoggerMiddleware(logger *zerolog.Logger) func(next http.Handler) http.Handl
 					http.Error(ww, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 				}
 
+				route := "unmatched"
+				if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+					route = rctx.RoutePattern()
+				}
+				metrics.ObserveRequest(route, r.Method, ww.Status(), t2.Sub(t1))
+
 				if !strings.Contains("/api/healthz/liveness|/api/healthz/readiness", r.URL.Path) {
 					// log end request
 					log.Trace().
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/SyncYomi/SyncYomi/internal/domain"
 )
@@ -14,23 +15,86 @@ type mockAPIKeyService struct {
 	// calls records every token ValidateAPIKey was asked about, so tests can
 	// assert which branch ran rather than only what it returned.
 	calls []string
+	// keys are the stored keys of all users
+	keys    []domain.APIKey
+	deleted []int
+	// grace is the grace period of the last Rotate
+	grace time.Duration
 }
 
 func (m *mockAPIKeyService) Get(ctx context.Context, key string) (*domain.APIKey, error) {
+	for _, k := range m.keys {
+		if k.Key == key {
+			return &k, nil
+		}
+	}
 	return nil, nil
 }
-func (m *mockAPIKeyService) List(ctx context.Context) ([]domain.APIKey, error)  { return nil, nil }
-func (m *mockAPIKeyService) Store(ctx context.Context, key *domain.APIKey) error { return nil }
+func (m *mockAPIKeyService) FindByID(ctx context.Context, id int) (*domain.APIKey, error) {
+	for _, k := range m.keys {
+		if k.ID == id {
+			return &k, nil
+		}
+	}
+	return nil, domain.ErrAPIKeyNotFound
+}
+func (m *mockAPIKeyService) List(ctx context.Context) ([]domain.APIKey, error) { return m.keys, nil }
+func (m *mockAPIKeyService) ListByUser(ctx context.Context, userID int) ([]domain.APIKey, error) {
+	var keys []domain.APIKey
+	for _, k := range m.keys {
+		if k.UserID == userID {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+func (m *mockAPIKeyService) Store(ctx context.Context, key *domain.APIKey) error {
+	key.ID = len(m.keys) + 1
+	key.Key = "generated"
+	key.Prefix = "generate"
+
+	// only the response has the key
+	stored := *key
+	stored.Key = ""
+	m.keys = append(m.keys, stored)
+	return nil
+}
 func (m *mockAPIKeyService) Update(ctx context.Context, key *domain.APIKey) error {
 	return nil
 }
-func (m *mockAPIKeyService) Delete(ctx context.Context, key string) error { return nil }
+func (m *mockAPIKeyService) Delete(ctx context.Context, id int) error {
+	m.deleted = append(m.deleted, id)
+	return nil
+}
+func (m *mockAPIKeyService) Usage(ctx context.Context) ([]domain.APIKeyUsage, error) {
+	usage := make([]domain.APIKeyUsage, 0, len(m.keys))
+	for _, k := range m.keys {
+		usage = append(usage, domain.APIKeyUsage{ID: k.ID, Name: k.Name, Prefix: k.Prefix})
+	}
+	return usage, nil
+}
+
+func (m *mockAPIKeyService) Rotate(ctx context.Context, id int, grace time.Duration) (*domain.APIKey, error) {
+	for _, k := range m.keys {
+		if k.ID == id {
+			m.grace = grace
+			k.Key = "rotated-" + k.Prefix
+			return &k, nil
+		}
+	}
+	return nil, domain.ErrAPIKeyNotFound
+}
 
-func (m *mockAPIKeyService) ValidateAPIKey(ctx context.Context, token string) bool {
+func (m *mockAPIKeyService) ValidateAPIKey(ctx context.Context, token string, ip string) bool {
 	m.calls = append(m.calls, token)
 	return token == m.validKey
 }
 
+// withAPIKey makes a request come from the api key with id, like IsAuthenticated does.
+func withAPIKey(r *http.Request, id int) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, &domain.APIKey{ID: id, Scopes: domain.DefaultScopes}))
+}
+
 func TestServer_IsAuthenticated(t *testing.T) {
 	const validKey = "valid-key"
 
@@ -38,7 +102,7 @@ func TestServer_IsAuthenticated(t *testing.T) {
 		name       string
 		header     string
 		query      string
-		session    string // "", "authed", "unauthed"
+		session    string // "", "authed", "unauthed", "stale"
 		wantStatus int
 		wantCalls  []string
 	}{
@@ -83,6 +147,13 @@ func TestServer_IsAuthenticated(t *testing.T) {
 			wantStatus: http.StatusUnauthorized,
 			wantCalls:  nil,
 		},
+		{
+			// sessions from before users owned their keys
+			name:       "session without user id is rejected",
+			session:    "stale",
+			wantStatus: http.StatusUnauthorized,
+			wantCalls:  nil,
+		},
 		{
 			// An invalid header must 401 outright, not quietly fall through to
 			// the session branch and let a cookie rescue it.
@@ -124,7 +195,10 @@ func TestServer_IsAuthenticated(t *testing.T) {
 			}
 			if tt.session != "" {
 				sess, _ := s.cookieStore.Get(req, "user_session")
-				sess.Values["authenticated"] = tt.session == "authed"
+				sess.Values["authenticated"] = tt.session != "unauthed"
+				if tt.session == "authed" {
+					sess.Values["user_id"] = 1
+				}
 				w := httptest.NewRecorder()
 				if err := sess.Save(req, w); err != nil {
 					t.Fatalf("saving session: %v", err)
@@ -147,3 +221,180 @@ func TestServer_IsAuthenticated(t *testing.T) {
 		})
 	}
 }
+
+func TestServer_RequireSession(t *testing.T) {
+	tests := []struct {
+		name       string
+		header     string
+		session    string // "", "authed", "unauthed"
+		wantStatus int
+	}{
+		{name: "authenticated session passes", session: "authed", wantStatus: http.StatusOK},
+		{name: "logged out session is rejected", session: "unauthed", wantStatus: http.StatusForbidden},
+		{name: "api token is rejected", header: "valid-key", wantStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &domain.Config{BaseURL: "/", SessionSecret: "test-secret"}
+			s := Server{cookieStore: newCookieStore(cfg)}
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				req.Header.Set("X-API-Token", tt.header)
+			}
+			if tt.session != "" {
+				sess, _ := s.cookieStore.Get(req, "user_session")
+				sess.Values["authenticated"] = tt.session == "authed"
+				w := httptest.NewRecorder()
+				if err := sess.Save(req, w); err != nil {
+					t.Fatalf("saving session: %v", err)
+				}
+				req.Header.Set("Cookie", w.Header().Get("Set-Cookie"))
+			}
+
+			rec := httptest.NewRecorder()
+			s.RequireSession(next).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("RequireSession() status = %v, want %v", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestServer_RequireRole(t *testing.T) {
+	users := &mockUserService{users: []domain.User{
+		{ID: 1, Username: "admin", Role: domain.RoleAdmin},
+		{ID: 2, Username: "member", Role: domain.RoleMember},
+		{ID: 3, Username: "viewer", Role: domain.RoleReadOnly},
+	}}
+	s := Server{userService: users}
+
+	tests := []struct {
+		name         string
+		userID       int
+		method       string
+		wantAdmin    int
+		wantReadOnly int
+	}{
+		{name: "admin changes", userID: 1, method: http.MethodPost, wantAdmin: http.StatusOK, wantReadOnly: http.StatusOK},
+		{name: "member changes", userID: 2, method: http.MethodPost, wantAdmin: http.StatusForbidden, wantReadOnly: http.StatusOK},
+		{name: "read-only looks", userID: 3, method: http.MethodGet, wantAdmin: http.StatusForbidden, wantReadOnly: http.StatusOK},
+		{name: "read-only changes", userID: 3, method: http.MethodDelete, wantAdmin: http.StatusForbidden, wantReadOnly: http.StatusForbidden},
+		{name: "unknown user", userID: 4, method: http.MethodPost, wantAdmin: http.StatusForbidden, wantReadOnly: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+
+			for _, check := range []struct {
+				name       string
+				handler    http.Handler
+				wantStatus int
+			}{
+				{"RequireRole(admin)", s.RequireRole(domain.RoleAdmin)(next), tt.wantAdmin},
+				{"DenyReadOnly", s.DenyReadOnly(next), tt.wantReadOnly},
+			} {
+				rec := httptest.NewRecorder()
+				withUser(tt.userID)(check.handler).ServeHTTP(rec, httptest.NewRequest(tt.method, "/", nil))
+
+				if rec.Code != check.wantStatus {
+					t.Errorf("%v status = %v, want %v", check.name, rec.Code, check.wantStatus)
+				}
+			}
+		})
+	}
+}
+
+func TestServer_RequireScope(t *testing.T) {
+	syncKey := &domain.APIKey{Key: "phone", Scopes: domain.DefaultScopes}
+	readKey := &domain.APIKey{Key: "reader", Scopes: []string{domain.ScopeSyncRead}}
+	adminKey := &domain.APIKey{Key: "script", Scopes: []string{domain.ScopeAdmin}}
+
+	tests := []struct {
+		name       string
+		key        *domain.APIKey
+		method     string
+		target     string
+		sync       bool
+		wantStatus int
+	}{
+		{name: "session calls the web API", method: http.MethodGet, target: "/api/config", wantStatus: http.StatusOK},
+		{name: "sync key calls the web API", key: syncKey, method: http.MethodGet, target: "/api/config", wantStatus: http.StatusForbidden},
+		{name: "admin key calls the web API", key: adminKey, method: http.MethodGet, target: "/api/config", wantStatus: http.StatusOK},
+		{name: "sync key downloads", key: syncKey, method: http.MethodGet, target: "/api/sync/content", sync: true, wantStatus: http.StatusOK},
+		{name: "sync key uploads", key: syncKey, method: http.MethodPut, target: "/api/sync/content", sync: true, wantStatus: http.StatusOK},
+		{name: "read key downloads", key: readKey, method: http.MethodGet, target: "/api/sync/content", sync: true, wantStatus: http.StatusOK},
+		{name: "read key uploads", key: readKey, method: http.MethodPut, target: "/api/sync/content", sync: true, wantStatus: http.StatusForbidden},
+		{name: "read key takes the lease", key: readKey, method: http.MethodPost, target: "/api/sync/lock", sync: true, wantStatus: http.StatusForbidden},
+		{name: "read key lists events", key: readKey, method: http.MethodGet, target: "/api/sync/events", sync: true, wantStatus: http.StatusForbidden},
+		{name: "sync key reports events", key: syncKey, method: http.MethodPost, target: "/api/sync/event", sync: true, wantStatus: http.StatusOK},
+		{name: "admin key syncs", key: adminKey, method: http.MethodGet, target: "/api/sync/content", sync: true, wantStatus: http.StatusForbidden},
+		{name: "session syncs", method: http.MethodPut, target: "/api/sync/content", sync: true, wantStatus: http.StatusForbidden},
+		{name: "session downloads", method: http.MethodGet, target: "/api/sync/content", sync: true, wantStatus: http.StatusForbidden},
+		{name: "session takes the lease", method: http.MethodPost, target: "/api/sync/lock", sync: true, wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s Server
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+
+			handler := s.RequireScope(domain.ScopeAdmin)(next)
+			if tt.sync {
+				handler = s.RequireSyncScope(next)
+			}
+
+			req := httptest.NewRequest(tt.method, tt.target, nil)
+			req = req.WithContext(context.WithValue(req.Context(), apiKeyContextKey{}, tt.key))
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %v, want %v", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestServer_IsAuthenticatedAPIKey(t *testing.T) {
+	api := &mockAPIKeyService{validKey: "phone", keys: []domain.APIKey{
+		{ID: 3, Key: "phone", UserID: 2, Scopes: domain.DefaultScopes},
+	}}
+	s := Server{apiService: api}
+
+	var key *domain.APIKey
+	var userID int
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key = requestAPIKey(r.Context())
+		userID = requestUserID(r.Context())
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-API-Token", "phone")
+	s.IsAuthenticated(next).ServeHTTP(httptest.NewRecorder(), req)
+
+	if key == nil || !key.HasScope(domain.ScopeSyncRead) || userID != 2 || key.ID != 3 {
+		t.Errorf("request key = %+v of user %v, want the key of user 2", key, userID)
+	}
+
+	// a valid key that cannot be read has no scopes, it is not a session
+	api.validKey = "gone"
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-API-Token", "gone")
+	s.IsAuthenticated(next).ServeHTTP(httptest.NewRecorder(), req)
+
+	if key == nil || len(key.Scopes) != 0 || key.ID != 0 {
+		t.Errorf("request key = %+v, want a key without scopes or sync data", key)
+	}
+}
@@ -21,12 +21,14 @@ type notificationService interface {
 type notificationHandler struct {
 	encoder encoder
 	service notificationService
+	audit   auditService
 }
 
-func newNotificationHandler(encoder encoder, service notificationService) *notificationHandler {
+func newNotificationHandler(encoder encoder, service notificationService, audit auditService) *notificationHandler {
 	return &notificationHandler{
 		encoder: encoder,
 		service: service,
+		audit:   audit,
 	}
 }
 
@@ -67,6 +69,8 @@ func (h notificationHandler) store(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	h.audit.Record(ctx, newAuditEntry(r, domain.AuditActionNotificationCreate, data.Name))
+
 	h.encoder.StatusResponse(ctx, w, filter, http.StatusCreated)
 }
 
@@ -87,6 +91,8 @@ func (h notificationHandler) update(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	h.audit.Record(ctx, newAuditEntry(r, domain.AuditActionNotificationUpdate, data.Name))
+
 	h.encoder.StatusResponse(ctx, w, filter, http.StatusOK)
 }
 
@@ -98,8 +104,16 @@ func (h notificationHandler) delete(w http.ResponseWriter, r *http.Request) {
 
 	id, _ := strconv.Atoi(notificationID)
 
+	// the name of the notification for the audit log, it is gone afterwards
+	target := notificationID
+	if n, err := h.service.FindByID(ctx, id); err == nil && n != nil {
+		target = n.Name
+	}
+
 	if err := h.service.Delete(ctx, id); err != nil {
 		// return err
+	} else {
+		h.audit.Record(ctx, newAuditEntry(r, domain.AuditActionNotificationDelete, target))
 	}
 
 	h.encoder.StatusResponse(ctx, w, nil, http.StatusNoContent)
@@ -6,6 +6,7 @@ import (
 	"github.com/SyncYomi/SyncYomi/internal/database"
 	"github.com/SyncYomi/SyncYomi/internal/domain"
 	"github.com/SyncYomi/SyncYomi/internal/logger"
+	"github.com/SyncYomi/SyncYomi/internal/metrics"
 	"github.com/SyncYomi/SyncYomi/web"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -15,12 +16,14 @@ import (
 	"github.com/rs/zerolog"
 	"net"
 	"net/http"
+	"time"
 )
 
 type Server struct {
-	log zerolog.Logger
-	sse *sse.Server
-	db  *database.DB
+	log     zerolog.Logger
+	sse     *sse.Server
+	db      *database.DB
+	metrics *metrics.Metrics
 
 	config      *config.AppConfig
 	cookieStore *sessions.CookieStore
@@ -30,9 +33,12 @@ type Server struct {
 	date    string
 
 	apiService          apikeyService
+	auditService        auditService
 	authService         authService
+	deviceService       deviceService
 	notificationService notificationService
 	updateService       updateService
+	userService         userService
 
 	syncService syncService
 }
@@ -55,13 +61,17 @@ func NewServer(
 	config *config.AppConfig,
 	sse *sse.Server,
 	db *database.DB,
+	metrics *metrics.Metrics,
 	version string,
 	commit string,
 	date string,
 	apiService apikeyService,
+	auditSvc auditService,
 	authService authService,
+	deviceSvc deviceService,
 	notificationSvc notificationService,
 	updateSvc updateService,
+	userSvc userService,
 	syncService syncService,
 ) Server {
 	return Server{
@@ -69,6 +79,7 @@ func NewServer(
 		config:  config,
 		sse:     sse,
 		db:      db,
+		metrics: metrics,
 		version: version,
 		commit:  commit,
 		date:    date,
@@ -76,9 +87,12 @@ func NewServer(
 		cookieStore: newCookieStore(config.Config),
 
 		apiService:          apiService,
+		auditService:        auditSvc,
 		authService:         authService,
+		deviceService:       deviceSvc,
 		notificationService: notificationSvc,
 		updateService:       updateSvc,
+		userService:         userSvc,
 		syncService:         syncService,
 	}
 }
@@ -91,7 +105,10 @@ func (s Server) Open() error {
 	}
 
 	server := http.Server{
-		Handler: s.Handler(),
+		Handler:      s.Handler(),
+		ReadTimeout:  time.Duration(s.config.Config.ReadTimeout) * time.Second,
+		WriteTimeout: time.Duration(s.config.Config.WriteTimeout) * time.Second,
+		IdleTimeout:  time.Duration(s.config.Config.IdleTimeout) * time.Second,
 	}
 
 	s.log.Info().Msgf("Starting server. Listening on %s", listener.Addr().String())
@@ -105,7 +122,7 @@ func (s Server) Handler() http.Handler {
 	r.Use(middleware.RequestID)
 	r.Use(middleware.RealIP)
 	r.Use(middleware.Recoverer)
-	r.Use(LoggerMiddleware(&s.log))
+	r.Use(LoggerMiddleware(&s.log, s.metrics))
 
 	c := cors.New(cors.Options{
 		AllowCredentials:   true,
@@ -120,31 +137,53 @@ func (s Server) Handler() http.Handler {
 
 	encoder := encoder{}
 
+	if s.metrics != nil {
+		r.With(s.MetricsAuth).Handle("/metrics", s.metrics.Handler())
+	}
+
 	r.Route("/api", func(r chi.Router) {
-		r.Route("/auth", newAuthHandler(encoder, s.log, s.config.Config, s.cookieStore, s.authService).Routes)
+		r.Route("/auth", newAuthHandler(encoder, s.log, s.config.Config, s.cookieStore, s.authService, s.auditService).Routes)
 		r.Route("/healthz", newHealthHandler(encoder, s.db).Routes)
 
 		r.Group(func(r chi.Router) {
 			r.Use(s.IsAuthenticated)
-
-			r.Route("/config", newConfigHandler(encoder, s, s.config).Routes)
-			r.Route("/keys", newAPIKeyHandler(encoder, s.apiService).Routes)
-			r.Route("/logs", newLogsHandler(s.config).Routes)
-			r.Route("/notification", newNotificationHandler(encoder, s.notificationService).Routes)
-			r.Route("/updates", newUpdateHandler(encoder, s.updateService).Routes)
-			r.Route("/sync", newSyncHandler(encoder, s.syncService).Routes)
-
-			r.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
-
-				// inject CORS headers to bypass checks
-				s.sse.Headers = map[string]string{
-					"Content-Type":      "text/event-stream",
-					"Cache-Control":     "no-cache",
-					"Connection":        "keep-alive",
-					"X-Accel-Buffering": "no",
-				}
-
-				s.sse.ServeHTTP(w, r)
+			r.Use(s.DenyReadOnly)
+
+			r.With(s.RequireSyncScope, s.TrackDevice, s.SyncMetrics).Route("/sync", newSyncHandler(encoder, s.config.Config, s.syncService).Routes)
+
+			// the API of the web interface, api keys need the admin scope
+			r.Group(func(r chi.Router) {
+				r.Use(s.RequireScope(domain.ScopeAdmin))
+
+				admin := s.RequireRole(domain.RoleAdmin)
+
+				r.With(s.RequireSession, admin).Route("/admin", newAdminHandler(encoder, s.log, s.db, s.config.Config, s.version).Routes)
+				r.With(s.RequireSession, admin).Route("/audit", newAuditHandler(encoder, s.auditService).Routes)
+				r.With(admin).Route("/config", newConfigHandler(encoder, s, s.config).Routes)
+				r.Route("/devices", newDeviceHandler(encoder, s.deviceService, s.apiService).Routes)
+				r.Route("/keys", newAPIKeyHandler(encoder, s.apiService, s.userService, s.auditService).Routes)
+				r.With(admin).Route("/logs", newLogsHandler(s.config).Routes)
+				r.With(admin).Route("/notification", newNotificationHandler(encoder, s.notificationService, s.auditService).Routes)
+				r.Route("/updates", newUpdateHandler(encoder, s.updateService).Routes)
+				r.With(s.RequireSession, admin).Route("/users", newUserHandler(encoder, s.userService, s.authService, s.auditService).Routes)
+
+				r.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+
+					// inject CORS headers to bypass checks
+					s.sse.Headers = map[string]string{
+						"Content-Type":      "text/event-stream",
+						"Cache-Control":     "no-cache",
+						"Connection":        "keep-alive",
+						"X-Accel-Buffering": "no",
+					}
+
+					// the stream stays open, so the server write timeout must not apply
+					if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+						s.log.Debug().Err(err).Msg("could not clear write deadline for events")
+					}
+
+					s.sse.ServeHTTP(w, r)
+				})
 			})
 		})
 	})
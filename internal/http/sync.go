@@ -1,13 +1,21 @@
 package http
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/SyncYomi/SyncYomi/internal/domain"
 	"github.com/SyncYomi/SyncYomi/internal/sync"
+	"github.com/SyncYomi/SyncYomi/pkg/bspatch"
 	"github.com/go-chi/chi/v5"
 )
 
@@ -15,12 +23,14 @@ type syncService = sync.Service
 
 type syncHandler struct {
 	encoder     encoder
+	config      *domain.Config
 	syncService syncService
 }
 
-func newSyncHandler(encoder encoder, syncService syncService) *syncHandler {
+func newSyncHandler(encoder encoder, config *domain.Config, syncService syncService) *syncHandler {
 	return &syncHandler{
 		encoder:     encoder,
+		config:      config,
 		syncService: syncService,
 	}
 }
@@ -34,16 +44,30 @@ type syncEventRequest struct {
 
 func (h syncHandler) Routes(r chi.Router) {
 	r.Get("/content", h.getContent)
+	r.Get("/watch", h.watch)
 	r.Put("/content", h.putContent)
+	r.Patch("/content", h.patchContent)
 	r.Post("/event", h.reportEvent)
+	r.Get("/events", h.listEvents)
+	r.Get("/history", h.listHistory)
+	r.Get("/history/{etag}", h.getHistory)
+	r.Post("/history/{etag}/restore", h.restoreHistory)
+	r.Post("/uploads", h.createUpload)
+	r.Get("/uploads/{id}", h.getUpload)
+	r.Put("/uploads/{id}/{offset}", h.putUploadChunk)
+	r.Post("/uploads/{id}/commit", h.commitUpload)
+	r.Get("/lock", h.getLock)
+	r.Post("/lock", h.acquireLock)
+	r.Put("/lock", h.extendLock)
+	r.Delete("/lock", h.releaseLock)
 }
 
 func (h syncHandler) getContent(w http.ResponseWriter, r *http.Request) {
-	apiKey := r.Header.Get("X-API-Token")
+	apiKeyID := requestAPIKeyID(r.Context())
 	etag := r.Header.Get("If-None-Match")
 
 	if etag != "" {
-		etagInDb, err := h.syncService.GetSyncDataETag(r.Context(), apiKey)
+		etagInDb, err := h.syncService.GetSyncDataETag(r.Context(), apiKeyID)
 		if err != nil {
 			log.Println(err)
 			h.encoder.StatusInternalError(w)
@@ -53,51 +77,203 @@ func (h syncHandler) getContent(w http.ResponseWriter, r *http.Request) {
 		if etagInDb != nil && etag == *etagInDb {
 			// nothing changed after last request
 			// see: https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/If-None-Match
+			w.Header().Add("Vary", "Accept-Encoding")
 			w.WriteHeader(http.StatusNotModified)
 			return
 		}
 	}
 
-	syncData, syncDataETag, err := h.syncService.GetSyncDataAndETag(r.Context(), apiKey)
+	written := false
+	found, err := h.syncService.WriteSyncDataTo(r.Context(), apiKeyID, func(etag string, size int64, data io.Reader) error {
+		w.Header().Set("Accept-Patch", bspatch.ContentType)
+
+		written = true
+		return writeSyncData(w, r, etag, size, data)
+	})
 
 	if err != nil {
+		if written {
+			// the status is already sent, the client sees a short response
+			log.Println(err)
+			return
+		}
 		h.encoder.StatusInternalError(w)
 		return
 	}
 
-	if syncData == nil {
+	if !found {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
+}
 
-	if syncDataETag != nil {
-		w.Header().Set("ETag", *syncDataETag)
+// readPayload reads the request body up to the max sync payload size,
+// decoding it according to Content-Encoding, and responds with 413 if it is larger.
+// Unlike downloads, uploads are buffered in memory, as the etag, quotas and merges
+// need the whole data; the limit bounds the memory a single upload can take.
+func (h syncHandler) readPayload(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	limit := h.config.MaxSyncPayloadBytes()
+	if limit > 0 {
+		if r.ContentLength > limit {
+			h.payloadTooLarge(w, r)
+			return nil, false
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+	}
+
+	encoding := r.Header.Get("Content-Encoding")
+	body, closeBody, err := decodeReader(r.Body, encoding)
+	if err != nil {
+		if errors.Is(err, errUnsupportedEncoding) {
+			h.encoder.StatusResponse(r.Context(), w, map[string]string{"message": "unsupported content encoding"}, http.StatusUnsupportedMediaType)
+			return nil, false
+		}
+		h.encoder.StatusResponse(r.Context(), w, err.Error(), http.StatusBadRequest)
+		return nil, false
 	}
+	defer closeBody()
 
+	var buf bytes.Buffer
+	if body == r.Body {
+		if r.ContentLength > 0 {
+			buf.Grow(int(r.ContentLength))
+		}
+	} else if limit > 0 {
+		// the decoded data is limited too, a small upload may decompress to a lot
+		body = io.LimitReader(body, limit+1)
+	}
+
+	if _, err := buf.ReadFrom(body); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			h.payloadTooLarge(w, r)
+			return nil, false
+		}
+		h.encoder.StatusResponse(r.Context(), w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	if limit > 0 && int64(buf.Len()) > limit {
+		h.payloadTooLarge(w, r)
+		return nil, false
+	}
+
+	return buf.Bytes(), true
+}
+
+// writeSyncData streams size bytes of sync data compressed according to Accept-Encoding.
+// The etag is the same for every encoding, as it identifies the data itself.
+func writeSyncData(w http.ResponseWriter, r *http.Request, etag string, size int64, data io.Reader) error {
+	encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+
+	w.Header().Add("Vary", "Accept-Encoding")
+	w.Header().Set("ETag", etag)
 	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Write(syncData)
+
+	if encoding == encodingIdentity {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		w.WriteHeader(http.StatusOK)
+		_, err := io.Copy(w, data)
+		return err
+	}
+
+	ew, err := encodeWriter(w, encoding)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Encoding", encoding)
 	w.WriteHeader(http.StatusOK)
+
+	if _, err := io.Copy(ew, data); err != nil {
+		return err
+	}
+	return ew.Close()
+}
+
+func (h syncHandler) payloadTooLarge(w http.ResponseWriter, r *http.Request) {
+	h.encoder.StatusResponse(r.Context(), w, map[string]string{
+		"message": fmt.Sprintf("sync data exceeds the max size of %d MB", h.config.MaxSyncPayloadSize),
+	}, http.StatusRequestEntityTooLarge)
+}
+
+// quotaExceeded writes the response for the quota errors of the sync service,
+// and reports whether err was one of them.
+func (h syncHandler) quotaExceeded(w http.ResponseWriter, r *http.Request, err error) bool {
+	switch {
+	case errors.Is(err, sync.ErrQuotaExceeded):
+		h.encoder.StatusResponse(r.Context(), w, map[string]string{
+			"message": "sync data exceeds the storage quota of the API key",
+		}, http.StatusRequestEntityTooLarge)
+		return true
+
+	case errors.Is(err, sync.ErrUploadQuotaExceeded):
+		// the quota resets at midnight UTC
+		now := time.Now().UTC()
+		reset := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+		w.Header().Set("Retry-After", strconv.Itoa(int(reset.Sub(now).Seconds())+1))
+		h.encoder.StatusResponse(r.Context(), w, map[string]string{
+			"message": "daily upload quota of the API key exceeded",
+		}, http.StatusTooManyRequests)
+		return true
+
+	default:
+		return false
+	}
+}
+
+// leaseHeld responds with 423 when another device holds the sync lease and leases are enforced,
+// and reports whether it did.
+func (h syncHandler) leaseHeld(w http.ResponseWriter, r *http.Request, apiKeyID int) bool {
+	lease, err := h.syncService.CheckLease(r.Context(), apiKeyID, r.Header.Get("X-Device-Id"))
+	if err != nil {
+		if errors.Is(err, sync.ErrLeaseHeld) {
+			h.encoder.StatusResponse(r.Context(), w, lease, http.StatusLocked)
+			return true
+		}
+		h.encoder.StatusInternalError(w)
+		return true
+	}
+
+	return false
 }
 
 func (h syncHandler) putContent(w http.ResponseWriter, r *http.Request) {
-	apiKey := r.Header.Get("X-API-Token")
+	apiKeyID := requestAPIKeyID(r.Context())
 	etag := r.Header.Get("If-Match")
+	deviceName := r.Header.Get("X-Device-Name")
 
-	// Read data from request body
-	requestData, err := io.ReadAll(r.Body)
-	if err != nil {
-		h.encoder.StatusResponse(r.Context(), w, err.Error(), http.StatusBadRequest)
+	if h.leaseHeld(w, r, apiKeyID) {
+		return
+	}
+
+	requestData, ok := h.readPayload(w, r)
+	if !ok {
 		return
 	}
 
 	var newEtag *string
-	if etag != "" {
-		newEtag, err = h.syncService.SetSyncDataIfMatch(r.Context(), apiKey, etag, requestData)
+	var err error
+	var merged bool
+	if etag != "" && r.Header.Get("X-Sync-Conflict") == "merge" {
+		// opt-in: merge with the stored data instead of failing the precondition
+		newEtag, merged, err = h.syncService.SetSyncDataMerge(r.Context(), apiKeyID, etag, deviceName, requestData)
+	} else if etag != "" {
+		newEtag, err = h.syncService.SetSyncDataIfMatch(r.Context(), apiKeyID, etag, deviceName, requestData)
 	} else {
-		newEtag, err = h.syncService.SetSyncData(r.Context(), apiKey, requestData)
+		newEtag, err = h.syncService.SetSyncData(r.Context(), apiKeyID, deviceName, requestData)
 	}
 	if err != nil {
+		if errors.Is(err, sync.ErrPayloadTooLarge) {
+			// merged data can grow past the limit
+			h.payloadTooLarge(w, r)
+			return
+		}
+		if h.quotaExceeded(w, r, err) {
+			return
+		}
 		h.encoder.StatusInternalError(w)
+		return
 	}
 
 	if newEtag == nil {
@@ -105,17 +281,463 @@ func (h syncHandler) putContent(w http.ResponseWriter, r *http.Request) {
 		// see: https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/If-Match
 		w.WriteHeader(http.StatusPreconditionFailed)
 	} else {
+		if merged {
+			w.Header().Set("X-Sync-Merged", "true")
+		}
+		w.Header().Set("Accept-Patch", bspatch.ContentType)
 		w.Header().Set("ETag", *newEtag)
 		w.WriteHeader(http.StatusOK)
 	}
 }
 
-func (h syncHandler) reportEvent(w http.ResponseWriter, r *http.Request) {
-	apiKey := r.Header.Get("X-API-Token")
-	if apiKey == "" {
-		apiKey = r.URL.Query().Get("apikey")
+// patchContent applies a bsdiff patch against the sync data in If-Match,
+// so devices only have to upload what changed.
+func (h syncHandler) patchContent(w http.ResponseWriter, r *http.Request) {
+	apiKeyID := requestAPIKeyID(r.Context())
+	etag := r.Header.Get("If-Match")
+	deviceName := r.Header.Get("X-Device-Name")
+
+	w.Header().Set("Accept-Patch", bspatch.ContentType)
+
+	if etag == "" {
+		// a patch is only meaningful against a known base
+		w.WriteHeader(http.StatusPreconditionRequired)
+		return
+	}
+
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != bspatch.ContentType {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	if h.leaseHeld(w, r, apiKeyID) {
+		return
+	}
+
+	patch, ok := h.readPayload(w, r)
+	if !ok {
+		return
+	}
+
+	newEtag, err := h.syncService.PatchSyncData(r.Context(), apiKeyID, etag, deviceName, patch)
+	if err != nil {
+		if errors.Is(err, sync.ErrPayloadTooLarge) {
+			h.payloadTooLarge(w, r)
+			return
+		}
+		if errors.Is(err, sync.ErrInvalidPatch) {
+			h.encoder.StatusResponse(r.Context(), w, map[string]string{"message": "invalid patch"}, http.StatusBadRequest)
+			return
+		}
+		if h.quotaExceeded(w, r, err) {
+			return
+		}
+		h.encoder.StatusInternalError(w)
+		return
+	}
+
+	if newEtag == nil {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+
+	w.Header().Set("ETag", *newEtag)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h syncHandler) listHistory(w http.ResponseWriter, r *http.Request) {
+	apiKeyID := requestAPIKeyID(r.Context())
+
+	history, err := h.syncService.ListSyncDataHistory(r.Context(), apiKeyID)
+	if err != nil {
+		h.encoder.StatusInternalError(w)
+		return
+	}
+
+	h.encoder.StatusResponse(r.Context(), w, history, http.StatusOK)
+}
+
+func (h syncHandler) getHistory(w http.ResponseWriter, r *http.Request) {
+	apiKeyID := requestAPIKeyID(r.Context())
+	etag := chi.URLParam(r, "etag")
+
+	data, err := h.syncService.GetSyncDataHistory(r.Context(), apiKeyID, etag)
+	if err != nil {
+		h.encoder.StatusInternalError(w)
+		return
+	}
+
+	if data == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if err := writeSyncData(w, r, etag, int64(len(data)), bytes.NewReader(data)); err != nil {
+		log.Println(err)
+	}
+}
+
+func (h syncHandler) restoreHistory(w http.ResponseWriter, r *http.Request) {
+	apiKeyID := requestAPIKeyID(r.Context())
+	etag := chi.URLParam(r, "etag")
+	deviceName := r.Header.Get("X-Device-Name")
+
+	if h.leaseHeld(w, r, apiKeyID) {
+		return
+	}
+
+	newEtag, err := h.syncService.RestoreSyncDataHistory(r.Context(), apiKeyID, etag, deviceName)
+	if err != nil {
+		if errors.Is(err, sync.ErrPayloadTooLarge) {
+			h.payloadTooLarge(w, r)
+			return
+		}
+		if h.quotaExceeded(w, r, err) {
+			return
+		}
+		h.encoder.StatusInternalError(w)
+		return
+	}
+
+	if newEtag == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("ETag", *newEtag)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h syncHandler) createUpload(w http.ResponseWriter, r *http.Request) {
+	apiKeyID := requestAPIKeyID(r.Context())
+	deviceName := r.Header.Get("X-Device-Name")
+
+	upload, err := h.syncService.CreateUpload(r.Context(), apiKeyID, deviceName)
+	if err != nil {
+		h.encoder.StatusInternalError(w)
+		return
+	}
+
+	h.encoder.StatusCreatedData(w, upload)
+}
+
+func (h syncHandler) getUpload(w http.ResponseWriter, r *http.Request) {
+	apiKeyID := requestAPIKeyID(r.Context())
+	id := chi.URLParam(r, "id")
+
+	upload, err := h.syncService.GetUpload(r.Context(), apiKeyID, id)
+	if err != nil {
+		if errors.Is(err, sync.ErrUploadNotFound) {
+			h.encoder.StatusNotFound(r.Context(), w)
+			return
+		}
+		h.encoder.StatusInternalError(w)
+		return
+	}
+
+	h.encoder.StatusResponse(r.Context(), w, upload, http.StatusOK)
+}
+
+func (h syncHandler) putUploadChunk(w http.ResponseWriter, r *http.Request) {
+	apiKeyID := requestAPIKeyID(r.Context())
+	id := chi.URLParam(r, "id")
+
+	offset, err := strconv.ParseInt(chi.URLParam(r, "offset"), 10, 64)
+	if err != nil || offset < 0 {
+		h.encoder.StatusResponse(r.Context(), w, map[string]string{"message": "invalid offset"}, http.StatusBadRequest)
+		return
+	}
+
+	chunk, ok := h.readPayload(w, r)
+	if !ok {
+		return
+	}
+
+	upload, err := h.syncService.WriteUploadChunk(r.Context(), apiKeyID, id, offset, chunk)
+	if err != nil {
+		switch {
+		case errors.Is(err, sync.ErrUploadNotFound):
+			h.encoder.StatusNotFound(r.Context(), w)
+		case errors.Is(err, sync.ErrUploadOffset):
+			// the device resumes from the offset the upload has
+			h.encoder.StatusResponse(r.Context(), w, upload, http.StatusConflict)
+		case errors.Is(err, sync.ErrPayloadTooLarge):
+			h.payloadTooLarge(w, r)
+		default:
+			if !h.quotaExceeded(w, r, err) {
+				h.encoder.StatusInternalError(w)
+			}
+		}
+		return
 	}
-	if apiKey == "" {
+
+	h.encoder.StatusResponse(r.Context(), w, upload, http.StatusOK)
+}
+
+func (h syncHandler) commitUpload(w http.ResponseWriter, r *http.Request) {
+	apiKeyID := requestAPIKeyID(r.Context())
+	id := chi.URLParam(r, "id")
+	etag := r.Header.Get("If-Match")
+
+	if h.leaseHeld(w, r, apiKeyID) {
+		return
+	}
+
+	newEtag, err := h.syncService.CommitUpload(r.Context(), apiKeyID, id, etag)
+	if err != nil {
+		if errors.Is(err, sync.ErrUploadNotFound) {
+			h.encoder.StatusNotFound(r.Context(), w)
+			return
+		}
+		if h.quotaExceeded(w, r, err) {
+			return
+		}
+		h.encoder.StatusInternalError(w)
+		return
+	}
+
+	if newEtag == nil {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+
+	w.Header().Set("ETag", *newEtag)
+	w.WriteHeader(http.StatusOK)
+}
+
+const (
+	// watchKeepAlive is how often a comment is sent on an idle watch stream,
+	// so proxies do not close it.
+	watchKeepAlive = 30 * time.Second
+	// watchPollTimeout is how long a long-poll watch waits by default, and at most.
+	watchPollTimeout    = 60 * time.Second
+	watchMaxPollTimeout = 5 * time.Minute
+)
+
+// watchEvent is sent when the sync data of the key is replaced.
+type watchEvent struct {
+	ETag string `json:"etag"`
+}
+
+// watch tells a device when the sync data of its key is replaced, so it can sync right away.
+// With Accept: text/event-stream it is a stream of "etag" events, starting with the current etag.
+// Otherwise it is a long-poll, which returns the etag once it differs from ?etag=,
+// or 304 after ?timeout= seconds.
+func (h syncHandler) watch(w http.ResponseWriter, r *http.Request) {
+	apiKeyID := requestAPIKeyID(r.Context())
+
+	// subscribe first, so a change right after reading the current etag is not missed
+	changes, cancel := h.syncService.Watch(apiKeyID)
+	defer cancel()
+
+	current, err := h.syncService.GetSyncDataETag(r.Context(), apiKeyID)
+	if err != nil {
+		h.encoder.StatusInternalError(w)
+		return
+	}
+
+	var etag string
+	if current != nil {
+		etag = *current
+	}
+
+	stream := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+
+	timeout := watchPollTimeout
+	if !stream {
+		if seconds := r.URL.Query().Get("timeout"); seconds != "" {
+			n, err := strconv.Atoi(seconds)
+			if err != nil || n < 0 || time.Duration(n)*time.Second > watchMaxPollTimeout {
+				h.encoder.StatusResponse(r.Context(), w, map[string]string{
+					"message": fmt.Sprintf("timeout must be between 0 and %d seconds", int(watchMaxPollTimeout.Seconds())),
+				}, http.StatusBadRequest)
+				return
+			}
+			timeout = time.Duration(n) * time.Second
+		}
+
+		if known := r.URL.Query().Get("etag"); known != etag {
+			h.encoder.StatusResponse(r.Context(), w, watchEvent{ETag: etag}, http.StatusOK)
+			return
+		}
+	}
+
+	// the watch outlasts the server write timeout
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		log.Println(err)
+	}
+
+	if !stream {
+		select {
+		case etag := <-changes:
+			h.encoder.StatusResponse(r.Context(), w, watchEvent{ETag: etag}, http.StatusOK)
+		case <-time.After(timeout):
+			w.WriteHeader(http.StatusNotModified)
+		case <-r.Context().Done():
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(etag string) error {
+		data, err := json.Marshal(watchEvent{ETag: etag})
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: etag\ndata: %s\n\n", data); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	if err := send(etag); err != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(watchKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case etag := <-changes:
+			if err := send(etag); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// syncLockRequest is the optional body of POST and PUT /api/sync/lock.
+type syncLockRequest struct {
+	// DeviceID identifies the device holding the lease, instead of the X-Device-Id header.
+	DeviceID string `json:"device_id"`
+	// TTL is how long the lease is held in seconds, the default if 0.
+	TTL int `json:"ttl"`
+}
+
+// readLockRequest reads the device id and ttl of a lease request,
+// and responds with 400 if the body is not valid.
+func (h syncHandler) readLockRequest(w http.ResponseWriter, r *http.Request) (syncLockRequest, bool) {
+	body := syncLockRequest{DeviceID: r.Header.Get("X-Device-Id")}
+
+	if r.ContentLength != 0 {
+		var req syncLockRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			h.encoder.StatusResponse(r.Context(), w, map[string]string{"message": "invalid JSON body"}, http.StatusBadRequest)
+			return body, false
+		}
+		if req.DeviceID != "" {
+			body.DeviceID = req.DeviceID
+		}
+		body.TTL = req.TTL
+	}
+
+	return body, true
+}
+
+// lockError writes the response for the lease errors of the sync service.
+func (h syncHandler) lockError(w http.ResponseWriter, r *http.Request, lease *domain.SyncLease, err error) {
+	switch {
+	case errors.Is(err, sync.ErrLeaseHeld):
+		h.encoder.StatusResponse(r.Context(), w, lease, http.StatusLocked)
+	case errors.Is(err, sync.ErrLeaseNotHeld):
+		h.encoder.StatusResponse(r.Context(), w, map[string]string{"message": "sync lease not held by the device"}, http.StatusConflict)
+	case errors.Is(err, sync.ErrInvalidLease):
+		h.encoder.StatusResponse(r.Context(), w, map[string]string{
+			"message": fmt.Sprintf("a device id and a ttl between %d and %d seconds are required", int(sync.MinLeaseTTL.Seconds()), int(sync.MaxLeaseTTL.Seconds())),
+		}, http.StatusBadRequest)
+	default:
+		h.encoder.StatusInternalError(w)
+	}
+}
+
+func (h syncHandler) getLock(w http.ResponseWriter, r *http.Request) {
+	apiKeyID := requestAPIKeyID(r.Context())
+
+	lease, err := h.syncService.GetLease(r.Context(), apiKeyID)
+	if err != nil {
+		h.encoder.StatusInternalError(w)
+		return
+	}
+
+	if lease == nil {
+		h.encoder.StatusNotFound(r.Context(), w)
+		return
+	}
+
+	h.encoder.StatusResponse(r.Context(), w, lease, http.StatusOK)
+}
+
+// acquireLock acquires the sync lease, a device already holding it gets it extended.
+func (h syncHandler) acquireLock(w http.ResponseWriter, r *http.Request) {
+	apiKeyID := requestAPIKeyID(r.Context())
+
+	req, ok := h.readLockRequest(w, r)
+	if !ok {
+		return
+	}
+
+	lease, err := h.syncService.AcquireLease(r.Context(), apiKeyID, req.DeviceID, time.Duration(req.TTL)*time.Second)
+	if err != nil {
+		h.lockError(w, r, lease, err)
+		return
+	}
+
+	h.encoder.StatusResponse(r.Context(), w, lease, http.StatusOK)
+}
+
+// extendLock is the heartbeat of a device holding the sync lease.
+func (h syncHandler) extendLock(w http.ResponseWriter, r *http.Request) {
+	apiKeyID := requestAPIKeyID(r.Context())
+
+	req, ok := h.readLockRequest(w, r)
+	if !ok {
+		return
+	}
+
+	lease, err := h.syncService.ExtendLease(r.Context(), apiKeyID, req.DeviceID, time.Duration(req.TTL)*time.Second)
+	if err != nil {
+		h.lockError(w, r, lease, err)
+		return
+	}
+
+	h.encoder.StatusResponse(r.Context(), w, lease, http.StatusOK)
+}
+
+func (h syncHandler) releaseLock(w http.ResponseWriter, r *http.Request) {
+	apiKeyID := requestAPIKeyID(r.Context())
+
+	req, ok := h.readLockRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.syncService.ReleaseLease(r.Context(), apiKeyID, req.DeviceID); err != nil {
+		h.lockError(w, r, nil, err)
+		return
+	}
+
+	h.encoder.NoContent(w)
+}
+
+func (h syncHandler) reportEvent(w http.ResponseWriter, r *http.Request) {
+	apiKeyID := requestAPIKeyID(r.Context())
+	if apiKeyID == 0 {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
@@ -130,7 +752,9 @@ func (h syncHandler) reportEvent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.syncService.ReportSyncEvent(r.Context(), apiKey, body.Event, body.DeviceName, body.Message); err != nil {
+	setDeviceName(r.Context(), body.DeviceName)
+
+	if err := h.syncService.ReportSyncEvent(r.Context(), apiKeyID, body.Event, body.DeviceName, body.Message); err != nil {
 		if errors.Is(err, sync.ErrInvalidSyncEvent) {
 			h.encoder.StatusResponse(r.Context(), w, map[string]string{"message": "invalid sync event"}, http.StatusBadRequest)
 			return
@@ -142,3 +766,90 @@ func (h syncHandler) reportEvent(w http.ResponseWriter, r *http.Request) {
 
 	h.encoder.NoContent(w)
 }
+
+// syncEventsResponse is the body of GET /api/sync/events.
+type syncEventsResponse struct {
+	Events []domain.SyncEvent     `json:"events"`
+	Total  int                    `json:"total"`
+	Limit  int                    `json:"limit"`
+	Offset int                    `json:"offset"`
+	Stats  *domain.SyncEventStats `json:"stats"`
+}
+
+// readEventFilter reads the sync event filter from the query, and responds with 400 if it is not valid.
+// Without an api key, as for the web UI, the events of all keys of the user are listed.
+func (h syncHandler) readEventFilter(w http.ResponseWriter, r *http.Request) (domain.SyncEventFilter, bool) {
+	query := r.URL.Query()
+
+	filter := domain.SyncEventFilter{
+		APIKeyID:   requestAPIKeyID(r.Context()),
+		UserID:     requestUserID(r.Context()),
+		DeviceName: query.Get("device"),
+		Event:      domain.NotificationEvent(query.Get("event")),
+	}
+
+	badRequest := func(message string) (domain.SyncEventFilter, bool) {
+		h.encoder.StatusResponse(r.Context(), w, map[string]string{"message": message}, http.StatusBadRequest)
+		return filter, false
+	}
+
+	for _, param := range []struct {
+		name  string
+		value *time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		if s := query.Get(param.name); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return badRequest(fmt.Sprintf("%v must be an RFC 3339 time", param.name))
+			}
+			*param.value = t
+		}
+	}
+
+	for _, param := range []struct {
+		name  string
+		value *int
+	}{{"limit", &filter.Limit}, {"offset", &filter.Offset}} {
+		if s := query.Get(param.name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				return badRequest(fmt.Sprintf("%v must be a positive number", param.name))
+			}
+			*param.value = n
+		}
+	}
+
+	return filter, true
+}
+
+// listEvents lists the reported sync events newest first, with the stats of all events matching the filter.
+func (h syncHandler) listEvents(w http.ResponseWriter, r *http.Request) {
+	filter, ok := h.readEventFilter(w, r)
+	if !ok {
+		return
+	}
+
+	events, total, err := h.syncService.ListEvents(r.Context(), filter)
+	if err != nil {
+		if errors.Is(err, sync.ErrInvalidEventFilter) {
+			h.encoder.StatusResponse(r.Context(), w, map[string]string{"message": "invalid sync event"}, http.StatusBadRequest)
+			return
+		}
+		h.encoder.StatusInternalError(w)
+		return
+	}
+
+	stats, err := h.syncService.EventStats(r.Context(), filter)
+	if err != nil {
+		h.encoder.StatusInternalError(w)
+		return
+	}
+
+	h.encoder.StatusResponse(r.Context(), w, syncEventsResponse{
+		Events: events,
+		Total:  total,
+		Limit:  sync.EventLimit(filter.Limit),
+		Offset: filter.Offset,
+		Stats:  stats,
+	}, http.StatusOK)
+}
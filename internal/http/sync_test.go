@@ -1,13 +1,19 @@
 package http
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/SyncYomi/SyncYomi/internal/domain"
 	"github.com/SyncYomi/SyncYomi/internal/sync"
 	"github.com/go-chi/chi/v5"
 )
@@ -22,46 +28,166 @@ type mockSyncService struct {
 	setDataEtag        *string
 	setDataIfMatchErr  error
 	setDataIfMatchEtag *string
+	mergeEtag          *string
+	merged             bool
+	patchEtag          *string
+	patchErr           error
+	upload             *domain.SyncUpload
+	uploadErr          error
+	commitEtag         *string
+	setData            []byte
 	reportEventErr     error
+	events             []domain.SyncEvent
+	eventsErr          error
+	eventFilter        domain.SyncEventFilter
+	history            []domain.SyncDataHistory
+	historyData        []byte
+	restoreEtag        *string
+	lease              *domain.SyncLease
+	leaseErr           error
+	leaseTTL           time.Duration
+	watch              chan string
 }
 
-func (m *mockSyncService) GetSyncDataETag(ctx context.Context, apiKey string) (*string, error) {
+func (m *mockSyncService) GetSyncDataETag(ctx context.Context, apiKeyID int) (*string, error) {
 	if m.getETagErr != nil {
 		return nil, m.getETagErr
 	}
 	return m.getETag, nil
 }
 
-func (m *mockSyncService) GetSyncDataAndETag(ctx context.Context, apiKey string) ([]byte, *string, error) {
+func (m *mockSyncService) GetSyncDataAndETag(ctx context.Context, apiKeyID int) ([]byte, *string, error) {
 	if m.getDataAndETagErr != nil {
 		return nil, nil, m.getDataAndETagErr
 	}
 	return m.getData, m.getDataETag, nil
 }
 
-func (m *mockSyncService) SetSyncData(ctx context.Context, apiKey string, data []byte) (*string, error) {
+func (m *mockSyncService) WriteSyncDataTo(ctx context.Context, apiKeyID int, fn func(etag string, size int64, data io.Reader) error) (bool, error) {
+	if m.getDataAndETagErr != nil {
+		return false, m.getDataAndETagErr
+	}
+	if m.getData == nil {
+		return false, nil
+	}
+	return true, fn(*m.getDataETag, int64(len(m.getData)), bytes.NewReader(m.getData))
+}
+
+func (m *mockSyncService) SetSyncData(ctx context.Context, apiKeyID int, deviceName string, data []byte) (*string, error) {
+	m.setData = data
 	if m.setDataErr != nil {
 		return nil, m.setDataErr
 	}
 	return m.setDataEtag, nil
 }
 
-func (m *mockSyncService) SetSyncDataIfMatch(ctx context.Context, apiKey string, etag string, data []byte) (*string, error) {
+func (m *mockSyncService) SetSyncDataIfMatch(ctx context.Context, apiKeyID int, etag string, deviceName string, data []byte) (*string, error) {
 	if m.setDataIfMatchErr != nil {
 		return nil, m.setDataIfMatchErr
 	}
 	return m.setDataIfMatchEtag, nil
 }
 
-func (m *mockSyncService) ReportSyncEvent(ctx context.Context, apiKey string, event string, deviceName string, detailMessage string) error {
+func (m *mockSyncService) SetSyncDataMerge(ctx context.Context, apiKeyID int, etag string, deviceName string, data []byte) (*string, bool, error) {
+	return m.mergeEtag, m.merged, nil
+}
+
+func (m *mockSyncService) PatchSyncData(ctx context.Context, apiKeyID int, etag string, deviceName string, patch []byte) (*string, error) {
+	if m.patchErr != nil {
+		return nil, m.patchErr
+	}
+	return m.patchEtag, nil
+}
+
+func (m *mockSyncService) ListSyncDataHistory(ctx context.Context, apiKeyID int) ([]domain.SyncDataHistory, error) {
+	return m.history, nil
+}
+
+func (m *mockSyncService) GetSyncDataHistory(ctx context.Context, apiKeyID int, etag string) ([]byte, error) {
+	return m.historyData, nil
+}
+
+func (m *mockSyncService) RestoreSyncDataHistory(ctx context.Context, apiKeyID int, etag string, deviceName string) (*string, error) {
+	return m.restoreEtag, nil
+}
+
+func (m *mockSyncService) CreateUpload(ctx context.Context, apiKeyID int, deviceName string) (*domain.SyncUpload, error) {
+	return m.upload, nil
+}
+
+func (m *mockSyncService) GetUpload(ctx context.Context, apiKeyID int, id string) (*domain.SyncUpload, error) {
+	return m.upload, m.uploadErr
+}
+
+func (m *mockSyncService) WriteUploadChunk(ctx context.Context, apiKeyID int, id string, offset int64, data []byte) (*domain.SyncUpload, error) {
+	return m.upload, m.uploadErr
+}
+
+func (m *mockSyncService) CommitUpload(ctx context.Context, apiKeyID int, id string, etag string) (*string, error) {
+	if m.uploadErr != nil {
+		return nil, m.uploadErr
+	}
+	return m.commitEtag, nil
+}
+
+func (m *mockSyncService) ExpireUploads(ctx context.Context) error {
+	return nil
+}
+
+func (m *mockSyncService) ReportSyncEvent(ctx context.Context, apiKeyID int, event string, deviceName string, detailMessage string) error {
 	return m.reportEventErr
 }
 
+func (m *mockSyncService) ListEvents(ctx context.Context, filter domain.SyncEventFilter) ([]domain.SyncEvent, int, error) {
+	m.eventFilter = filter
+	if m.eventsErr != nil {
+		return nil, 0, m.eventsErr
+	}
+	return m.events, len(m.events), nil
+}
+
+func (m *mockSyncService) EventStats(ctx context.Context, filter domain.SyncEventFilter) (*domain.SyncEventStats, error) {
+	return &domain.SyncEventStats{Total: len(m.events), Devices: []domain.SyncEventDeviceStats{}}, nil
+}
+
+func (m *mockSyncService) ExpireEvents(ctx context.Context) error {
+	return nil
+}
+
+func (m *mockSyncService) Watch(apiKeyID int) (<-chan string, func()) {
+	if m.watch == nil {
+		m.watch = make(chan string, 1)
+	}
+	return m.watch, func() {}
+}
+
+func (m *mockSyncService) AcquireLease(ctx context.Context, apiKeyID int, deviceID string, ttl time.Duration) (*domain.SyncLease, error) {
+	m.leaseTTL = ttl
+	return m.lease, m.leaseErr
+}
+
+func (m *mockSyncService) ExtendLease(ctx context.Context, apiKeyID int, deviceID string, ttl time.Duration) (*domain.SyncLease, error) {
+	m.leaseTTL = ttl
+	return m.lease, m.leaseErr
+}
+
+func (m *mockSyncService) ReleaseLease(ctx context.Context, apiKeyID int, deviceID string) error {
+	return m.leaseErr
+}
+
+func (m *mockSyncService) GetLease(ctx context.Context, apiKeyID int) (*domain.SyncLease, error) {
+	return m.lease, m.leaseErr
+}
+
+func (m *mockSyncService) CheckLease(ctx context.Context, apiKeyID int, deviceID string) (*domain.SyncLease, error) {
+	return m.lease, m.leaseErr
+}
+
 func TestSyncHandler_getContent(t *testing.T) {
 	enc := encoder{}
 	tests := []struct {
 		name           string
-		apiKey         string
+		apiKeyID       int
 		ifNoneMatch    string
 		mock           *mockSyncService
 		wantStatus     int
@@ -70,13 +196,13 @@ func TestSyncHandler_getContent(t *testing.T) {
 	}{
 		{
 			name:       "no data returns 404",
-			apiKey:     "key1",
+			apiKeyID:   1,
 			mock:       &mockSyncService{getData: nil, getDataETag: nil},
 			wantStatus: http.StatusNotFound,
 		},
 		{
 			name:           "returns data and etag",
-			apiKey:         "key1",
+			apiKeyID:       1,
 			mock:           &mockSyncService{getData: []byte("sync-payload"), getDataETag: strPtr("etag-1")},
 			wantStatus:     http.StatusOK,
 			wantETag:       "etag-1",
@@ -84,14 +210,14 @@ func TestSyncHandler_getContent(t *testing.T) {
 		},
 		{
 			name:        "304 when If-None-Match matches",
-			apiKey:      "key1",
+			apiKeyID:    1,
 			ifNoneMatch: "etag-1",
 			mock:        &mockSyncService{getETag: strPtr("etag-1")},
 			wantStatus:  http.StatusNotModified,
 		},
 		{
 			name:        "200 when If-None-Match does not match",
-			apiKey:      "key1",
+			apiKeyID:    1,
 			ifNoneMatch: "old-etag",
 			mock:        &mockSyncService{getETag: strPtr("etag-1"), getData: []byte("data"), getDataETag: strPtr("etag-1")},
 			wantStatus:  http.StatusOK,
@@ -102,10 +228,10 @@ func TestSyncHandler_getContent(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			r := chi.NewRouter()
 			r.Route("/", func(r chi.Router) {
-				newSyncHandler(enc, tt.mock).Routes(r)
+				newSyncHandler(enc, &domain.Config{MaxSyncPayloadSize: 1}, tt.mock).Routes(r)
 			})
 			req := httptest.NewRequest(http.MethodGet, "/content", nil)
-			req.Header.Set("X-API-Token", tt.apiKey)
+			req = withAPIKey(req, tt.apiKeyID)
 			if tt.ifNoneMatch != "" {
 				req.Header.Set("If-None-Match", tt.ifNoneMatch)
 			}
@@ -128,16 +254,18 @@ func TestSyncHandler_putContent(t *testing.T) {
 	enc := encoder{}
 	tests := []struct {
 		name       string
-		apiKey     string
+		apiKeyID   int
 		ifMatch    string
+		conflict   string
 		body       []byte
 		mock       *mockSyncService
 		wantStatus int
 		wantETag   string
+		wantMerged bool
 	}{
 		{
 			name:       "put without etag returns 200 and new etag",
-			apiKey:     "key1",
+			apiKeyID:   1,
 			body:       []byte("new-sync-data"),
 			mock:       &mockSyncService{setDataEtag: strPtr("etag-new")},
 			wantStatus: http.StatusOK,
@@ -145,7 +273,7 @@ func TestSyncHandler_putContent(t *testing.T) {
 		},
 		{
 			name:       "put with If-Match returns 412 when etag mismatch",
-			apiKey:     "key1",
+			apiKeyID:   1,
 			ifMatch:    "old-etag",
 			body:       []byte("new-sync-data"),
 			mock:       &mockSyncService{setDataIfMatchEtag: nil},
@@ -153,33 +281,466 @@ func TestSyncHandler_putContent(t *testing.T) {
 		},
 		{
 			name:       "put with If-Match returns 200 when match",
-			apiKey:     "key1",
+			apiKeyID:   1,
 			ifMatch:    "old-etag",
 			body:       []byte("new-sync-data"),
 			mock:       &mockSyncService{setDataIfMatchEtag: strPtr("etag-after")},
 			wantStatus: http.StatusOK,
 			wantETag:   "etag-after",
 		},
+		{
+			name:       "put with merge returns merged etag",
+			apiKeyID:   1,
+			ifMatch:    "old-etag",
+			conflict:   "merge",
+			body:       []byte("new-sync-data"),
+			mock:       &mockSyncService{mergeEtag: strPtr("etag-merged"), merged: true},
+			wantStatus: http.StatusOK,
+			wantETag:   "etag-merged",
+			wantMerged: true,
+		},
+		{
+			name:       "put with merge returns 412 when data cannot be merged",
+			apiKeyID:   1,
+			ifMatch:    "old-etag",
+			conflict:   "merge",
+			body:       []byte("new-sync-data"),
+			mock:       &mockSyncService{setDataIfMatchEtag: strPtr("etag-after")},
+			wantStatus: http.StatusPreconditionFailed,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			r := chi.NewRouter()
 			r.Route("/", func(r chi.Router) {
-				newSyncHandler(enc, tt.mock).Routes(r)
+				newSyncHandler(enc, &domain.Config{MaxSyncPayloadSize: 1}, tt.mock).Routes(r)
 			})
 			req := httptest.NewRequest(http.MethodPut, "/content", bytes.NewReader(tt.body))
-			req.Header.Set("X-API-Token", tt.apiKey)
+			req = withAPIKey(req, tt.apiKeyID)
 			if tt.ifMatch != "" {
 				req.Header.Set("If-Match", tt.ifMatch)
 			}
+			if tt.conflict != "" {
+				req.Header.Set("X-Sync-Conflict", tt.conflict)
+			}
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("putContent() status = %v, want %v", rec.Code, tt.wantStatus)
+			}
+			if tt.wantETag != "" && rec.Header().Get("ETag") != tt.wantETag {
+				t.Errorf("ETag = %q, want %q", rec.Header().Get("ETag"), tt.wantETag)
+			}
+			if merged := rec.Header().Get("X-Sync-Merged") == "true"; merged != tt.wantMerged {
+				t.Errorf("X-Sync-Merged = %v, want %v", merged, tt.wantMerged)
+			}
+		})
+	}
+}
+
+func TestSyncHandler_putContent_tooLarge(t *testing.T) {
+	enc := encoder{}
+	body := bytes.Repeat([]byte("a"), 1<<20+1)
+
+	tests := []struct {
+		name string
+		body io.Reader
+	}{
+		{name: "content length over limit", body: bytes.NewReader(body)},
+		{name: "body over limit without content length", body: io.MultiReader(bytes.NewReader(body))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := chi.NewRouter()
+			r.Route("/", func(r chi.Router) {
+				newSyncHandler(enc, &domain.Config{MaxSyncPayloadSize: 1}, &mockSyncService{setDataEtag: strPtr("etag-new")}).Routes(r)
+			})
+			req := httptest.NewRequest(http.MethodPut, "/content", tt.body)
+			req = withAPIKey(req, 1)
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			if rec.Code != http.StatusRequestEntityTooLarge {
+				t.Errorf("putContent() status = %v, want %v", rec.Code, http.StatusRequestEntityTooLarge)
+			}
+		})
+	}
+}
+
+func TestSyncHandler_putContent_quota(t *testing.T) {
+	enc := encoder{}
+	tests := []struct {
+		name           string
+		err            error
+		wantStatus     int
+		wantRetryAfter bool
+	}{
+		{name: "storage quota returns 413", err: sync.ErrQuotaExceeded, wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "upload quota returns 429", err: sync.ErrUploadQuotaExceeded, wantStatus: http.StatusTooManyRequests, wantRetryAfter: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := chi.NewRouter()
+			r.Route("/", func(r chi.Router) {
+				newSyncHandler(enc, &domain.Config{}, &mockSyncService{setDataErr: tt.err}).Routes(r)
+			})
+			req := httptest.NewRequest(http.MethodPut, "/content", bytes.NewReader([]byte("data")))
+			req = withAPIKey(req, 1)
 			rec := httptest.NewRecorder()
 			r.ServeHTTP(rec, req)
 			if rec.Code != tt.wantStatus {
 				t.Errorf("putContent() status = %v, want %v", rec.Code, tt.wantStatus)
 			}
+			if retryAfter := rec.Header().Get("Retry-After") != ""; retryAfter != tt.wantRetryAfter {
+				t.Errorf("Retry-After set = %v, want %v", retryAfter, tt.wantRetryAfter)
+			}
+		})
+	}
+}
+
+func TestSyncHandler_contentEncoding(t *testing.T) {
+	enc := encoder{}
+	payload := []byte("sync-payload")
+
+	for _, encoding := range []string{encodingGzip, encodingZstd} {
+		t.Run("download "+encoding, func(t *testing.T) {
+			r := chi.NewRouter()
+			r.Route("/", func(r chi.Router) {
+				newSyncHandler(enc, &domain.Config{}, &mockSyncService{getData: payload, getDataETag: strPtr("etag-1")}).Routes(r)
+			})
+			req := httptest.NewRequest(http.MethodGet, "/content", nil)
+			req.Header.Set("Accept-Encoding", encoding)
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+
+			if got := rec.Header().Get("Content-Encoding"); got != encoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, encoding)
+			}
+			if got := rec.Header().Get("ETag"); got != "etag-1" {
+				t.Errorf("ETag = %q, want %q", got, "etag-1")
+			}
+			body, closeBody, err := decodeReader(rec.Body, encoding)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closeBody()
+			got, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Errorf("body = %q, want %q", got, payload)
+			}
+		})
+
+		t.Run("upload "+encoding, func(t *testing.T) {
+			var compressed bytes.Buffer
+			w, err := encodeWriter(&compressed, encoding)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write(payload)
+			w.Close()
+
+			mock := &mockSyncService{setDataEtag: strPtr("etag-new")}
+			r := chi.NewRouter()
+			r.Route("/", func(r chi.Router) {
+				newSyncHandler(enc, &domain.Config{}, mock).Routes(r)
+			})
+			req := httptest.NewRequest(http.MethodPut, "/content", &compressed)
+			req.Header.Set("Content-Encoding", encoding)
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Errorf("putContent() status = %v, want %v", rec.Code, http.StatusOK)
+			}
+			if !bytes.Equal(mock.setData, payload) {
+				t.Errorf("stored data = %q, want %q", mock.setData, payload)
+			}
+		})
+	}
+
+	t.Run("upload with unsupported encoding", func(t *testing.T) {
+		r := chi.NewRouter()
+		r.Route("/", func(r chi.Router) {
+			newSyncHandler(enc, &domain.Config{}, &mockSyncService{}).Routes(r)
+		})
+		req := httptest.NewRequest(http.MethodPut, "/content", bytes.NewReader(payload))
+		req.Header.Set("Content-Encoding", "br")
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("putContent() status = %v, want %v", rec.Code, http.StatusUnsupportedMediaType)
+		}
+	})
+
+	t.Run("upload decompressing over limit", func(t *testing.T) {
+		var compressed bytes.Buffer
+		w, _ := encodeWriter(&compressed, encodingGzip)
+		w.Write(bytes.Repeat([]byte("a"), 2<<20))
+		w.Close()
+
+		r := chi.NewRouter()
+		r.Route("/", func(r chi.Router) {
+			newSyncHandler(enc, &domain.Config{MaxSyncPayloadSize: 1}, &mockSyncService{}).Routes(r)
+		})
+		req := httptest.NewRequest(http.MethodPut, "/content", &compressed)
+		req.Header.Set("Content-Encoding", encodingGzip)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("putContent() status = %v, want %v", rec.Code, http.StatusRequestEntityTooLarge)
+		}
+	})
+}
+
+func TestSyncHandler_patchContent(t *testing.T) {
+	enc := encoder{}
+	tests := []struct {
+		name        string
+		ifMatch     string
+		contentType string
+		mock        *mockSyncService
+		wantStatus  int
+		wantETag    string
+	}{
+		{
+			name:        "428 without If-Match",
+			contentType: "application/x-bsdiff",
+			mock:        &mockSyncService{patchEtag: strPtr("etag-new")},
+			wantStatus:  http.StatusPreconditionRequired,
+		},
+		{
+			name:        "415 for unknown patch format",
+			ifMatch:     "etag-1",
+			contentType: "application/vcdiff",
+			mock:        &mockSyncService{patchEtag: strPtr("etag-new")},
+			wantStatus:  http.StatusUnsupportedMediaType,
+		},
+		{
+			name:        "412 when base does not match",
+			ifMatch:     "etag-1",
+			contentType: "application/x-bsdiff",
+			mock:        &mockSyncService{},
+			wantStatus:  http.StatusPreconditionFailed,
+		},
+		{
+			name:        "400 for invalid patch",
+			ifMatch:     "etag-1",
+			contentType: "application/x-bsdiff",
+			mock:        &mockSyncService{patchErr: sync.ErrInvalidPatch},
+			wantStatus:  http.StatusBadRequest,
+		},
+		{
+			name:        "200 returns new etag",
+			ifMatch:     "etag-1",
+			contentType: "application/x-bsdiff",
+			mock:        &mockSyncService{patchEtag: strPtr("etag-new")},
+			wantStatus:  http.StatusOK,
+			wantETag:    "etag-new",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := chi.NewRouter()
+			r.Route("/", func(r chi.Router) {
+				newSyncHandler(enc, &domain.Config{MaxSyncPayloadSize: 1}, tt.mock).Routes(r)
+			})
+			req := httptest.NewRequest(http.MethodPatch, "/content", bytes.NewReader([]byte("patch")))
+			req = withAPIKey(req, 1)
+			req.Header.Set("Content-Type", tt.contentType)
+			if tt.ifMatch != "" {
+				req.Header.Set("If-Match", tt.ifMatch)
+			}
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("patchContent() status = %v, want %v", rec.Code, tt.wantStatus)
+			}
+			if tt.wantETag != "" && rec.Header().Get("ETag") != tt.wantETag {
+				t.Errorf("ETag = %q, want %q", rec.Header().Get("ETag"), tt.wantETag)
+			}
+			if rec.Header().Get("Accept-Patch") != "application/x-bsdiff" {
+				t.Errorf("Accept-Patch = %q, want %q", rec.Header().Get("Accept-Patch"), "application/x-bsdiff")
+			}
+		})
+	}
+}
+
+func TestSyncHandler_history(t *testing.T) {
+	enc := encoder{}
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		mock       *mockSyncService
+		wantStatus int
+		wantETag   string
+		wantBody   string
+	}{
+		{
+			name:       "list returns history",
+			method:     http.MethodGet,
+			target:     "/history",
+			mock:       &mockSyncService{history: []domain.SyncDataHistory{{ETag: "etag-1", DeviceName: "Phone", Size: 4}}},
+			wantStatus: http.StatusOK,
+			wantBody:   `"etag":"etag-1"`,
+		},
+		{
+			name:       "get unknown version returns 404",
+			method:     http.MethodGet,
+			target:     "/history/etag-unknown",
+			mock:       &mockSyncService{},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "get returns version data",
+			method:     http.MethodGet,
+			target:     "/history/etag-1",
+			mock:       &mockSyncService{historyData: []byte("old-data")},
+			wantStatus: http.StatusOK,
+			wantETag:   "etag-1",
+			wantBody:   "old-data",
+		},
+		{
+			name:       "restore unknown version returns 404",
+			method:     http.MethodPost,
+			target:     "/history/etag-unknown/restore",
+			mock:       &mockSyncService{},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "restore returns new etag",
+			method:     http.MethodPost,
+			target:     "/history/etag-1/restore",
+			mock:       &mockSyncService{restoreEtag: strPtr("etag-restored")},
+			wantStatus: http.StatusOK,
+			wantETag:   "etag-restored",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := chi.NewRouter()
+			r.Route("/", func(r chi.Router) {
+				newSyncHandler(enc, &domain.Config{MaxSyncPayloadSize: 1}, tt.mock).Routes(r)
+			})
+			req := httptest.NewRequest(tt.method, tt.target, nil)
+			req = withAPIKey(req, 1)
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %v, want %v", rec.Code, tt.wantStatus)
+			}
 			if tt.wantETag != "" && rec.Header().Get("ETag") != tt.wantETag {
 				t.Errorf("ETag = %q, want %q", rec.Header().Get("ETag"), tt.wantETag)
 			}
+			if tt.wantBody != "" && !bytes.Contains(rec.Body.Bytes(), []byte(tt.wantBody)) {
+				t.Errorf("body %q does not contain %q", rec.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestSyncHandler_uploads(t *testing.T) {
+	enc := encoder{}
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		ifMatch    string
+		mock       *mockSyncService
+		wantStatus int
+		wantETag   string
+		wantBody   string
+	}{
+		{
+			name:       "create returns upload",
+			method:     http.MethodPost,
+			target:     "/uploads",
+			mock:       &mockSyncService{upload: &domain.SyncUpload{ID: "upload-1"}},
+			wantStatus: http.StatusCreated,
+			wantBody:   `"id":"upload-1"`,
+		},
+		{
+			name:       "get unknown upload returns 404",
+			method:     http.MethodGet,
+			target:     "/uploads/upload-1",
+			mock:       &mockSyncService{uploadErr: sync.ErrUploadNotFound},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "get returns offset",
+			method:     http.MethodGet,
+			target:     "/uploads/upload-1",
+			mock:       &mockSyncService{upload: &domain.SyncUpload{ID: "upload-1", Offset: 4}},
+			wantStatus: http.StatusOK,
+			wantBody:   `"offset":4`,
+		},
+		{
+			name:       "chunk with invalid offset returns 400",
+			method:     http.MethodPut,
+			target:     "/uploads/upload-1/abc",
+			mock:       &mockSyncService{},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "chunk at wrong offset returns 409 with offset",
+			method:     http.MethodPut,
+			target:     "/uploads/upload-1/0",
+			mock:       &mockSyncService{upload: &domain.SyncUpload{ID: "upload-1", Offset: 4}, uploadErr: sync.ErrUploadOffset},
+			wantStatus: http.StatusConflict,
+			wantBody:   `"offset":4`,
+		},
+		{
+			name:       "chunk returns new offset",
+			method:     http.MethodPut,
+			target:     "/uploads/upload-1/0",
+			mock:       &mockSyncService{upload: &domain.SyncUpload{ID: "upload-1", Offset: 4}},
+			wantStatus: http.StatusOK,
+			wantBody:   `"offset":4`,
+		},
+		{
+			name:       "commit with etag mismatch returns 412",
+			method:     http.MethodPost,
+			target:     "/uploads/upload-1/commit",
+			ifMatch:    "old-etag",
+			mock:       &mockSyncService{},
+			wantStatus: http.StatusPreconditionFailed,
+		},
+		{
+			name:       "commit returns new etag",
+			method:     http.MethodPost,
+			target:     "/uploads/upload-1/commit",
+			ifMatch:    "old-etag",
+			mock:       &mockSyncService{commitEtag: strPtr("etag-new")},
+			wantStatus: http.StatusOK,
+			wantETag:   "etag-new",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := chi.NewRouter()
+			r.Route("/", func(r chi.Router) {
+				newSyncHandler(enc, &domain.Config{MaxSyncPayloadSize: 1}, tt.mock).Routes(r)
+			})
+			req := httptest.NewRequest(tt.method, tt.target, bytes.NewReader([]byte("data")))
+			req = withAPIKey(req, 1)
+			if tt.ifMatch != "" {
+				req.Header.Set("If-Match", tt.ifMatch)
+			}
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %v, want %v", rec.Code, tt.wantStatus)
+			}
+			if tt.wantETag != "" && rec.Header().Get("ETag") != tt.wantETag {
+				t.Errorf("ETag = %q, want %q", rec.Header().Get("ETag"), tt.wantETag)
+			}
+			if tt.wantBody != "" && !bytes.Contains(rec.Body.Bytes(), []byte(tt.wantBody)) {
+				t.Errorf("body %q does not contain %q", rec.Body.String(), tt.wantBody)
+			}
 		})
 	}
 }
@@ -189,8 +750,7 @@ func TestSyncHandler_reportEvent(t *testing.T) {
 	tests := []struct {
 		name       string
 		method     string
-		apiKey     string
-		apiKeyIn   string
+		apiKeyID   int
 		body       interface{}
 		mock       *mockSyncService
 		wantStatus int
@@ -206,8 +766,7 @@ func TestSyncHandler_reportEvent(t *testing.T) {
 		{
 			name:       "400 when invalid JSON",
 			method:     http.MethodPost,
-			apiKey:     "key1",
-			apiKeyIn:   "header",
+			apiKeyID:   1,
 			body:       "not json",
 			mock:       &mockSyncService{},
 			wantStatus: http.StatusBadRequest,
@@ -215,8 +774,7 @@ func TestSyncHandler_reportEvent(t *testing.T) {
 		{
 			name:       "400 when event missing",
 			method:     http.MethodPost,
-			apiKey:     "key1",
-			apiKeyIn:   "header",
+			apiKeyID:   1,
 			body:       map[string]string{},
 			mock:       &mockSyncService{},
 			wantStatus: http.StatusBadRequest,
@@ -225,27 +783,24 @@ func TestSyncHandler_reportEvent(t *testing.T) {
 		{
 			name:       "400 when invalid event",
 			method:     http.MethodPost,
-			apiKey:     "key1",
-			apiKeyIn:   "header",
+			apiKeyID:   1,
 			body:       map[string]string{"event": "INVALID_EVENT"},
 			mock:       &mockSyncService{reportEventErr: sync.ErrInvalidSyncEvent},
 			wantStatus: http.StatusBadRequest,
 			wantBody:   "invalid sync event",
 		},
 		{
-			name:       "204 success with header API key",
+			name:       "204 success",
 			method:     http.MethodPost,
-			apiKey:     "key1",
-			apiKeyIn:   "header",
+			apiKeyID:   1,
 			body:       map[string]string{"event": "SYNC_STARTED"},
 			mock:       &mockSyncService{},
 			wantStatus: http.StatusNoContent,
 		},
 		{
-			name:       "204 success with query API key",
+			name:       "204 success with device name and message",
 			method:     http.MethodPost,
-			apiKey:     "key1",
-			apiKeyIn:   "query",
+			apiKeyID:   1,
 			body:       map[string]string{"event": "SYNC_SUCCESS", "device_name": "My Phone", "message": "done"},
 			mock:       &mockSyncService{},
 			wantStatus: http.StatusNoContent,
@@ -253,8 +808,7 @@ func TestSyncHandler_reportEvent(t *testing.T) {
 		{
 			name:       "204 for SYNC_CANCELLED",
 			method:     http.MethodPost,
-			apiKey:     "key1",
-			apiKeyIn:   "header",
+			apiKeyID:   1,
 			body:       map[string]string{"event": "SYNC_CANCELLED", "device_name": "Tablet", "message": "User cancelled"},
 			mock:       &mockSyncService{},
 			wantStatus: http.StatusNoContent,
@@ -264,7 +818,7 @@ func TestSyncHandler_reportEvent(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			r := chi.NewRouter()
 			r.Route("/", func(r chi.Router) {
-				newSyncHandler(enc, tt.mock).Routes(r)
+				newSyncHandler(enc, &domain.Config{MaxSyncPayloadSize: 1}, tt.mock).Routes(r)
 			})
 			var bodyBytes []byte
 			switch b := tt.body.(type) {
@@ -279,11 +833,8 @@ func TestSyncHandler_reportEvent(t *testing.T) {
 			}
 			req := httptest.NewRequest(tt.method, "/event", bytes.NewReader(bodyBytes))
 			req.Header.Set("Content-Type", "application/json")
-			switch tt.apiKeyIn {
-			case "header":
-				req.Header.Set("X-API-Token", tt.apiKey)
-			case "query":
-				req.URL.RawQuery = "apikey=" + tt.apiKey
+			if tt.apiKeyID != 0 {
+				req = withAPIKey(req, tt.apiKeyID)
 			}
 			rec := httptest.NewRecorder()
 			r.ServeHTTP(rec, req)
@@ -297,4 +848,290 @@ func TestSyncHandler_reportEvent(t *testing.T) {
 	}
 }
 
+func TestSyncHandler_events(t *testing.T) {
+	enc := encoder{}
+	since := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		query      string
+		apiKeyID   int
+		mock       *mockSyncService
+		wantStatus int
+		wantBody   string
+		wantFilter *domain.SyncEventFilter
+	}{
+		{
+			name:     "200 with filters of the query",
+			query:    "device=Phone&event=SYNC_FAILED&since=2024-05-01T00:00:00Z&limit=10&offset=20",
+			apiKeyID: 1,
+			mock: &mockSyncService{events: []domain.SyncEvent{
+				{ID: 1, APIKeyID: 1, DeviceName: "Phone", Event: domain.NotificationEventSyncFailed, Message: "timeout"},
+			}},
+			wantStatus: http.StatusOK,
+			wantBody:   `"total":1,"limit":10,"offset":20`,
+			wantFilter: &domain.SyncEventFilter{
+				APIKeyID:   1,
+				DeviceName: "Phone",
+				Event:      domain.NotificationEventSyncFailed,
+				Since:      since,
+				Limit:      10,
+				Offset:     20,
+			},
+		},
+		{
+			name:       "200 with the default limit",
+			apiKeyID:   1,
+			mock:       &mockSyncService{},
+			wantStatus: http.StatusOK,
+			wantBody:   `"limit":50`,
+		},
+		{
+			name:       "events of the api key of the request",
+			apiKeyID:   2,
+			mock:       &mockSyncService{},
+			wantStatus: http.StatusOK,
+			wantFilter: &domain.SyncEventFilter{APIKeyID: 2},
+		},
+		{
+			name:       "400 when since is not a time",
+			query:      "since=yesterday",
+			apiKeyID:   1,
+			mock:       &mockSyncService{},
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "since must be an RFC 3339 time",
+		},
+		{
+			name:       "400 when limit is negative",
+			query:      "limit=-1",
+			apiKeyID:   1,
+			mock:       &mockSyncService{},
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "limit must be a positive number",
+		},
+		{
+			name:       "400 when event is invalid",
+			query:      "event=SYNC_MAYBE",
+			apiKeyID:   1,
+			mock:       &mockSyncService{eventsErr: sync.ErrInvalidEventFilter},
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "invalid sync event",
+		},
+		{
+			name:       "500 on service error",
+			apiKeyID:   1,
+			mock:       &mockSyncService{eventsErr: errors.New("db down")},
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := chi.NewRouter()
+			r.Route("/", newSyncHandler(enc, &domain.Config{}, tt.mock).Routes)
+
+			req := httptest.NewRequest(http.MethodGet, "/events?"+tt.query, nil)
+			if tt.apiKeyID != 0 {
+				req = withAPIKey(req, tt.apiKeyID)
+			}
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("listEvents() status = %v, want %v", rec.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("body %q does not contain %q", rec.Body.String(), tt.wantBody)
+			}
+			if tt.wantFilter != nil && tt.mock.eventFilter != *tt.wantFilter {
+				t.Errorf("filter = %+v, want %+v", tt.mock.eventFilter, *tt.wantFilter)
+			}
+		})
+	}
+}
+
 func strPtr(s string) *string { return &s }
+
+func TestSyncHandler_lock(t *testing.T) {
+	enc := encoder{}
+	lease := &domain.SyncLease{DeviceID: "phone"}
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		mock       *mockSyncService
+		wantStatus int
+		wantTTL    time.Duration
+	}{
+		{
+			name:       "acquire returns the lease",
+			method:     http.MethodPost,
+			path:       "/lock",
+			body:       `{"ttl": 30}`,
+			mock:       &mockSyncService{lease: lease},
+			wantStatus: http.StatusOK,
+			wantTTL:    30 * time.Second,
+		},
+		{
+			name:       "acquire held by another device returns 423",
+			method:     http.MethodPost,
+			path:       "/lock",
+			mock:       &mockSyncService{lease: lease, leaseErr: sync.ErrLeaseHeld},
+			wantStatus: http.StatusLocked,
+		},
+		{
+			name:       "acquire with invalid ttl returns 400",
+			method:     http.MethodPost,
+			path:       "/lock",
+			mock:       &mockSyncService{leaseErr: sync.ErrInvalidLease},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "acquire with invalid body returns 400",
+			method:     http.MethodPost,
+			path:       "/lock",
+			body:       `{`,
+			mock:       &mockSyncService{lease: lease},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "heartbeat without the lease returns 409",
+			method:     http.MethodPut,
+			path:       "/lock",
+			mock:       &mockSyncService{leaseErr: sync.ErrLeaseNotHeld},
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name:       "release returns 204",
+			method:     http.MethodDelete,
+			path:       "/lock",
+			mock:       &mockSyncService{},
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "no lease returns 404",
+			method:     http.MethodGet,
+			path:       "/lock",
+			mock:       &mockSyncService{},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "put while another device holds the lease returns 423",
+			method:     http.MethodPut,
+			path:       "/content",
+			body:       "data",
+			mock:       &mockSyncService{lease: lease, leaseErr: sync.ErrLeaseHeld, setDataEtag: strPtr("etag-new")},
+			wantStatus: http.StatusLocked,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := chi.NewRouter()
+			r.Route("/", func(r chi.Router) {
+				newSyncHandler(enc, &domain.Config{}, tt.mock).Routes(r)
+			})
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req = withAPIKey(req, 1)
+			req.Header.Set("X-Device-Id", "tablet")
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("%v %v status = %v, want %v", tt.method, tt.path, rec.Code, tt.wantStatus)
+			}
+			if tt.wantTTL != 0 && tt.mock.leaseTTL != tt.wantTTL {
+				t.Errorf("ttl = %v, want %v", tt.mock.leaseTTL, tt.wantTTL)
+			}
+			if tt.mock.setData != nil {
+				t.Errorf("sync data written while the lease is held")
+			}
+		})
+	}
+}
+
+func TestSyncHandler_watch(t *testing.T) {
+	enc := encoder{}
+
+	t.Run("long-poll returns the etag when it differs", func(t *testing.T) {
+		mock := &mockSyncService{getETag: strPtr("etag-2")}
+		r := chi.NewRouter()
+		r.Route("/", newSyncHandler(enc, &domain.Config{}, mock).Routes)
+
+		req := httptest.NewRequest(http.MethodGet, "/watch?etag=etag-1", nil)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"etag-2"`) {
+			t.Errorf("watch() = %v %q, want 200 with etag-2", rec.Code, rec.Body.String())
+		}
+	})
+
+	t.Run("long-poll waits for a change", func(t *testing.T) {
+		mock := &mockSyncService{getETag: strPtr("etag-1"), watch: make(chan string, 1)}
+		mock.watch <- "etag-2"
+		r := chi.NewRouter()
+		r.Route("/", newSyncHandler(enc, &domain.Config{}, mock).Routes)
+
+		req := httptest.NewRequest(http.MethodGet, "/watch?etag=etag-1", nil)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"etag-2"`) {
+			t.Errorf("watch() = %v %q, want 200 with etag-2", rec.Code, rec.Body.String())
+		}
+	})
+
+	t.Run("long-poll returns 304 after the timeout", func(t *testing.T) {
+		mock := &mockSyncService{getETag: strPtr("etag-1")}
+		r := chi.NewRouter()
+		r.Route("/", newSyncHandler(enc, &domain.Config{}, mock).Routes)
+
+		req := httptest.NewRequest(http.MethodGet, "/watch?etag=etag-1&timeout=0", nil)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != http.StatusNotModified {
+			t.Errorf("watch() status = %v, want %v", rec.Code, http.StatusNotModified)
+		}
+	})
+
+	t.Run("stream sends the current etag and changes", func(t *testing.T) {
+		mock := &mockSyncService{getETag: strPtr("etag-1"), watch: make(chan string, 1)}
+		r := chi.NewRouter()
+		r.Route("/", newSyncHandler(enc, &domain.Config{}, mock).Routes)
+		srv := httptest.NewServer(r)
+		defer srv.Close()
+
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/watch", nil)
+		req.Header.Set("Accept", "text/event-stream")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Fatalf("Content-Type = %q", ct)
+		}
+
+		reader := bufio.NewReader(resp.Body)
+		readEvent := func() string {
+			var event string
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					t.Fatal(err)
+				}
+				if line == "\n" {
+					return event
+				}
+				event += line
+			}
+		}
+
+		if event := readEvent(); event != "event: etag\ndata: {\"etag\":\"etag-1\"}\n" {
+			t.Errorf("first event = %q", event)
+		}
+
+		mock.watch <- "etag-2"
+		if event := readEvent(); event != "event: etag\ndata: {\"etag\":\"etag-2\"}\n" {
+			t.Errorf("second event = %q", event)
+		}
+	})
+}
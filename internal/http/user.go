@@ -0,0 +1,213 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/SyncYomi/SyncYomi/internal/domain"
+	"github.com/go-chi/chi/v5"
+)
+
+type userService interface {
+	FindByID(ctx context.Context, id int) (*domain.User, error)
+	FindByUsername(ctx context.Context, username string) (*domain.User, error)
+	List(ctx context.Context) ([]domain.User, error)
+	SetRole(ctx context.Context, id int, role domain.Role) error
+	Delete(ctx context.Context, id int) error
+}
+
+type userHandler struct {
+	encoder encoder
+	service userService
+	auth    authService
+	audit   auditService
+}
+
+func newUserHandler(encoder encoder, service userService, auth authService, audit auditService) *userHandler {
+	return &userHandler{
+		encoder: encoder,
+		service: service,
+		auth:    auth,
+		audit:   audit,
+	}
+}
+
+func (h userHandler) Routes(r chi.Router) {
+	r.Get("/", h.list)
+	r.Post("/", h.store)
+	r.Put("/{userID}/role", h.setRole)
+	r.Delete("/{userID}", h.delete)
+}
+
+// userResponse is a user without its password hash.
+type userResponse struct {
+	ID       int         `json:"id"`
+	Username string      `json:"username"`
+	Role     domain.Role `json:"role"`
+}
+
+func newUserResponse(user domain.User) userResponse {
+	return userResponse{ID: user.ID, Username: user.Username, Role: user.Role}
+}
+
+type userIDContextKey struct{}
+
+// requestUserID returns the user making an authenticated request, set by IsAuthenticated:
+// the user of the session, or the owner of the api key.
+func requestUserID(ctx context.Context) int {
+	id, _ := ctx.Value(userIDContextKey{}).(int)
+	return id
+}
+
+func (h userHandler) list(w http.ResponseWriter, r *http.Request) {
+	users, err := h.service.List(r.Context())
+	if err != nil {
+		h.encoder.StatusInternalError(w)
+		return
+	}
+
+	response := make([]userResponse, 0, len(users))
+	for _, user := range users {
+		response = append(response, newUserResponse(user))
+	}
+
+	h.encoder.StatusResponse(r.Context(), w, response, http.StatusOK)
+}
+
+// store creates a user with the username, password and role of the body,
+// users without a role are members.
+func (h userHandler) store(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context()
+		data domain.User
+	)
+
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		h.encoder.StatusResponse(ctx, w, map[string]string{"message": "invalid request body"}, http.StatusBadRequest)
+		return
+	}
+
+	if data.Username == "" || data.Password == "" {
+		h.encoder.StatusResponse(ctx, w, map[string]string{"message": "username and password are required"}, http.StatusBadRequest)
+		return
+	}
+
+	if data.Role == "" {
+		data.Role = domain.RoleMember
+	}
+
+	if !data.Role.Valid() {
+		h.encoder.StatusResponse(ctx, w, map[string]string{"message": "unknown role"}, http.StatusBadRequest)
+		return
+	}
+
+	if err := h.auth.CreateUser(ctx, data.Username, data.Password, data.Role); err != nil {
+		if errors.Is(err, domain.ErrUserExists) {
+			h.encoder.StatusResponse(ctx, w, map[string]string{"message": "username is taken"}, http.StatusConflict)
+			return
+		}
+		h.encoder.StatusInternalError(w)
+		return
+	}
+
+	user, err := h.service.FindByUsername(ctx, data.Username)
+	if err != nil || user == nil {
+		h.encoder.StatusInternalError(w)
+		return
+	}
+
+	h.audit.Record(ctx, newAuditEntry(r, domain.AuditActionUserCreate, user.Username))
+
+	h.encoder.StatusResponse(ctx, w, newUserResponse(*user), http.StatusCreated)
+}
+
+// setRole changes the role of a user, users cannot change their own role
+// so there is always an admin left.
+func (h userHandler) setRole(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	id, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		h.encoder.StatusResponse(ctx, w, map[string]string{"message": "invalid user id"}, http.StatusBadRequest)
+		return
+	}
+
+	var data struct {
+		Role domain.Role `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil || !data.Role.Valid() {
+		h.encoder.StatusResponse(ctx, w, map[string]string{"message": "unknown role"}, http.StatusBadRequest)
+		return
+	}
+
+	if id == requestUserID(ctx) {
+		h.encoder.StatusResponse(ctx, w, map[string]string{"message": "users cannot change their own role"}, http.StatusBadRequest)
+		return
+	}
+
+	before, err := h.service.FindByID(ctx, id)
+	if err != nil {
+		h.encoder.StatusInternalError(w)
+		return
+	}
+	if before == nil {
+		h.encoder.StatusNotFound(ctx, w)
+		return
+	}
+
+	if err := h.service.SetRole(ctx, id, data.Role); err != nil {
+		if errors.Is(err, domain.ErrUserNotFound) {
+			h.encoder.StatusNotFound(ctx, w)
+			return
+		}
+		h.encoder.StatusInternalError(w)
+		return
+	}
+
+	entry := newAuditEntry(r, domain.AuditActionUserUpdate, before.Username)
+	entry.Before = auditValue(map[string]domain.Role{"role": before.Role})
+	entry.After = auditValue(map[string]domain.Role{"role": data.Role})
+	h.audit.Record(ctx, entry)
+
+	before.Role = data.Role
+
+	h.encoder.StatusResponse(ctx, w, newUserResponse(*before), http.StatusOK)
+}
+
+// delete removes a user and the api keys it owns, users cannot delete themselves.
+func (h userHandler) delete(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	id, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		h.encoder.StatusResponse(ctx, w, map[string]string{"message": "invalid user id"}, http.StatusBadRequest)
+		return
+	}
+
+	if id == requestUserID(ctx) {
+		h.encoder.StatusResponse(ctx, w, map[string]string{"message": "users cannot delete themselves"}, http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.service.FindByID(ctx, id)
+	if err != nil {
+		h.encoder.StatusInternalError(w)
+		return
+	}
+	if user == nil {
+		h.encoder.StatusNotFound(ctx, w)
+		return
+	}
+
+	if err := h.service.Delete(ctx, id); err != nil {
+		h.encoder.StatusInternalError(w)
+		return
+	}
+
+	h.audit.Record(ctx, newAuditEntry(r, domain.AuditActionUserDelete, user.Username))
+
+	h.encoder.NoContent(w)
+}
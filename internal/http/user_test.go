@@ -0,0 +1,185 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/SyncYomi/SyncYomi/internal/domain"
+	"github.com/go-chi/chi/v5"
+)
+
+type mockUserService struct {
+	users   []domain.User
+	deleted []int
+}
+
+func (m *mockUserService) FindByID(ctx context.Context, id int) (*domain.User, error) {
+	for _, u := range m.users {
+		if u.ID == id {
+			return &u, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *mockUserService) FindByUsername(ctx context.Context, username string) (*domain.User, error) {
+	for _, u := range m.users {
+		if u.Username == username {
+			return &u, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *mockUserService) List(ctx context.Context) ([]domain.User, error) {
+	return m.users, nil
+}
+
+func (m *mockUserService) SetRole(ctx context.Context, id int, role domain.Role) error {
+	for i := range m.users {
+		if m.users[i].ID == id {
+			m.users[i].Role = role
+			return nil
+		}
+	}
+	return domain.ErrUserNotFound
+}
+
+func (m *mockUserService) Delete(ctx context.Context, id int) error {
+	m.deleted = append(m.deleted, id)
+	return nil
+}
+
+// withUser makes the requests of the router come from the user with id.
+func withUser(id int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userIDContextKey{}, id)))
+		})
+	}
+}
+
+func TestUserHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		body       string
+		auth       *mockAuthService
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "list leaves out passwords",
+			method:     http.MethodGet,
+			target:     "/",
+			wantStatus: http.StatusOK,
+			wantBody:   `[{"id":1,"username":"admin","role":"admin"},{"id":2,"username":"guest","role":"member"}]`,
+		},
+		{
+			name:       "store creates a user",
+			method:     http.MethodPost,
+			target:     "/",
+			body:       `{"username":"guest","password":"p"}`,
+			wantStatus: http.StatusCreated,
+			wantBody:   `{"id":2,"username":"guest","role":"member"}`,
+		},
+		{
+			name:       "store of an unknown role",
+			method:     http.MethodPost,
+			target:     "/",
+			body:       `{"username":"guest","password":"p","role":"owner"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "set the role of another user",
+			method:     http.MethodPut,
+			target:     "/2/role",
+			body:       `{"role":"read_only"}`,
+			wantStatus: http.StatusOK,
+			wantBody:   `{"id":2,"username":"guest","role":"read_only"}`,
+		},
+		{
+			name:       "set your own role",
+			method:     http.MethodPut,
+			target:     "/1/role",
+			body:       `{"role":"member"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "set an unknown role",
+			method:     http.MethodPut,
+			target:     "/2/role",
+			body:       `{"role":"owner"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "set the role of an unknown user",
+			method:     http.MethodPut,
+			target:     "/3/role",
+			body:       `{"role":"member"}`,
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "store needs a password",
+			method:     http.MethodPost,
+			target:     "/",
+			body:       `{"username":"guest"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "store of a taken username",
+			method:     http.MethodPost,
+			target:     "/",
+			body:       `{"username":"guest","password":"p"}`,
+			auth:       &mockAuthService{createErr: domain.ErrUserExists},
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name:       "delete another user",
+			method:     http.MethodDelete,
+			target:     "/2",
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "delete yourself",
+			method:     http.MethodDelete,
+			target:     "/1",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "delete an unknown user",
+			method:     http.MethodDelete,
+			target:     "/3",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users := &mockUserService{users: []domain.User{
+				{ID: 1, Username: "admin", Password: "hash", Role: domain.RoleAdmin},
+				{ID: 2, Username: "guest", Password: "hash", Role: domain.RoleMember},
+			}}
+			auth := tt.auth
+			if auth == nil {
+				auth = &mockAuthService{}
+			}
+
+			r := chi.NewRouter()
+			r.With(withUser(1)).Route("/", newUserHandler(encoder{}, users, auth, &mockAuditService{}).Routes)
+
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body)))
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %v, want %v", rec.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && strings.TrimSpace(rec.Body.String()) != tt.wantBody {
+				t.Errorf("body = %s, want %s", rec.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
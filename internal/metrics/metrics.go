@@ -0,0 +1,185 @@
+// Package metrics collects the prometheus metrics served on /metrics.
+//
+// A nil *Metrics is valid and records nothing, so components work
+// without metrics in tests and commands.
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "syncyomi"
+
+type Metrics struct {
+	registry *prometheus.Registry
+
+	httpRequests        *prometheus.CounterVec
+	httpRequestDuration *prometheus.HistogramVec
+	syncRequests        *prometheus.CounterVec
+	syncBytes           *prometheus.CounterVec
+	notifications       *prometheus.CounterVec
+	jobRuns             *prometheus.CounterVec
+	jobLastRun          *prometheus.GaugeVec
+}
+
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests by route, method and status.",
+		}, []string{"route", "method", "status"}),
+
+		httpRequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Latency of HTTP requests by route and method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+
+		syncRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sync_requests_total",
+			Help:      "Requests for sync content by method and status, 304 is unchanged data and 412 a conflict.",
+		}, []string{"method", "status"}),
+
+		syncBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sync_bytes_total",
+			Help:      "Bytes received and sent by sync requests by api key name and direction.",
+		}, []string{"key", "direction"}),
+
+		notifications: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "notifications_sent_total",
+			Help:      "Notifications sent by sender type and result.",
+		}, []string{"type", "result"}),
+
+		jobRuns: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "scheduler_job_runs_total",
+			Help:      "Runs of scheduled jobs.",
+		}, []string{"job"}),
+
+		jobLastRun: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "scheduler_job_last_run_timestamp_seconds",
+			Help:      "Time the scheduled job last finished.",
+		}, []string{"job"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.httpRequests,
+		m.httpRequestDuration,
+		m.syncRequests,
+		m.syncBytes,
+		m.notifications,
+		m.jobRuns,
+		m.jobLastRun,
+	)
+
+	return m
+}
+
+// Handler serves the metrics in the prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// RegisterDB exposes the statistics of the database connection pool.
+func (m *Metrics) RegisterDB(stats func() sql.DBStats) {
+	if m == nil {
+		return
+	}
+
+	gauge := func(name string, help string, value func(s sql.DBStats) float64) prometheus.Collector {
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "db",
+			Name:      name,
+			Help:      help,
+		}, func() float64 { return value(stats()) })
+	}
+
+	counter := func(name string, help string, value func(s sql.DBStats) float64) prometheus.Collector {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "db",
+			Name:      name,
+			Help:      help,
+		}, func() float64 { return value(stats()) })
+	}
+
+	m.registry.MustRegister(
+		gauge("max_open_connections", "Maximum number of open connections.", func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) }),
+		gauge("open_connections", "Established connections, in use and idle.", func(s sql.DBStats) float64 { return float64(s.OpenConnections) }),
+		gauge("in_use_connections", "Connections in use.", func(s sql.DBStats) float64 { return float64(s.InUse) }),
+		gauge("idle_connections", "Idle connections.", func(s sql.DBStats) float64 { return float64(s.Idle) }),
+		counter("wait_count_total", "Connections waited for.", func(s sql.DBStats) float64 { return float64(s.WaitCount) }),
+		counter("wait_duration_seconds_total", "Time spent waiting for connections.", func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() }),
+	)
+}
+
+// ObserveRequest records an HTTP request, route is the pattern it matched.
+func (m *Metrics) ObserveRequest(route string, method string, status int, duration time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.httpRequests.WithLabelValues(route, method, strconv.Itoa(status)).Inc()
+	m.httpRequestDuration.WithLabelValues(route, method).Observe(duration.Seconds())
+}
+
+// ObserveSync records a request for sync content.
+func (m *Metrics) ObserveSync(method string, status int) {
+	if m == nil {
+		return
+	}
+
+	m.syncRequests.WithLabelValues(method, strconv.Itoa(status)).Inc()
+}
+
+// AddSyncBytes records the bytes a sync request of an api key received and sent.
+func (m *Metrics) AddSyncBytes(key string, in int64, out int64) {
+	if m == nil {
+		return
+	}
+
+	m.syncBytes.WithLabelValues(key, "in").Add(float64(in))
+	m.syncBytes.WithLabelValues(key, "out").Add(float64(out))
+}
+
+// NotificationSent records a notification sent by a sender of the given type.
+func (m *Metrics) NotificationSent(senderType string, err error) {
+	if m == nil {
+		return
+	}
+
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+
+	m.notifications.WithLabelValues(senderType, result).Inc()
+}
+
+// JobRun records a run of a scheduled job.
+func (m *Metrics) JobRun(job string) {
+	if m == nil {
+		return
+	}
+
+	m.jobRuns.WithLabelValues(job).Inc()
+	m.jobLastRun.WithLabelValues(job).SetToCurrentTime()
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/SyncYomi/SyncYomi/internal/domain"
 	"github.com/SyncYomi/SyncYomi/internal/logger"
+	"github.com/SyncYomi/SyncYomi/internal/metrics"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 	"golang.org/x/sync/errgroup"
@@ -24,13 +25,15 @@ type Service interface {
 type service struct {
 	log     zerolog.Logger
 	repo    domain.NotificationRepo
+	metrics *metrics.Metrics
 	senders []domain.NotificationSender
 }
 
-func NewService(log logger.Logger, repo domain.NotificationRepo) Service {
+func NewService(log logger.Logger, repo domain.NotificationRepo, metrics *metrics.Metrics) Service {
 	s := &service{
 		log:     log.With().Str("module", "notification").Logger(),
 		repo:    repo,
+		metrics: metrics,
 		senders: []domain.NotificationSender{},
 	}
 
@@ -118,18 +121,35 @@ func (s *service) registerSenders() {
 		if n.Enabled {
 			switch n.Type {
 			case domain.NotificationTypeDiscord:
-				s.senders = append(s.senders, NewDiscordSender(s.log, n))
+				s.senders = append(s.senders, s.measured(n.Type, NewDiscordSender(s.log, n)))
 			case domain.NotificationTypeNotifiarr:
-				s.senders = append(s.senders, NewNotifiarrSender(s.log, n))
+				s.senders = append(s.senders, s.measured(n.Type, NewNotifiarrSender(s.log, n)))
 			case domain.NotificationTypeTelegram:
-				s.senders = append(s.senders, NewTelegramSender(s.log, n))
+				s.senders = append(s.senders, s.measured(n.Type, NewTelegramSender(s.log, n)))
 			case domain.NotificationTypeNtfy:
-				s.senders = append(s.senders, NewNtfySender(s.log, n))
+				s.senders = append(s.senders, s.measured(n.Type, NewNtfySender(s.log, n)))
 			}
 		}
 	}
 }
 
+// measuredSender counts the notifications a sender sends in the metrics.
+type measuredSender struct {
+	domain.NotificationSender
+	senderType domain.NotificationType
+	metrics    *metrics.Metrics
+}
+
+func (s *service) measured(senderType domain.NotificationType, sender domain.NotificationSender) domain.NotificationSender {
+	return measuredSender{NotificationSender: sender, senderType: senderType, metrics: s.metrics}
+}
+
+func (m measuredSender) Send(event domain.NotificationEvent, payload domain.NotificationPayload) error {
+	err := m.NotificationSender.Send(event, payload)
+	m.metrics.NotificationSent(string(m.senderType), err)
+	return err
+}
+
 // Send notifications
 func (s *service) Send(event domain.NotificationEvent, payload domain.NotificationPayload) {
 	if len(s.senders) > 0 {
@@ -2,8 +2,10 @@ package scheduler
 
 import (
 	"context"
+	"github.com/SyncYomi/SyncYomi/internal/audit"
 	"github.com/SyncYomi/SyncYomi/internal/domain"
 	"github.com/SyncYomi/SyncYomi/internal/notification"
+	"github.com/SyncYomi/SyncYomi/internal/sync"
 	"github.com/SyncYomi/SyncYomi/internal/update"
 	"github.com/rs/zerolog"
 	"time"
@@ -43,3 +45,39 @@ func (j *CheckUpdatesJob) Run() {
 		j.lastCheckVersion = newRelease.TagName
 	}
 }
+
+type ExpireSyncUploadsJob struct {
+	Name    string
+	Log     zerolog.Logger
+	SyncSvc sync.Service
+}
+
+func (j *ExpireSyncUploadsJob) Run() {
+	if err := j.SyncSvc.ExpireUploads(context.TODO()); err != nil {
+		j.Log.Error().Err(err).Msg("could not expire sync uploads")
+	}
+}
+
+type ExpireSyncEventsJob struct {
+	Name    string
+	Log     zerolog.Logger
+	SyncSvc sync.Service
+}
+
+func (j *ExpireSyncEventsJob) Run() {
+	if err := j.SyncSvc.ExpireEvents(context.TODO()); err != nil {
+		j.Log.Error().Err(err).Msg("could not expire sync events")
+	}
+}
+
+type ExpireAuditLogJob struct {
+	Name     string
+	Log      zerolog.Logger
+	AuditSvc audit.Service
+}
+
+func (j *ExpireAuditLogJob) Run() {
+	if err := j.AuditSvc.Expire(context.TODO()); err != nil {
+		j.Log.Error().Err(err).Msg("could not expire audit log")
+	}
+}
@@ -1,9 +1,12 @@
 package scheduler
 
 import (
+	"github.com/SyncYomi/SyncYomi/internal/audit"
 	"github.com/SyncYomi/SyncYomi/internal/domain"
 	"github.com/SyncYomi/SyncYomi/internal/logger"
+	"github.com/SyncYomi/SyncYomi/internal/metrics"
 	"github.com/SyncYomi/SyncYomi/internal/notification"
+	syncsvc "github.com/SyncYomi/SyncYomi/internal/sync"
 	"github.com/SyncYomi/SyncYomi/internal/update"
 	"github.com/robfig/cron/v3"
 	"github.com/rs/zerolog"
@@ -25,18 +28,24 @@ type service struct {
 	version         string
 	notificationSvc notification.Service
 	updateSvc       *update.Service
+	syncSvc         syncsvc.Service
+	auditSvc        audit.Service
+	metrics         *metrics.Metrics
 
 	cron *cron.Cron
 	jobs map[string]cron.EntryID
 	m    sync.RWMutex
 }
 
-func NewService(log logger.Logger, config *domain.Config, notificationSvc notification.Service, updateSvc *update.Service) Service {
+func NewService(log logger.Logger, config *domain.Config, notificationSvc notification.Service, updateSvc *update.Service, syncSvc syncsvc.Service, auditSvc audit.Service, metrics *metrics.Metrics) Service {
 	return &service{
 		log:             log.With().Str("module", "scheduler").Logger(),
 		config:          config,
 		notificationSvc: notificationSvc,
 		updateSvc:       updateSvc,
+		syncSvc:         syncSvc,
+		auditSvc:        auditSvc,
+		metrics:         metrics,
 		cron: cron.New(cron.WithChain(
 			cron.Recover(cron.DefaultLogger),
 		)),
@@ -73,6 +82,36 @@ func (s *service) addAppJobs() {
 			s.log.Error().Err(err).Msgf("scheduler.addAppJobs: error adding job: %v", id)
 		}
 	}
+
+	expireUploads := &ExpireSyncUploadsJob{
+		Name:    "sync-expire-uploads",
+		Log:     s.log.With().Str("job", "sync-expire-uploads").Logger(),
+		SyncSvc: s.syncSvc,
+	}
+
+	if id, err := s.AddJob(expireUploads, 1*time.Hour, "sync-expire-uploads"); err != nil {
+		s.log.Error().Err(err).Msgf("scheduler.addAppJobs: error adding job: %v", id)
+	}
+
+	expireEvents := &ExpireSyncEventsJob{
+		Name:    "sync-expire-events",
+		Log:     s.log.With().Str("job", "sync-expire-events").Logger(),
+		SyncSvc: s.syncSvc,
+	}
+
+	if id, err := s.AddJob(expireEvents, 6*time.Hour, "sync-expire-events"); err != nil {
+		s.log.Error().Err(err).Msgf("scheduler.addAppJobs: error adding job: %v", id)
+	}
+
+	expireAuditLog := &ExpireAuditLogJob{
+		Name:     "audit-expire",
+		Log:      s.log.With().Str("job", "audit-expire").Logger(),
+		AuditSvc: s.auditSvc,
+	}
+
+	if id, err := s.AddJob(expireAuditLog, 6*time.Hour, "audit-expire"); err != nil {
+		s.log.Error().Err(err).Msgf("scheduler.addAppJobs: error adding job: %v", id)
+	}
 }
 
 func (s *service) Stop() {
@@ -81,10 +120,20 @@ func (s *service) Stop() {
 	return
 }
 
+// measure counts the runs of a job in the metrics.
+func (s *service) measure(identifier string) cron.JobWrapper {
+	return func(job cron.Job) cron.Job {
+		return cron.FuncJob(func() {
+			job.Run()
+			s.metrics.JobRun(identifier)
+		})
+	}
+}
+
 func (s *service) AddJob(job cron.Job, interval time.Duration, identifier string) (int, error) {
 
 	id := s.cron.Schedule(cron.Every(interval), cron.NewChain(
-		cron.SkipIfStillRunning(cron.DiscardLogger)).Then(job),
+		cron.SkipIfStillRunning(cron.DiscardLogger), s.measure(identifier)).Then(job),
 	)
 
 	s.log.Debug().Msgf("scheduler.AddJob: job successfully added: %s id %d", identifier, id)
@@ -0,0 +1,69 @@
+package snapshot
+
+import (
+	"context"
+
+	"github.com/SyncYomi/SyncYomi/internal/database"
+	"github.com/SyncYomi/SyncYomi/pkg/errors"
+)
+
+// Copy copies the snapshot tables of src to dst, with the ids, etags and timestamps kept,
+// and returns the number of rows copied by table. dst has to be empty, and is
+// unchanged if the copy fails or the row counts do not match.
+func Copy(ctx context.Context, src *database.DB, dst *database.DB) (map[string]int, error) {
+	tables := src.SnapshotTables()
+
+	for _, table := range tables {
+		count, err := dst.CountSnapshotRows(ctx, table)
+		if err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			return nil, errors.New("target database is not empty: %v has %d rows", table, count)
+		}
+	}
+
+	restore, err := dst.BeginSnapshotRestore(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := map[string]int{}
+	for _, table := range tables {
+		err := src.ExportSnapshotTable(ctx, table, func(row database.SnapshotRow) error {
+			rows[table]++
+			return restore.Insert(table, row)
+		})
+		if err != nil {
+			restore.Rollback()
+			return nil, err
+		}
+
+		count, err := restore.Count(table)
+		if err != nil {
+			restore.Rollback()
+			return nil, err
+		}
+		if count != rows[table] {
+			restore.Rollback()
+			return nil, errors.New("row count of %v does not match: copied %d, target has %d", table, rows[table], count)
+		}
+
+		// the server may still be running on src, rows written meanwhile would be lost
+		count, err = src.CountSnapshotRows(ctx, table)
+		if err != nil {
+			restore.Rollback()
+			return nil, err
+		}
+		if count != rows[table] {
+			restore.Rollback()
+			return nil, errors.New("%v changed during the copy: copied %d rows, source has %d, run it again", table, rows[table], count)
+		}
+	}
+
+	if err := restore.Commit(); err != nil {
+		return nil, err
+	}
+
+	return rows, nil
+}
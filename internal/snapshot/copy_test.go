@@ -0,0 +1,62 @@
+package snapshot
+
+import (
+	"context"
+	"testing"
+
+	"github.com/SyncYomi/SyncYomi/internal/database"
+	"github.com/SyncYomi/SyncYomi/internal/domain"
+	"github.com/SyncYomi/SyncYomi/internal/logger"
+)
+
+func TestCopy(t *testing.T) {
+	ctx := context.Background()
+	log := logger.Mock()
+
+	src := openTestDB(t, &domain.Config{ConfigPath: t.TempDir()})
+	key := &domain.APIKey{Name: "phone", Key: "key1", Scopes: []string{}}
+	if err := database.NewAPIRepo(log, src).Store(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	srcSync := database.NewSyncRepo(log, src)
+	if _, _, err := srcSync.SetSyncData(ctx, key.ID, "phone", []byte("old library")); err != nil {
+		t.Fatal(err)
+	}
+	etag, _, err := srcSync.SetSyncData(ctx, key.ID, "tablet", []byte("library"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := srcSync.ListSyncDataHistory(ctx, key.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := openTestDB(t, &domain.Config{ConfigPath: t.TempDir()})
+
+	rows, err := Copy(ctx, src, dst)
+	if err != nil {
+		t.Fatalf("Copy() error = %v", err)
+	}
+	if rows["api_key"] != 1 || rows["sync_data"] != 1 {
+		t.Errorf("Copy() rows = %v", rows)
+	}
+
+	dstSync := database.NewSyncRepo(log, dst)
+	got, err := dstSync.ListSyncDataHistory(ctx, key.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].ETag != want[0].ETag || !got[0].CreatedAt.Equal(want[0].CreatedAt) {
+		t.Errorf("copied history = %+v, want %+v", got, want)
+	}
+
+	data, gotEtag, err := dstSync.GetSyncDataAndETag(ctx, key.ID)
+	if err != nil || string(data) != "library" || *gotEtag != *etag {
+		t.Errorf("copied data = %q, %v", data, err)
+	}
+
+	// the target is no longer empty
+	if _, err := Copy(ctx, src, dst); err == nil {
+		t.Error("Copy() to a database with rows error = nil, want error")
+	}
+}
@@ -0,0 +1,319 @@
+// Package snapshot creates and restores backups of a whole instance.
+//
+// A snapshot is a gzipped tar archive with:
+//
+//	manifest.json         what the snapshot contains, always the first file
+//	config.toml           the config file of the instance
+//	tables/<table>.jsonl  the rows of each table, one json object per line
+//
+// Rows are written by column name with the sync data decrypted,
+// so a snapshot can be restored with another database driver,
+// blob storage or encryption key.
+package snapshot
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/SyncYomi/SyncYomi/internal/database"
+	"github.com/SyncYomi/SyncYomi/pkg/errors"
+)
+
+// FormatVersion is the version of the snapshot layout,
+// snapshots of a newer format are not restored.
+const FormatVersion = 1
+
+const (
+	manifestName = "manifest.json"
+	configName   = "config.toml"
+	tablesDir    = "tables/"
+	tableExt     = ".jsonl"
+)
+
+type Manifest struct {
+	Format    int       `json:"format"`
+	Version   string    `json:"version"`
+	Driver    string    `json:"driver"`
+	CreatedAt time.Time `json:"created_at"`
+	Tables    []string  `json:"tables"`
+
+	// Rows is the number of rows written or restored by table,
+	// the manifest comes first in the archive so it does not have them.
+	Rows map[string]int `json:"-"`
+}
+
+// Summary lists the row count of each table, like "2 users, 1 api_key".
+func (m *Manifest) Summary() string {
+	parts := make([]string, 0, len(m.Tables))
+	for _, table := range m.Tables {
+		parts = append(parts, fmt.Sprintf("%d %v", m.Rows[table], table))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Create writes a snapshot of the database and the config file in configPath to w.
+func Create(ctx context.Context, w io.Writer, db *database.DB, configPath string, version string) (*Manifest, error) {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	now := time.Now().UTC()
+
+	manifest := &Manifest{
+		Format:    FormatVersion,
+		Version:   version,
+		Driver:    db.Driver,
+		CreatedAt: now,
+		Tables:    db.SnapshotTables(),
+		Rows:      map[string]int{},
+	}
+
+	if err := writeJSON(tw, manifestName, now, manifest); err != nil {
+		return nil, err
+	}
+
+	config, err := os.ReadFile(filepath.Join(configPath, configName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "could not read config")
+	}
+	if err == nil {
+		if err := writeFile(tw, configName, now, config); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, table := range manifest.Tables {
+		count, err := writeTable(ctx, tw, db, table, now)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Rows[table] = count
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, errors.Wrap(err, "could not write snapshot")
+	}
+	if err := gz.Close(); err != nil {
+		return nil, errors.Wrap(err, "could not write snapshot")
+	}
+
+	return manifest, nil
+}
+
+// writeTable writes the rows of a table to a temporary file first,
+// since tar needs the size of a file before its content.
+func writeTable(ctx context.Context, tw *tar.Writer, db *database.DB, table string, modTime time.Time) (int, error) {
+	tmp, err := os.CreateTemp("", "syncyomi-snapshot-*.jsonl")
+	if err != nil {
+		return 0, errors.Wrap(err, "could not create temporary file")
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	buf := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(buf)
+
+	count := 0
+	err = db.ExportSnapshotTable(ctx, table, func(row database.SnapshotRow) error {
+		count++
+		return enc.Encode(row)
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "could not export table %v", table)
+	}
+
+	if err := buf.Flush(); err != nil {
+		return 0, errors.Wrap(err, "could not write temporary file")
+	}
+
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	header := &tar.Header{
+		Name:    tablesDir + table + tableExt,
+		Mode:    0600,
+		Size:    size,
+		ModTime: modTime,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return 0, errors.Wrap(err, "could not write snapshot")
+	}
+	if _, err := io.Copy(tw, tmp); err != nil {
+		return 0, errors.Wrap(err, "could not write snapshot")
+	}
+
+	return count, nil
+}
+
+func writeJSON(tw *tar.Writer, name string, modTime time.Time, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(tw, name, modTime, data)
+}
+
+func writeFile(tw *tar.Writer, name string, modTime time.Time, data []byte) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: modTime,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return errors.Wrap(err, "could not write snapshot")
+	}
+	if _, err := tw.Write(data); err != nil {
+		return errors.Wrap(err, "could not write snapshot")
+	}
+	return nil
+}
+
+type RestoreOptions struct {
+	// ConfigPath is where config.toml is written with Config.
+	ConfigPath string
+	// Config restores the config file, the current one is kept as config.toml.bak.
+	Config bool
+}
+
+// Restore replaces the content of the database with a snapshot read from r,
+// the database is unchanged if the snapshot cannot be restored.
+func Restore(ctx context.Context, r io.Reader, db *database.DB, opts RestoreOptions) (*Manifest, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "not a snapshot")
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+
+	header, err := tr.Next()
+	if err != nil || header.Name != manifestName {
+		return nil, errors.New("not a snapshot: %v missing", manifestName)
+	}
+
+	var manifest Manifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return nil, errors.Wrap(err, "invalid manifest")
+	}
+
+	if manifest.Format > FormatVersion {
+		return nil, errors.New("snapshot format %d is newer than the supported format %d, upgrade syncyomi first", manifest.Format, FormatVersion)
+	}
+
+	restore, err := db.BeginSnapshotRestore(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var config []byte
+	manifest.Rows = map[string]int{}
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			restore.Rollback()
+			return nil, errors.Wrap(err, "could not read snapshot")
+		}
+
+		switch {
+		case header.Name == configName:
+			if config, err = io.ReadAll(tr); err != nil {
+				restore.Rollback()
+				return nil, errors.Wrap(err, "could not read snapshot")
+			}
+
+		case strings.HasPrefix(header.Name, tablesDir) && strings.HasSuffix(header.Name, tableExt):
+			table := strings.TrimSuffix(strings.TrimPrefix(header.Name, tablesDir), tableExt)
+			count, err := restoreTable(tr, restore, table)
+			if err != nil {
+				restore.Rollback()
+				return nil, err
+			}
+			manifest.Rows[table] = count
+		}
+	}
+
+	for _, table := range manifest.Tables {
+		if _, ok := manifest.Rows[table]; !ok {
+			restore.Rollback()
+			return nil, errors.New("snapshot is incomplete: table %v missing", table)
+		}
+	}
+
+	if opts.Config && config != nil {
+		if err := writeConfig(opts.ConfigPath, config); err != nil {
+			restore.Rollback()
+			return nil, err
+		}
+	}
+
+	if err := restore.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &manifest, nil
+}
+
+// restoreTable inserts the rows of a table, and returns how many there were.
+func restoreTable(r io.Reader, restore *database.SnapshotRestore, table string) (int, error) {
+	scanner := bufio.NewScanner(r)
+	// rows with sync data are as large as the library
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<31-1)
+
+	count := 0
+	for scanner.Scan() {
+		count++
+
+		dec := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		dec.UseNumber()
+
+		var row database.SnapshotRow
+		if err := dec.Decode(&row); err != nil {
+			return 0, errors.Wrap(err, "invalid row %d of %v", count, table)
+		}
+
+		if err := restore.Insert(table, row); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, errors.Wrap(err, "could not read table %v", table)
+	}
+
+	return count, nil
+}
+
+func writeConfig(configPath string, config []byte) error {
+	path := filepath.Join(configPath, configName)
+
+	if current, err := os.ReadFile(path); err == nil {
+		if err := os.WriteFile(path+".bak", current, 0600); err != nil {
+			return errors.Wrap(err, "could not back up config")
+		}
+	}
+
+	if err := os.WriteFile(path, config, 0600); err != nil {
+		return errors.Wrap(err, "could not write config")
+	}
+
+	return nil
+}
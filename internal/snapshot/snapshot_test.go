@@ -0,0 +1,137 @@
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/SyncYomi/SyncYomi/internal/database"
+	"github.com/SyncYomi/SyncYomi/internal/domain"
+	"github.com/SyncYomi/SyncYomi/internal/logger"
+)
+
+func openTestDB(t *testing.T, cfg *domain.Config) *database.DB {
+	t.Helper()
+
+	cfg.DatabaseType = "sqlite"
+	db, err := database.NewDB(cfg, logger.Mock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func TestCreateRestore(t *testing.T) {
+	ctx := context.Background()
+	log := logger.Mock()
+
+	// the source encrypts the sync data, the target does not
+	srcDir := t.TempDir()
+	src := openTestDB(t, &domain.Config{ConfigPath: srcDir, EncryptionKey: "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE="})
+	if err := os.WriteFile(filepath.Join(srcDir, "config.toml"), []byte("port = 8282\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := database.NewUserRepo(log, src).Store(ctx, domain.User{Username: "admin", Password: "hash"}); err != nil {
+		t.Fatal(err)
+	}
+	key := &domain.APIKey{Name: "phone", Key: "key1", Scopes: []string{}, MaxDailyUpload: 100}
+	if err := database.NewAPIRepo(log, src).Store(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	syncRepo := database.NewSyncRepo(log, src)
+	if _, _, err := syncRepo.SetSyncData(ctx, key.ID, "phone", []byte("old library")); err != nil {
+		t.Fatal(err)
+	}
+	etag, _, err := syncRepo.SetSyncData(ctx, key.ID, "tablet", []byte("new library"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := Create(ctx, &buf, src, srcDir, "test"); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+
+	dstDir := t.TempDir()
+	dst := openTestDB(t, &domain.Config{ConfigPath: dstDir})
+
+	// replaced by the restore
+	if err := database.NewAPIRepo(log, dst).Store(ctx, &domain.APIKey{Name: "other", Key: "key2", Scopes: []string{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := Restore(ctx, bytes.NewReader(buf.Bytes()), dst, RestoreOptions{ConfigPath: dstDir, Config: true})
+	if err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+	if manifest.Version != "test" || manifest.Rows["sync_data_history"] != 1 {
+		t.Errorf("Restore() manifest = %+v", manifest)
+	}
+
+	keys, err := database.NewAPIRepo(log, dst).GetKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].ID != key.ID || keys[0].Prefix != "key1" || keys[0].MaxDailyUpload != 100 {
+		t.Errorf("restored keys = %+v", keys)
+	}
+
+	if user, err := database.NewUserRepo(log, dst).FindByUsername(ctx, "admin"); err != nil || user.Password != "hash" {
+		t.Errorf("restored user = %+v, %v", user, err)
+	}
+
+	dstSync := database.NewSyncRepo(log, dst)
+	data, gotEtag, err := dstSync.GetSyncDataAndETag(ctx, key.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "new library" || *gotEtag != *etag {
+		t.Errorf("restored sync data = %q, etag %v, want %q, etag %v", data, *gotEtag, "new library", *etag)
+	}
+
+	history, err := dstSync.ListSyncDataHistory(ctx, key.ID)
+	if err != nil || len(history) != 1 || history[0].DeviceName != "phone" {
+		t.Fatalf("restored history = %+v, %v", history, err)
+	}
+	if old, err := dstSync.GetSyncDataHistory(ctx, key.ID, history[0].ETag); err != nil || string(old) != "old library" {
+		t.Errorf("restored history data = %q, %v", old, err)
+	}
+
+	config, err := os.ReadFile(filepath.Join(dstDir, "config.toml"))
+	if err != nil || string(config) != "port = 8282\n" {
+		t.Errorf("restored config = %q, %v", config, err)
+	}
+
+	// new rows continue after the restored ids
+	if _, _, err := dstSync.SetSyncData(ctx, key.ID, "phone", []byte("newer library")); err != nil {
+		t.Errorf("SetSyncData() after restore error = %v", err)
+	}
+}
+
+func TestRestore_invalid(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	db := openTestDB(t, &domain.Config{ConfigPath: dir})
+
+	if err := database.NewAPIRepo(logger.Mock(), db).Store(ctx, &domain.APIKey{Name: "phone", Key: "key1", Scopes: []string{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Restore(ctx, bytes.NewReader([]byte("not a snapshot")), db, RestoreOptions{}); err == nil {
+		t.Error("Restore() error = nil, want error")
+	}
+
+	// the database is unchanged
+	keys, err := database.NewAPIRepo(logger.Mock(), db).GetKeys(ctx)
+	if err != nil || len(keys) != 1 {
+		t.Errorf("keys after failed restore = %+v, %v", keys, err)
+	}
+}
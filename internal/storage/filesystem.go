@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/SyncYomi/SyncYomi/internal/domain"
+	"github.com/SyncYomi/SyncYomi/pkg/errors"
+)
+
+// FilesystemStore stores blobs as files in a directory.
+type FilesystemStore struct {
+	root string
+}
+
+func NewFilesystemStore(root string) *FilesystemStore {
+	return &FilesystemStore{root: root}
+}
+
+// path spreads the blobs over subdirectories by the first characters of the key,
+// to keep directories small.
+func (s *FilesystemStore) path(key string) (string, error) {
+	if !validKey(key) {
+		return "", errors.New("invalid blob key: %q", key)
+	}
+
+	dir := "_"
+	if len(key) >= 2 {
+		dir = key[:2]
+	}
+
+	return filepath.Join(s.root, dir, key), nil
+}
+
+func (s *FilesystemStore) Put(ctx context.Context, key string, data []byte) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errors.Wrap(err, "could not create blob directory")
+	}
+
+	// write to a temporary file first, so a blob is never read half written
+	tmp, err := os.CreateTemp(filepath.Dir(path), key+".*.tmp")
+	if err != nil {
+		return errors.Wrap(err, "could not create blob")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "could not write blob")
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "could not write blob")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "could not write blob")
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return errors.Wrap(err, "could not write blob")
+	}
+
+	return nil
+}
+
+func (s *FilesystemStore) Get(ctx context.Context, key string) ([]byte, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, domain.ErrBlobNotFound
+		}
+		return nil, errors.Wrap(err, "could not read blob")
+	}
+
+	return data, nil
+}
+
+func (s *FilesystemStore) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, domain.ErrBlobNotFound
+		}
+		return nil, errors.Wrap(err, "could not read blob")
+	}
+
+	return f, nil
+}
+
+func (s *FilesystemStore) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "could not delete blob")
+	}
+
+	return nil
+}
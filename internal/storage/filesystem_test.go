@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/SyncYomi/SyncYomi/internal/domain"
+)
+
+// testBlobStore checks the behaviour shared by all blob stores.
+func testBlobStore(t *testing.T, s domain.BlobStore) {
+	t.Helper()
+	ctx := context.Background()
+
+	if _, err := s.Get(ctx, "missing"); !errors.Is(err, domain.ErrBlobNotFound) {
+		t.Errorf("Get() missing error = %v, want %v", err, domain.ErrBlobNotFound)
+	}
+
+	if err := s.Put(ctx, "key1", []byte("one")); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if err := s.Put(ctx, "key1", []byte("two")); err != nil {
+		t.Fatalf("Put() replace error = %v", err)
+	}
+
+	got, err := s.Get(ctx, "key1")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if !bytes.Equal(got, []byte("two")) {
+		t.Errorf("Get() = %q, want %q", got, "two")
+	}
+
+	r, err := s.Open(ctx, "key1")
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	got, err = io.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(got, []byte("two")) {
+		t.Errorf("Open() read = %q, %v, want %q", got, err, "two")
+	}
+
+	if err := s.Delete(ctx, "key1"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if err := s.Delete(ctx, "key1"); err != nil {
+		t.Errorf("Delete() missing error = %v", err)
+	}
+	if _, err := s.Get(ctx, "key1"); !errors.Is(err, domain.ErrBlobNotFound) {
+		t.Errorf("Get() deleted error = %v, want %v", err, domain.ErrBlobNotFound)
+	}
+	if _, err := s.Open(ctx, "key1"); !errors.Is(err, domain.ErrBlobNotFound) {
+		t.Errorf("Open() deleted error = %v, want %v", err, domain.ErrBlobNotFound)
+	}
+
+	if err := s.Put(ctx, "../escape", []byte("x")); err == nil {
+		t.Error("Put() invalid key error = nil, want error")
+	}
+}
+
+func TestFilesystemStore(t *testing.T) {
+	root := t.TempDir()
+	s := NewFilesystemStore(filepath.Join(root, "blobs"))
+
+	testBlobStore(t, s)
+
+	if err := s.Put(context.Background(), "abcdef", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "blobs", "ab", "abcdef")); err != nil {
+		t.Errorf("Put() did not write the blob file: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "escape")); !os.IsNotExist(err) {
+		t.Error("Put() wrote outside of the root")
+	}
+}
@@ -0,0 +1,298 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/SyncYomi/SyncYomi/internal/domain"
+	"github.com/SyncYomi/SyncYomi/pkg/errors"
+)
+
+type S3Options struct {
+	// Endpoint is the URL of the S3 compatible server, e.g. https://s3.us-east-1.amazonaws.com
+	Endpoint        string
+	Region          string
+	Bucket          string
+	Prefix          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// PathStyle puts the bucket in the path instead of the host name, as MinIO expects.
+	PathStyle bool
+}
+
+// s3ResponseHeaderTimeout bounds the wait for the response headers of a request,
+// dialing and the TLS handshake keep the timeouts of http.DefaultTransport.
+const s3ResponseHeaderTimeout = time.Minute
+
+// S3Store stores blobs as objects in an S3 compatible bucket,
+// requests are signed with AWS Signature Version 4.
+type S3Store struct {
+	opts     S3Options
+	endpoint *url.URL
+	client   *http.Client
+
+	// now is replaced in tests
+	now func() time.Time
+}
+
+func NewS3Store(opts S3Options) (*S3Store, error) {
+	endpoint, err := url.Parse(opts.Endpoint)
+	if err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, errors.New("s3: invalid endpoint: %q", opts.Endpoint)
+	}
+
+	if opts.Region == "" {
+		opts.Region = "us-east-1"
+	}
+
+	// no client wide timeout, it would cut off streamed downloads,
+	// their bodies are bound to the context of the caller instead
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = s3ResponseHeaderTimeout
+
+	return &S3Store{
+		opts:     opts,
+		endpoint: endpoint,
+		client:   &http.Client{Transport: transport},
+		now:      time.Now,
+	}, nil
+}
+
+// objectURL returns the URL of the object holding the blob key.
+func (s *S3Store) objectURL(key string) (*url.URL, error) {
+	if !validKey(key) {
+		return nil, errors.New("invalid blob key: %q", key)
+	}
+
+	u := *s.endpoint
+	object := strings.TrimSuffix(u.Path, "/") + "/"
+	if s.opts.PathStyle {
+		object += s.opts.Bucket + "/"
+	} else {
+		u.Host = s.opts.Bucket + "." + u.Host
+	}
+	u.Path = object + s.opts.Prefix + key
+
+	return &u, nil
+}
+
+func (s *S3Store) Put(ctx context.Context, key string, data []byte) error {
+	resp, err := s.do(ctx, http.MethodPut, key, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+
+	return nil
+}
+
+func (s *S3Store) Get(ctx context.Context, key string) ([]byte, error) {
+	body, err := s.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, errors.Wrap(err, "s3: could not read object")
+	}
+
+	return data, nil
+}
+
+func (s *S3Store) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, domain.ErrBlobNotFound
+	default:
+		defer resp.Body.Close()
+		return nil, responseError(resp)
+	}
+}
+
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	default:
+		return responseError(resp)
+	}
+}
+
+func (s *S3Store) do(ctx context.Context, method string, key string, body []byte) (*http.Response, error) {
+	u, err := s.objectURL(key)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "s3: could not create request")
+	}
+	if body == nil {
+		req.Body = http.NoBody
+	}
+
+	s.sign(req, body)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "s3: request failed")
+	}
+
+	return resp, nil
+}
+
+// responseError reads the S3 error response, the body is xml with a code and message.
+func responseError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return errors.New("s3: unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+}
+
+// sign adds the AWS Signature Version 4 authorization to req for s3,
+// which also signs the hash of the body.
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (s *S3Store) sign(req *http.Request, body []byte) {
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", s.now().UTC().Format(amzDateFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signV4(req, payloadHash, s.opts.AccessKeyID, s.opts.SecretAccessKey, s.opts.Region, "s3")
+}
+
+const amzDateFormat = "20060102T150405Z"
+
+// signV4 adds the AWS Signature Version 4 authorization to req, signing the host
+// and all headers already set, which have to include X-Amz-Date.
+// https://docs.aws.amazon.com/IAM/latest/UserGuide/create-signed-request.html
+func signV4(req *http.Request, payloadHash string, accessKeyID string, secretAccessKey string, region string, service string) {
+	amzDate := req.Header.Get("X-Amz-Date")
+	day := amzDate[:len("20060102")]
+
+	canonical, signedHeaders := canonicalRequest(req, payloadHash)
+
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonical)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKeyID, scope, signedHeaders, signature))
+}
+
+// canonicalRequest returns the canonical form of req that is signed, and the names of the signed headers.
+// The path is used as is, s3 does not normalize or double escape it like other services.
+func canonicalRequest(req *http.Request, payloadHash string) (string, string) {
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		if strings.EqualFold(name, "Authorization") {
+			continue
+		}
+		folded := make([]string, len(values))
+		for i, v := range values {
+			// sequential spaces are folded into one
+			folded[i] = strings.Join(strings.Fields(v), " ")
+		}
+		headers[strings.ToLower(name)] = strings.Join(folded, ",")
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	return strings.Join([]string{
+		req.Method,
+		path,
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n"), signedHeaders
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		values := query[k]
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, uriEncode(k)+"="+uriEncode(v))
+		}
+	}
+
+	return strings.Join(parts, "&")
+}
+
+// uriEncode escapes everything but the unreserved characters, as SigV4 requires.
+func uriEncode(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
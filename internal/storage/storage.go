@@ -0,0 +1,45 @@
+// Package storage implements the blob stores holding the sync data.
+package storage
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/SyncYomi/SyncYomi/internal/domain"
+	"github.com/SyncYomi/SyncYomi/pkg/errors"
+)
+
+// New returns the blob store selected in the config.
+func New(cfg *domain.Config) (domain.BlobStore, error) {
+	switch cfg.BlobStorage {
+	case "", "filesystem":
+		root := cfg.BlobStoragePath
+		if root == "" {
+			root = filepath.Join(cfg.ConfigPath, "blobs")
+		}
+		return NewFilesystemStore(root), nil
+
+	case "s3":
+		if cfg.S3Endpoint == "" || cfg.S3Bucket == "" {
+			return nil, errors.New("s3: endpoint and bucket required")
+		}
+		return NewS3Store(S3Options{
+			Endpoint:        cfg.S3Endpoint,
+			Region:          cfg.S3Region,
+			Bucket:          cfg.S3Bucket,
+			Prefix:          cfg.S3Prefix,
+			AccessKeyID:     cfg.S3AccessKeyID,
+			SecretAccessKey: cfg.S3SecretAccessKey,
+			PathStyle:       cfg.S3PathStyle,
+		})
+
+	default:
+		return nil, errors.New("unsupported blob storage: %v", cfg.BlobStorage)
+	}
+}
+
+// validKey reports whether key can be used as a file or object name,
+// keys are generated by the database so anything else is a bug.
+func validKey(key string) bool {
+	return key != "" && key != "." && key != ".." && !strings.ContainsAny(key, `/\`)
+}
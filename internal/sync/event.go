@@ -0,0 +1,161 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/SyncYomi/SyncYomi/internal/domain"
+)
+
+// ErrInvalidEventFilter is returned by ListEvents when the filter has an unknown event type or a negative offset.
+var ErrInvalidEventFilter = errors.New("invalid sync event filter")
+
+const (
+	// DefaultEventLimit is the number of events listed when the filter has no limit.
+	DefaultEventLimit = 50
+	// MaxEventLimit bounds the number of events listed at once.
+	MaxEventLimit = 500
+)
+
+// storeSyncEvent keeps a reported sync event for the history,
+// a failure is only logged so the event is still notified.
+func (s service) storeSyncEvent(ctx context.Context, apiKeyID int, event domain.NotificationEvent, deviceName string, detailMessage string) {
+	err := s.repo.StoreSyncEvent(ctx, &domain.SyncEvent{
+		APIKeyID:   apiKeyID,
+		DeviceName: deviceName,
+		Event:      event,
+		Message:    detailMessage,
+	})
+	if err != nil {
+		s.log.Error().Err(err).Msgf("could not store sync event: %v", event)
+	}
+}
+
+// List the sync events matching filter, newest first, and the number of
+// events matching it without limit and offset.
+// The limit defaults to DefaultEventLimit and is capped at MaxEventLimit.
+func (s service) ListEvents(ctx context.Context, filter domain.SyncEventFilter) ([]domain.SyncEvent, int, error) {
+	if filter.Event != "" {
+		if _, err := parseSyncEvent(string(filter.Event)); err != nil {
+			return nil, 0, ErrInvalidEventFilter
+		}
+	}
+	if filter.Offset < 0 {
+		return nil, 0, ErrInvalidEventFilter
+	}
+
+	filter.Limit = EventLimit(filter.Limit)
+
+	return s.repo.ListSyncEvents(ctx, filter)
+}
+
+// EventLimit returns the number of events ListEvents lists for limit.
+func EventLimit(limit int) int {
+	if limit <= 0 {
+		return DefaultEventLimit
+	}
+	if limit > MaxEventLimit {
+		return MaxEventLimit
+	}
+	return limit
+}
+
+// Sum up the sync events matching filter by device, limit and offset are ignored.
+func (s service) EventStats(ctx context.Context, filter domain.SyncEventFilter) (*domain.SyncEventStats, error) {
+	counts, err := s.repo.CountSyncEvents(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return syncEventStats(counts), nil
+}
+
+// syncEventStats sums up event counts by device, devices with the most failures first.
+func syncEventStats(counts []domain.SyncEventCount) *domain.SyncEventStats {
+	type deviceKey struct {
+		apiKeyID int
+		name     string
+	}
+
+	stats := &domain.SyncEventStats{Devices: []domain.SyncEventDeviceStats{}}
+	devices := map[deviceKey]*domain.SyncEventDeviceStats{}
+	var order []deviceKey
+
+	for _, c := range counts {
+		key := deviceKey{c.APIKeyID, c.DeviceName}
+		device, ok := devices[key]
+		if !ok {
+			device = &domain.SyncEventDeviceStats{APIKeyID: c.APIKeyID, APIKeyName: c.APIKeyName, DeviceName: c.DeviceName}
+			devices[key] = device
+			order = append(order, key)
+		}
+
+		device.Total += c.Count
+		stats.Total += c.Count
+
+		if c.LastAt.After(device.LastEventAt) {
+			device.LastEventAt = c.LastAt
+		}
+
+		switch c.Event {
+		case domain.NotificationEventSyncSuccess:
+			device.Successes += c.Count
+			stats.Successes += c.Count
+		case domain.NotificationEventSyncFailed, domain.NotificationEventSyncError:
+			device.Failures += c.Count
+			stats.Failures += c.Count
+			if device.LastFailureAt == nil || c.LastAt.After(*device.LastFailureAt) {
+				lastAt := c.LastAt
+				device.LastFailureAt = &lastAt
+			}
+		}
+	}
+
+	stats.SuccessRate = successRate(stats.Successes, stats.Failures)
+
+	for _, key := range order {
+		device := devices[key]
+		device.SuccessRate = successRate(device.Successes, device.Failures)
+		stats.Devices = append(stats.Devices, *device)
+	}
+
+	sort.SliceStable(stats.Devices, func(i, j int) bool {
+		if stats.Devices[i].Failures != stats.Devices[j].Failures {
+			return stats.Devices[i].Failures > stats.Devices[j].Failures
+		}
+		return stats.Devices[i].LastEventAt.After(stats.Devices[j].LastEventAt)
+	})
+
+	return stats
+}
+
+// successRate is the share of finished syncs that succeeded, started and cancelled
+// syncs do not count. It is 0 when no sync finished.
+func successRate(successes int, failures int) float64 {
+	if successes+failures == 0 {
+		return 0
+	}
+	return float64(successes) / float64(successes+failures)
+}
+
+// Delete the sync events older than the syncEventRetention days of the config.
+func (s service) ExpireEvents(ctx context.Context) error {
+	if s.config.SyncEventRetention <= 0 {
+		return nil
+	}
+
+	before := time.Now().AddDate(0, 0, -s.config.SyncEventRetention)
+
+	deleted, err := s.repo.DeleteSyncEvents(ctx, before)
+	if err != nil {
+		return err
+	}
+
+	if deleted > 0 {
+		s.log.Info().Msgf("Deleted %d expired sync events", deleted)
+	}
+
+	return nil
+}
@@ -0,0 +1,123 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/SyncYomi/SyncYomi/internal/domain"
+)
+
+// ErrLeaseHeld is returned when another device holds the sync lease.
+var ErrLeaseHeld = errors.New("sync lease held by another device")
+
+// ErrLeaseNotHeld is returned when a device extends or releases a sync lease it does not hold.
+var ErrLeaseNotHeld = errors.New("sync lease not held")
+
+// ErrInvalidLease is returned when a lease is requested without a device id or with a ttl out of range.
+var ErrInvalidLease = errors.New("invalid sync lease")
+
+const (
+	// DefaultLeaseTTL is how long a lease is held when the device does not ask for a ttl.
+	DefaultLeaseTTL = time.Minute
+	// MinLeaseTTL and MaxLeaseTTL bound the ttl a device can ask for,
+	// a device that needs longer extends the lease while it syncs.
+	MinLeaseTTL = 5 * time.Second
+	MaxLeaseTTL = 10 * time.Minute
+)
+
+// leaseTTL returns the ttl of a lease, DefaultLeaseTTL if ttl is zero.
+func leaseTTL(deviceID string, ttl time.Duration) (time.Duration, error) {
+	if deviceID == "" {
+		return 0, ErrInvalidLease
+	}
+	if ttl == 0 {
+		return DefaultLeaseTTL, nil
+	}
+	if ttl < MinLeaseTTL || ttl > MaxLeaseTTL {
+		return 0, ErrInvalidLease
+	}
+	return ttl, nil
+}
+
+// Acquire the sync lease for a device, or extend it if the device already holds it.
+// Returns ErrLeaseHeld and the current lease if another device holds it.
+func (s service) AcquireLease(ctx context.Context, apiKeyID int, deviceID string, ttl time.Duration) (*domain.SyncLease, error) {
+	ttl, err := leaseTTL(deviceID, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	lease, acquired, err := s.repo.AcquireSyncLease(ctx, apiKeyID, deviceID, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	if !acquired {
+		return lease, ErrLeaseHeld
+	}
+
+	return lease, nil
+}
+
+// Extend the sync lease held by a device, returns ErrLeaseNotHeld if it does not hold it.
+func (s service) ExtendLease(ctx context.Context, apiKeyID int, deviceID string, ttl time.Duration) (*domain.SyncLease, error) {
+	ttl, err := leaseTTL(deviceID, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	lease, err := s.repo.ExtendSyncLease(ctx, apiKeyID, deviceID, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	if lease == nil {
+		return nil, ErrLeaseNotHeld
+	}
+
+	return lease, nil
+}
+
+// Release the sync lease held by a device, returns ErrLeaseNotHeld if it does not hold it.
+func (s service) ReleaseLease(ctx context.Context, apiKeyID int, deviceID string) error {
+	if deviceID == "" {
+		return ErrInvalidLease
+	}
+
+	released, err := s.repo.ReleaseSyncLease(ctx, apiKeyID, deviceID)
+	if err != nil {
+		return err
+	}
+
+	if !released {
+		return ErrLeaseNotHeld
+	}
+
+	return nil
+}
+
+// Get the sync lease, returns nil if no device holds it.
+func (s service) GetLease(ctx context.Context, apiKeyID int) (*domain.SyncLease, error) {
+	return s.repo.GetSyncLease(ctx, apiKeyID)
+}
+
+// Check that a device may write sync data when leases are enforced,
+// returns ErrLeaseHeld and the current lease if another device holds it.
+// Writes are not refused while no device holds the lease.
+func (s service) CheckLease(ctx context.Context, apiKeyID int, deviceID string) (*domain.SyncLease, error) {
+	if !s.config.EnforceSyncLease {
+		return nil, nil
+	}
+
+	lease, err := s.repo.GetSyncLease(ctx, apiKeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	if lease != nil && lease.DeviceID != deviceID {
+		return lease, ErrLeaseHeld
+	}
+
+	return lease, nil
+}
@@ -0,0 +1,31 @@
+package sync
+
+import (
+	"github.com/SyncYomi/SyncYomi/internal/domain"
+)
+
+// ValidateSyncData checks sync data against the limits of uploads,
+// the configured max payload size and the max data size of the key.
+func ValidateSyncData(config *domain.Config, key *domain.APIKey, data []byte) error {
+	size := int64(len(data))
+
+	if limit := config.MaxSyncPayloadBytes(); limit > 0 && size > limit {
+		return ErrPayloadTooLarge
+	}
+
+	if key.MaxDataSize > 0 && size > key.MaxDataSize {
+		return ErrQuotaExceeded
+	}
+
+	return nil
+}
+
+// HistoryDepth returns the number of versions kept in the history of the key,
+// the configured depth unless the key has a lower one.
+func HistoryDepth(config *domain.Config, key *domain.APIKey) int {
+	depth := config.SyncHistoryDepth
+	if key.MaxHistoryDepth > 0 && key.MaxHistoryDepth < depth {
+		depth = key.MaxHistoryDepth
+	}
+	return depth
+}
@@ -4,77 +4,582 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"time"
 
+	"github.com/SyncYomi/SyncYomi/internal/backup"
 	"github.com/SyncYomi/SyncYomi/internal/domain"
 	"github.com/SyncYomi/SyncYomi/internal/logger"
 	"github.com/SyncYomi/SyncYomi/internal/notification"
+	"github.com/SyncYomi/SyncYomi/pkg/bspatch"
 	"github.com/rs/zerolog"
 )
 
 // ErrInvalidSyncEvent is returned by ReportSyncEvent when the event string is not a valid sync event type.
 var ErrInvalidSyncEvent = errors.New("invalid sync event")
 
+// ErrPayloadTooLarge is returned when sync data would exceed the configured max payload size.
+var ErrPayloadTooLarge = errors.New("payload too large")
+
+// ErrUploadNotFound is returned when a chunked upload does not exist or has expired.
+var ErrUploadNotFound = errors.New("upload not found")
+
+// ErrUploadOffset is returned by WriteUploadChunk when the chunk does not start where the upload ends.
+var ErrUploadOffset = errors.New("upload offset mismatch")
+
+// ErrInvalidPatch is returned by PatchSyncData when the patch cannot be applied to the stored data.
+var ErrInvalidPatch = errors.New("invalid patch")
+
+// ErrQuotaExceeded is returned when sync data would exceed the max data size of the api key.
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// ErrUploadQuotaExceeded is returned when an upload would exceed the daily upload quota of the api key.
+var ErrUploadQuotaExceeded = errors.New("daily upload quota exceeded")
+
 type Service interface {
 	// Get etag of sync data.
 	// For avoid memory usage, only the etag will be returnedj
-	GetSyncDataETag(ctx context.Context, apiKey string) (*string, error)
+	GetSyncDataETag(ctx context.Context, apiKeyID int) (*string, error)
 	// Get sync data and etag
-	GetSyncDataAndETag(ctx context.Context, apiKey string) ([]byte, *string, error)
+	GetSyncDataAndETag(ctx context.Context, apiKeyID int) ([]byte, *string, error)
+	// Pass the etag, size and a reader of the sync data to fn, returns false if there is no sync data.
+	// The data is streamed from storage where possible, the reader is only valid until fn returns.
+	WriteSyncDataTo(ctx context.Context, apiKeyID int, fn func(etag string, size int64, data io.Reader) error) (bool, error)
 	// Create or replace sync data, returns the new etag.
-	SetSyncData(ctx context.Context, apiKey string, data []byte) (*string, error)
+	SetSyncData(ctx context.Context, apiKeyID int, deviceName string, data []byte) (*string, error)
 	// Replace sync data only if the etag matches,
 	// returns the new etag if updated, or nil if not.
-	SetSyncDataIfMatch(ctx context.Context, apiKey string, etag string, data []byte) (*string, error)
-	// ReportSyncEvent sends a device-reported sync event to the notification service.
-	ReportSyncEvent(ctx context.Context, apiKey string, event string, deviceName string, detailMessage string) error
+	SetSyncDataIfMatch(ctx context.Context, apiKeyID int, etag string, deviceName string, data []byte) (*string, error)
+	// Replace sync data if the etag matches, otherwise merge it with the stored data.
+	// Returns the new etag and whether a merge happened, or nil if the data could not be merged.
+	SetSyncDataMerge(ctx context.Context, apiKeyID int, etag string, deviceName string, data []byte) (*string, bool, error)
+	// Apply a binary patch to the sync data with the given etag,
+	// returns the new etag if updated, or nil if the etag does not match.
+	PatchSyncData(ctx context.Context, apiKeyID int, etag string, deviceName string, patch []byte) (*string, error)
+	// List the previous versions of sync data, newest first.
+	ListSyncDataHistory(ctx context.Context, apiKeyID int) ([]domain.SyncDataHistory, error)
+	// Get a previous version of sync data by its etag, returns nil if not found.
+	GetSyncDataHistory(ctx context.Context, apiKeyID int, etag string) ([]byte, error)
+	// Restore a previous version of sync data as the current one,
+	// returns its new etag, or nil if the version was not found.
+	RestoreSyncDataHistory(ctx context.Context, apiKeyID int, etag string, deviceName string) (*string, error)
+	// Start a chunked upload of sync data.
+	CreateUpload(ctx context.Context, apiKeyID int, deviceName string) (*domain.SyncUpload, error)
+	// Get a chunked upload, returns ErrUploadNotFound if it does not exist.
+	GetUpload(ctx context.Context, apiKeyID int, id string) (*domain.SyncUpload, error)
+	// Append a chunk at offset to an upload, returns the upload with its new offset.
+	// Returns ErrUploadOffset and the upload if offset is not where the upload ends.
+	WriteUploadChunk(ctx context.Context, apiKeyID int, id string, offset int64, data []byte) (*domain.SyncUpload, error)
+	// Replace sync data with an upload, only if the etag matches when one is given.
+	// Returns the new etag if updated, or nil if not.
+	CommitUpload(ctx context.Context, apiKeyID int, id string, etag string) (*string, error)
+	// Delete the chunked uploads that were abandoned.
+	ExpireUploads(ctx context.Context) error
+	// ReportSyncEvent stores a device-reported sync event and sends it to the notification service.
+	ReportSyncEvent(ctx context.Context, apiKeyID int, event string, deviceName string, detailMessage string) error
+	// List the sync events matching filter, newest first, and the number of
+	// events matching it without limit and offset.
+	ListEvents(ctx context.Context, filter domain.SyncEventFilter) ([]domain.SyncEvent, int, error)
+	// Sum up the sync events matching filter by device, limit and offset are ignored.
+	EventStats(ctx context.Context, filter domain.SyncEventFilter) (*domain.SyncEventStats, error)
+	// Delete the sync events older than the retention of the config.
+	ExpireEvents(ctx context.Context) error
+	// Watch returns a channel receiving the etag of the sync data of the key
+	// each time it is replaced, until the returned func is called.
+	Watch(apiKeyID int) (<-chan string, func())
+	// Acquire the sync lease for a device, or extend it if the device already holds it.
+	// Returns ErrLeaseHeld and the current lease if another device holds it.
+	AcquireLease(ctx context.Context, apiKeyID int, deviceID string, ttl time.Duration) (*domain.SyncLease, error)
+	// Extend the sync lease held by a device, returns ErrLeaseNotHeld if it does not hold it.
+	ExtendLease(ctx context.Context, apiKeyID int, deviceID string, ttl time.Duration) (*domain.SyncLease, error)
+	// Release the sync lease held by a device, returns ErrLeaseNotHeld if it does not hold it.
+	ReleaseLease(ctx context.Context, apiKeyID int, deviceID string) error
+	// Get the sync lease, returns nil if no device holds it.
+	GetLease(ctx context.Context, apiKeyID int) (*domain.SyncLease, error)
+	// Check that a device may write sync data when leases are enforced,
+	// returns ErrLeaseHeld and the current lease if another device holds it.
+	CheckLease(ctx context.Context, apiKeyID int, deviceID string) (*domain.SyncLease, error)
 }
 
-func NewService(log logger.Logger, repo domain.SyncRepo, notificationSvc notification.Service, apiRepo domain.APIRepo) Service {
+func NewService(log logger.Logger, config *domain.Config, repo domain.SyncRepo, notificationSvc notification.Service, apiRepo domain.APIRepo) Service {
 	return &service{
 		log:                 log.With().Str("module", "sync").Logger(),
+		config:              config,
 		repo:                repo,
 		notificationService: notificationSvc,
 		apiRepo:             apiRepo,
+		watchers:            newWatchers(),
 	}
 }
 
 type service struct {
 	log                 zerolog.Logger
+	config              *domain.Config
 	repo                domain.SyncRepo
 	notificationService notification.Service
 	apiRepo             domain.APIRepo
+	watchers            *watchers
 }
 
 // Get etag of sync data.
 // For avoid memory usage, only the etag will be returned.
-func (s service) GetSyncDataETag(ctx context.Context, apiKey string) (*string, error) {
-	return s.repo.GetSyncDataETag(ctx, apiKey)
+func (s service) GetSyncDataETag(ctx context.Context, apiKeyID int) (*string, error) {
+	return s.repo.GetSyncDataETag(ctx, apiKeyID)
 }
 
 // Get sync data and etag
-func (s service) GetSyncDataAndETag(ctx context.Context, apiKey string) ([]byte, *string, error) {
-	return s.repo.GetSyncDataAndETag(ctx, apiKey)
+func (s service) GetSyncDataAndETag(ctx context.Context, apiKeyID int) ([]byte, *string, error) {
+	return s.repo.GetSyncDataAndETag(ctx, apiKeyID)
+}
+
+// Pass the etag, size and a reader of the sync data to fn, returns false if there is no sync data.
+// The data is streamed from storage where possible, the reader is only valid until fn returns.
+func (s service) WriteSyncDataTo(ctx context.Context, apiKeyID int, fn func(etag string, size int64, data io.Reader) error) (bool, error) {
+	return s.repo.WriteSyncDataTo(ctx, apiKeyID, fn)
 }
 
 // Create or replace sync data, returns the new etag.
-func (s service) SetSyncData(ctx context.Context, apiKey string, data []byte) (*string, error) {
-	return s.repo.SetSyncData(ctx, apiKey, data)
+func (s service) SetSyncData(ctx context.Context, apiKeyID int, deviceName string, data []byte) (*string, error) {
+	key, err := s.validate(ctx, apiKeyID, data)
+	if err != nil {
+		return nil, err
+	}
+
+	refund, err := s.chargeUpload(ctx, key, int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	newEtag, written, err := s.setSyncData(ctx, key, deviceName, data)
+	if err != nil || !written {
+		refund()
+	}
+
+	return newEtag, err
 }
 
 // Replace sync data only if the etag matches,
 // returns the new etag if updated, or nil if not.
-func (s service) SetSyncDataIfMatch(ctx context.Context, apiKey string, etag string, data []byte) (*string, error) {
-	return s.repo.SetSyncDataIfMatch(ctx, apiKey, etag, data)
+func (s service) SetSyncDataIfMatch(ctx context.Context, apiKeyID int, etag string, deviceName string, data []byte) (*string, error) {
+	key, err := s.validate(ctx, apiKeyID, data)
+	if err != nil {
+		return nil, err
+	}
+
+	refund, err := s.chargeUpload(ctx, key, int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	newEtag, written, err := s.setSyncDataIfMatch(ctx, key, etag, deviceName, data)
+	if err != nil || !written {
+		refund()
+	}
+
+	return newEtag, err
+}
+
+// setSyncData replaces the sync data of the key, returns the new etag and whether it was written.
+// The data is neither validated nor charged to the upload quota here, callers do both first.
+func (s service) setSyncData(ctx context.Context, key *domain.APIKey, deviceName string, data []byte) (*string, bool, error) {
+	newEtag, written, err := s.repo.SetSyncData(ctx, key.ID, deviceName, data)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// unchanged data wakes up no watcher, they already have it
+	if written {
+		s.watchers.publish(key.ID, *newEtag)
+		s.pruneHistory(ctx, key)
+	}
+
+	return newEtag, written, nil
+}
+
+// setSyncDataIfMatch is setSyncData if the etag matches, the new etag is nil if not.
+func (s service) setSyncDataIfMatch(ctx context.Context, key *domain.APIKey, etag string, deviceName string, data []byte) (*string, bool, error) {
+	newEtag, written, err := s.repo.SetSyncDataIfMatch(ctx, key.ID, etag, deviceName, data)
+	if err != nil || newEtag == nil {
+		return nil, false, err
+	}
+
+	if written {
+		s.watchers.publish(key.ID, *newEtag)
+		s.pruneHistory(ctx, key)
+	}
+
+	return newEtag, written, nil
+}
+
+// mergeAttempts is how often a merge is retried when the data keeps changing underneath it.
+const mergeAttempts = 3
+
+// Replace sync data if the etag matches, otherwise merge it with the stored data.
+// Returns the new etag and whether a merge happened, or nil if the data could not be merged,
+// in which case the device has to resolve the conflict itself.
+func (s service) SetSyncDataMerge(ctx context.Context, apiKeyID int, etag string, deviceName string, data []byte) (*string, bool, error) {
+	key, err := s.validate(ctx, apiKeyID, data)
+	if err != nil {
+		return nil, false, err
+	}
+
+	refund, err := s.chargeUpload(ctx, key, int64(len(data)))
+	if err != nil {
+		return nil, false, err
+	}
+
+	newEtag, merged, written, err := s.mergeSyncData(ctx, key, etag, deviceName, data)
+	if err != nil || !written {
+		refund()
+	}
+
+	return newEtag, merged, err
+}
+
+// mergeSyncData is SetSyncDataMerge without the upload quota,
+// it also returns whether new sync data was written.
+func (s service) mergeSyncData(ctx context.Context, key *domain.APIKey, etag string, deviceName string, data []byte) (*string, bool, bool, error) {
+	newEtag, written, err := s.setSyncDataIfMatch(ctx, key, etag, deviceName, data)
+	if err != nil || newEtag != nil {
+		return newEtag, false, written, err
+	}
+
+	uploaded, err := backup.Decode(data, s.config.MaxSyncPayloadBytes())
+	if errors.Is(err, backup.ErrTooLarge) {
+		return nil, false, false, ErrPayloadTooLarge
+	} else if err != nil {
+		s.log.Warn().Err(err).Msg("could not decode uploaded sync data for merge")
+		return nil, false, false, nil
+	}
+
+	for i := 0; i < mergeAttempts; i++ {
+		storedData, storedEtag, err := s.repo.GetSyncDataAndETag(ctx, key.ID)
+		if err != nil {
+			return nil, false, false, err
+		}
+
+		if storedData == nil || storedEtag == nil {
+			// the stored data is gone, nothing to merge with
+			newEtag, written, err = s.setSyncData(ctx, key, deviceName, data)
+			return newEtag, false, written, err
+		}
+
+		stored, err := backup.Decode(storedData, s.config.MaxSyncPayloadBytes())
+		if errors.Is(err, backup.ErrTooLarge) {
+			return nil, false, false, ErrPayloadTooLarge
+		} else if err != nil {
+			s.log.Warn().Err(err).Msg("could not decode stored sync data for merge")
+			return nil, false, false, nil
+		}
+
+		merged := backup.Merge(stored, uploaded)
+
+		// keep the encoding the device uploaded with
+		mergedData := backup.Marshal(merged)
+		if backup.IsCompressed(data) {
+			if mergedData, err = backup.Encode(merged); err != nil {
+				return nil, false, false, err
+			}
+		}
+
+		// merging can grow the data past the limits the upload was within
+		if err := ValidateSyncData(s.config, key, mergedData); err != nil {
+			return nil, false, false, err
+		}
+
+		newEtag, written, err = s.setSyncDataIfMatch(ctx, key, *storedEtag, deviceName, mergedData)
+		if err != nil {
+			return nil, false, false, err
+		}
+		if newEtag != nil {
+			s.log.Info().Msgf("Merged conflicting sync data: etag=\"%v\" stored=\"%v\"", etag, *storedEtag)
+			return newEtag, true, written, nil
+		}
+	}
+
+	s.log.Warn().Msgf("Could not merge sync data after %d attempts", mergeAttempts)
+
+	return nil, false, false, nil
+}
+
+// Apply a binary patch to the sync data with the given etag,
+// returns the new etag if updated, or nil if the etag does not match.
+func (s service) PatchSyncData(ctx context.Context, apiKeyID int, etag string, deviceName string, patch []byte) (*string, error) {
+	key, err := s.apiRepo.FindByID(ctx, apiKeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	data, currentEtag, err := s.repo.GetSyncDataAndETag(ctx, apiKeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	if currentEtag == nil || *currentEtag != etag {
+		return nil, nil
+	}
+
+	newData, err := bspatch.Apply(data, patch, s.config.MaxSyncPayloadBytes())
+	if errors.Is(err, bspatch.ErrTooLarge) {
+		return nil, ErrPayloadTooLarge
+	} else if err != nil {
+		s.log.Debug().Err(err).Msg("could not apply sync data patch")
+		return nil, ErrInvalidPatch
+	}
+
+	if err := ValidateSyncData(s.config, key, newData); err != nil {
+		return nil, err
+	}
+
+	refund, err := s.chargeUpload(ctx, key, int64(len(patch)))
+	if err != nil {
+		return nil, err
+	}
+
+	// the data may have changed since it was read, so the etag is checked again
+	newEtag, written, err := s.setSyncDataIfMatch(ctx, key, etag, deviceName, newData)
+	if err != nil || !written {
+		refund()
+	}
+
+	return newEtag, err
+}
+
+// List the previous versions of sync data, newest first.
+func (s service) ListSyncDataHistory(ctx context.Context, apiKeyID int) ([]domain.SyncDataHistory, error) {
+	return s.repo.ListSyncDataHistory(ctx, apiKeyID)
+}
+
+// Get a previous version of sync data by its etag, returns nil if not found.
+func (s service) GetSyncDataHistory(ctx context.Context, apiKeyID int, etag string) ([]byte, error) {
+	return s.repo.GetSyncDataHistory(ctx, apiKeyID, etag)
+}
+
+// Restore a previous version of sync data as the current one,
+// returns its new etag, or nil if the version was not found.
+//
+// The restored data gets a new etag, so devices still holding the version pick it up
+// through If-None-Match like after any other change.
+func (s service) RestoreSyncDataHistory(ctx context.Context, apiKeyID int, etag string, deviceName string) (*string, error) {
+	data, err := s.repo.GetSyncDataHistory(ctx, apiKeyID, etag)
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	key, err := s.apiRepo.FindByID(ctx, apiKeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	// the limits of the key may have changed since the version was stored
+	if err := ValidateSyncData(s.config, key, data); err != nil {
+		return nil, err
+	}
+
+	s.log.Info().Msgf("Restoring sync data from history: etag=\"%v\"", etag)
+
+	newEtag, written, err := s.repo.RestoreSyncData(ctx, apiKeyID, deviceName, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if written {
+		s.watchers.publish(key.ID, *newEtag)
+		s.pruneHistory(ctx, key)
+	}
+
+	return newEtag, nil
+}
+
+// uploadExpiry is how long a chunked upload is kept after the last chunk was written.
+const uploadExpiry = 24 * time.Hour
+
+// Start a chunked upload of sync data.
+func (s service) CreateUpload(ctx context.Context, apiKeyID int, deviceName string) (*domain.SyncUpload, error) {
+	return s.repo.CreateSyncUpload(ctx, apiKeyID, deviceName)
+}
+
+// Get a chunked upload, returns ErrUploadNotFound if it does not exist.
+func (s service) GetUpload(ctx context.Context, apiKeyID int, id string) (*domain.SyncUpload, error) {
+	upload, err := s.repo.GetSyncUpload(ctx, apiKeyID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if upload == nil {
+		return nil, ErrUploadNotFound
+	}
+
+	return upload, nil
+}
+
+// Append a chunk at offset to an upload, returns the upload with its new offset.
+// Returns ErrUploadOffset and the upload if offset is not where the upload ends,
+// so the device can resume from there.
+func (s service) WriteUploadChunk(ctx context.Context, apiKeyID int, id string, offset int64, data []byte) (*domain.SyncUpload, error) {
+	if limit := s.config.MaxSyncPayloadBytes(); limit > 0 && offset+int64(len(data)) > limit {
+		return nil, ErrPayloadTooLarge
+	}
+
+	key, err := s.checkDataSize(ctx, apiKeyID, offset+int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	refund, err := s.chargeUpload(ctx, key, int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	// a chunk at the wrong offset is not stored, so a retry is only charged once
+	ok, err := s.repo.AppendSyncUploadChunk(ctx, apiKeyID, id, offset, data)
+	if err != nil || !ok {
+		refund()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	upload, err := s.GetUpload(ctx, apiKeyID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return upload, ErrUploadOffset
+	}
+
+	return upload, nil
+}
+
+// Replace sync data with an upload, only if the etag matches when one is given.
+// Returns the new etag if updated, or nil if not.
+// The upload is kept when the etag does not match, it expires like an abandoned one.
+func (s service) CommitUpload(ctx context.Context, apiKeyID int, id string, etag string) (*string, error) {
+	upload, err := s.GetUpload(ctx, apiKeyID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := s.repo.GetSyncUploadData(ctx, apiKeyID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if data == nil {
+		return nil, ErrUploadNotFound
+	}
+
+	key, err := s.validate(ctx, apiKeyID, data)
+	if err != nil {
+		return nil, err
+	}
+
+	// the chunks were charged to the upload quota as they came in
+	var newEtag *string
+	if etag != "" {
+		newEtag, _, err = s.setSyncDataIfMatch(ctx, key, etag, upload.DeviceName, data)
+	} else {
+		newEtag, _, err = s.setSyncData(ctx, key, upload.DeviceName, data)
+	}
+	if err != nil || newEtag == nil {
+		return nil, err
+	}
+
+	if err := s.repo.DeleteSyncUpload(ctx, apiKeyID, id); err != nil {
+		s.log.Error().Err(err).Msg("could not delete committed sync upload")
+	}
+
+	return newEtag, nil
+}
+
+// Watch returns a channel receiving the etag of the sync data of the key
+// each time it is replaced, until the returned func is called.
+func (s service) Watch(apiKeyID int) (<-chan string, func()) {
+	return s.watchers.subscribe(apiKeyID)
+}
+
+// Delete the chunked uploads that were abandoned.
+func (s service) ExpireUploads(ctx context.Context) error {
+	deleted, err := s.repo.DeleteExpiredSyncUploads(ctx, time.Now().Add(-uploadExpiry))
+	if err != nil {
+		return err
+	}
+
+	if deleted > 0 {
+		s.log.Info().Msgf("Deleted %d expired sync uploads", deleted)
+	}
+
+	return nil
+}
+
+// pruneHistory drops the versions beyond the history depth of the key.
+// Failing to prune is not fatal for the write that triggered it.
+func (s service) pruneHistory(ctx context.Context, key *domain.APIKey) {
+	if err := s.repo.PruneSyncDataHistory(ctx, key.ID, HistoryDepth(s.config, key)); err != nil {
+		s.log.Error().Err(err).Msg("could not prune sync data history")
+	}
+}
+
+// validate returns the key, or an error if data is over the limits of uploads.
+func (s service) validate(ctx context.Context, apiKeyID int, data []byte) (*domain.APIKey, error) {
+	key, err := s.apiRepo.FindByID(ctx, apiKeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ValidateSyncData(s.config, key, data); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// checkDataSize returns the key, or ErrQuotaExceeded if size is over its max data size.
+func (s service) checkDataSize(ctx context.Context, apiKeyID int, size int64) (*domain.APIKey, error) {
+	key, err := s.apiRepo.FindByID(ctx, apiKeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	if key.MaxDataSize > 0 && size > key.MaxDataSize {
+		return nil, ErrQuotaExceeded
+	}
+
+	return key, nil
+}
+
+// chargeUpload counts uploaded bytes towards the daily upload quota of the key,
+// returns ErrUploadQuotaExceeded without counting them if the quota would be exceeded.
+// The bytes are counted before they are written, so concurrent uploads cannot both
+// pass the quota; the returned func gives them back when nothing was written.
+func (s service) chargeUpload(ctx context.Context, key *domain.APIKey, bytes int64) (func(), error) {
+	day := time.Now()
+
+	ok, err := s.apiRepo.ChargeUploadUsage(ctx, key.ID, day, bytes, key.MaxDailyUpload)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, ErrUploadQuotaExceeded
+	}
+
+	return func() {
+		if err := s.apiRepo.AddUploadUsage(ctx, key.ID, day, -bytes); err != nil {
+			s.log.Error().Err(err).Msg("could not give back upload usage")
+		}
+	}, nil
 }
 
-func (s service) ReportSyncEvent(ctx context.Context, apiKey string, event string, deviceName string, detailMessage string) error {
+func (s service) ReportSyncEvent(ctx context.Context, apiKeyID int, event string, deviceName string, detailMessage string) error {
 	ev, err := parseSyncEvent(event)
 	if err != nil {
 		return err
 	}
+	s.storeSyncEvent(ctx, apiKeyID, ev, deviceName, detailMessage)
 	keyName := "Unknown"
-	if key, err := s.apiRepo.Get(ctx, apiKey); err == nil && key != nil && key.Name != "" {
+	if key, err := s.apiRepo.FindByID(ctx, apiKeyID); err == nil && key != nil && key.Name != "" {
 		keyName = key.Name
 	}
 	payload := s.buildSyncPayload(ev, keyName, deviceName, detailMessage)
@@ -1,10 +1,15 @@
 package sync
 
 import (
+	"context"
 	"errors"
 	"testing"
+	"time"
 
+	"github.com/SyncYomi/SyncYomi/internal/backup"
+	"github.com/SyncYomi/SyncYomi/internal/database"
 	"github.com/SyncYomi/SyncYomi/internal/domain"
+	"github.com/SyncYomi/SyncYomi/internal/logger"
 )
 
 func TestParseSyncEvent(t *testing.T) {
@@ -41,3 +46,329 @@ func TestParseSyncEvent(t *testing.T) {
 		})
 	}
 }
+
+// mockAPIRepo keeps one key and its upload usage in memory.
+type mockAPIRepo struct {
+	key      domain.APIKey
+	uploaded int64
+}
+
+func (m *mockAPIRepo) Store(ctx context.Context, key *domain.APIKey) error  { return nil }
+func (m *mockAPIRepo) Update(ctx context.Context, key *domain.APIKey) error { return nil }
+func (m *mockAPIRepo) Delete(ctx context.Context, id int) error             { return nil }
+func (m *mockAPIRepo) GetKeys(ctx context.Context) ([]domain.APIKey, error) {
+	return []domain.APIKey{m.key}, nil
+}
+func (m *mockAPIRepo) GetUserKeys(ctx context.Context, userID int) ([]domain.APIKey, error) {
+	return []domain.APIKey{m.key}, nil
+}
+func (m *mockAPIRepo) Get(ctx context.Context, key string) (*domain.APIKey, error) {
+	k := m.key
+	return &k, nil
+}
+func (m *mockAPIRepo) FindByID(ctx context.Context, id int) (*domain.APIKey, error) {
+	k := m.key
+	return &k, nil
+}
+func (m *mockAPIRepo) Rotate(ctx context.Context, id int, newKey string, graceUntil time.Time) error {
+	return nil
+}
+func (m *mockAPIRepo) SetLastUsed(ctx context.Context, id int, at time.Time, ip string) error {
+	return nil
+}
+func (m *mockAPIRepo) AddUploadUsage(ctx context.Context, id int, day time.Time, bytes int64) error {
+	m.uploaded += bytes
+	return nil
+}
+func (m *mockAPIRepo) ChargeUploadUsage(ctx context.Context, id int, day time.Time, bytes int64, max int64) (bool, error) {
+	if max > 0 && m.uploaded+bytes > max {
+		return false, nil
+	}
+	m.uploaded += bytes
+	return true, nil
+}
+func (m *mockAPIRepo) ListUsage(ctx context.Context, since time.Time, today time.Time) ([]domain.APIKeyUsage, error) {
+	return nil, nil
+}
+
+func TestService_quotas(t *testing.T) {
+	ctx := context.Background()
+	repo := &mockAPIRepo{key: domain.APIKey{ID: 1, MaxDataSize: 10, MaxDailyUpload: 15}}
+	s := service{apiRepo: repo}
+
+	if _, err := s.checkDataSize(ctx, 1, 10); err != nil {
+		t.Errorf("checkDataSize() at the quota error = %v", err)
+	}
+	if _, err := s.checkDataSize(ctx, 1, 11); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("checkDataSize() over the quota error = %v, want %v", err, ErrQuotaExceeded)
+	}
+
+	if _, err := s.chargeUpload(ctx, &repo.key, 10); err != nil {
+		t.Fatalf("chargeUpload() error = %v", err)
+	}
+	if _, err := s.chargeUpload(ctx, &repo.key, 6); !errors.Is(err, ErrUploadQuotaExceeded) {
+		t.Errorf("chargeUpload() over the quota error = %v, want %v", err, ErrUploadQuotaExceeded)
+	}
+	if repo.uploaded != 10 {
+		t.Errorf("uploaded = %d, want %d, rejected uploads are not counted", repo.uploaded, 10)
+	}
+	refund, err := s.chargeUpload(ctx, &repo.key, 5)
+	if err != nil {
+		t.Errorf("chargeUpload() up to the quota error = %v", err)
+	}
+	refund()
+	if repo.uploaded != 10 {
+		t.Errorf("uploaded = %d, want %d, refunded uploads are not counted", repo.uploaded, 10)
+	}
+
+	// no limits
+	repo.key = domain.APIKey{ID: 1}
+	if _, err := s.checkDataSize(ctx, 1, 1<<40); err != nil {
+		t.Errorf("checkDataSize() without quota error = %v", err)
+	}
+	if _, err := s.chargeUpload(ctx, &repo.key, 1<<40); err != nil {
+		t.Errorf("chargeUpload() without quota error = %v", err)
+	}
+}
+
+func TestSyncEventStats(t *testing.T) {
+	t1 := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+
+	stats := syncEventStats([]domain.SyncEventCount{
+		{APIKeyID: 1, DeviceName: "Phone", Event: domain.NotificationEventSyncStarted, Count: 5, LastAt: t2},
+		{APIKeyID: 1, DeviceName: "Phone", Event: domain.NotificationEventSyncSuccess, Count: 4, LastAt: t2},
+		{APIKeyID: 1, DeviceName: "Tablet", Event: domain.NotificationEventSyncSuccess, Count: 1, LastAt: t1},
+		{APIKeyID: 1, DeviceName: "Tablet", Event: domain.NotificationEventSyncFailed, Count: 2, LastAt: t1},
+		{APIKeyID: 1, DeviceName: "Tablet", Event: domain.NotificationEventSyncError, Count: 1, LastAt: t2},
+		{APIKeyID: 1, DeviceName: "Tablet", Event: domain.NotificationEventSyncCancelled, Count: 3, LastAt: t2},
+	})
+
+	if stats.Total != 16 || stats.Successes != 5 || stats.Failures != 3 {
+		t.Errorf("stats = %d total, %d successes, %d failures, want 16, 5, 3", stats.Total, stats.Successes, stats.Failures)
+	}
+	if stats.SuccessRate != 5.0/8 {
+		t.Errorf("SuccessRate = %v, want %v", stats.SuccessRate, 5.0/8)
+	}
+
+	if len(stats.Devices) != 2 {
+		t.Fatalf("len(Devices) = %d, want 2", len(stats.Devices))
+	}
+
+	tablet := stats.Devices[0]
+	if tablet.DeviceName != "Tablet" {
+		t.Errorf("Devices[0] = %q, want the device with the most failures first", tablet.DeviceName)
+	}
+	if tablet.Failures != 3 || tablet.SuccessRate != 0.25 {
+		t.Errorf("Tablet = %d failures, %v success rate, want 3, 0.25", tablet.Failures, tablet.SuccessRate)
+	}
+	if tablet.LastFailureAt == nil || !tablet.LastFailureAt.Equal(t2) || !tablet.LastEventAt.Equal(t2) {
+		t.Errorf("Tablet last failure = %v, last event = %v, want %v", tablet.LastFailureAt, tablet.LastEventAt, t2)
+	}
+
+	phone := stats.Devices[1]
+	if phone.SuccessRate != 1 || phone.LastFailureAt != nil {
+		t.Errorf("Phone = %v success rate, last failure %v, want 1 and none", phone.SuccessRate, phone.LastFailureAt)
+	}
+
+	if empty := syncEventStats(nil); empty.SuccessRate != 0 || empty.Devices == nil {
+		t.Errorf("empty stats = %+v, want 0 success rate and no devices", empty)
+	}
+}
+
+// newTestService returns a service on a new sqlite database, with a key stored with the quotas of key.
+func newTestService(t *testing.T, key domain.APIKey) (Service, *domain.APIKey, domain.APIRepo) {
+	t.Helper()
+
+	ctx := context.Background()
+	log := logger.Mock()
+
+	db, err := database.NewDB(&domain.Config{DatabaseType: "sqlite", ConfigPath: t.TempDir()}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	apiRepo := database.NewAPIRepo(log, db)
+	key.Name, key.Key, key.Scopes = "phone", "secret", []string{}
+	if err := apiRepo.Store(ctx, &key); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &domain.Config{SyncHistoryDepth: 10, MaxSyncPayloadSize: 1}
+	return NewService(log, cfg, database.NewSyncRepo(log, db), nil, apiRepo), &key, apiRepo
+}
+
+func TestService_publishOnlyWrites(t *testing.T) {
+	ctx := context.Background()
+	s, key, _ := newTestService(t, domain.APIKey{})
+
+	events, stop := s.Watch(key.ID)
+	defer stop()
+
+	etag, err := s.SetSyncData(ctx, key.ID, "phone", []byte("library"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-events:
+		if got != *etag {
+			t.Errorf("Watch() = %q, want %q", got, *etag)
+		}
+	default:
+		t.Fatal("Watch() received nothing for new data")
+	}
+
+	// uploading the stored data again writes nothing
+	if _, err := s.SetSyncData(ctx, key.ID, "tablet", []byte("library")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SetSyncDataIfMatch(ctx, key.ID, "sha256=other", "tablet", []byte("library")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-events:
+		t.Errorf("Watch() = %q for unchanged data, want nothing", got)
+	default:
+	}
+}
+
+func TestService_uploadQuotaOnlyCountsWrites(t *testing.T) {
+	ctx := context.Background()
+	s, key, apiRepo := newTestService(t, domain.APIKey{MaxDataSize: 10, MaxDailyUpload: 100})
+
+	usage := func() int64 {
+		t.Helper()
+		keys, err := apiRepo.ListUsage(ctx, time.Now(), time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return keys[0].UploadedToday
+	}
+
+	etag, err := s.SetSyncData(ctx, key.ID, "phone", []byte("library"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := usage(); got != 7 {
+		t.Fatalf("usage = %d, want %d", got, 7)
+	}
+
+	// unchanged data, an etag mismatch, data over the quota and a chunk at the wrong offset write nothing
+	if _, err := s.SetSyncData(ctx, key.ID, "phone", []byte("library")); err != nil {
+		t.Fatal(err)
+	}
+	if newEtag, err := s.SetSyncDataIfMatch(ctx, key.ID, "sha256=other", "phone", []byte("other")); err != nil || newEtag != nil {
+		t.Fatalf("SetSyncDataIfMatch() = %v, %v, want nil, nil", newEtag, err)
+	}
+	if _, err := s.SetSyncDataIfMatch(ctx, key.ID, *etag, "phone", []byte("much too large")); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("SetSyncDataIfMatch() error = %v, want %v", err, ErrQuotaExceeded)
+	}
+	upload, err := s.CreateUpload(ctx, key.ID, "phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.WriteUploadChunk(ctx, key.ID, upload.ID, 0, []byte("lib")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.WriteUploadChunk(ctx, key.ID, upload.ID, 0, []byte("lib")); !errors.Is(err, ErrUploadOffset) {
+		t.Fatalf("WriteUploadChunk() retry error = %v, want %v", err, ErrUploadOffset)
+	}
+
+	if got := usage(); got != 10 {
+		t.Errorf("usage = %d, want %d", got, 10)
+	}
+}
+
+func TestService_RestoreSyncDataHistory(t *testing.T) {
+	ctx := context.Background()
+	s, key, _ := newTestService(t, domain.APIKey{})
+
+	oldEtag, err := s.SetSyncData(ctx, key.ID, "phone", []byte("old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newEtag, err := s.SetSyncData(ctx, key.ID, "tablet", []byte("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events, stop := s.Watch(key.ID)
+	defer stop()
+
+	restored, err := s.RestoreSyncDataHistory(ctx, key.ID, *oldEtag, "web")
+	if err != nil || restored == nil {
+		t.Fatalf("RestoreSyncDataHistory() = %v, %v", restored, err)
+	}
+	if *restored == *oldEtag || *restored == *newEtag {
+		t.Errorf("RestoreSyncDataHistory() = %q, want a new etag", *restored)
+	}
+
+	// a device holding the newer etag is told about the change and cannot overwrite it
+	select {
+	case got := <-events:
+		if got != *restored {
+			t.Errorf("Watch() = %q, want %q", got, *restored)
+		}
+	default:
+		t.Error("Watch() received nothing for the restore")
+	}
+	if got, err := s.SetSyncDataIfMatch(ctx, key.ID, *newEtag, "tablet", []byte("newer")); err != nil || got != nil {
+		t.Errorf("SetSyncDataIfMatch() with the newer etag = %v, %v, want nil, nil", got, err)
+	}
+
+	// so is a device still holding the restored version
+	current, err := s.GetSyncDataETag(ctx, key.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, held := range []string{*oldEtag, *newEtag} {
+		if *current == held {
+			t.Errorf("GetSyncDataETag() = %q, the etag a device already has", *current)
+		}
+	}
+
+	data, _, err := s.GetSyncDataAndETag(ctx, key.ID)
+	if err != nil || string(data) != "old" {
+		t.Errorf("GetSyncDataAndETag() = %q, %v, want %q", data, err, "old")
+	}
+
+	// uploading or restoring the restored data again changes nothing
+	if got, err := s.SetSyncData(ctx, key.ID, "phone", []byte("old")); err != nil || *got != *restored {
+		t.Errorf("SetSyncData() of the restored data = %v, %v, want %q", got, err, *restored)
+	}
+	if got, err := s.RestoreSyncDataHistory(ctx, key.ID, *oldEtag, "web"); err != nil || *got != *restored {
+		t.Errorf("RestoreSyncDataHistory() again = %v, %v, want %q", got, err, *restored)
+	}
+	select {
+	case got := <-events:
+		t.Errorf("Watch() = %q after writing nothing", got)
+	default:
+	}
+}
+
+func TestService_SetSyncDataMerge_validatesMergedData(t *testing.T) {
+	ctx := context.Background()
+
+	stored := backup.Marshal(&backup.Backup{Manga: []backup.Manga{{Source: 1, URL: "/stored", Title: "Stored"}}})
+	uploaded := backup.Marshal(&backup.Backup{Manga: []backup.Manga{{Source: 1, URL: "/uploaded", Title: "Uploaded"}}})
+
+	// both fit on their own, merged they do not
+	s, key, _ := newTestService(t, domain.APIKey{MaxDataSize: int64(max(len(stored), len(uploaded)))})
+
+	etag, err := s.SetSyncData(ctx, key.ID, "phone", stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := s.SetSyncDataMerge(ctx, key.ID, "sha256=other", "tablet", uploaded); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("SetSyncDataMerge() error = %v, want %v", err, ErrQuotaExceeded)
+	}
+
+	if current, err := s.GetSyncDataETag(ctx, key.ID); err != nil || *current != *etag {
+		t.Errorf("etag = %v, %v, want the stored %v", current, err, *etag)
+	}
+}
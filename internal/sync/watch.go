@@ -0,0 +1,60 @@
+package sync
+
+import (
+	stdsync "sync"
+)
+
+// watchers passes the etags of new sync data to the devices watching a key.
+type watchers struct {
+	mu   stdsync.Mutex
+	subs map[int]map[chan string]struct{}
+}
+
+func newWatchers() *watchers {
+	return &watchers{subs: map[int]map[chan string]struct{}{}}
+}
+
+// subscribe returns a channel receiving the etags of new sync data of the key,
+// and the func to stop receiving them.
+func (w *watchers) subscribe(apiKeyID int) (<-chan string, func()) {
+	// a watcher that falls behind only needs the latest etag
+	ch := make(chan string, 1)
+
+	w.mu.Lock()
+	if w.subs[apiKeyID] == nil {
+		w.subs[apiKeyID] = map[chan string]struct{}{}
+	}
+	w.subs[apiKeyID][ch] = struct{}{}
+	w.mu.Unlock()
+
+	var once stdsync.Once
+	return ch, func() {
+		once.Do(func() {
+			w.mu.Lock()
+			delete(w.subs[apiKeyID], ch)
+			if len(w.subs[apiKeyID]) == 0 {
+				delete(w.subs, apiKeyID)
+			}
+			w.mu.Unlock()
+		})
+	}
+}
+
+// publish sends the etag of new sync data to the watchers of the key,
+// replacing an etag they did not receive yet.
+func (w *watchers) publish(apiKeyID int, etag string) {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for ch := range w.subs[apiKeyID] {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- etag
+	}
+}
@@ -3,13 +3,16 @@ package user
 import (
 	"context"
 	"github.com/SyncYomi/SyncYomi/internal/domain"
-	"github.com/SyncYomi/SyncYomi/pkg/errors"
 )
 
 type Service interface {
 	GetUserCount(ctx context.Context) (int, error)
 	FindByUsername(ctx context.Context, username string) (*domain.User, error)
+	FindByID(ctx context.Context, id int) (*domain.User, error)
+	List(ctx context.Context) ([]domain.User, error)
 	CreateUser(ctx context.Context, user domain.User) error
+	SetRole(ctx context.Context, id int, role domain.Role) error
+	Delete(ctx context.Context, id int) error
 }
 
 type service struct {
@@ -35,15 +38,44 @@ func (s *service) FindByUsername(ctx context.Context, username string) (*domain.
 	return user, nil
 }
 
+func (s *service) FindByID(ctx context.Context, id int) (*domain.User, error) {
+	return s.repo.FindByID(ctx, id)
+}
+
+func (s *service) List(ctx context.Context) ([]domain.User, error) {
+	return s.repo.List(ctx)
+}
+
 func (s *service) CreateUser(ctx context.Context, newUser domain.User) error {
-	userCount, err := s.repo.GetUserCount(ctx)
+	existing, err := s.repo.FindByUsername(ctx, newUser.Username)
 	if err != nil {
 		return err
 	}
 
-	if userCount > 0 {
-		return errors.New("only 1 user account is supported at the moment")
+	if existing != nil {
+		return domain.ErrUserExists
 	}
 
 	return s.repo.Store(ctx, newUser)
 }
+
+// SetRole changes the role of a user.
+func (s *service) SetRole(ctx context.Context, id int, role domain.Role) error {
+	user, err := s.repo.FindByID(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if user == nil {
+		return domain.ErrUserNotFound
+	}
+
+	user.Role = role
+
+	return s.repo.Update(ctx, *user)
+}
+
+// Delete the user and the api keys it owns.
+func (s *service) Delete(ctx context.Context, id int) error {
+	return s.repo.Delete(ctx, id)
+}
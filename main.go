@@ -6,12 +6,15 @@ import (
 	"syscall"
 
 	"github.com/SyncYomi/SyncYomi/internal/api"
+	"github.com/SyncYomi/SyncYomi/internal/audit"
 	"github.com/SyncYomi/SyncYomi/internal/auth"
 	"github.com/SyncYomi/SyncYomi/internal/config"
 	"github.com/SyncYomi/SyncYomi/internal/database"
+	"github.com/SyncYomi/SyncYomi/internal/device"
 	"github.com/SyncYomi/SyncYomi/internal/events"
 	"github.com/SyncYomi/SyncYomi/internal/http"
 	"github.com/SyncYomi/SyncYomi/internal/logger"
+	"github.com/SyncYomi/SyncYomi/internal/metrics"
 	"github.com/SyncYomi/SyncYomi/internal/notification"
 	"github.com/SyncYomi/SyncYomi/internal/scheduler"
 	"github.com/SyncYomi/SyncYomi/internal/server"
@@ -30,6 +33,10 @@ var (
 )
 
 func main() {
+	if runCommand(os.Args[1:]) {
+		return
+	}
+
 	var configPath string
 	pflag.StringVar(&configPath, "config", "", "path to configuration file")
 	pflag.Parse()
@@ -70,9 +77,18 @@ func main() {
 	log.Info().Msgf("Log-level: %s", cfg.Config.LogLevel)
 	log.Info().Msgf("Using database: %s", db.Driver)
 
+	// metrics are nil when disabled, which records nothing
+	var metricsCollector *metrics.Metrics
+	if cfg.Config.MetricsEnabled {
+		metricsCollector = metrics.New()
+		metricsCollector.RegisterDB(db.Stats)
+	}
+
 	// setup repos
 	var (
 		apikeyRepo       = database.NewAPIRepo(log, db)
+		auditRepo        = database.NewAuditRepo(log, db)
+		deviceRepo       = database.NewDeviceRepo(log, db)
 		notificationRepo = database.NewNotificationRepo(log, db)
 		userRepo         = database.NewUserRepo(log, db)
 		syncRepo         = database.NewSyncRepo(log, db)
@@ -81,12 +97,14 @@ func main() {
 	// setup services
 	var (
 		apiService          = api.NewService(log, apikeyRepo)
-		notificationService = notification.NewService(log, notificationRepo)
+		auditService        = audit.NewService(log, cfg.Config, auditRepo)
+		deviceService       = device.NewService(log, deviceRepo)
+		notificationService = notification.NewService(log, notificationRepo, metricsCollector)
 		updateService       = update.NewUpdate(log, cfg.Config)
-		schedulingService   = scheduler.NewService(log, cfg.Config, notificationService, updateService)
+		syncService         = sync.NewService(log, cfg.Config, syncRepo, notificationService, apikeyRepo)
+		schedulingService   = scheduler.NewService(log, cfg.Config, notificationService, updateService, syncService, auditService, metricsCollector)
 		userService         = user.NewService(userRepo)
 		authService         = auth.NewService(log, userService)
-		syncService         = sync.NewService(log, syncRepo, notificationService, apikeyRepo)
 	)
 
 	// register event subscribers
@@ -100,13 +118,17 @@ func main() {
 			cfg,
 			serverEvents,
 			db,
+			metricsCollector,
 			version,
 			commit,
 			date,
 			apiService,
+			auditService,
 			authService,
+			deviceService,
 			notificationService,
 			updateService,
+			userService,
 			syncService,
 		)
 		errorChannel <- httpServer.Open()
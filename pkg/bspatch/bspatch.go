@@ -0,0 +1,106 @@
+// Package bspatch applies binary patches in the BSDIFF40 format
+// produced by bsdiff (https://www.daemonology.net/bsdiff/).
+package bspatch
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ContentType is the media type of a BSDIFF40 patch.
+const ContentType = "application/x-bsdiff"
+
+var (
+	// ErrCorruptPatch is returned by Apply if the patch is not a valid BSDIFF40 patch.
+	ErrCorruptPatch = errors.New("bspatch: corrupt patch")
+
+	// ErrTooLarge is returned by Apply if the patched data would exceed the size limit.
+	ErrTooLarge = errors.New("bspatch: patched data too large")
+)
+
+var magic = []byte("BSDIFF40")
+
+const headerSize = 32
+
+// Apply applies a BSDIFF40 patch to old and returns the patched data.
+// maxSize limits the size of the patched data, zero means no limit.
+func Apply(old []byte, patch []byte, maxSize int64) ([]byte, error) {
+	if len(patch) < headerSize || !bytes.Equal(patch[:len(magic)], magic) {
+		return nil, ErrCorruptPatch
+	}
+
+	ctrlLen := offtin(patch[8:16])
+	diffLen := offtin(patch[16:24])
+	newSize := offtin(patch[24:32])
+	if ctrlLen < 0 || diffLen < 0 || newSize < 0 ||
+		ctrlLen > int64(len(patch)-headerSize) ||
+		diffLen > int64(len(patch)-headerSize)-ctrlLen {
+		return nil, ErrCorruptPatch
+	}
+	if maxSize > 0 && newSize > maxSize {
+		return nil, ErrTooLarge
+	}
+
+	body := patch[headerSize:]
+	ctrl := bzip2.NewReader(bytes.NewReader(body[:ctrlLen]))
+	diff := bzip2.NewReader(bytes.NewReader(body[ctrlLen : ctrlLen+diffLen]))
+	extra := bzip2.NewReader(bytes.NewReader(body[ctrlLen+diffLen:]))
+
+	out := make([]byte, newSize)
+	oldSize := int64(len(old))
+
+	var buf [24]byte
+	var oldPos, newPos int64
+	for newPos < newSize {
+		if _, err := io.ReadFull(ctrl, buf[:]); err != nil {
+			return nil, corrupt(err)
+		}
+		add := offtin(buf[0:8])
+		copyLen := offtin(buf[8:16])
+		seek := offtin(buf[16:24])
+
+		// add the diff block to the old data
+		if add < 0 || add > newSize-newPos {
+			return nil, ErrCorruptPatch
+		}
+		if _, err := io.ReadFull(diff, out[newPos:newPos+add]); err != nil {
+			return nil, corrupt(err)
+		}
+		for i := int64(0); i < add; i++ {
+			if oldPos+i >= 0 && oldPos+i < oldSize {
+				out[newPos+i] += old[oldPos+i]
+			}
+		}
+		newPos += add
+		oldPos += add
+
+		// copy the extra block as is
+		if copyLen < 0 || copyLen > newSize-newPos {
+			return nil, ErrCorruptPatch
+		}
+		if _, err := io.ReadFull(extra, out[newPos:newPos+copyLen]); err != nil {
+			return nil, corrupt(err)
+		}
+		newPos += copyLen
+		oldPos += seek
+	}
+
+	return out, nil
+}
+
+// offtin decodes the sign-magnitude little-endian integers used by bsdiff.
+func offtin(b []byte) int64 {
+	y := int64(binary.LittleEndian.Uint64(b) &^ (1 << 63))
+	if b[7]&0x80 != 0 {
+		return -y
+	}
+	return y
+}
+
+func corrupt(err error) error {
+	return fmt.Errorf("%w: %v", ErrCorruptPatch, err)
+}
@@ -0,0 +1,78 @@
+package bspatch
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+var (
+	testOld = []byte("hello world, this is syncyomi")
+	testNew = []byte("Hello there, this is syncyomi!")
+)
+
+// testPatch turns testOld into testNew, made with bz2 following the bsdiff format.
+func testPatch(t *testing.T) []byte {
+	t.Helper()
+	patch, err := hex.DecodeString("" +
+		"425344494646343030000000000000002b000000000000001e00000000000000" +
+		"425a68393141592653592e2da7a300000de0006b08100020002184c42180d689" +
+		"093500866fc5dc914e14240b8b69e8c0425a6839314159265359eabf9b490000" +
+		"02e00140000800400020002126419890b8bb9229c2848755fcda48425a683931" +
+		"415926535941b812c60000029180200002401400200030cd00c3440c6e2ee48a" +
+		"70a1208370258c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return patch
+}
+
+func TestApply(t *testing.T) {
+	got, err := Apply(testOld, testPatch(t), 0)
+	if err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	if string(got) != string(testNew) {
+		t.Errorf("Apply() = %q, want %q", got, testNew)
+	}
+}
+
+func TestApply_errors(t *testing.T) {
+	patch := testPatch(t)
+
+	tests := []struct {
+		name    string
+		patch   []byte
+		maxSize int64
+		wantErr error
+	}{
+		{name: "empty", patch: nil, wantErr: ErrCorruptPatch},
+		{name: "wrong magic", patch: append([]byte("BSDIFF41"), patch[8:]...), wantErr: ErrCorruptPatch},
+		{name: "truncated", patch: patch[:40], wantErr: ErrCorruptPatch},
+		{name: "too large", patch: patch, maxSize: 10, wantErr: ErrTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Apply(testOld, tt.patch, tt.maxSize); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Apply() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOfftin(t *testing.T) {
+	tests := []struct {
+		in   []byte
+		want int64
+	}{
+		{in: []byte{0, 0, 0, 0, 0, 0, 0, 0}, want: 0},
+		{in: []byte{5, 0, 0, 0, 0, 0, 0, 0}, want: 5},
+		{in: []byte{5, 0, 0, 0, 0, 0, 0, 0x80}, want: -5},
+		{in: []byte{0, 1, 0, 0, 0, 0, 0, 0}, want: 256},
+	}
+	for _, tt := range tests {
+		if got := offtin(tt.in); got != tt.want {
+			t.Errorf("offtin(%v) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+// Package envelope implements envelope encryption with AES-GCM.
+//
+// Every message is encrypted with its own random data key, and the data key
+// is encrypted ("wrapped") with a master key. Master keys have an id which is
+// stored with the message, so a master key can be replaced by re-wrapping the
+// data keys without touching the messages themselves.
+//
+// Messages are sealed with additional data, which is authenticated but not
+// encrypted. Binding a message to where it is stored keeps a message from
+// being opened in place of another one.
+package envelope
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// KeySize is the size of master and data keys, which selects AES-256.
+const KeySize = 32
+
+var (
+	// ErrUnknownKey is returned by Open if the message was sealed
+	// with a master key that is not in the keyring.
+	ErrUnknownKey = errors.New("envelope: unknown master key")
+
+	// ErrDecrypt is returned by Open if the message or its data key was modified,
+	// sealed with different additional data, or with a different master key of the same id.
+	ErrDecrypt = errors.New("envelope: message authentication failed")
+)
+
+// Keyring holds the master keys by id, new messages are sealed with the current one.
+type Keyring struct {
+	current string
+	keys    map[string][]byte
+}
+
+// NewKeyring returns a keyring sealing with the master key current,
+// which must be one of keys.
+func NewKeyring(current string, keys map[string][]byte) (*Keyring, error) {
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("envelope: current key %q not found", current)
+	}
+
+	for id, key := range keys {
+		if id == "" || strings.ContainsAny(id, " \t") {
+			return nil, fmt.Errorf("envelope: invalid key id %q", id)
+		}
+		if len(key) != KeySize {
+			return nil, fmt.Errorf("envelope: key %q must be %d bytes, got %d", id, KeySize, len(key))
+		}
+	}
+
+	return &Keyring{current: current, keys: keys}, nil
+}
+
+// ParseKey decodes a base64 encoded master key.
+func ParseKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("envelope: key is not valid base64: %w", err)
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("envelope: key must be %d bytes, got %d", KeySize, len(key))
+	}
+	return key, nil
+}
+
+// ReadKeyFile reads master keys from a file with one "<id> <base64 key>" per line.
+// Empty lines and lines starting with # are ignored.
+// The id of the last key is returned, so appending a key makes it the newest.
+func ReadKeyFile(path string) (map[string][]byte, string, error) {
+	f, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	keys := map[string][]byte{}
+	var last string
+
+	scanner := bufio.NewScanner(bytes.NewReader(f))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, "", fmt.Errorf("envelope: %s:%d: want \"<id> <key>\"", path, line)
+		}
+
+		key, err := ParseKey(fields[1])
+		if err != nil {
+			return nil, "", fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+
+		keys[fields[0]] = key
+		last = fields[0]
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, "", err
+	}
+
+	return keys, last, nil
+}
+
+// CurrentKeyID returns the id of the master key new messages are sealed with.
+func (k *Keyring) CurrentKeyID() string {
+	return k.current
+}
+
+// Seal encrypts plaintext with a new data key and authenticates additionalData,
+// and returns the ciphertext with the data key wrapped by the current master key.
+func (k *Keyring) Seal(plaintext []byte, additionalData []byte) (ciphertext []byte, dataKey []byte, keyID string, err error) {
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, nil, "", err
+	}
+
+	if ciphertext, err = seal(key, plaintext, additionalData); err != nil {
+		return nil, nil, "", err
+	}
+
+	if dataKey, err = seal(k.keys[k.current], key, []byte(k.current)); err != nil {
+		return nil, nil, "", err
+	}
+
+	return ciphertext, dataKey, k.current, nil
+}
+
+// Open decrypts a message sealed with the data key wrapped by the master key keyID,
+// additionalData must be the same the message was sealed with.
+func (k *Keyring) Open(ciphertext []byte, dataKey []byte, keyID string, additionalData []byte) ([]byte, error) {
+	key, err := k.unwrap(dataKey, keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	return open(key, ciphertext, additionalData)
+}
+
+// Rewrap wraps a data key with the current master key,
+// the message it encrypts stays the same.
+func (k *Keyring) Rewrap(dataKey []byte, keyID string) ([]byte, string, error) {
+	key, err := k.unwrap(dataKey, keyID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	wrapped, err := seal(k.keys[k.current], key, []byte(k.current))
+	if err != nil {
+		return nil, "", err
+	}
+
+	return wrapped, k.current, nil
+}
+
+func (k *Keyring) unwrap(dataKey []byte, keyID string) ([]byte, error) {
+	master, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, keyID)
+	}
+
+	// the key id is authenticated, so a data key cannot be moved to another master key
+	return open(master, dataKey, []byte(keyID))
+}
+
+// seal encrypts with AES-GCM and prepends the random nonce.
+func seal(key []byte, plaintext []byte, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(plaintext)+gcm.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(key []byte, ciphertext []byte, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < gcm.NonceSize()+gcm.Overhead() {
+		return nil, ErrDecrypt
+	}
+
+	nonce, ciphertext := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, additionalData)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
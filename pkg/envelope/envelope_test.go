@@ -0,0 +1,134 @@
+package envelope
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, KeySize)
+}
+
+func TestKeyring_SealOpen(t *testing.T) {
+	k, err := NewKeyring("one", map[string][]byte{"one": testKey(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext := []byte("reading history")
+	ciphertext, dataKey, keyID, err := k.Seal(plaintext, []byte("row 1"))
+	if err != nil {
+		t.Fatalf("Seal() error = %v", err)
+	}
+	if keyID != "one" {
+		t.Errorf("Seal() keyID = %q, want %q", keyID, "one")
+	}
+	if bytes.Contains(ciphertext, plaintext) {
+		t.Error("Seal() ciphertext contains the plaintext")
+	}
+
+	got, err := k.Open(ciphertext, dataKey, keyID, []byte("row 1"))
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("Open() = %q, want %q", got, plaintext)
+	}
+
+	// messages are bound to their additional data
+	if _, err := k.Open(ciphertext, dataKey, keyID, []byte("row 2")); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("Open() other additional data error = %v, want %v", err, ErrDecrypt)
+	}
+	if _, err := k.Open(ciphertext, dataKey, keyID, nil); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("Open() without additional data error = %v, want %v", err, ErrDecrypt)
+	}
+
+	// modified messages are rejected
+	ciphertext[len(ciphertext)-1] ^= 1
+	if _, err := k.Open(ciphertext, dataKey, keyID, []byte("row 1")); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("Open() modified error = %v, want %v", err, ErrDecrypt)
+	}
+
+	if _, err := k.Open(ciphertext, dataKey, "two", []byte("row 1")); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Open() unknown key error = %v, want %v", err, ErrUnknownKey)
+	}
+}
+
+func TestKeyring_Rewrap(t *testing.T) {
+	old, _ := NewKeyring("one", map[string][]byte{"one": testKey(1)})
+	ciphertext, dataKey, keyID, err := old.Seal([]byte("data"), []byte("row 1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, _ := NewKeyring("two", map[string][]byte{"one": testKey(1), "two": testKey(2)})
+	dataKey, keyID, err = rotated.Rewrap(dataKey, keyID)
+	if err != nil {
+		t.Fatalf("Rewrap() error = %v", err)
+	}
+	if keyID != "two" {
+		t.Errorf("Rewrap() keyID = %q, want %q", keyID, "two")
+	}
+
+	// the old master key is no longer needed
+	only, _ := NewKeyring("two", map[string][]byte{"two": testKey(2)})
+	got, err := only.Open(ciphertext, dataKey, keyID, []byte("row 1"))
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	if string(got) != "data" {
+		t.Errorf("Open() = %q, want %q", got, "data")
+	}
+}
+
+func TestNewKeyring_invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		current string
+		keys    map[string][]byte
+	}{
+		{name: "missing current", current: "two", keys: map[string][]byte{"one": testKey(1)}},
+		{name: "short key", current: "one", keys: map[string][]byte{"one": []byte("short")}},
+		{name: "empty id", current: "", keys: map[string][]byte{"": testKey(1)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewKeyring(tt.current, tt.keys); err == nil {
+				t.Error("NewKeyring() error = nil, want error")
+			}
+		})
+	}
+}
+
+func TestReadKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	content := "# rotated 2024\n" +
+		"one " + base64.StdEncoding.EncodeToString(testKey(1)) + "\n" +
+		"\n" +
+		"two " + base64.StdEncoding.EncodeToString(testKey(2)) + "\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, last, err := ReadKeyFile(path)
+	if err != nil {
+		t.Fatalf("ReadKeyFile() error = %v", err)
+	}
+	if last != "two" {
+		t.Errorf("ReadKeyFile() last = %q, want %q", last, "two")
+	}
+	if len(keys) != 2 || !bytes.Equal(keys["one"], testKey(1)) {
+		t.Errorf("ReadKeyFile() keys = %v", keys)
+	}
+
+	if err := os.WriteFile(path, []byte("one notbase64!\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ReadKeyFile(path); err == nil {
+		t.Error("ReadKeyFile() error = nil, want error")
+	}
+}
@@ -83,8 +83,8 @@ export const APIClient = {
   },
   apikeys: {
     getAll: () => appClient.Get<APIKey[]>("api/keys"),
-    create: (key: APIKey) => appClient.Post("api/keys", key),
-    delete: (key: string) => appClient.Delete(`api/keys/${key}`),
+    create: (key: APIKey) => appClient.Post<APIKey>("api/keys", key),
+    delete: (id: number) => appClient.Delete(`api/keys/${id}`),
   },
   config: {
     get: () => appClient.Get<Config>("api/config"),
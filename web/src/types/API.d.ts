@@ -1,6 +1,9 @@
 interface APIKey {
+  id: number;
   name: string;
-  key: string;
+  // the key is only sent when it is created, it is stored hashed
+  key?: string;
+  prefix: string;
   scopes: string[];
   created_at: Date;
 }